@@ -13,6 +13,7 @@ import (
 
 type FSProbeInfo struct {
     Available int
+    NodeID string
 }
 
 type FileServer struct {
@@ -20,6 +21,16 @@ type FileServer struct {
     expectations *ExpectationDB
     nsConn NSConnector
 
+    // Persistent identity of the fileserver, NS tells fileservers apart
+    // by it rather than by address.
+    nodeID string
+
+    // Where the address of NS is remembered on probe, empty if it isn't
+    nsSaveFile string
+
+    // Optional, nil if reads go straight to chunks
+    cache *ChunkCache
+
     // clientHandler ...also, maybe
     innerHandler http.Handler
 }
@@ -38,12 +49,29 @@ func NewFileServer(store ChunkDB, nsConn NSConnector) (s *FileServer) {
     innerRouter.Handle("/purge", http.HandlerFunc(s.PurgeHandler))
     innerRouter.Handle("/probe", http.HandlerFunc(s.ProbeHandler))
     innerRouter.Handle("/replicate", http.HandlerFunc(s.ReplicateHandler))
+    innerRouter.Handle("/stats", http.HandlerFunc(s.StatsHandler))
 
     s.innerHandler = innerRouter
 
     return
 }
 
+func (s *FileServer) SetNodeID(id string) {
+    s.nodeID = id
+}
+
+// SaveNSTo makes the fileserver remember the address of NS in filename once
+// it is probed, so that it recognizes NS after restart.
+func (s *FileServer) SaveNSTo(filename string) {
+    s.nsSaveFile = filename
+}
+
+// SetCache puts cache in front of reads from the chunk storage. Chunks
+// removed from the storage are also removed from cache.
+func (s *FileServer) SetCache(cache *ChunkCache) {
+    s.cache = cache
+}
+
 func (s *FileServer) Expect(token string, action ExpectAction, chunks ...string) error {
     // TODO: timeout
     exp := s.expectations.Get(token)
@@ -92,7 +120,7 @@ func (s *FileServer) fulfillExpectation(token, id string) {
         toPurge := s.expectations.Remove(token)
 
         for _, id := range toPurge {
-            go s.chunks.Remove(id)
+            go s.removeChunk(id)
         }
     }
 }
@@ -212,28 +240,31 @@ func (s *FileServer) CancelTokenHandler(w http.ResponseWriter, r *http.Request)
 
     toPurge = append(toPurge, s.expectations.Remove(token)...)
     for _, id := range toPurge {
-        go s.chunks.Remove(id)
+        go s.removeChunk(id)
     }
 
     w.WriteHeader(http.StatusOK)
 }
 
 func (s *FileServer) PurgeHandler(w http.ResponseWriter, r *http.Request) {
-    buf := &bytes.Buffer{}
-    io.Copy(buf, r.Body)
-
-    var chunks []string
-    if err := json.Unmarshal(buf.Bytes(), &chunks); err != nil {
+    chunks, err := readChunkList(r.Body)
+    if err != nil {
         w.WriteHeader(http.StatusBadRequest)
         return
     }
 
+    s.Purge(chunks...)
+
+    w.WriteHeader(http.StatusOK)
+}
+
+// Purge removes chunks as soon as all tokens associated with them are
+// fulfilled or cancelled.
+func (s *FileServer) Purge(chunks ...string) {
     toPurge := s.expectations.MakeObsolete(chunks...)
     for _, id := range toPurge {
-        go s.chunks.Remove(id)
+        go s.removeChunk(id)
     }
-
-    w.WriteHeader(http.StatusOK)
 }
 
 func (s *FileServer) ProbeHandler(w http.ResponseWriter, r *http.Request) {
@@ -244,15 +275,18 @@ func (s *FileServer) ProbeHandler(w http.ResponseWriter, r *http.Request) {
 
     log.Print("Probed")
 
-    // TODO: inject this functionality and test it.
-    save, err := os.Create(".tsukifs")
-    if err == nil {
-        fmt.Fprint(save, r.RemoteAddr)
-        save.Close()
-    }
-
     s.nsConn.SetNSAddr(r.RemoteAddr)
 
+    if s.nsSaveFile != "" {
+        save, err := os.Create(s.nsSaveFile)
+        if err == nil {
+            fmt.Fprint(save, s.nsConn.GetNSAddr())
+            save.Close()
+        } else {
+            log.Printf("warning: could not remember NS address, %v", err)
+        }
+    }
+
     info := s.GenerateProbeInfo()
 
     probeBytes, err := json.Marshal(info)
@@ -269,62 +303,85 @@ func (s *FileServer) ReplicateHandler(w http.ResponseWriter, r *http.Request) {
     token := r.URL.Query().Get("token")
     destIP := r.URL.Query().Get("addr")
 
-    // TODO: remove copypasta
-    buf := &bytes.Buffer{}
-    io.Copy(buf, r.Body)
+    chunks, err := readChunkList(r.Body)
+    if err != nil {
+        w.WriteHeader(http.StatusBadRequest)
+        return
+    }
 
-    var chunks []string
-    if err := json.Unmarshal(buf.Bytes(), &chunks); err != nil {
+    err = s.Expect(token, ExpectActionRead, chunks...)
+    if err != nil {
+        log.Printf("error: replicas could not be registered internally, token=%s, chunks=%v, %v", token, chunks, err)
         w.WriteHeader(http.StatusBadRequest)
         return
     }
 
     for _, id := range chunks {
-        err := s.Expect(token, ExpectActionRead, id)
-        if err != nil {
-            log.Printf("error: replica could not be registered internally, token=%s, chunkId=%s", token, id)
-            continue
-        }
+        s.replicateChunk(token, id, destIP)
+    }
 
-        defer s.fulfillExpectation(token, id)
+    w.WriteHeader(http.StatusOK)
+}
 
-        chunk, closeChunk, err := s.chunks.Get(id)
+func (s *FileServer) replicateChunk(token, id, destIP string) {
+    defer s.fulfillExpectation(token, id)
 
-        if err != nil {
-            w.WriteHeader(http.StatusBadRequest)
-            return
-        }
-        defer closeChunk()
+    chunk, closeChunk, err := s.getChunk(id)
+    defer closeChunk()
 
+    if err != nil {
+        log.Printf("warning: could not replicate chunk %s, %v", id, err)
+        return
+    }
 
-        destAddr := fmt.Sprintf("http://%s/chunks/%s?token=%s", destIP, id, token)
-        resp, err := http.Post(destAddr, "application/octet-stream", chunk)
+    destAddr := fmt.Sprintf("http://%s/chunks/%s?token=%s", destIP, id, token)
+    resp, err := http.Post(destAddr, "application/octet-stream", chunk)
 
-        if err != nil {
-            log.Printf("warning: could not replicate chunk to %s, %v.", destAddr, err)
-            continue
-        }
-        defer resp.Body.Close()
+    if err != nil {
+        log.Printf("warning: could not replicate chunk to %s, %v.", destAddr, err)
+        return
+    }
+    defer resp.Body.Close()
 
-        status := resp.StatusCode
-        if status != http.StatusOK {
-            log.Printf("warning: chunk replica was not accepted by %s, response status code: %d", 
-                        destAddr, status)
-        }
+    status := resp.StatusCode
+    if status != http.StatusOK {
+        log.Printf("warning: chunk replica was not accepted by %s, response status code: %d", 
+                    destAddr, status)
+    }
+}
+
+func (s *FileServer) StatsHandler(w http.ResponseWriter, r *http.Request) {
+    var stats CacheStats
+    if s.cache != nil {
+        stats = s.cache.Stats()
+    }
+
+    statsBytes, err := json.Marshal(stats)
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        return
     }
 
     w.WriteHeader(http.StatusOK)
+    fmt.Fprint(w, string(statsBytes))
 }
 
 func (s *FileServer) GenerateProbeInfo() *FSProbeInfo {
     return &FSProbeInfo {
         Available: s.chunks.BytesAvailable(),
+        NodeID: s.nodeID,
     }
 }
 
 func (cs *FileServer) ServeClient(w http.ResponseWriter, r *http.Request) {
-    chunkId := strings.TrimPrefix(r.URL.Path, "/chunks/")
     token := r.URL.Query().Get("token")
+
+    if r.URL.Path == "/batch" {
+        cs.ServeBatch(w, r, token)
+        return
+    }
+
+    chunkId := strings.TrimPrefix(r.URL.Path, "/chunks/")
     
     switch r.Method {
     case http.MethodGet:
@@ -336,6 +393,19 @@ func (cs *FileServer) ServeClient(w http.ResponseWriter, r *http.Request) {
     }
 }
 
+// ServeBatch transfers several chunks authorized by the same token in one
+// request. See WriteFrameHeader for the body format.
+func (cs *FileServer) ServeBatch(w http.ResponseWriter, r *http.Request, token string) {
+    switch r.Method {
+    case http.MethodGet:
+        cs.SendBatch(w, r, token)
+    case http.MethodPost:
+        cs.ReceiveBatch(w, r, token)
+    default:
+        w.WriteHeader(http.StatusMethodNotAllowed)
+    }
+}
+
 func (s *FileServer) SendChunk(w http.ResponseWriter, r *http.Request, id, token string) {
     log.Printf("Chunk READ request: id=%s, token=%s", id, token)
 
@@ -345,7 +415,7 @@ func (s *FileServer) SendChunk(w http.ResponseWriter, r *http.Request, id, token
     }
     defer s.fulfillExpectation(token, id)
 
-    chunk, closeChunk, err := s.chunks.Get(id)
+    chunk, closeChunk, err := s.getChunk(id)
     defer closeChunk()
 
     if err != nil {
@@ -357,33 +427,190 @@ func (s *FileServer) SendChunk(w http.ResponseWriter, r *http.Request, id, token
     return
 }
 
+// SendBatch expects a JSON list of chunk IDs in the request body and streams
+// the chunks back framed, in the same order.
+func (s *FileServer) SendBatch(w http.ResponseWriter, r *http.Request, token string) {
+    chunks, err := readChunkList(r.Body)
+    if err != nil {
+        w.WriteHeader(http.StatusBadRequest)
+        fmt.Fprint(w, err)
+        return
+    }
+
+    log.Printf("Batch READ request: chunks=%v, token=%s", chunks, token)
+
+    requested := make(map[string]bool)
+    for _, id := range chunks {
+        if requested[id] || s.GetTokenExpectationForChunk(token, id) == ExpectActionNothing {
+            w.WriteHeader(http.StatusUnauthorized)
+            return
+        }
+        requested[id] = true
+
+        if !s.chunks.Exists(id) {
+            w.WriteHeader(http.StatusNotFound)
+            return
+        }
+    }
+
+    w.Header().Set("Content-Type", "application/octet-stream")
+    w.WriteHeader(http.StatusOK)
+
+    for _, id := range chunks {
+        // The status is already sent, so the only way to report a failure
+        // is to cut the stream short.
+        if err := s.sendFrame(w, id, token); err != nil {
+            log.Printf("warning: batch READ interrupted, chunk=%s, token=%s, %v", id, token, err)
+            return
+        }
+    }
+}
+
+func (s *FileServer) sendFrame(w io.Writer, id, token string) error {
+    defer s.fulfillExpectation(token, id)
+
+    chunk, closeChunk, err := s.getChunk(id)
+    defer closeChunk()
+
+    if err != nil {
+        return err
+    }
+
+    buf := &bytes.Buffer{}
+    if _, err := io.Copy(buf, chunk); err != nil {
+        return err
+    }
+
+    return WriteFrame(w, id, buf.Bytes())
+}
+
 func (s *FileServer) ReceiveChunk(w http.ResponseWriter, r *http.Request, id, token string) {
     log.Printf("Chunk WRITE request: id=%s, token=%s", id, token)
 
+    status := s.storeChunk(id, token, r.Body, -1)
+    w.WriteHeader(status)
+
+    if status == http.StatusOK {
+        log.Printf("Chunk WRITE request SUCCESS: id=%s, token=%s", id, token)
+    }
+}
+
+// ReceiveBatch stores framed chunks from the request body until the first
+// failure. The response contains a JSON list of the chunks stored.
+func (s *FileServer) ReceiveBatch(w http.ResponseWriter, r *http.Request, token string) {
+    log.Printf("Batch WRITE request: token=%s", token)
+
+    stored := []string{}
+    status := http.StatusOK
+
+    for {
+        id, size, err := ReadFrameHeader(r.Body)
+        if err == io.EOF {
+            break
+        }
+
+        if err != nil {
+            status = http.StatusBadRequest
+            break
+        }
+
+        status = s.storeChunk(id, token, io.LimitReader(r.Body, size), size)
+        if status != http.StatusOK {
+            break
+        }
+
+        stored = append(stored, id)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(stored)
+}
+
+// storeChunk writes chunk contents authorized by token and notifies NS.
+// If size is not negative, contents of different length are rejected.
+// Returns HTTP status of the operation.
+func (s *FileServer) storeChunk(id, token string, src io.Reader, size int64) int {
     if s.GetTokenExpectationForChunk(token, id) == ExpectActionNothing {
-        w.WriteHeader(http.StatusUnauthorized)
-        return
+        return http.StatusUnauthorized
     }
     defer s.fulfillExpectation(token, id)
 
     chunk, finishChunk, err := s.chunks.Create(id)
-    defer finishChunk()
 
     if err == ErrChunkExists {
-        w.WriteHeader(http.StatusForbidden)
-        return
+        finishChunk()
+        return http.StatusForbidden
     }
 
     if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
+        finishChunk()
         log.Printf("internal error: %v", err)
-        return
+        return http.StatusInternalServerError
     }
 
-    io.Copy(chunk, r.Body)
+    written, err := io.Copy(chunk, src)
+    finishChunk()
+
+    if err != nil || size >= 0 && written != size {
+        log.Printf("warning: chunk %s is incomplete, %d bytes written, %v", id, written, err)
+        s.removeChunk(id)
+        return http.StatusBadRequest
+    }
 
     s.nsConn.ReceivedChunk(id)
-    w.WriteHeader(http.StatusOK)
 
-    log.Printf("Chunk WRITE request SUCCESS: id=%s, token=%s", id, token)
+    return http.StatusOK
+}
+
+// getChunk has the same contract as ChunkDB.Get, but serves chunks from
+// cache when possible.
+func (s *FileServer) getChunk(id string) (io.Reader, func(), error) {
+    if s.cache == nil {
+        return s.chunks.Get(id)
+    }
+
+    if contents, cached := s.cache.Get(id); cached {
+        return bytes.NewReader(contents), func(){}, nil
+    }
+
+    chunk, closeChunk, err := s.chunks.Get(id)
+    defer closeChunk()
+
+    if err != nil {
+        return nil, func(){}, err
+    }
+
+    buf := &bytes.Buffer{}
+    if _, err := io.Copy(buf, chunk); err != nil {
+        return nil, func(){}, err
+    }
+
+    // the chunk may have been removed since it was read
+    contents := buf.Bytes()
+    s.cache.PutIf(id, contents, s.chunks.Exists)
+
+    return bytes.NewReader(contents), func(){}, nil
+}
+
+func (s *FileServer) removeChunk(id string) error {
+    err := s.chunks.Remove(id)
+
+    if s.cache != nil {
+        s.cache.Remove(id)
+    }
+
+    return err
+}
+
+func readChunkList(body io.Reader) ([]string, error) {
+    buf := &bytes.Buffer{}
+    io.Copy(buf, body)
+
+    var chunks []string
+    if err := json.Unmarshal(buf.Bytes(), &chunks); err != nil {
+        return nil, err
+    }
+
+    return chunks, nil
 }
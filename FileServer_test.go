@@ -1,6 +1,7 @@
 package tsuki_test
 
 import (
+	"bytes"
 	"encoding/json"
     "net"
 	"net/http"
@@ -209,6 +210,246 @@ func TestFS_ChunkReceive(t *testing.T) {
     })
 }
 
+func TestFS_BatchSend(t *testing.T) {
+    store := tsuki.NewInMemoryChunkStorage(
+        map[string]string {
+            "0" : "Hello",
+            "1" : "world",
+            "2" : "!",
+    })
+
+    nsConn := &tsuki.SpyNSConnector{}
+
+    fsd := tsuki.NewFileServer(store, nsConn)
+
+    t.Run("get expected chunks in requested order",
+    func (t *testing.T) {
+        token := "ordered"
+        fsd.Expect(token, tsuki.ExpectActionRead, "0", "1", "2")
+
+        request := tsuki.NewBatchReadRequest(token, "2", "0", "1")
+        response := httptest.NewRecorder()
+
+        fsd.ServeClient(response, request)
+
+        tsuki.AssertStatus(t, response.Code, http.StatusOK)
+        tsuki.AssertBatchContents(t, response.Body, store, "2", "0", "1")
+
+        // Chunks can not be read twice with the same token
+        request = tsuki.NewGetChunkRequest("0", token)
+        response = httptest.NewRecorder()
+
+        fsd.ServeClient(response, request)
+
+        tsuki.AssertStatus(t, response.Code, http.StatusUnauthorized)
+    })
+
+    t.Run("get batch with unexpected chunk",
+    func (t *testing.T) {
+        token := "partial"
+        fsd.Expect(token, tsuki.ExpectActionRead, "0", "1")
+
+        request := tsuki.NewBatchReadRequest(token, "0", "1", "2")
+        response := httptest.NewRecorder()
+
+        fsd.ServeClient(response, request)
+
+        tsuki.AssertStatus(t, response.Code, http.StatusUnauthorized)
+
+        // Nothing was read, so the token is still good
+        request = tsuki.NewBatchReadRequest(token, "0", "1")
+        response = httptest.NewRecorder()
+
+        fsd.ServeClient(response, request)
+
+        tsuki.AssertStatus(t, response.Code, http.StatusOK)
+        tsuki.AssertBatchContents(t, response.Body, store, "0", "1")
+    })
+
+    t.Run("get batch with duplicate chunk",
+    func (t *testing.T) {
+        token := "duplicate"
+        fsd.Expect(token, tsuki.ExpectActionRead, "0", "1")
+
+        request := tsuki.NewBatchReadRequest(token, "0", "1", "0")
+        response := httptest.NewRecorder()
+
+        fsd.ServeClient(response, request)
+
+        tsuki.AssertStatus(t, response.Code, http.StatusUnauthorized)
+    })
+}
+
+func TestFS_BatchReceive(t *testing.T) {
+    store := tsuki.NewInMemoryChunkStorage(
+        map[string]string {
+            "0" : "abcde",
+    })
+
+    nsConn := &tsuki.SpyNSConnector{}
+
+    fsd := tsuki.NewFileServer(store, nsConn)
+
+    contents := map[string]string {
+        "0": "i'm overwritting existing chunk!",
+        "1": "first",
+        "2": "",
+        "3": "third",
+        "4": "fourth",
+    }
+
+    t.Run("upload expected chunks",
+    func (t *testing.T) {
+        nsConn.Reset()
+        token := "upload"
+        fsd.Expect(token, tsuki.ExpectActionWrite, "1", "2", "3")
+
+        request := tsuki.NewBatchWriteRequest(token, contents, "1", "2", "3")
+        response := httptest.NewRecorder()
+
+        fsd.ServeClient(response, request)
+
+        tsuki.AssertStatus(t, response.Code, http.StatusOK)
+        tsuki.AssertStoredChunks(t, response.Body, "1", "2", "3")
+        tsuki.AssertReceivedChunkCalls(t, nsConn, "1", "2", "3")
+
+        for _, id := range []string{"1", "2", "3"} {
+            tsuki.AssertChunkContents(t, store, id, contents[id])
+        }
+    })
+
+    t.Run("upload stops at the first rejected chunk",
+    func (t *testing.T) {
+        nsConn.Reset()
+        token := "rejected"
+        fsd.Expect(token, tsuki.ExpectActionWrite, "4", "0")
+
+        request := tsuki.NewBatchWriteRequest(token, contents, "4", "0", "5")
+        response := httptest.NewRecorder()
+
+        fsd.ServeClient(response, request)
+
+        tsuki.AssertStatus(t, response.Code, http.StatusForbidden)
+        tsuki.AssertStoredChunks(t, response.Body, "4")
+        tsuki.AssertReceivedChunkCalls(t, nsConn, "4")
+        tsuki.AssertChunkContents(t, store, "0", "abcde")
+        tsuki.AssertChunkDoesntExists(t, store, "5")
+    })
+
+    t.Run("upload truncated batch",
+    func (t *testing.T) {
+        nsConn.Reset()
+        token := "truncated"
+        fsd.Expect(token, tsuki.ExpectActionWrite, "6")
+
+        buf := &bytes.Buffer{}
+        tsuki.WriteFrameHeader(buf, "6", 100)
+        buf.WriteString("not a hundred bytes")
+
+        request, _ := http.NewRequest(http.MethodPost, "/batch?token=" + token, buf)
+        response := httptest.NewRecorder()
+
+        fsd.ServeClient(response, request)
+
+        tsuki.AssertStatus(t, response.Code, http.StatusBadRequest)
+        tsuki.AssertStoredChunks(t, response.Body)
+        tsuki.AssertReceivedChunkCalls(t, nsConn)
+        tsuki.AssertChunkDoesntExists(t, store, "6")
+    })
+}
+
+func TestFS_ChunkCache(t *testing.T) {
+    store := tsuki.NewInMemoryChunkStorage(
+        map[string]string {
+            "0" : "Hello",
+            "1" : "world",
+    })
+
+    nsConn := &tsuki.SpyNSConnector{}
+
+    fsd := tsuki.NewFileServer(store, nsConn)
+    fsd.SetCache(tsuki.NewChunkCache(1024))
+
+    getChunk := func(t *testing.T, chunkId, token string) {
+        t.Helper()
+
+        fsd.Expect(token, tsuki.ExpectActionRead, chunkId)
+
+        request := tsuki.NewGetChunkRequest(chunkId, token)
+        response := httptest.NewRecorder()
+
+        fsd.ServeClient(response, request)
+
+        tsuki.AssertStatus(t, response.Code, http.StatusOK)
+        tsuki.AssertResponseBody(t, response.Body.String(), store.Index[chunkId])
+    }
+
+    getStats := func(t *testing.T) (stats tsuki.CacheStats) {
+        t.Helper()
+
+        request, _ := http.NewRequest(http.MethodGet, "/stats", nil)
+        response := httptest.NewRecorder()
+
+        fsd.ServeNS(response, request)
+
+        tsuki.AssertStatus(t, response.Code, http.StatusOK)
+
+        if err := json.Unmarshal(response.Body.Bytes(), &stats); err != nil {
+            t.Fatalf("could not parse stats JSON output %q, %v", response.Body.String(), err)
+        }
+
+        return
+    }
+
+    t.Run("read chunk twice",
+    func (t *testing.T) {
+        getChunk(t, "0", "first")
+        getChunk(t, "0", "second")
+
+        AssertCacheStats(t, getStats(t), tsuki.CacheStats{Hits: 1, Misses: 1, Size: 5, Budget: 1024})
+    })
+
+    t.Run("batch read goes through cache",
+    func (t *testing.T) {
+        token := "batch"
+        fsd.Expect(token, tsuki.ExpectActionRead, "0", "1")
+
+        request := tsuki.NewBatchReadRequest(token, "0", "1")
+        response := httptest.NewRecorder()
+
+        fsd.ServeClient(response, request)
+
+        tsuki.AssertStatus(t, response.Code, http.StatusOK)
+        tsuki.AssertBatchContents(t, response.Body, store, "0", "1")
+
+        AssertCacheStats(t, getStats(t), tsuki.CacheStats{Hits: 2, Misses: 2, Size: 10, Budget: 1024})
+    })
+
+    t.Run("purge invalidates cache",
+    func (t *testing.T) {
+        request := tsuki.NewPurgeRequest("0")
+        response := httptest.NewRecorder()
+
+        fsd.ServeNS(response, request)
+
+        tsuki.AssertStatus(t, response.Code, http.StatusOK)
+
+        time.Sleep(5 * time.Millisecond)
+
+        tsuki.AssertChunkDoesntExists(t, store, "0")
+        AssertCacheStats(t, getStats(t), tsuki.CacheStats{Hits: 2, Misses: 2, Size: 5, Budget: 1024})
+
+        fsd.Expect("purged", tsuki.ExpectActionRead, "0")
+
+        request = tsuki.NewGetChunkRequest("0", "purged")
+        response = httptest.NewRecorder()
+
+        fsd.ServeClient(response, request)
+
+        tsuki.AssertStatus(t, response.Code, http.StatusUnauthorized)
+    })
+}
+
 func TestFS_ReceiveExpect(t *testing.T) {
     store := tsuki.NewInMemoryChunkStorage(
         map[string]string {
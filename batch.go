@@ -0,0 +1,60 @@
+package tsuki
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Batch transfers pack several chunks into a single HTTP body. Every chunk
+// is preceded by a frame header: the length of the chunk ID (uint16), the ID
+// itself and the length of the chunk contents (uint64), all big-endian.
+// The contents follow the header immediately.
+
+const maxFrameIDLen = 1 << 16 - 1
+
+func WriteFrameHeader(w io.Writer, id string, size int64) error {
+    if len(id) > maxFrameIDLen {
+        return fmt.Errorf("write frame: chunk id is too long")
+    }
+
+    header := make([]byte, 2 + len(id) + 8)
+    binary.BigEndian.PutUint16(header, uint16(len(id)))
+    copy(header[2:], id)
+    binary.BigEndian.PutUint64(header[2 + len(id):], uint64(size))
+
+    _, err := w.Write(header)
+    return err
+}
+
+// ReadFrameHeader returns io.EOF only if the stream ended cleanly right
+// before a frame.
+func ReadFrameHeader(r io.Reader) (id string, size int64, err error) {
+    var idLen uint16
+    if err = binary.Read(r, binary.BigEndian, &idLen); err != nil {
+        return
+    }
+
+    idBytes := make([]byte, idLen)
+    if _, err = io.ReadFull(r, idBytes); err != nil {
+        err = fmt.Errorf("read frame: %v", err)
+        return
+    }
+
+    var size64 uint64
+    if err = binary.Read(r, binary.BigEndian, &size64); err != nil {
+        err = fmt.Errorf("read frame: %v", err)
+        return
+    }
+
+    return string(idBytes), int64(size64), nil
+}
+
+func WriteFrame(w io.Writer, id string, contents []byte) error {
+    if err := WriteFrameHeader(w, id, int64(len(contents))); err != nil {
+        return err
+    }
+
+    _, err := w.Write(contents)
+    return err
+}
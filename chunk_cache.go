@@ -0,0 +1,115 @@
+package tsuki
+
+import (
+	"container/list"
+	"sync"
+)
+
+type CacheStats struct {
+    Hits int
+    Misses int
+    Size int
+    Budget int
+}
+
+// ChunkCache keeps contents of recently read chunks in memory. The total
+// size of cached chunks never exceeds the budget, least recently used chunks
+// are evicted first.
+type ChunkCache struct {
+    mu sync.Mutex
+    budget int
+    size int
+
+    // Front is the most recently used chunk
+    order *list.List
+    index map[string]*list.Element
+
+    hits int
+    misses int
+}
+
+type cachedChunk struct {
+    id string
+    contents []byte
+}
+
+func NewChunkCache(budget int) *ChunkCache {
+    return &ChunkCache{
+        budget: budget,
+        order: list.New(),
+        index: make(map[string]*list.Element),
+    }
+}
+
+func (c *ChunkCache) Get(id string) ([]byte, bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    elem, cached := c.index[id]
+    if !cached {
+        c.misses++
+        return nil, false
+    }
+
+    c.hits++
+    c.order.MoveToFront(elem)
+
+    return elem.Value.(*cachedChunk).contents, true
+}
+
+// Put does nothing if contents alone do not fit into the budget.
+func (c *ChunkCache) Put(id string, contents []byte) {
+    c.PutIf(id, contents, func(string) bool { return true })
+}
+
+// PutIf is Put of a chunk that exists according to exists, which is asked
+// with the cache locked. Chunks are removed from the storage before they are
+// removed from the cache, so a chunk read just before its removal is not
+// left in the cache.
+func (c *ChunkCache) PutIf(id string, contents []byte, exists func(id string) bool) {
+    if len(contents) > c.budget {
+        return
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if _, cached := c.index[id]; cached || !exists(id) {
+        return
+    }
+
+    for c.size + len(contents) > c.budget {
+        c.evict(c.order.Back())
+    }
+
+    c.index[id] = c.order.PushFront(&cachedChunk{id, contents})
+    c.size += len(contents)
+}
+
+func (c *ChunkCache) Remove(id string) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if elem, cached := c.index[id]; cached {
+        c.evict(elem)
+    }
+}
+
+func (c *ChunkCache) Stats() CacheStats {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    return CacheStats{
+        Hits: c.hits,
+        Misses: c.misses,
+        Size: c.size,
+        Budget: c.budget,
+    }
+}
+
+// Expects c.mu to be locked
+func (c *ChunkCache) evict(elem *list.Element) {
+    chunk := c.order.Remove(elem).(*cachedChunk)
+    delete(c.index, chunk.id)
+    c.size -= len(chunk.contents)
+}
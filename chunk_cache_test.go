@@ -0,0 +1,81 @@
+package tsuki_test
+
+import (
+	"testing"
+
+	"github.com/kureduro/tsuki"
+)
+
+func AssertCacheStats(t *testing.T, got, want tsuki.CacheStats) {
+    t.Helper()
+
+    if got != want {
+        t.Errorf("got cache stats %+v, want %+v", got, want)
+    }
+}
+
+func TestChunkCache(t *testing.T) {
+    cache := tsuki.NewChunkCache(10)
+
+    cache.Put("a", []byte("abcd"))
+    cache.Put("b", []byte("efgh"))
+
+    t.Run("get cached chunk",
+    func (t *testing.T) {
+        got, cached := cache.Get("a")
+        if !cached || string(got) != "abcd" {
+            t.Errorf("got %q (cached: %v), want %q", got, cached, "abcd")
+        }
+
+        AssertCacheStats(t, cache.Stats(), tsuki.CacheStats{Hits: 1, Size: 8, Budget: 10})
+    })
+
+    t.Run("evict least recently used chunk",
+    func (t *testing.T) {
+        // "a" was used after "b"
+        cache.Put("c", []byte("ijk"))
+
+        if _, cached := cache.Get("b"); cached {
+            t.Errorf("expected chunk b to be evicted, but it's not")
+        }
+
+        if _, cached := cache.Get("a"); !cached {
+            t.Errorf("expected chunk a to be cached, but it's not")
+        }
+
+        AssertCacheStats(t, cache.Stats(), tsuki.CacheStats{Hits: 2, Misses: 1, Size: 7, Budget: 10})
+    })
+
+    t.Run("skip removed chunk",
+    func (t *testing.T) {
+        cache.PutIf("removed", []byte("x"), func(string) bool { return false })
+
+        if _, cached := cache.Get("removed"); cached {
+            t.Errorf("expected removed chunk not to be cached, but it is")
+        }
+    })
+
+    t.Run("skip chunk larger than budget",
+    func (t *testing.T) {
+        cache.Put("huge", []byte("0123456789abcdef"))
+
+        if _, cached := cache.Get("huge"); cached {
+            t.Errorf("expected chunk over budget not to be cached, but it is")
+        }
+
+        if _, cached := cache.Get("c"); !cached {
+            t.Errorf("expected chunk c to be cached, but it's not")
+        }
+    })
+
+    t.Run("remove chunk",
+    func (t *testing.T) {
+        cache.Remove("a")
+
+        if _, cached := cache.Get("a"); cached {
+            t.Errorf("expected chunk a to be removed, but it's not")
+        }
+
+        AssertCacheStats(t, cache.Stats(), tsuki.CacheStats{Hits: 3, Misses: 4, Size: 3, Budget: 10})
+    })
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"strings"
@@ -30,6 +31,9 @@ type ChunkDB interface {
 
     // Should be concurrency safe
     Remove(id string) error
+
+    // IDs of all stored chunks
+    List() []string
     
     BytesAvailable() int
 }
@@ -117,6 +121,21 @@ func (s *InMemoryChunkStorage) Remove(id string) error {
     return nil
 }
 
+func (s *InMemoryChunkStorage) List() []string {
+    s.accessCount.Add(1)
+    defer s.accessCount.Done()
+
+    s.Mu.RLock()
+    defer s.Mu.RUnlock()
+
+    chunks := make([]string, 0, len(s.Index))
+    for id := range s.Index {
+        chunks = append(chunks, id)
+    }
+
+    return chunks
+}
+
 func (s *InMemoryChunkStorage) BytesAvailable() int {
     return 1024 * 1024 * 10
 }
@@ -164,9 +183,36 @@ func NewFileSystemChunkStorage(dir string) (*FileSystemChunkStorage, error) {
     return store, nil
 }
 
+// LoadFileSystemChunkStorage keeps chunks already stored in dir, so that
+// they survive restart of the fileserver.
+func LoadFileSystemChunkStorage(dir string) (*FileSystemChunkStorage, error) {
+    err := os.MkdirAll(dir, 0755)
+    if err != nil {
+        return nil, fmt.Errorf("load storage: %v", err)
+    }
+
+    files, err := ioutil.ReadDir(dir)
+    if err != nil {
+        return nil, fmt.Errorf("load storage: %v", err)
+    }
+
+    store := &FileSystemChunkStorage{
+        Dir: dir,
+        index: make(map[string]*sync.RWMutex),
+    }
+
+    for _, file := range files {
+        if file.Mode().IsRegular() {
+            store.index[file.Name()] = &sync.RWMutex{}
+        }
+    }
+
+    return store, nil
+}
+
 func (s *FileSystemChunkStorage) Create(id string) (io.Writer, func(), error) {
     if s.Exists(id) {
-        return nil, func(){}, fmt.Errorf("create chunk: %s already exists", id)
+        return nil, func(){}, ErrChunkExists
     }
 
     file, err := os.Create(path.Join(s.Dir, id))
@@ -192,7 +238,7 @@ func (s *FileSystemChunkStorage) Create(id string) (io.Writer, func(), error) {
 }
 
 func (s *FileSystemChunkStorage) Get(id string) (io.Reader, func(), error) {
-    file, err := os.Open(id)
+    file, err := os.Open(path.Join(s.Dir, id))
     if err != nil {
         return nil, func(){}, fmt.Errorf("get chunk: %v", err)
     }
@@ -243,9 +289,25 @@ func (s *FileSystemChunkStorage) Remove(id string) error {
         return fmt.Errorf("remove chunk: %v", err)
     }
 
+    s.mu.Lock()
+    delete(s.index, id)
+    s.mu.Unlock()
+
     return nil
 }
 
+func (s *FileSystemChunkStorage) List() []string {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    chunks := make([]string, 0, len(s.index))
+    for id := range s.index {
+        chunks = append(chunks, id)
+    }
+
+    return chunks
+}
+
 func (s *FileSystemChunkStorage) BytesAvailable() int {
     var stat syscall.Statfs_t
     syscall.Statfs(s.Dir, &stat)
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
@@ -8,23 +9,38 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/cheggaaa/pb/v3"
+	"github.com/cheggaaa/pb/v3/termutil"
+	"github.com/kureduro/tsuki"
 	"github.com/urfave/cli/v2"
 )
 
 const (
     TempNS = "tsuki.ns"
     TempCwd = "tsuki.cwd"
+    AuthName = "auth"
 )
 
 const EnvDebug = "TSUKI_DEBUG"
 
 const NSCLIENTPORT = ":7070"
 
+// Fileservers confirm chunks to the name server within a few seconds
+const (
+    commitAttempts = 10
+    commitInterval = 500 * time.Millisecond
+)
+
+// Chunks that fileservers failed to store are sent elsewhere this many times
+const reuploadAttempts = 5
+
 const BarTemplate = ` chunk {{ string . "chunkProgress" }}   {{ percent . }} {{ speed . }}`
 
 var ns string
@@ -41,6 +57,8 @@ type ClientMessage struct {
 	Objects []string       `json:"objects"`
 	Token   string         `json:"token"`
 	Chunks  []ChunkMessage `json:"chunks"`
+
+	UploadID string `json:"uploadID"`
 }
 
 func FullOrRelative(filepath, wd string) string {
@@ -61,8 +79,82 @@ func LocalWd() string {
 }
 
 type NSClientConnector struct {
+	// Comma separated, the primary name server and its standbys
 	NSAddr string
     chunkSize int
+
+    // API key the requests are signed with, see login; User and Password
+    // are used instead, when set
+    Key string
+    User string
+    Password string
+
+    // Index of the name server that answered last
+    current int
+}
+
+// nsClient keeps credentials on redirects to the leader of a group of name
+// servers, those are dropped for other hosts by default.
+var nsClient = &http.Client{
+    CheckRedirect: func(req *http.Request, via []*http.Request) error {
+        if len(via) >= 10 {
+            return fmt.Errorf("stopped after 10 redirects")
+        }
+
+        req.Header.Set("Authorization", via[0].Header.Get("Authorization"))
+        return nil
+    },
+}
+
+func (conn *NSClientConnector) sign(req *http.Request) {
+    if conn.User != "" {
+        req.SetBasicAuth(conn.User, conn.Password)
+    } else if conn.Key != "" {
+        req.Header.Set("Authorization", "Bearer " + conn.Key)
+    }
+}
+
+// get sends the request to the name server that answered last. If it is
+// down or is a standby, the request is sent to the other ones in turn.
+func (conn *NSClientConnector) get(request string) (resp *http.Response, err error) {
+    return conn.send(http.MethodGet, request, nil)
+}
+
+// send is like get, the form is sent in the body of the request.
+func (conn *NSClientConnector) send(method, request string, form url.Values) (resp *http.Response, err error) {
+    addrs := strings.Split(conn.NSAddr, ",")
+
+    for i := range addrs {
+        current := (conn.current + i) % len(addrs)
+
+        var body io.Reader
+        if form != nil {
+            body = strings.NewReader(form.Encode())
+        }
+
+        req, _ := http.NewRequest(method, fmt.Sprintf("http://%s%s%s", addrs[current], NSCLIENTPORT, request), body)
+        if form != nil {
+            req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        }
+        conn.sign(req)
+
+        resp, err = nsClient.Do(req)
+        if err != nil {
+            log.Printf("warning: name server %s is unreachable, %v", addrs[current], err)
+            continue
+        }
+
+        if resp.StatusCode == http.StatusServiceUnavailable && i != len(addrs) - 1 {
+            log.Printf("warning: name server %s is unavailable", addrs[current])
+            resp.Body.Close()
+            continue
+        }
+
+        conn.current = current
+        return resp, nil
+    }
+
+    return nil, err
 }
 
 func UnmarshalNSResponse(response *http.Response) (msg *ClientMessage, err error) {
@@ -80,9 +172,50 @@ func UnmarshalNSResponse(response *http.Response) (msg *ClientMessage, err error
 }
 
 func (conn *NSClientConnector) GetNS(cmd, path string) (*ClientMessage, error) {
-	addr := fmt.Sprintf("http://%s%s/%s?address=%s", conn.NSAddr, NSCLIENTPORT, cmd, path)
+	addr := fmt.Sprintf("/%s?address=%s", cmd, path)
+
+	resp, err := conn.get(addr)
+	if err != nil {
+		return nil, fmt.Errorf("request: %v", err)
+	}
+
+	msg, err := UnmarshalNSResponse(resp)
+    if err != nil {
+        return nil, fmt.Errorf("request: %v", err)
+    }
+
+	if msg.Status != http.StatusOK {
+		return nil, fmt.Errorf(msg.Message)
+	}
+
+	return msg, nil
+}
+
+// GetNSQuery sends the command with arbitrary parameters.
+func (conn *NSClientConnector) GetNSQuery(cmd string, query url.Values) (*ClientMessage, error) {
+	addr := fmt.Sprintf("/%s?%s", cmd, query.Encode())
+
+	resp, err := conn.get(addr)
+	if err != nil {
+		return nil, fmt.Errorf("request: %v", err)
+	}
+
+	msg, err := UnmarshalNSResponse(resp)
+    if err != nil {
+        return nil, fmt.Errorf("request: %v", err)
+    }
+
+	if msg.Status != http.StatusOK {
+		return nil, fmt.Errorf(msg.Message)
+	}
+
+	return msg, nil
+}
 
-	resp, err := http.Get(addr)
+// PostNSForm sends the command with parameters in the body, those are not
+// to be seen in logs of requests, such as passwords.
+func (conn *NSClientConnector) PostNSForm(cmd string, form url.Values) (*ClientMessage, error) {
+	resp, err := conn.send(http.MethodPost, "/" + cmd, form)
 	if err != nil {
 		return nil, fmt.Errorf("request: %v", err)
 	}
@@ -100,9 +233,9 @@ func (conn *NSClientConnector) GetNS(cmd, path string) (*ClientMessage, error) {
 }
 
 func (conn *NSClientConnector) GetNSInit() error {
-	addr := fmt.Sprintf("http://%s%s/init", conn.NSAddr, NSCLIENTPORT)
+	addr := "/init"
 
-	resp, err := http.Get(addr)
+	resp, err := conn.get(addr)
 	if err != nil {
 		return fmt.Errorf("request: %v", err)
 	}
@@ -118,10 +251,30 @@ func (conn *NSClientConnector) GetNSInit() error {
 
 	return nil
 }
-func (conn *NSClientConnector) GetNSUpload(path string, size int64) (*ClientMessage, error) {
-	addr := fmt.Sprintf("http://%s%s/upload?address=%s&size=%d", conn.NSAddr, NSCLIENTPORT, path, size)
+func (conn *NSClientConnector) GetNSUpload(path string, size int64, overwrite bool) (*ClientMessage, error) {
+	addr := fmt.Sprintf("/upload?address=%s&size=%d&overwrite=%t", path, size, overwrite)
 
-	resp, err := http.Get(addr)
+	resp, err := conn.get(addr)
+	if err != nil {
+        return nil, fmt.Errorf("request: %v", err)
+	}
+
+	msg, err := UnmarshalNSResponse(resp)
+    if err != nil {
+        return nil, fmt.Errorf("request: %v", err)
+    }
+
+	if msg.Status != http.StatusOK {
+		return nil, fmt.Errorf(msg.Message)
+	}
+
+	return msg, nil
+}
+
+func (conn *NSClientConnector) GetNSAppend(path string, size int64) (*ClientMessage, error) {
+	addr := fmt.Sprintf("/append?address=%s&size=%d", path, size)
+
+	resp, err := conn.get(addr)
 	if err != nil {
         return nil, fmt.Errorf("request: %v", err)
 	}
@@ -139,9 +292,9 @@ func (conn *NSClientConnector) GetNSUpload(path string, size int64) (*ClientMess
 }
 
 func (conn *NSClientConnector) GetNSFromTo(cmd, from, to string) (*ClientMessage, error) {
-	addr := fmt.Sprintf("http://%s%s/%s?from=%s&to=%s", conn.NSAddr, NSCLIENTPORT, cmd, from, to)
+	addr := fmt.Sprintf("/%s?from=%s&to=%s", cmd, from, to)
 
-	resp, err := http.Get(addr)
+	resp, err := conn.get(addr)
 	if err != nil {
         return nil, fmt.Errorf("request: %v", err)
 	}
@@ -159,9 +312,9 @@ func (conn *NSClientConnector) GetNSFromTo(cmd, from, to string) (*ClientMessage
 }
 
 func (conn *NSClientConnector) GetNSObjectInfo(path string) (string, error) {
-	addr := fmt.Sprintf("http://%s%s/info?address=%s", conn.NSAddr, NSCLIENTPORT, path)
+	addr := fmt.Sprintf("/info?address=%s", path)
 
-	resp, err := http.Get(addr)
+	resp, err := conn.get(addr)
 	if err != nil {
 		return "", fmt.Errorf("request: %v", err)
 	}
@@ -179,9 +332,9 @@ func (conn *NSClientConnector) GetNSObjectInfo(path string) (string, error) {
 }
 
 func (conn *NSClientConnector) GetChunkSize() (int, error) {
-	addr := fmt.Sprintf("http://%s%s/getChunkSize", conn.NSAddr, NSCLIENTPORT)
+	addr := "/getChunkSize"
 
-	resp, err := http.Get(addr)
+	resp, err := conn.get(addr)
 	if err != nil {
 		return 0, fmt.Errorf("send chunk size request: %v", err)
 	}
@@ -199,15 +352,20 @@ func (conn *NSClientConnector) GetChunkSize() (int, error) {
 	return size, nil
 }
 
-func (conn *NSClientConnector) Cd(path string) error {
-	msg, err := conn.GetNS("cd", path)
+// Cd returns the directory with symbolic links on the way resolved.
+func (conn *NSClientConnector) Cd(dir string) (string, error) {
+	msg, err := conn.GetNS("cd", dir)
     if err != nil {
-        return fmt.Errorf("cd: %v", err)
+        return "", fmt.Errorf("cd: %v", err)
     }
 
 	log.Printf("Received message: %#v", msg)
 
-	return nil
+	if len(msg.Objects) == 0 {
+		return dir, nil
+	}
+
+	return path.Join("/", msg.Objects[0]), nil
 }
 
 
@@ -277,204 +435,1076 @@ func (conn *NSClientConnector) Copy(from, to string) error {
 	return nil
 }
 
-func (conn *NSClientConnector) Move(from, to string) error {
-	msg, err := conn.GetNSFromTo("mv", from, to)
+func (conn *NSClientConnector) Versions(path string) ([]string, error) {
+	msg, err := conn.GetNSQuery("versions", url.Values{"address": {path}})
 	if err != nil {
-		return fmt.Errorf("mv: %v", err)
+		return nil, fmt.Errorf("versions: %v", err)
 	}
 
-	log.Printf("Received message: %#v", msg)
-
-	return nil
+	return msg.Objects, nil
 }
 
-func (conn *NSClientConnector) writeChunkToFS(addr, chunkId, token string, src io.Reader) error {
-    fsAddr := fmt.Sprintf("http://%s/chunks/%s?token=%s", addr, chunkId, token)
-    resp, err := http.Post(fsAddr, "application/octet-stream", src)
-    if err != nil {
-        return fmt.Errorf("send chunk: %v", err)
-    }
-
-    if resp.StatusCode != http.StatusOK {
-        return fmt.Errorf("send chunk: %d %s", resp.StatusCode, resp.Status)
-    }
+func (conn *NSClientConnector) RestoreVersion(path string, version int) error {
+	query := url.Values{"address": {path}, "version": {strconv.Itoa(version)}}
 
-    return nil
-}
+	msg, err := conn.GetNSQuery("versions/restore", query)
+	if err != nil {
+		return fmt.Errorf("restore: %v", err)
+	}
 
-func (conn *NSClientConnector) Upload(file io.Reader, destPath string, fileSize int64) error {
-    var err error
-    if conn.chunkSize == 0 {
-        conn.chunkSize, err = conn.GetChunkSize()
-        if err != nil {
-            return fmt.Errorf("upload init: %v", err)
-        }
-    }
+	log.Printf("Received message: %#v", msg)
 
-    msg, err := conn.GetNSUpload(destPath, fileSize)
-    if err != nil {
-        return fmt.Errorf("upload request: %v", err)
-    }
+	return nil
+}
 
-    uploaded := 0
-    for i, meta := range msg.Chunks {
-        width := len(strconv.Itoa(len(msg.Chunks)))
+func (conn *NSClientConnector) KeepVersions(path string, count int) error {
+	query := url.Values{"address": {path}, "count": {strconv.Itoa(count)}}
 
-        requestSize := conn.chunkSize
-        if int(fileSize) - uploaded < requestSize {
-            requestSize = int(fileSize) - uploaded
-        }
+	msg, err := conn.GetNSQuery("versions/keep", query)
+	if err != nil {
+		return fmt.Errorf("keep: %v", err)
+	}
 
-        bar := pb.ProgressBarTemplate(BarTemplate).Start(requestSize)
-        bar.Set("chunkProgress", fmt.Sprintf("% *d/%d", width, i + 1, len(msg.Chunks)))
+	log.Printf("Received message: %#v", msg)
 
-        chunkSrc := io.LimitReader(file, int64(conn.chunkSize))
-        barReader := bar.NewProxyReader(chunkSrc)
+	return nil
+}
 
-        err := conn.writeChunkToFS(meta.StorageIP, meta.ChunkID, msg.Token, barReader)
-        if err != nil {
-            return fmt.Errorf("upload sequence:")
-        }
+// SetQuota limits logical bytes, replicas counted, and objects in the
+// directory, 0 is no limit.
+func (conn *NSClientConnector) SetQuota(path string, bytes int64, objects int) error {
+	query := url.Values{"address": {path}, "bytes": {strconv.FormatInt(bytes, 10)}, "objects": {strconv.Itoa(objects)}}
 
-        uploaded += conn.chunkSize
-        bar.Finish()
-    }
+	msg, err := conn.GetNSQuery("quota", query)
+	if err != nil {
+		return fmt.Errorf("quota: %v", err)
+	}
 
 	log.Printf("Received message: %#v", msg)
 
 	return nil
 }
 
-func (conn *NSClientConnector) downloadChunk(addr, chunkId, token string, dest io.Writer) error {
-    fsAddr := fmt.Sprintf("http://%s/chunks/%s?token=%s", addr, chunkId, token)
-    resp, err := http.Get(fsAddr)
-    if err != nil {
-        return fmt.Errorf("fetch chunk: %v", err)
-    }
+// Symlink links the path to the target, which is absolute or relative to the
+// directory of the link.
+func (conn *NSClientConnector) Symlink(target, path string) error {
+	msg, err := conn.GetNSQuery("symlink", url.Values{"address": {path}, "target": {target}})
+	if err != nil {
+		return fmt.Errorf("ln: %v", err)
+	}
 
-    if resp.StatusCode != http.StatusOK {
-        return fmt.Errorf("fetch chunk: %d %s", resp.StatusCode, resp.Status)
-    }
+	log.Printf("Received message: %#v", msg)
 
-    _, err = io.Copy(dest, resp.Body)
-    if err != nil {
-        return fmt.Errorf("fetch chunk: %v", err)
-    }
+	return nil
+}
 
-    return nil
+func (conn *NSClientConnector) Readlink(path string) (string, error) {
+	msg, err := conn.GetNSQuery("readlink", url.Values{"address": {path}})
+	if err != nil {
+		return "", fmt.Errorf("readlink: %v", err)
+	}
+
+	return msg.Message, nil
 }
 
-func (conn *NSClientConnector) Download(srcPath string, file io.Writer) error {
-    var err error
-    if conn.chunkSize == 0 {
-        conn.chunkSize, err = conn.GetChunkSize()
-        if err != nil {
-            return fmt.Errorf("download init: %v", err)
-        }
-    }
+func (conn *NSClientConnector) Xattrs(path string) ([]string, error) {
+	msg, err := conn.GetNSQuery("xattrs", url.Values{"address": {path}})
+	if err != nil {
+		return nil, fmt.Errorf("xattr: %v", err)
+	}
 
-    msg, err := conn.GetNS("download", srcPath)
-    if err != nil {
-        return fmt.Errorf("download, request stage: %v", err)
-    }
+	return msg.Objects, nil
+}
 
-    for i, meta := range msg.Chunks {
-        width := len(strconv.Itoa(len(msg.Chunks)))
+func (conn *NSClientConnector) GetXattr(path, name string) (string, error) {
+	msg, err := conn.GetNSQuery("xattrs/get", url.Values{"address": {path}, "name": {name}})
+	if err != nil {
+		return "", fmt.Errorf("xattr get: %v", err)
+	}
 
-        requestSize := conn.chunkSize
+	return msg.Message, nil
+}
 
-        bar := pb.ProgressBarTemplate(BarTemplate).Start(requestSize)
-        bar.Set("chunkProgress", fmt.Sprintf("% *d/%d", width, i + 1, len(msg.Chunks)))
+func (conn *NSClientConnector) SetXattr(path, name, value string) error {
+	msg, err := conn.PostNSForm("xattrs/set", url.Values{"address": {path}, "name": {name}, "value": {value}})
+	if err != nil {
+		return fmt.Errorf("xattr set: %v", err)
+	}
 
-        barWriter := bar.NewProxyWriter(file)
+	log.Printf("Received message: %#v", msg)
 
-        err := conn.downloadChunk(meta.StorageIP, meta.ChunkID, msg.Token, barWriter)
-        if err != nil {
-            return fmt.Errorf("download sequence: %v", err)
-        }
+	return nil
+}
 
-        bar.Finish()
-    }
+func (conn *NSClientConnector) RemoveXattr(path, name string) error {
+	msg, err := conn.GetNSQuery("xattrs/remove", url.Values{"address": {path}, "name": {name}})
+	if err != nil {
+		return fmt.Errorf("xattr rm: %v", err)
+	}
 
 	log.Printf("Received message: %#v", msg)
 
 	return nil
 }
 
-func saveCwd() {
-    filename := path.Join(os.TempDir(), TempCwd)
-    file, err := os.Create(filename)
-    if err != nil {
-        log.Printf("warning: could not create temp file, %v", err)
-        return
-    }
-    defer file.Close()
+func (conn *NSClientConnector) Snapshots() ([]string, error) {
+	msg, err := conn.GetNSQuery("snapshots", url.Values{})
+	if err != nil {
+		return nil, fmt.Errorf("snapshots: %v", err)
+	}
 
-    fmt.Fprint(file, cwd)
+	return msg.Objects, nil
 }
 
-func loadFromTemp(name string) string {
-    filename := path.Join(os.TempDir(), name)
-    if _, err := os.Stat(filename); os.IsNotExist(err) {
-        return ""
-    }
+func (conn *NSClientConnector) CreateSnapshot(path, name string) error {
+	msg, err := conn.GetNSQuery("snapshots/create", url.Values{"address": {path}, "name": {name}})
+	if err != nil {
+		return fmt.Errorf("snapshot: %v", err)
+	}
 
-    file, err := os.Open(filename)
-    if err != nil {
-        log.Printf("warning: could not open temp file, %v", err)
-        return ""
-    }
-    defer file.Close()
+	log.Printf("Received message: %#v", msg)
 
-    buf := &bytes.Buffer{}
-    io.Copy(buf, file)
+	return nil
+}
 
-    return buf.String()
+func (conn *NSClientConnector) RemoveSnapshot(name string) error {
+	msg, err := conn.GetNSQuery("snapshots/remove", url.Values{"name": {name}})
+	if err != nil {
+		return fmt.Errorf("snapshot rm: %v", err)
+	}
+
+	log.Printf("Received message: %#v", msg)
+
+	return nil
 }
 
-func main() {
-    _, debugMode := os.LookupEnv(EnvDebug)
-    if !debugMode {
-        log.SetOutput(ioutil.Discard)
-    }
+func (conn *NSClientConnector) Trash() ([]string, error) {
+	msg, err := conn.GetNSQuery("trash", url.Values{})
+	if err != nil {
+		return nil, fmt.Errorf("trash: %v", err)
+	}
 
-    ns := loadFromTemp(TempNS)
+	return msg.Objects, nil
+}
 
-	conn := &NSClientConnector{
-		NSAddr: ns,
+// Restore brings back the object removed from the path or, if ref is an id
+// listed by Trash, the object of that id.
+func (conn *NSClientConnector) Restore(ref string) error {
+	msg, err := conn.GetNSQuery("trash/restore", url.Values{"ref": {ref}})
+	if err != nil {
+		return fmt.Errorf("restore: %v", err)
 	}
 
-    cwd = loadFromTemp(TempCwd)
-    if cwd == "" {
-        cwd = "/"
-        saveCwd()
-    }
+	log.Printf("Received message: %#v", msg)
 
-	app := &cli.App{
-		Name:  "tsuki",
-		Usage: "a CLI interface to tsukiFS distributed file system",
-        Commands: []*cli.Command {
-            {
-                Name: "connect",
-                Usage: "Probe and remember name server for future calls",
-                Action: func(c *cli.Context) error {
-                    conn.NSAddr = c.Args().First()
+	return nil
+}
 
-                    _, err := conn.Ls("/")
-                    if err != nil {
-                        return fmt.Errorf("%v", err)
-                    }
+func (conn *NSClientConnector) PurgeTrash(id string) error {
+	msg, err := conn.GetNSQuery("trash/purge", url.Values{"id": {id}})
+	if err != nil {
+		return fmt.Errorf("trash purge: %v", err)
+	}
 
-                    file, err := os.Create(path.Join(os.TempDir(), TempNS))
-                    if err != nil {
-                        fmt.Printf("warning: could not create NS temp file: %v", err)
-                        return nil
-                    }
-                    defer file.Close()
+	log.Printf("Received message: %#v", msg)
 
-                    fmt.Fprint(file, conn.NSAddr)
+	return nil
+}
 
-                    return nil
+// WhoAmI returns the name and the role of the account signed in.
+func (conn *NSClientConnector) WhoAmI() (string, error) {
+	msg, err := conn.GetNSQuery("whoami", url.Values{})
+	if err != nil {
+		return "", fmt.Errorf("whoami: %v", err)
+	}
+
+	return msg.Message, nil
+}
+
+// Login signs in with the password, or with the key, if the password is
+// empty, and remembers an API key for future calls. A key is created for
+// the password, so that the password itself is never stored.
+func (conn *NSClientConnector) Login(user, password, key string) error {
+	if key == "" {
+		conn.User, conn.Password = user, password
+		msg, err := conn.GetNSQuery("users/keys/add", url.Values{})
+		conn.User, conn.Password = "", ""
+		if err != nil {
+			return fmt.Errorf("login: %v", err)
+		}
+
+		key = msg.Token
+	}
+
+	conn.Key = key
+	if _, err := conn.WhoAmI(); err != nil {
+		return fmt.Errorf("login: %v", err)
+	}
+
+	filename, err := authFile()
+	if err == nil {
+		err = os.MkdirAll(path.Dir(filename), 0700)
+	}
+	if err != nil {
+		return fmt.Errorf("login: could not save the key: %v", err)
+	}
+
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("login: could not save the key: %v", err)
+	}
+	defer file.Close()
+
+	fmt.Fprint(file, conn.Key)
+
+	return nil
+}
+
+// Logout revokes the key remembered by Login and forgets it.
+func (conn *NSClientConnector) Logout() error {
+	if len(conn.Key) >= 8 {
+		if _, err := conn.GetNSQuery("users/keys/remove", url.Values{"id": {conn.Key[:8]}}); err != nil {
+			log.Printf("warning: could not revoke the key: %v", err)
+		}
+	}
+
+	filename, err := authFile()
+	if err != nil {
+		return fmt.Errorf("logout: %v", err)
+	}
+
+	err = os.Remove(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("logout: %v", err)
+	}
+
+	return nil
+}
+
+// authFile is where Login remembers the key. Unlike the temporary directory,
+// the config directory of the user cannot be written by others.
+func authFile() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(dir, "tsuki", AuthName), nil
+}
+
+// loadKey returns the key remembered by Login, if there is one.
+func loadKey() string {
+	filename, err := authFile()
+	if err != nil {
+		return ""
+	}
+
+	key, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return ""
+	}
+
+	return string(key)
+}
+
+func (conn *NSClientConnector) Users() ([]string, error) {
+	msg, err := conn.GetNSQuery("users", url.Values{})
+	if err != nil {
+		return nil, fmt.Errorf("users: %v", err)
+	}
+
+	return msg.Objects, nil
+}
+
+func (conn *NSClientConnector) AddUser(name, password string, admin bool) error {
+	msg, err := conn.PostNSForm("users/add", url.Values{"name": {name}, "password": {password}, "admin": {strconv.FormatBool(admin)}})
+	if err != nil {
+		return fmt.Errorf("users add: %v", err)
+	}
+
+	log.Printf("Received message: %#v", msg)
+
+	return nil
+}
+
+func (conn *NSClientConnector) RemoveUser(name string) error {
+	msg, err := conn.GetNSQuery("users/remove", url.Values{"name": {name}})
+	if err != nil {
+		return fmt.Errorf("users rm: %v", err)
+	}
+
+	log.Printf("Received message: %#v", msg)
+
+	return nil
+}
+
+// SetPassword changes the password of the account, the one signed in, if
+// name is empty.
+func (conn *NSClientConnector) SetPassword(name, password string) error {
+	msg, err := conn.PostNSForm("users/passwd", url.Values{"name": {name}, "password": {password}})
+	if err != nil {
+		return fmt.Errorf("passwd: %v", err)
+	}
+
+	log.Printf("Received message: %#v", msg)
+
+	return nil
+}
+
+// SetGroups replaces the groups of the account, the first one is given to the
+// objects the user creates.
+func (conn *NSClientConnector) SetGroups(name string, groups []string) error {
+	msg, err := conn.GetNSQuery("users/groups", url.Values{"name": {name}, "groups": {strings.Join(groups, ",")}})
+	if err != nil {
+		return fmt.Errorf("users groups: %v", err)
+	}
+
+	log.Printf("Received message: %#v", msg)
+
+	return nil
+}
+
+func (conn *NSClientConnector) Keys() ([]string, error) {
+	msg, err := conn.GetNSQuery("users/keys", url.Values{})
+	if err != nil {
+		return nil, fmt.Errorf("keys: %v", err)
+	}
+
+	return msg.Objects, nil
+}
+
+func (conn *NSClientConnector) AddKey() (string, error) {
+	msg, err := conn.GetNSQuery("users/keys/add", url.Values{})
+	if err != nil {
+		return "", fmt.Errorf("keys add: %v", err)
+	}
+
+	return msg.Token, nil
+}
+
+func (conn *NSClientConnector) RemoveKey(id string) error {
+	msg, err := conn.GetNSQuery("users/keys/remove", url.Values{"id": {id}})
+	if err != nil {
+		return fmt.Errorf("keys rm: %v", err)
+	}
+
+	log.Printf("Received message: %#v", msg)
+
+	return nil
+}
+
+func (conn *NSClientConnector) Move(from, to string) error {
+	msg, err := conn.GetNSFromTo("mv", from, to)
+	if err != nil {
+		return fmt.Errorf("mv: %v", err)
+	}
+
+	log.Printf("Received message: %#v", msg)
+
+	return nil
+}
+
+func (conn *NSClientConnector) Chmod(path, mode string) error {
+	msg, err := conn.GetNSQuery("chmod", url.Values{"address": {path}, "mode": {mode}})
+	if err != nil {
+		return fmt.Errorf("chmod: %v", err)
+	}
+
+	log.Printf("Received message: %#v", msg)
+
+	return nil
+}
+
+// Chown gives the object to the owner and the group. The owner is kept, if it
+// is empty, the group is kept, if it is nil.
+func (conn *NSClientConnector) Chown(path, owner string, group *string) error {
+	query := url.Values{"address": {path}, "owner": {owner}}
+	if group != nil {
+		query.Set("group", *group)
+	}
+
+	msg, err := conn.GetNSQuery("chown", query)
+	if err != nil {
+		return fmt.Errorf("chown: %v", err)
+	}
+
+	log.Printf("Received message: %#v", msg)
+
+	return nil
+}
+
+func (conn *NSClientConnector) GetNSUploadSession(cmd, id string) (*ClientMessage, error) {
+	addr := fmt.Sprintf("/upload/%s?id=%s", cmd, id)
+
+	resp, err := conn.get(addr)
+	if err != nil {
+        return nil, fmt.Errorf("request: %v", err)
+	}
+
+	msg, err := UnmarshalNSResponse(resp)
+    if err != nil {
+        return nil, fmt.Errorf("request: %v", err)
+    }
+
+	return msg, nil
+}
+
+// CommitUpload makes the uploaded file visible. Fileservers confirm chunks to
+// the name server in the background, so the commit is retried until they do.
+func (conn *NSClientConnector) CommitUpload(id string) error {
+    for attempt := 0; ; attempt++ {
+        msg, err := conn.GetNSUploadSession("commit", id)
+        if err != nil {
+            return err
+        }
+
+        switch {
+        case msg.Status == http.StatusOK:
+            return nil
+        case msg.Status == http.StatusConflict && attempt < commitAttempts:
+            time.Sleep(commitInterval)
+        default:
+            return fmt.Errorf(msg.Message)
+        }
+    }
+}
+
+// Reupload asks the name server to move the chunk to another fileserver.
+func (conn *NSClientConnector) Reupload(id, chunkID string) (*ClientMessage, error) {
+	addr := fmt.Sprintf("/reupload?id=%s&chunkID=%s", id, chunkID)
+
+	resp, err := conn.get(addr)
+	if err != nil {
+        return nil, fmt.Errorf("reupload request: %v", err)
+	}
+
+	msg, err := UnmarshalNSResponse(resp)
+    if err != nil {
+        return nil, fmt.Errorf("reupload request: %v", err)
+    }
+
+	if msg.Status != http.StatusOK || len(msg.Chunks) != 1 {
+		return nil, fmt.Errorf("reupload request: %s", msg.Message)
+	}
+
+	return msg, nil
+}
+
+// AbortUpload rolls the upload back. It is a courtesy to the name server,
+// which rolls back abandoned uploads anyway.
+func (conn *NSClientConnector) AbortUpload(id string) {
+    msg, err := conn.GetNSUploadSession("abort", id)
+    if err != nil {
+        log.Printf("warning: could not abort upload, %v", err)
+        return
+    }
+
+    if msg.Status != http.StatusOK {
+        log.Printf("warning: could not abort upload, %s", msg.Message)
+    }
+}
+
+// chunkRuns splits chunks into runs of consecutive chunks stored on the same
+// fileserver, so that every run is transferred in a single request.
+func chunkRuns(chunks []ChunkMessage) [][]ChunkMessage {
+    var runs [][]ChunkMessage
+
+    for i, meta := range chunks {
+        if i == 0 || chunks[i - 1].StorageIP != meta.StorageIP {
+            runs = append(runs, nil)
+        }
+
+        runs[len(runs) - 1] = append(runs[len(runs) - 1], meta)
+    }
+
+    return runs
+}
+
+func (conn *NSClientConnector) writeBatchToFS(addr, token string, src io.Reader) ([]string, error) {
+    fsAddr := fmt.Sprintf("http://%s/batch?token=%s", addr, token)
+    resp, err := http.Post(fsAddr, "application/octet-stream", src)
+    if err != nil {
+        return nil, fmt.Errorf("send chunks: %v", err)
+    }
+    defer resp.Body.Close()
+
+    var stored []string
+    if err := json.NewDecoder(resp.Body).Decode(&stored); err != nil {
+        log.Printf("warning: could not unmarshal list of stored chunks, %v", err)
+    }
+
+    if resp.StatusCode != http.StatusOK {
+        return stored, fmt.Errorf("send chunks: %d %s", resp.StatusCode, resp.Status)
+    }
+
+    return stored, nil
+}
+
+// Upload writes the file to destPath. With overwrite, an existing file at
+// destPath keeps its contents until the new ones are stored.
+func (conn *NSClientConnector) Upload(file io.ReaderAt, destPath string, fileSize int64, overwrite bool) error {
+    var err error
+    if conn.chunkSize == 0 {
+        conn.chunkSize, err = conn.GetChunkSize()
+        if err != nil {
+            return fmt.Errorf("upload init: %v", err)
+        }
+    }
+
+    msg, err := conn.GetNSUpload(destPath, fileSize, overwrite)
+    if err != nil {
+        return fmt.Errorf("upload request: %v", err)
+    }
+
+    return conn.finishUpload(file, msg, fileSize)
+}
+
+// Append writes the contents of file after the end of destPath. The appended
+// data shows up at once, when it is all stored.
+func (conn *NSClientConnector) Append(file io.ReaderAt, destPath string, fileSize int64) error {
+    var err error
+    if conn.chunkSize == 0 {
+        conn.chunkSize, err = conn.GetChunkSize()
+        if err != nil {
+            return fmt.Errorf("append init: %v", err)
+        }
+    }
+
+    msg, err := conn.GetNSAppend(destPath, fileSize)
+    if err != nil {
+        return fmt.Errorf("append request: %v", err)
+    }
+
+    return conn.finishUpload(file, msg, fileSize)
+}
+
+// finishUpload writes the chunks granted by the name server and commits the
+// upload, or aborts it on failure.
+func (conn *NSClientConnector) finishUpload(file io.ReaderAt, msg *ClientMessage, fileSize int64) error {
+    if err := conn.uploadChunks(file, msg, fileSize); err != nil {
+        conn.AbortUpload(msg.UploadID)
+        return err
+    }
+
+    if err := conn.CommitUpload(msg.UploadID); err != nil {
+        conn.AbortUpload(msg.UploadID)
+        return fmt.Errorf("upload commit: %v", err)
+    }
+
+	log.Printf("Received message: %#v", msg)
+
+	return nil
+}
+
+// uploadBatch writes the run of chunks to a fileserver in one request and
+// returns the chunks that were stored. Every chunk is read from its own
+// section of the file, so that it can be sent again.
+func (conn *NSClientConnector) uploadBatch(file io.ReaderAt, fileSize int64, token string, run []ChunkMessage, index map[string]int) ([]string, error) {
+    width := len(strconv.Itoa(len(index)))
+
+    src, dest := io.Pipe()
+    go func() {
+        for _, meta := range run {
+            offset := int64(index[meta.ChunkID] * conn.chunkSize)
+            requestSize := int64(conn.chunkSize)
+            if fileSize - offset < requestSize {
+                requestSize = fileSize - offset
+            }
+
+            if err := tsuki.WriteFrameHeader(dest, meta.ChunkID, requestSize); err != nil {
+                dest.CloseWithError(err)
+                return
+            }
+
+            bar := pb.ProgressBarTemplate(BarTemplate).Start64(requestSize)
+            bar.Set("chunkProgress", fmt.Sprintf("% *d/%d", width, index[meta.ChunkID] + 1, len(index)))
+
+            chunkSrc := io.NewSectionReader(file, offset, requestSize)
+            if _, err := io.Copy(dest, bar.NewProxyReader(chunkSrc)); err != nil {
+                dest.CloseWithError(err)
+                return
+            }
+
+            bar.Finish()
+        }
+
+        dest.Close()
+    }()
+
+    stored, err := conn.writeBatchToFS(run[0].StorageIP, token, src)
+    src.Close()
+
+    if err == nil && len(stored) < len(run) {
+        err = fmt.Errorf("%d of %d chunks stored", len(stored), len(run))
+    }
+
+    return stored, err
+}
+
+// uploadChunks writes chunks of the upload to fileservers. A chunk that a
+// fileserver fails to store is moved to another one by the name server and
+// sent again.
+func (conn *NSClientConnector) uploadChunks(file io.ReaderAt, msg *ClientMessage, fileSize int64) error {
+    index := map[string]int{}
+    for i, meta := range msg.Chunks {
+        index[meta.ChunkID] = i
+    }
+
+    type batch struct {
+        token string
+        run   []ChunkMessage
+    }
+
+    var batches []batch
+    for _, run := range chunkRuns(msg.Chunks) {
+        batches = append(batches, batch{msg.Token, run})
+    }
+
+    retries := 0
+    for len(batches) != 0 {
+        next := batches[0]
+        batches = batches[1:]
+
+        stored, err := conn.uploadBatch(file, fileSize, next.token, next.run, index)
+        if err == nil || len(stored) >= len(next.run) {
+            continue
+        }
+
+        failed := next.run[len(stored)]
+        if retries == reuploadAttempts {
+            return fmt.Errorf("upload sequence: chunk %d of %d not stored, %v", index[failed.ChunkID] + 1, len(msg.Chunks), err)
+        }
+        retries++
+
+        log.Printf("warning: chunk %d of %d not stored on %s, %v; retrying", index[failed.ChunkID] + 1, len(msg.Chunks), failed.StorageIP, err)
+
+        moved, err := conn.Reupload(msg.UploadID, failed.ChunkID)
+        if err != nil {
+            return fmt.Errorf("upload sequence: %v", err)
+        }
+
+        batches = append(batches, batch{moved.Token, moved.Chunks})
+        if rest := next.run[len(stored) + 1:]; len(rest) != 0 {
+            // the fileserver may still accept the rest of the run
+            batches = append(batches, batch{next.token, rest})
+        }
+    }
+
+    return nil
+}
+
+func (conn *NSClientConnector) downloadBatch(addr, token string, run []ChunkMessage, first, total int, dest io.Writer) error {
+    ids := make([]string, 0, len(run))
+    for _, meta := range run {
+        ids = append(ids, meta.ChunkID)
+    }
+
+    jsonIds, _ := json.Marshal(ids)
+
+    fsAddr := fmt.Sprintf("http://%s/batch?token=%s", addr, token)
+    req, _ := http.NewRequest(http.MethodGet, fsAddr, bytes.NewBuffer(jsonIds))
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return fmt.Errorf("fetch chunks: %v", err)
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("fetch chunks: %d %s", resp.StatusCode, resp.Status)
+    }
+
+    width := len(strconv.Itoa(total))
+    for i, want := range ids {
+        id, size, err := tsuki.ReadFrameHeader(resp.Body)
+        if err != nil {
+            return fmt.Errorf("fetch chunk %s: %v", want, err)
+        }
+
+        if id != want {
+            return fmt.Errorf("fetch chunk %s: got %s instead", want, id)
+        }
+
+        bar := pb.ProgressBarTemplate(BarTemplate).Start64(size)
+        bar.Set("chunkProgress", fmt.Sprintf("% *d/%d", width, first + i + 1, total))
+
+        _, err = io.CopyN(bar.NewProxyWriter(dest), resp.Body, size)
+        if err != nil {
+            return fmt.Errorf("fetch chunk %s: %v", id, err)
+        }
+
+        bar.Finish()
+    }
+
+    return nil
+}
+
+// Download writes the file to file. A version other than 0 is a previous
+// version of the file, 1 is the latest one.
+func (conn *NSClientConnector) Download(srcPath string, version int, file io.Writer) error {
+    var err error
+    if conn.chunkSize == 0 {
+        conn.chunkSize, err = conn.GetChunkSize()
+        if err != nil {
+            return fmt.Errorf("download init: %v", err)
+        }
+    }
+
+    query := url.Values{"address": {srcPath}}
+    if version != 0 {
+        query.Set("version", strconv.Itoa(version))
+    }
+
+    msg, err := conn.GetNSQuery("download", query)
+    if err != nil {
+        return fmt.Errorf("download, request stage: %v", err)
+    }
+
+    downloaded := 0
+    for _, run := range chunkRuns(msg.Chunks) {
+        err := conn.downloadBatch(run[0].StorageIP, msg.Token, run, downloaded, len(msg.Chunks), file)
+        if err != nil {
+            return fmt.Errorf("download sequence: %v", err)
+        }
+
+        downloaded += len(run)
+    }
+
+	log.Printf("Received message: %#v", msg)
+
+	return nil
+}
+
+func saveCwd() {
+    filename := path.Join(os.TempDir(), TempCwd)
+    file, err := os.Create(filename)
+    if err != nil {
+        log.Printf("warning: could not create temp file, %v", err)
+        return
+    }
+    defer file.Close()
+
+    fmt.Fprint(file, cwd)
+}
+
+var passwordFlag = &cli.StringFlag{
+    Name: "password",
+    Usage: "Do not prompt for the password",
+}
+
+var loginFlags = []cli.Flag{
+    passwordFlag,
+    &cli.StringFlag{
+        Name: "key",
+        Usage: "Sign in with the API key instead of USER and the password",
+    },
+}
+
+// login signs in as the user or with the key of the flag.
+func login(c *cli.Context, conn *NSClientConnector, user string) error {
+    key := c.String("key")
+
+    password := ""
+    if key == "" {
+        if user == "" {
+            return fmt.Errorf("error: provide the name of the user or an API key")
+        }
+
+        var err error
+        password, err = readPassword(c, "Password: ")
+        if err != nil {
+            return fmt.Errorf("error: %v", err)
+        }
+    }
+
+    err := conn.Login(user, password, key)
+    if err != nil {
+        return fmt.Errorf("error: %v", err)
+    }
+
+    return nil
+}
+
+// readPassword prompts for the password, unless it is given with the flag.
+func readPassword(c *cli.Context, prompt string) (string, error) {
+    if password := c.String("password"); password != "" {
+        return password, nil
+    }
+
+    fmt.Print(prompt)
+
+    // the password is not echoed, unless the input is not a terminal
+    if quit, err := termutil.RawModeOn(); err == nil {
+        defer func() {
+            termutil.RawModeOff()
+            close(quit)
+            fmt.Println()
+        }()
+    }
+
+    password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+    if err != nil && password == "" {
+        return "", fmt.Errorf("could not read the password: %v", err)
+    }
+
+    return strings.TrimRight(password, "\r\n"), nil
+}
+
+func loadFromTemp(name string) string {
+    filename := path.Join(os.TempDir(), name)
+    if _, err := os.Stat(filename); os.IsNotExist(err) {
+        return ""
+    }
+
+    file, err := os.Open(filename)
+    if err != nil {
+        log.Printf("warning: could not open temp file, %v", err)
+        return ""
+    }
+    defer file.Close()
+
+    buf := &bytes.Buffer{}
+    io.Copy(buf, file)
+
+    return buf.String()
+}
+
+func main() {
+    _, debugMode := os.LookupEnv(EnvDebug)
+    if !debugMode {
+        log.SetOutput(ioutil.Discard)
+    }
+
+    ns := loadFromTemp(TempNS)
+
+	conn := &NSClientConnector{
+		NSAddr: ns,
+		Key: loadKey(),
+	}
+
+    cwd = loadFromTemp(TempCwd)
+    if cwd == "" {
+        cwd = "/"
+        saveCwd()
+    }
+
+	app := &cli.App{
+		Name:  "tsuki",
+		Usage: "a CLI interface to tsukiFS distributed file system",
+        Commands: []*cli.Command {
+            {
+                Name: "connect",
+                Usage: "Probe and remember name server (or comma separated name servers) for future calls, then sign in as USER",
+                Flags: loginFlags,
+                Action: func(c *cli.Context) error {
+                    conn.NSAddr = c.Args().First()
+
+                    resp, err := conn.get("/whoami")
+                    if err != nil {
+                        return fmt.Errorf("%v", err)
+                    }
+                    resp.Body.Close()
+
+                    file, err := os.Create(path.Join(os.TempDir(), TempNS))
+                    if err != nil {
+                        fmt.Printf("warning: could not create NS temp file: %v", err)
+                        return nil
+                    }
+                    defer file.Close()
+
+                    fmt.Fprint(file, conn.NSAddr)
+
+                    if c.Args().Len() < 2 && c.String("key") == "" {
+                        if resp.StatusCode == http.StatusUnauthorized {
+                            fmt.Println("connected; sign in with tsuki login USER")
+                        }
+                        return nil
+                    }
+
+                    return login(c, conn, c.Args().Get(1))
+                },
+            },
+            {
+                Name: "login",
+                Usage: "Sign in as USER, an API key is created and remembered for future calls",
+                Flags: loginFlags,
+                Action: func(c *cli.Context) error {
+                    return login(c, conn, c.Args().First())
+                },
+            },
+            {
+                Name: "logout",
+                Usage: "Revoke and forget the API key remembered by login",
+                Action: func(c *cli.Context) error {
+                    err := conn.Logout()
+                    if err != nil {
+                        return fmt.Errorf("error: %v", err)
+                    }
+
+                    return nil
+                },
+            },
+            {
+                Name: "whoami",
+                Usage: "Print the user signed in and the role",
+                Action: func(c *cli.Context) error {
+                    user, err := conn.WhoAmI()
+                    if err != nil {
+                        return fmt.Errorf("error: %v", err)
+                    }
+
+                    fmt.Println(user)
+
+                    return nil
+                },
+            },
+            {
+                Name: "users",
+                Usage: "List users, admins only",
+                Subcommands: []*cli.Command{
+                    {
+                        Name: "add",
+                        Usage: "Create user NAME, admins only",
+                        Flags: []cli.Flag{
+                            &cli.BoolFlag{
+                                Name: "admin",
+                                Value: false,
+                                Usage: "Let the user initialize storage and manage users",
+                            },
+                            passwordFlag,
+                        },
+                        Action: func(c *cli.Context) error {
+                            if c.Args().Len() != 1 {
+                                return fmt.Errorf("error: provide the name of the user")
+                            }
+
+                            password, err := readPassword(c, "Password of the user: ")
+                            if err != nil {
+                                return fmt.Errorf("error: %v", err)
+                            }
+
+                            err = conn.AddUser(c.Args().Get(0), password, c.Bool("admin"))
+                            if err != nil {
+                                return fmt.Errorf("error: %v", err)
+                            }
+
+                            return nil
+                        },
+                    },
+                    {
+                        Name: "rm",
+                        Usage: "Remove user NAME along with the keys, admins only",
+                        Action: func(c *cli.Context) error {
+                            if c.Args().Len() != 1 {
+                                return fmt.Errorf("error: provide the name of the user")
+                            }
+
+                            err := conn.RemoveUser(c.Args().Get(0))
+                            if err != nil {
+                                return fmt.Errorf("error: %v", err)
+                            }
+
+                            return nil
+                        },
+                    },
+                    {
+                        Name: "passwd",
+                        Usage: "Change the password, or the password of user NAME, admins only",
+                        Flags: []cli.Flag{passwordFlag},
+                        Action: func(c *cli.Context) error {
+                            password, err := readPassword(c, "New password: ")
+                            if err != nil {
+                                return fmt.Errorf("error: %v", err)
+                            }
+
+                            err = conn.SetPassword(c.Args().First(), password)
+                            if err != nil {
+                                return fmt.Errorf("error: %v", err)
+                            }
+
+                            return nil
+                        },
+                    },
+                    {
+                        Name: "groups",
+                        Usage: "Set groups of user NAME to comma separated GROUPS, admins only",
+                        Action: func(c *cli.Context) error {
+                            if c.Args().Len() != 2 {
+                                return fmt.Errorf("error: provide the name of the user and the groups")
+                            }
+
+                            groups := []string{}
+                            if c.Args().Get(1) != "" {
+                                groups = strings.Split(c.Args().Get(1), ",")
+                            }
+
+                            err := conn.SetGroups(c.Args().Get(0), groups)
+                            if err != nil {
+                                return fmt.Errorf("error: %v", err)
+                            }
+
+                            return nil
+                        },
+                    },
+                    {
+                        Name: "keys",
+                        Usage: "List API keys",
+                        Subcommands: []*cli.Command{
+                            {
+                                Name: "add",
+                                Usage: "Create an API key, it is printed only once",
+                                Action: func(c *cli.Context) error {
+                                    key, err := conn.AddKey()
+                                    if err != nil {
+                                        return fmt.Errorf("error: %v", err)
+                                    }
+
+                                    fmt.Println(key)
+
+                                    return nil
+                                },
+                            },
+                            {
+                                Name: "rm",
+                                Usage: "Revoke API key ID",
+                                Action: func(c *cli.Context) error {
+                                    if c.Args().Len() != 1 {
+                                        return fmt.Errorf("error: provide the id of the key")
+                                    }
+
+                                    err := conn.RemoveKey(c.Args().Get(0))
+                                    if err != nil {
+                                        return fmt.Errorf("error: %v", err)
+                                    }
+
+                                    return nil
+                                },
+                            },
+                        },
+                        Action: func(c *cli.Context) error {
+                            keys, err := conn.Keys()
+                            if err != nil {
+                                return fmt.Errorf("error: %v", err)
+                            }
+
+                            for _, key := range keys {
+                                fmt.Println(key)
+                            }
+
+                            return nil
+                        },
+                    },
+                },
+                Action: func(c *cli.Context) error {
+                    users, err := conn.Users()
+                    if err != nil {
+                        return fmt.Errorf("error: %v", err)
+                    }
+
+                    for _, user := range users {
+                        fmt.Println(user)
+                    }
+
+                    return nil
                 },
             },
             {
@@ -525,7 +1555,7 @@ func main() {
 
                     newPath := FullOrRelative(c.Args().Get(0), cwd)
 
-                    err := conn.Cd(newPath)
+                    newPath, err := conn.Cd(newPath)
                     if err != nil {
                         return fmt.Errorf("error: %v", err)
                     }
@@ -609,6 +1639,13 @@ func main() {
             {
                 Name: "upload",
                 Usage: "Upload LOCAL file to REMOTE",
+                Flags: []cli.Flag{
+                    &cli.BoolFlag{
+                        Name: "overwrite",
+                        Value: false,
+                        Usage: "Replace REMOTE, if exists, once the upload is complete",
+                    },
+                },
                 Action: func(c *cli.Context) error {
                     if c.Args().Len() < 1 {
                         return fmt.Errorf("error: provide local (and, optionally, remote) paths to the file")
@@ -632,7 +1669,37 @@ func main() {
                         return fmt.Errorf("upload: %v", err)
                     }
 
-                    err = conn.Upload(file, remotePath, stat.Size())
+                    err = conn.Upload(file, remotePath, stat.Size(), c.Bool("overwrite"))
+                    if err != nil {
+                        return fmt.Errorf("error: %v", err)
+                    }
+
+                    return nil
+                },
+            },
+            {
+                Name: "append",
+                Usage: "Append LOCAL file to the end of REMOTE",
+                Action: func(c *cli.Context) error {
+                    if c.Args().Len() != 2 {
+                        return fmt.Errorf("error: provide local and remote paths to the files")
+                    }
+
+                    localPath  := FullOrRelative(c.Args().Get(0), LocalWd())
+                    remotePath := FullOrRelative(c.Args().Get(1), cwd)
+
+                    file, err := os.Open(localPath)
+                    if err != nil {
+                        return fmt.Errorf("append: %v", err)
+                    }
+                    defer file.Close()
+
+                    stat, err := file.Stat()
+                    if err != nil {
+                        return fmt.Errorf("append: %v", err)
+                    }
+
+                    err = conn.Append(file, remotePath, stat.Size())
                     if err != nil {
                         return fmt.Errorf("error: %v", err)
                     }
@@ -649,6 +1716,11 @@ func main() {
                         Value: false,
                         Usage: "Overwrite destination, if exists",
                     },
+                    &cli.IntFlag{
+                        Name: "version",
+                        Value: 0,
+                        Usage: "Download a previous version, 1 is the latest one",
+                    },
                 },
                 Action: func(c *cli.Context) error {
                     if c.Args().Len() < 1 {
@@ -685,7 +1757,326 @@ func main() {
                     }
                     defer file.Close()
 
-                    err = conn.Download(remotePath, file)
+                    err = conn.Download(remotePath, c.Int("version"), file)
+                    if err != nil {
+                        return fmt.Errorf("error: %v", err)
+                    }
+
+                    return nil
+                },
+            },
+            {
+                Name: "versions",
+                Usage: "List previous versions of REMOTE file",
+                Subcommands: []*cli.Command{
+                    {
+                        Name: "restore",
+                        Usage: "Make VERSION of REMOTE file current",
+                        Action: func(c *cli.Context) error {
+                            if c.Args().Len() != 2 {
+                                return fmt.Errorf("error: provide remote path to the file and the version")
+                            }
+
+                            version, err := strconv.Atoi(c.Args().Get(1))
+                            if err != nil {
+                                return fmt.Errorf("error: wrong version %q", c.Args().Get(1))
+                            }
+
+                            err = conn.RestoreVersion(FullOrRelative(c.Args().Get(0), cwd), version)
+                            if err != nil {
+                                return fmt.Errorf("error: %v", err)
+                            }
+
+                            return nil
+                        },
+                    },
+                    {
+                        Name: "keep",
+                        Usage: "Keep COUNT previous versions of files in REMOTE directory",
+                        Action: func(c *cli.Context) error {
+                            if c.Args().Len() != 2 {
+                                return fmt.Errorf("error: provide remote path to the directory and the number of versions")
+                            }
+
+                            count, err := strconv.Atoi(c.Args().Get(1))
+                            if err != nil {
+                                return fmt.Errorf("error: wrong number of versions %q", c.Args().Get(1))
+                            }
+
+                            err = conn.KeepVersions(FullOrRelative(c.Args().Get(0), cwd), count)
+                            if err != nil {
+                                return fmt.Errorf("error: %v", err)
+                            }
+
+                            return nil
+                        },
+                    },
+                },
+                Action: func(c *cli.Context) error {
+                    if c.Args().Len() != 1 {
+                        return fmt.Errorf("error: provide remote path to the file")
+                    }
+
+                    versions, err := conn.Versions(FullOrRelative(c.Args().Get(0), cwd))
+                    if err != nil {
+                        return fmt.Errorf("error: %v", err)
+                    }
+
+                    for _, version := range versions {
+                        fmt.Println(version)
+                    }
+
+                    return nil
+                },
+            },
+            {
+                Name: "ln",
+                Usage: "Create symbolic link REMOTE to TARGET, absolute or relative to the directory of the link",
+                Flags: []cli.Flag{
+                    &cli.BoolFlag{
+                        Name: "s",
+                        Value: false,
+                        Usage: "Make a symbolic link, the only kind there is",
+                    },
+                },
+                Action: func(c *cli.Context) error {
+                    if !c.Bool("s") {
+                        return fmt.Errorf("error: hard links are not supported; use ln -s")
+                    }
+                    if c.Args().Len() != 2 {
+                        return fmt.Errorf("error: provide the target and remote path to the link")
+                    }
+
+                    // the target is kept as it is given, relative targets are resolved by the nameserver
+                    err := conn.Symlink(c.Args().Get(0), FullOrRelative(c.Args().Get(1), cwd))
+                    if err != nil {
+                        return fmt.Errorf("error: %v", err)
+                    }
+
+                    return nil
+                },
+            },
+            {
+                Name: "readlink",
+                Usage: "Print the target of REMOTE symbolic link",
+                Action: func(c *cli.Context) error {
+                    if c.Args().Len() != 1 {
+                        return fmt.Errorf("error: provide remote path to the link")
+                    }
+
+                    target, err := conn.Readlink(FullOrRelative(c.Args().Get(0), cwd))
+                    if err != nil {
+                        return fmt.Errorf("error: %v", err)
+                    }
+
+                    fmt.Println(target)
+
+                    return nil
+                },
+            },
+            {
+                Name: "xattr",
+                Usage: "List extended attributes of REMOTE object as NAME=VALUE",
+                Subcommands: []*cli.Command{
+                    {
+                        Name: "get",
+                        Usage: "Print attribute NAME of REMOTE object",
+                        Action: func(c *cli.Context) error {
+                            if c.Args().Len() != 2 {
+                                return fmt.Errorf("error: provide remote path to the object and the name of the attribute")
+                            }
+
+                            value, err := conn.GetXattr(FullOrRelative(c.Args().Get(0), cwd), c.Args().Get(1))
+                            if err != nil {
+                                return fmt.Errorf("error: %v", err)
+                            }
+
+                            fmt.Println(value)
+
+                            return nil
+                        },
+                    },
+                    {
+                        Name: "set",
+                        Usage: "Set attribute NAME of REMOTE object to VALUE",
+                        Action: func(c *cli.Context) error {
+                            if c.Args().Len() != 3 {
+                                return fmt.Errorf("error: provide remote path to the object, the name and the value of the attribute")
+                            }
+
+                            err := conn.SetXattr(FullOrRelative(c.Args().Get(0), cwd), c.Args().Get(1), c.Args().Get(2))
+                            if err != nil {
+                                return fmt.Errorf("error: %v", err)
+                            }
+
+                            return nil
+                        },
+                    },
+                    {
+                        Name: "rm",
+                        Usage: "Remove attribute NAME of REMOTE object",
+                        Action: func(c *cli.Context) error {
+                            if c.Args().Len() != 2 {
+                                return fmt.Errorf("error: provide remote path to the object and the name of the attribute")
+                            }
+
+                            err := conn.RemoveXattr(FullOrRelative(c.Args().Get(0), cwd), c.Args().Get(1))
+                            if err != nil {
+                                return fmt.Errorf("error: %v", err)
+                            }
+
+                            return nil
+                        },
+                    },
+                },
+                Action: func(c *cli.Context) error {
+                    if c.Args().Len() != 1 {
+                        return fmt.Errorf("error: provide remote path to the object")
+                    }
+
+                    xattrs, err := conn.Xattrs(FullOrRelative(c.Args().Get(0), cwd))
+                    if err != nil {
+                        return fmt.Errorf("error: %v", err)
+                    }
+
+                    for _, xattr := range xattrs {
+                        fmt.Println(xattr)
+                    }
+
+                    return nil
+                },
+            },
+            {
+                Name: "quota",
+                Usage: "Limit REMOTE directory, admins only; see the usage with info",
+                Flags: []cli.Flag{
+                    &cli.Int64Flag{
+                        Name: "bytes",
+                        Value: 0,
+                        Usage: "Maximum of bytes, replicas counted; 0 is no limit",
+                    },
+                    &cli.IntFlag{
+                        Name: "objects",
+                        Value: 0,
+                        Usage: "Maximum of files and directories; 0 is no limit",
+                    },
+                },
+                Action: func(c *cli.Context) error {
+                    if c.Args().Len() != 1 {
+                        return fmt.Errorf("error: provide remote path to the directory")
+                    }
+
+                    err := conn.SetQuota(FullOrRelative(c.Args().Get(0), cwd), c.Int64("bytes"), c.Int("objects"))
+                    if err != nil {
+                        return fmt.Errorf("error: %v", err)
+                    }
+
+                    return nil
+                },
+            },
+            {
+                Name: "snapshot",
+                Usage: "Manage read-only snapshots of directories, kept in /.snapshots",
+                Subcommands: []*cli.Command{
+                    {
+                        Name: "create",
+                        Usage: "Freeze REMOTE directory as /.snapshots/NAME",
+                        Action: func(c *cli.Context) error {
+                            if c.Args().Len() != 2 {
+                                return fmt.Errorf("error: provide remote path to the directory and the name of the snapshot")
+                            }
+
+                            err := conn.CreateSnapshot(FullOrRelative(c.Args().Get(0), cwd), c.Args().Get(1))
+                            if err != nil {
+                                return fmt.Errorf("error: %v", err)
+                            }
+
+                            return nil
+                        },
+                    },
+                    {
+                        Name: "ls",
+                        Usage: "List snapshots",
+                        Action: func(c *cli.Context) error {
+                            snapshots, err := conn.Snapshots()
+                            if err != nil {
+                                return fmt.Errorf("error: %v", err)
+                            }
+
+                            for _, snapshot := range snapshots {
+                                fmt.Println(snapshot)
+                            }
+
+                            return nil
+                        },
+                    },
+                    {
+                        Name: "rm",
+                        Usage: "Remove snapshot NAME",
+                        Action: func(c *cli.Context) error {
+                            if c.Args().Len() != 1 {
+                                return fmt.Errorf("error: provide the name of the snapshot")
+                            }
+
+                            err := conn.RemoveSnapshot(c.Args().Get(0))
+                            if err != nil {
+                                return fmt.Errorf("error: %v", err)
+                            }
+
+                            return nil
+                        },
+                    },
+                },
+            },
+            {
+                Name: "trash",
+                Usage: "List removed objects, kept in /.trash until the retention runs out",
+                Subcommands: []*cli.Command{
+                    {
+                        Name: "purge",
+                        Usage: "Remove object ID from the trash for good",
+                        Action: func(c *cli.Context) error {
+                            if c.Args().Len() != 1 {
+                                return fmt.Errorf("error: provide the id of the object in the trash")
+                            }
+
+                            err := conn.PurgeTrash(c.Args().Get(0))
+                            if err != nil {
+                                return fmt.Errorf("error: %v", err)
+                            }
+
+                            return nil
+                        },
+                    },
+                },
+                Action: func(c *cli.Context) error {
+                    trashed, err := conn.Trash()
+                    if err != nil {
+                        return fmt.Errorf("error: %v", err)
+                    }
+
+                    for _, object := range trashed {
+                        fmt.Println(object)
+                    }
+
+                    return nil
+                },
+            },
+            {
+                Name: "restore",
+                Usage: "Restore removed REMOTE object, or object ID of the trash, to where it was",
+                Action: func(c *cli.Context) error {
+                    if c.Args().Len() != 1 {
+                        return fmt.Errorf("error: provide remote path to the removed object or its id in the trash")
+                    }
+
+                    // ids are listed by trash, they never contain slashes
+                    ref := c.Args().Get(0)
+                    if _, err := strconv.Atoi(strings.SplitN(ref, "-", 2)[0]); err != nil || strings.Contains(ref, "/") {
+                        ref = FullOrRelative(ref, cwd)
+                    }
+
+                    err := conn.Restore(ref)
                     if err != nil {
                         return fmt.Errorf("error: %v", err)
                     }
@@ -714,16 +2105,59 @@ func main() {
             },
             {
                 Name: "cp",
-                Usage: "Copy REMOTE file to REMOTE",
+                Usage: "Copy REMOTE file or directory to REMOTE",
                 Action: func(c *cli.Context) error {
                     if c.Args().Len() != 2 {
-                        return fmt.Errorf("error: provide remote paths to the two files")
+                        return fmt.Errorf("error: provide remote paths to the two objects")
                     }
 
                     srcPath  := FullOrRelative(c.Args().Get(0), cwd)
                     destPath := FullOrRelative(c.Args().Get(1), cwd)
 
-                    err := conn.Move(srcPath, destPath)
+                    err := conn.Copy(srcPath, destPath)
+                    if err != nil {
+                        return fmt.Errorf("error: %v", err)
+                    }
+
+                    return nil
+                },
+            },
+            {
+                Name: "chmod",
+                Usage: "Set octal permission bits MODE of REMOTE object, e.g. 750",
+                Action: func(c *cli.Context) error {
+                    if c.Args().Len() != 2 {
+                        return fmt.Errorf("error: provide the mode and remote path to the object")
+                    }
+
+                    remotePath := FullOrRelative(c.Args().Get(1), cwd)
+
+                    err := conn.Chmod(remotePath, c.Args().Get(0))
+                    if err != nil {
+                        return fmt.Errorf("error: %v", err)
+                    }
+
+                    return nil
+                },
+            },
+            {
+                Name: "chown",
+                Usage: "Give REMOTE object to OWNER[:GROUP], or to :GROUP keeping the owner",
+                Action: func(c *cli.Context) error {
+                    if c.Args().Len() != 2 {
+                        return fmt.Errorf("error: provide the owner and remote path to the object")
+                    }
+
+                    owner := c.Args().Get(0)
+                    var group *string
+                    if i := strings.Index(owner, ":"); i >= 0 {
+                        name := owner[i+1:]
+                        owner, group = owner[:i], &name
+                    }
+
+                    remotePath := FullOrRelative(c.Args().Get(1), cwd)
+
+                    err := conn.Chown(remotePath, owner, group)
                     if err != nil {
                         return fmt.Errorf("error: %v", err)
                     }
@@ -6,54 +6,106 @@ import (
     "os"
 	"log"
 	"net/http"
+	"path"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/kureduro/tsuki"
 )
 
-var port int
-var ns, dbDir string
+const (
+    nodeIDFile = ".tsukinode"
+    nsSaveFile = ".tsukifs"
+)
+
+var port, cacheSize int
+var ns, dataDir, dbDir string
+var publicHost, privateHost string
+var gcPeriod, gcGrace time.Duration
 
 func init() {
     flag.IntVar(&port, "port", 7000, "port for clients")
-    flag.StringVar(&ns, "ns", "", "address of the name server")
-    flag.StringVar(&dbDir, "db", "chunks", "directory where chunks will be stored, erased on startup")
+    flag.StringVar(&ns, "ns", "", "address of the name server, or comma separated addresses of the primary one and standbys")
+    flag.StringVar(&publicHost, "public", "", "host clients should use, the private one by default")
+    flag.StringVar(&privateHost, "private", "", "host the name server should use, the one it sees by default")
+    flag.StringVar(&dataDir, "data", ".", "directory where the identity of the fileserver and its chunks are kept")
+    flag.StringVar(&dbDir, "db", "chunks", "directory where chunks will be stored, relative to the data directory")
+    flag.IntVar(&cacheSize, "cache", 0, "size of the hot chunk cache in MB, 0 disables it")
+    flag.DurationVar(&gcPeriod, "gc", 10 * time.Minute, "period of orphan chunk reconciliation with the name server")
+    flag.DurationVar(&gcGrace, "gcgrace", time.Hour, "how long a chunk stays orphan before it is deleted")
 }
 
 func main() {
 
     flag.Parse()
 
-    if _, err := os.Stat(".tsukifs"); err == nil {
-        save, err := os.Open(".tsukifs")
+    if err := os.MkdirAll(dataDir, 0755); err != nil {
+        log.Fatal(err)
+    }
+
+    nsSavePath := path.Join(dataDir, nsSaveFile)
+    if _, err := os.Stat(nsSavePath); err == nil {
+        save, err := os.Open(nsSavePath)
         if err != nil {
             log.Fatal(err)
         }
         defer save.Close()
 
         fmt.Fscanf(save, "%s", &ns)
-        log.Printf("Found .tsukifs: NS=%s", ns)
+        log.Printf("Found %s: NS=%s", nsSavePath, ns)
+    }
+
+    nodeID, err := tsuki.LoadNodeID(path.Join(dataDir, nodeIDFile))
+    if err != nil {
+        log.Fatal(err)
     }
+    log.Printf("node id: %s", nodeID)
 
     addrForClients := ":" + strconv.Itoa(port)
     addrForInner := ":" + strconv.Itoa(port + 1)
 
     log.Printf("listening for clients at %s", addrForClients)
 
-    store, err := tsuki.NewFileSystemChunkStorage(dbDir)
+    if !path.IsAbs(dbDir) {
+        dbDir = path.Join(dataDir, dbDir)
+    }
+
+    store, err := tsuki.LoadFileSystemChunkStorage(dbDir)
     if err != nil {
         log.Fatal(err)
     }
 
-    nsConn := &tsuki.HTTPNSConnector{}
-    nsConn.SetNSAddr(ns)
+    // Without NS address, the fileserver waits to be probed by NS
+    var registration *tsuki.FSRegisterInfo
+    var nsAddrs []string
+    if ns != "" {
+        registration = &tsuki.FSRegisterInfo{
+            NodeID: nodeID,
+            PublicHost: publicHost,
+            PrivateHost: privateHost,
+            Available: store.BytesAvailable(),
+        }
+        nsAddrs = strings.Split(ns, ",")
+    }
+
+    nsConn := tsuki.NewMultiNSConnector(nodeID, registration, nsAddrs...)
 
     heart := tsuki.NewHeart(nsConn, 3 * time.Second)
     go heart.Poll(-1)
 
     server := tsuki.NewFileServer(store, nsConn)
+    server.SetNodeID(nodeID)
+    server.SaveNSTo(nsSavePath)
+
+    if cacheSize > 0 {
+        log.Printf("caching up to %d MB of chunks", cacheSize)
+        server.SetCache(tsuki.NewChunkCache(cacheSize * 1024 * 1024))
+    }
+
+    collector := tsuki.NewOrphanCollector(server, gcGrace)
+    go tsuki.NewHeart(collector, gcPeriod).Poll(-1)
 
     var wg sync.WaitGroup
     wg.Add(2)
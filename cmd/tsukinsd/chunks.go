@@ -1,9 +1,7 @@
 package main
 
 import (
-	"encoding/gob"
 	"fmt"
-	"os"
 	"sync"
 )
 
@@ -18,28 +16,29 @@ type Chunk struct {
 	ChunkID string
 	File    string
 	//FServers         []*FileServerInfo
-	FServers      map[string]*FileServerInfo
+	FServers      map[string]*FileServerInfo // node ID -> fileserver
 	Status        int
-	Statuses      map[string]int
+	Statuses      map[string]int // node ID -> status
 	ReadyReplicas int
 	AllReplicas   int
+	Refs          int // files sharing the chunk, since copies do not copy data
 	ssmu          sync.Mutex
 }
 
 type ChunkTable struct {
-	ivmu          sync.Mutex
 	Table         map[string]*Chunk
-	InvertedTable map[string][]*Chunk // node hostname -> []*Chunk
+	InvertedTable map[string][]*Chunk // node ID -> []*Chunk
 }
 
 func (ct *ChunkTable) AddChunk(chunkID string, file string, initNode *FileServerInfo) (*Chunk, bool) {
 	chunk := Chunk{
 		ChunkID:     chunkID,
 		File:        file,
-		FServers:    map[string]*FileServerInfo{initNode.PrivateHost: initNode},
+		FServers:    map[string]*FileServerInfo{initNode.NodeID: initNode},
 		Status:      PENDING,
-		Statuses:    map[string]int{initNode.PrivateHost: PENDING},
+		Statuses:    map[string]int{initNode.NodeID: PENDING},
 		AllReplicas: 1,
+		Refs:        1,
 	}
 
 	ct.Table[chunkID] = &chunk
@@ -47,50 +46,205 @@ func (ct *ChunkTable) AddChunk(chunkID string, file string, initNode *FileServer
 	return &chunk, true
 }
 
+// AssignChunk adds a new pending chunk of the file, stored on fs.
+func (ct *ChunkTable) AssignChunk(file *Node, chunkID string, fs *FileServerInfo) *Chunk {
+	file.Chunks = append(file.Chunks, chunkID)
+	file.Pending[chunkID] = true
+
+	chunk, _ := ct.AddChunk(chunkID, file.Address, fs)
+	ct.InvertedTable[fs.NodeID] = append(ct.InvertedTable[fs.NodeID], chunk)
+
+	return chunk
+}
+
+// Relink points chunks stored on the fileserver to it, replacing the
+// placeholder they were loaded with.
+func (ct *ChunkTable) Relink(fs *FileServerInfo) {
+	for _, chunk := range ct.InvertedTable[fs.NodeID] {
+		if _, ok := chunk.FServers[fs.NodeID]; ok {
+			chunk.FServers[fs.NodeID] = fs
+		}
+	}
+}
+
+// Reassign moves the pending chunk to fs. The fileservers that did not receive
+// it are forgotten, a late confirmation from them is ignored.
+func (ct *ChunkTable) Reassign(chunk *Chunk, fs *FileServerInfo) {
+	for nodeID := range chunk.FServers {
+		if chunk.Statuses[nodeID] != PENDING {
+			continue
+		}
+
+		delete(chunk.FServers, nodeID)
+		delete(chunk.Statuses, nodeID)
+		chunk.AllReplicas -= 1
+
+		stored := ct.InvertedTable[nodeID]
+		for i := range stored {
+			if stored[i] == chunk {
+				ct.InvertedTable[nodeID] = append(stored[:i:i], stored[i+1:]...)
+				break
+			}
+		}
+	}
+
+	if chunk.ReadyReplicas == 0 {
+		// a pending chunk is marked down, once its fileserver is
+		chunk.Status = PENDING
+	}
+
+	chunk.AddFSToChunk(fs)
+	ct.InvertedTable[fs.NodeID] = append(ct.InvertedTable[fs.NodeID], chunk)
+}
+
 func (c *Chunk) AddFSToChunk(fs *FileServerInfo) {
-	c.FServers[fs.PrivateHost] = fs
-	c.Statuses[fs.PrivateHost] = PENDING
+	c.FServers[fs.NodeID] = fs
+	c.Statuses[fs.NodeID] = PENDING
 	c.AllReplicas += 1
 }
 
-func (ct *ChunkTable) SaveChunkTable(saveTo string) bool {
-	file, _ := os.Create(saveTo)
-	defer file.Close()
-	encoder := gob.NewEncoder(file)
+// dropReplica forgets the replica of the chunk on the fileserver.
+func (ct *ChunkTable) dropReplica(chunk *Chunk, nodeID string) {
+	if _, ok := chunk.FServers[nodeID]; !ok {
+		return
+	}
+
+	if chunk.Statuses[nodeID] == OK {
+		chunk.ReadyReplicas -= 1
+	}
+	chunk.AllReplicas -= 1
+	delete(chunk.FServers, nodeID)
+	delete(chunk.Statuses, nodeID)
 
-	encoder.Encode(ct)
-	return true
+	chunks := ct.InvertedTable[nodeID]
+	for i, held := range chunks {
+		if held == chunk {
+			// copied, so that callers may range over the old slice
+			ct.InvertedTable[nodeID] = append(chunks[:i:i], chunks[i+1:]...)
+			break
+		}
+	}
+	if len(ct.InvertedTable[nodeID]) == 0 {
+		delete(ct.InvertedTable, nodeID)
+	}
 }
 
+// Ref counts one more file referencing the chunks.
+func (ct *ChunkTable) Ref(chunks []string) {
+	for _, chunkID := range chunks {
+		if chunk, ok := ct.Table[chunkID]; ok {
+			chunk.Refs += 1
+		}
+	}
+}
+
+// Unref counts one file less referencing the chunks and returns the chunks
+// that are not referenced anymore, those may be purged. They are marked
+// obsolete at once, so that a snapshot taken before the purge keeps them so.
+func (ct *ChunkTable) Unref(chunks []string) []string {
+	unused := []string{}
+	for _, chunkID := range chunks {
+		chunk, ok := ct.Table[chunkID]
+		if !ok {
+			continue
+		}
+
+		chunk.Refs -= 1
+		if chunk.Refs <= 0 {
+			chunk.Status = OBSOLETE
+			unused = append(unused, chunkID)
+		}
+	}
+
+	return unused
+}
+
+// purging returns the purge of the chunks as a side effect of an operation,
+// see Tree.AfterCommit.
+func (ct *ChunkTable) purging(chunks []string) func() {
+	return func() { ct.PurgeChunks(chunks) }
+}
+
+// PurgeChunks locks treemu, since it is called in a separate goroutine.
 func (ct *ChunkTable) PurgeChunks(chunks []string) {
 	cock := map[int][]string{}
+
+	treemu.Lock()
 	for _, chunkName := range chunks {
-		chunk := ct.Table[chunkName]
+		// /init may have reset the table, or the chunk is purged already
+		chunk, ok := ct.Table[chunkName]
+		if !ok {
+			continue
+		}
 
 		chunk.Status = OBSOLETE
 		for _, fs := range chunk.FServers {
 			if fs.GetStatus() == LIVE {
-				// todo: add to queue if not alive
+				// if not alive, the fileserver will learn about obsolete chunk on inventory
 				cock[fs.ID] = append(cock[fs.ID], chunk.ChunkID)
 			}
 		}
 	}
+	treemu.Unlock()
 
 	for key, value := range cock {
 		storages.PurgeChunks(key, value)
 	}
 }
 
-func LoadChunkTable(openFrom string) *ChunkTable {
-	file, _ := os.Open(openFrom)
-	defer file.Close()
+// Orphans returns those of the chunks stored on the fileserver that it should
+// not have: unknown, obsolete or assigned to other fileservers.
+func (ct *ChunkTable) Orphans(nodeID string, chunks []string) []string {
+	orphans := []string{}
+	for _, chunkID := range chunks {
+		chunk, ok := ct.Table[chunkID]
+		if !ok || chunk.Status == OBSOLETE {
+			orphans = append(orphans, chunkID)
+			continue
+		}
 
-	decoder := gob.NewDecoder(file)
+		if _, assigned := chunk.FServers[nodeID]; !assigned {
+			orphans = append(orphans, chunkID)
+		}
+	}
+
+	return orphans
+}
 
-	var chunkTable ChunkTable
-	decoder.Decode(&chunkTable)
+func NewChunkTable() *ChunkTable {
+	return &ChunkTable{
+		Table:         map[string]*Chunk{}, // chunkID -> chunk
+		InvertedTable: map[string][]*Chunk{},
+	}
+}
+
+// relink is called on a decoded table. It takes fileservers of chunks from
+// pool, fileservers that are not there yet are replaced with placeholders.
+func (ct *ChunkTable) relink(pool *PoolInfo) {
+	if ct.Table == nil {
+		ct.Table = map[string]*Chunk{}
+	}
 
-	return &chunkTable
+	// the inverted table is rebuilt from chunks, instead of being decoded
+	// into copies of them
+	ct.InvertedTable = map[string][]*Chunk{}
+	for _, chunk := range ct.Table {
+		if chunk.Statuses == nil {
+			chunk.Statuses = map[string]int{}
+		}
+
+		if chunk.Refs == 0 && chunk.Status != OBSOLETE {
+			// saved before references were counted
+			chunk.Refs = 1
+		}
+
+		fservers := map[string]*FileServerInfo{}
+		for nodeID := range chunk.FServers {
+			fservers[nodeID] = pool.GetOrPlaceholder(nodeID)
+			ct.InvertedTable[nodeID] = append(ct.InvertedTable[nodeID], chunk)
+		}
+		chunk.FServers = fservers
+	}
 }
 
 func (ct *ChunkTable) String() string {
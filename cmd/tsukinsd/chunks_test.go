@@ -0,0 +1,41 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChunkTable_Orphans(t *testing.T) {
+	fs1 := &FileServerInfo{NodeID: "node-a", PrivateHost: "10.0.0.1"}
+	fs2 := &FileServerInfo{NodeID: "node-b", PrivateHost: "10.0.0.1"}
+
+	table := &ChunkTable{
+		Table:         map[string]*Chunk{},
+		InvertedTable: map[string][]*Chunk{},
+	}
+
+	table.AddChunk("ok", "a.txt", fs1)
+	table.AddChunk("elsewhere", "a.txt", fs2)
+	obsolete, _ := table.AddChunk("obsolete", "b.txt", fs1)
+	obsolete.Status = OBSOLETE
+
+	got := table.Orphans(fs1.NodeID, []string{"ok", "elsewhere", "obsolete", "unknown"})
+	want := []string{"elsewhere", "obsolete", "unknown"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got orphans %v, want %v", got, want)
+	}
+}
+
+func TestChunkTable_PurgeMissing(t *testing.T) {
+	fs := &FileServerInfo{NodeID: "node-a"}
+	table := NewChunkTable()
+	table.AddChunk("kept", "a.txt", fs)
+
+	// the table may be reset by /init before the purge takes the lock
+	table.PurgeChunks([]string{"gone", "kept", "kept"})
+
+	if table.Table["kept"].Status != OBSOLETE {
+		t.Errorf("got status %d, want OBSOLETE", table.Table["kept"].Status)
+	}
+}
@@ -18,7 +18,15 @@ type Namenode struct {
 	TreeUpdatePeriod  int64
 	TreeLogName       string
 	TreeGobName       string
-	ChunkTableGobName string
+	SnapshotsKept     int
+	Primary           string // private address of the primary nameserver, if this one is a standby
+	ClusterSecret     string // required from standbys following the log, which is not served if empty
+	StandbyPollPeriod time.Duration
+	Peers             []string // private addresses of the group of nameservers, including this one
+	RaftStateName     string
+	UploadLease       time.Duration // uploads that are not committed in time are rolled back
+	TrashRetention    time.Duration // removed objects are kept in /.trash for as long; 0 removes them at once
+	AdminPassword     string        // of the built-in admin account, which is disabled if empty
 	SoftDeathTime     time.Duration
 	HardDeathTime     time.Duration
 	ChunkSize         int
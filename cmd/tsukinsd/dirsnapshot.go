@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// Directory snapshots are read-only copies of subtrees kept under
+// /.snapshots/<name>. Like copies, they share chunks with the originals, so
+// the chunks are not purged while a snapshot references them.
+const snapshotsDir = ".snapshots"
+
+// InSnapshot tells whether the address is in a directory snapshot, those are
+// read-only.
+func InSnapshot(address string) bool {
+	address, _ = CleanAddress(address)
+
+	return address == snapshotsDir || strings.HasPrefix(address, snapshotsDir+"/")
+}
+
+func snapshotAddress(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return "", fmt.Errorf("%q wrong snapshot name", name)
+	}
+
+	return path.Join(snapshotsDir, name), nil
+}
+
+// CreateDirSnapshot freezes the directory as /.snapshots/<name>. Only
+// metadata is copied, the caller references the chunks of the snapshot.
+func (t *Tree) CreateDirSnapshot(address string, name string, createdOn time.Time) (*Node, error) {
+	address, matched := CleanAddress(address)
+
+	if !matched {
+		return nil, fmt.Errorf("/%s wrong file name format", address)
+	}
+	if !t.DirectoryExists(address) {
+		return nil, fmt.Errorf("/%s/ directory does not exist", address)
+	}
+	if InSnapshot(address) {
+		return nil, fmt.Errorf("/%s/ is a snapshot already", address)
+	}
+	if InTrash(address) {
+		return nil, readOnly(address)
+	}
+	if err := t.allow(address, permRead|permExec); err != nil {
+		return nil, err
+	}
+
+	snapshot, err := snapshotAddress(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := t.Nodes[snapshot]; ok {
+		return nil, fmt.Errorf("snapshot %s already exists", name)
+	}
+
+	dir, err := t.readOnlyDir(snapshotsDir, createdOn)
+	if err != nil {
+		return nil, err
+	}
+
+	frozen := t.copySubtree(t.Nodes[address], snapshot, snapshotsDir)
+	frozen.CreatedOn = createdOn
+	t.claim(frozen, false)
+	dir.Childs = append(dir.Childs, frozen)
+
+	bytes, objects := frozen.usage()
+	t.account(snapshotsDir, bytes, objects)
+
+	t.CommitUpdate("snapshot", address, name, createdOn.Format(time.RFC3339Nano))
+
+	return frozen, nil
+}
+
+// RemoveDirSnapshot removes the snapshot. The caller releases its chunks.
+func (t *Tree) RemoveDirSnapshot(name string) (*Node, error) {
+	snapshot, err := snapshotAddress(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !t.DirectoryExists(snapshot) {
+		return nil, fmt.Errorf("snapshot %s does not exist", name)
+	}
+
+	frozen := t.Nodes[snapshot]
+	if !t.mayManage(frozen) {
+		return nil, fmt.Errorf("snapshot %s permission denied; not the owner", name)
+	}
+
+	frozen.Removed = true
+	t.Removed = append(t.Removed, frozen)
+	t.forget(frozen)
+
+	bytes, objects := frozen.usage()
+	t.account(snapshotsDir, -bytes, -objects)
+
+	t.CommitUpdate("rmsnapshot", name)
+
+	return frozen, nil
+}
+
+// forget drops the node and everything in it from the index of nodes, so
+// that a new snapshot may take the name.
+func (t *Tree) forget(node *Node) {
+	if t.Nodes[node.Address] == node {
+		delete(t.Nodes, node.Address)
+	}
+
+	for _, child := range node.Childs {
+		t.forget(child)
+	}
+}
+
+// DirSnapshots lists snapshots along with the time they were taken.
+func (t *Tree) DirSnapshots() []string {
+	list := []string{}
+
+	dir, ok := t.Nodes[snapshotsDir]
+	if !ok {
+		return list
+	}
+
+	for _, frozen := range dir.Childs {
+		if frozen.Removed || !t.Exists(frozen.Address) {
+			continue
+		}
+
+		list = append(list, fmt.Sprintf("%s\t%s", path.Base(frozen.Address), frozen.CreatedOn.Format(time.RFC3339)))
+	}
+
+	return list
+}
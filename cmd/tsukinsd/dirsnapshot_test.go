@@ -0,0 +1,145 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTree_DirSnapshots(t *testing.T) {
+	f := newTreeFixture(t)
+	tree, table := f.tree, f.table
+
+	tree.CreateDirectory("project")
+	tree.CreateDirectory("project/src")
+	f.upload(t, "project/a.txt", "a1")
+	f.upload(t, "project/src/b.txt", "b1")
+
+	frozen, err := tree.CreateDirSnapshot("project", "before", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.Ref(frozen.AllChunks())
+
+	t.Run("snapshot pins chunks of removed files",
+		func(t *testing.T) {
+			file, err := tree.RemoveFile("project/a.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := table.Unref(file.Chunks); len(got) != 0 {
+				t.Errorf("got %v released, want none", got)
+			}
+
+			if !tree.FileExists(".snapshots/before/a.txt") || !tree.FileExists(".snapshots/before/src/b.txt") {
+				t.Errorf("snapshot lost its files")
+			}
+		})
+
+	t.Run("snapshot is read-only",
+		func(t *testing.T) {
+			if _, err := tree.CreateFile(".snapshots/before/c.txt", 0); err == nil {
+				t.Errorf("created a file in a snapshot")
+			}
+			if err := tree.CreateDirectory(".snapshots/other"); err == nil {
+				t.Errorf("created a directory among snapshots")
+			}
+			if _, err := tree.RemoveFile(".snapshots/before/a.txt"); err == nil {
+				t.Errorf("removed a file of a snapshot")
+			}
+			if _, err := tree.RemoveDirectory(".snapshots/before"); err == nil {
+				t.Errorf("removed a snapshot with rmdir")
+			}
+			if _, err := tree.Move(".snapshots/before/a.txt", "a.txt", table); err == nil {
+				t.Errorf("moved a file out of a snapshot")
+			}
+			if _, err := tree.CopyFile("project/src/b.txt", ".snapshots/before"); err == nil {
+				t.Errorf("copied a file into a snapshot")
+			}
+			if _, err := tree.StageOverwrite(".snapshots/before/a.txt", 10, "id"); err == nil {
+				t.Errorf("overwrote a file of a snapshot")
+			}
+
+			// files are restored by copying them out
+			if _, err := tree.CopyFile(".snapshots/before/a.txt", "project/a.txt"); err != nil {
+				t.Errorf("could not copy a file out of a snapshot: %v", err)
+			}
+			table.Ref([]string{"a1"})
+		})
+
+	t.Run("snapshot of the root leaves other snapshots out",
+		func(t *testing.T) {
+			root, err := tree.CreateDirSnapshot(".", "root", time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			table.Ref(root.AllChunks())
+
+			if tree.Exists(".snapshots/root/.snapshots") {
+				t.Errorf("snapshots were copied into the snapshot")
+			}
+
+			got := tree.DirSnapshots()
+			if len(got) != 2 {
+				t.Errorf("got snapshots %v, want 2 of them", got)
+			}
+		})
+
+	t.Run("removed snapshot releases chunks",
+		func(t *testing.T) {
+			removed, err := tree.RemoveDirSnapshot("before")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := table.Unref(removed.AllChunks()); len(got) != 0 {
+				t.Errorf("got %v released, want none, the root snapshot holds them", got)
+			}
+
+			removed, _ = tree.RemoveDirSnapshot("root")
+			if got := table.Unref(removed.AllChunks()); len(got) != 0 {
+				t.Errorf("got %v released, want none, files hold them", got)
+			}
+
+			reused, err := tree.CreateDirSnapshot("project", "before", time.Now())
+			if err != nil {
+				t.Fatalf("name of a removed snapshot cannot be reused: %v", err)
+			}
+			table.Ref(reused.AllChunks())
+			tree.ClearRemoved()
+
+			if !tree.FileExists(".snapshots/before/a.txt") {
+				t.Errorf("new snapshot was cleared along with the removed one")
+			}
+		})
+
+	t.Run("replay",
+		func(t *testing.T) {
+			f.snapshot(t)
+
+			// replayed on top of the snapshot
+			after, err := tree.CreateDirSnapshot("project", "after", time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			table.Ref(after.AllChunks())
+
+			recovered, recoveredTable := f.recover(t)
+
+			for _, name := range []string{"before", "after"} {
+				want, _ := tree.LS(".snapshots/" + name)
+				got, _ := recovered.LS(".snapshots/" + name)
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("%s: got %v, want %v", name, got, want)
+				}
+			}
+
+			// the file and both snapshots
+			for chunkID, want := range map[string]int{"a1": 3, "b1": 3} {
+				if got := recoveredTable.Table[chunkID].Refs; got != want || table.Table[chunkID].Refs != want {
+					t.Errorf("chunk %s: got %d references, %d before recovery, want %d", chunkID, got, table.Table[chunkID].Refs, want)
+				}
+			}
+		})
+}
@@ -1,38 +1,79 @@
 package main
 
 import (
-	"encoding/gob"
 	"fmt"
 	"log"
-	"os"
 	"path"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 )
 
+// treemu guards the tree and the chunk table, along with t and ct, which are
+// replaced on recovery. Handlers hold it for the whole request, for reading
+// if they change nothing. Methods of Tree and ChunkTable expect it to be held
+// by the caller.
+var treemu sync.RWMutex
+
 type Tree struct {
 	Nodes   map[string]*Node
 	Version int64
+	Term    int64 // of the last operation, see Raft
 	Removed []*Node
+	Users   map[string]*User // accounts of the public API, see User
 	Conf    Namenode
+
+	// the log starts right after the last snapshot
+	SnapshotVersion int64
+	SnapshotTerm    int64
+
+	// set while the log is replayed, so that operations are not logged again
+	replaying bool
+
+	// nil, unless the log is replicated to a group of nameservers
+	raft *Raft
+
+	// the user whose request is served, see ActAs
+	acting *User
+
+	// set by Commit, see snapshotIfDue
+	snapshotDue bool
 }
 
 type Node struct {
-	Address     string
-	IsDirectory bool
-	Childs      []*Node
-	Parent      string
-	Removed     bool
-	Pending     map[string]bool
-	Chunks      []string
-	CreatedOn   time.Time
-	Size        int
+	Address      string
+	IsDirectory  bool
+	Childs       []*Node
+	Parent       string
+	Removed      bool
+	Pending      map[string]bool
+	Chunks       []string
+	CreatedOn    time.Time
+	Size         int
+	UploadID     string // set until the upload is committed, see Upload
+	Staged       *Node  // new version of the file, until the overwrite is committed
+	Versions     []Version
+	KeepVersions int    // directories only, how many versions files in it keep
+	TrashedFrom  string // set while the node is in the trash, see Trash
+	TrashedOn    time.Time
+	TrashedBy    string
+	Owner        string // see CheckAccess
+	Group        string
+	Mode         uint32 // rwx bits of the owner, the group and others
+	QuotaBytes   int64  // directories only, logical bytes beneath it; 0 is no limit, see checkQuota
+	QuotaObjects int
+	Xattrs       map[string]string // extended attributes, see SetXattr
+	Symlink      string            // target of a symbolic link, see Resolve
+
+	// beneath the directory, see account
+	usedBytes   int64
+	usedObjects int
 }
 
 func InitTree(conf Namenode) *Tree {
-	root := &Node{Address: ".", IsDirectory: true, Childs: make([]*Node, 0), Parent: "", CreatedOn: time.Now()}
-	tree := &Tree{Nodes: map[string]*Node{".": root}, Conf: conf}
+	root := &Node{Address: ".", IsDirectory: true, Childs: make([]*Node, 0), Parent: "", CreatedOn: time.Now(), Owner: adminName, Mode: defaultDirMode}
+	tree := &Tree{Nodes: map[string]*Node{".": root}, Users: map[string]*User{}, Conf: conf}
 
 	return tree
 }
@@ -45,12 +86,52 @@ func (node *Node) String() string {
 	return fmt.Sprintf("Node{Address: %q, IsDirectory: %v, Childs: %v, Parent: %q, Removed: %v, Chunks: %v}", node.Address, node.IsDirectory, node.Childs, node.Parent, node.Removed, node.Chunks)
 }
 
+// IsReadOnly tells whether the address is in a directory snapshot or in the
+// trash, neither may be changed by clients.
+func IsReadOnly(address string) bool {
+	return InSnapshot(address) || InTrash(address)
+}
+
+func readOnly(address string) error {
+	if InTrash(address) {
+		return fmt.Errorf("/%s is read-only; it is in the trash, restore it first", address)
+	}
+
+	return fmt.Errorf("/%s is read-only; it is in a snapshot", address)
+}
+
+// readOnlyDir returns the directory, creating it in its existing parent if
+// it does not exist yet. CreateDirectory refuses the address, since it is read-only.
+func (t *Tree) readOnlyDir(address string, createdOn time.Time) (*Node, error) {
+	dir, ok := t.Nodes[address]
+	if !ok {
+		parent := path.Dir(address)
+		dir = &Node{Address: address, IsDirectory: true, Parent: parent, CreatedOn: createdOn, Owner: adminName, Mode: defaultDirMode}
+		t.Nodes[parent].Childs = append(t.Nodes[parent].Childs, dir)
+		t.Nodes[address] = dir
+		t.account(parent, 0, 1)
+	} else if !dir.IsDirectory {
+		return nil, fmt.Errorf("/%s is a file", address)
+	}
+
+	return dir, nil
+}
+
 func (t *Tree) CreateFile(fileName string, size int) (*Node, error) {
+	return t.createFile(fileName, size, time.Now())
+}
+
+// createFile creates the file as of the time, which is logged, so that the
+// replayed file is created at the same time.
+func (t *Tree) createFile(fileName string, size int, createdOn time.Time) (*Node, error) {
 	fileName, matched := CleanAddress(fileName)
 
 	if !matched {
 		return nil, fmt.Errorf("wrong file name format")
 	}
+	if IsReadOnly(fileName) {
+		return nil, readOnly(fileName)
+	}
 
 	_, fileExists := t.Nodes[fileName]
 
@@ -64,6 +145,12 @@ func (t *Tree) CreateFile(fileName string, size int) (*Node, error) {
 	if !dirExists {
 		return nil, fmt.Errorf("/%s/ directory does not exist", dirPath)
 	}
+	if err := t.allowEntries(fileName); err != nil {
+		return nil, err
+	}
+	if err := t.checkQuota(dirPath, int64(size), 1, ""); err != nil {
+		return nil, err
+	}
 	dir, _ := t.GetNodeByAddress(dirPath)
 
 	newFile := &Node{
@@ -72,20 +159,26 @@ func (t *Tree) CreateFile(fileName string, size int) (*Node, error) {
 		Childs:      nil,
 		Parent:      dir.Address,
 		Pending:     map[string]bool{},
-		CreatedOn: time.Now(),
+		CreatedOn: createdOn,
 		Size: size,
 	}
 
+	t.own(newFile)
+
 	dir.Childs = append(dir.Childs, newFile)
 	t.Nodes[fileName] = newFile
+	t.account(dir.Address, int64(size), 1)
 
-	t.CommitUpdate("touch", fileName)
+	t.Commit(LogRecord{Command: "touch", Args: []string{fileName, createdOn.Format(time.RFC3339Nano)}, Size: size})
 
 	return newFile, nil
 }
 
 func (t *Tree) GetFile(address string) (*Node, error) {
-	address = path.Clean(address)
+	address, err := t.Resolve(address)
+	if err != nil {
+		return nil, err
+	}
 
 	if !t.FileExists(address) {
 		return nil, fmt.Errorf("/%s file does not exist", address)
@@ -106,6 +199,9 @@ func (t *Tree) RemoveFile(address string) (*Node, error) {
 	if !matched {
 		return nil, fmt.Errorf("/%s wrong file name format", address)
 	}
+	if IsReadOnly(address) {
+		return nil, readOnly(address)
+	}
 
 	exists, isDirectory := t.PathExists(address)
 	if !exists {
@@ -113,6 +209,9 @@ func (t *Tree) RemoveFile(address string) (*Node, error) {
 	} else if isDirectory {
 		return nil, fmt.Errorf("/%s/ cannot remove directory; use rmdir instead", address)
 	}
+	if err := t.allowEntries(address); err != nil {
+		return nil, err
+	}
 
 	removed := t.Nodes[address]
 	removed.Removed = true // lazy removing
@@ -120,17 +219,28 @@ func (t *Tree) RemoveFile(address string) (*Node, error) {
 
 	delete(t.Nodes, address)
 
+	bytes, objects := removed.usage()
+	t.account(removed.Parent, -bytes, -objects)
+
 	t.CommitUpdate("rmfile", address)
 
 	return removed, nil
 }
 
 func (t *Tree) CreateDirectory(address string) error {
+	return t.createDirectory(address, time.Now())
+}
+
+// createDirectory creates the directory as of the time, see createFile.
+func (t *Tree) createDirectory(address string, createdOn time.Time) error {
 	address, matched := CleanAddress(address)
 
 	if !matched {
 		return fmt.Errorf("/%s wrong file name format", address)
 	}
+	if IsReadOnly(address) {
+		return readOnly(address)
+	}
 
 	exists, _ := t.PathExists(address)
 
@@ -143,6 +253,12 @@ func (t *Tree) CreateDirectory(address string) error {
 	if !dirExists {
 		return fmt.Errorf("/%s the parent directory (%s) does not exist", address, dirPath)
 	}
+	if err := t.allowEntries(address); err != nil {
+		return err
+	}
+	if err := t.checkQuota(dirPath, 0, 1, ""); err != nil {
+		return err
+	}
 	dir := t.Nodes[dirPath]
 
 	newDir := &Node{
@@ -150,13 +266,16 @@ func (t *Tree) CreateDirectory(address string) error {
 		IsDirectory: true,
 		Childs:      nil,
 		Parent:      dir.Address,
-		CreatedOn: time.Now(),
+		CreatedOn: createdOn,
 	}
 
+	t.own(newDir)
+
 	dir.Childs = append(dir.Childs, newDir)
 	t.Nodes[address] = newDir
+	t.account(dir.Address, 0, 1)
 
-	t.CommitUpdate("mkdir", address)
+	t.CommitUpdate("mkdir", address, createdOn.Format(time.RFC3339Nano))
 
 	return nil
 }
@@ -167,14 +286,24 @@ func (t *Tree) RemoveDirectory(address string) (*Node, error) {
 	if !matched {
 		return nil, fmt.Errorf("wrong file name format")
 	}
+	if IsReadOnly(address) {
+		return nil, readOnly(address)
+	}
 	if !t.DirectoryExists(address) {
 		return nil, fmt.Errorf("/%s/ directory does not exist", address)
 	}
+	if err := t.allowEntries(address); err != nil {
+		return nil, err
+	}
 
 	node, _ := t.GetNodeByAddress(address)
 	node.Removed = true // lazy removing; will be removed later
 	t.Removed = append(t.Removed, node)
-	delete(t.Nodes, address)
+	// the whole subtree, so that a new directory at the address is empty
+	t.forget(node)
+
+	bytes, objects := node.usage()
+	t.account(node.Parent, -bytes, -objects)
 
 	t.CommitUpdate("rmdir", address)
 
@@ -195,6 +324,11 @@ func (t *Tree) CD(address string) (string, error) {
 		return "", fmt.Errorf("wrong file name format")
 	}
 
+	address, err := t.Resolve(address)
+	if err != nil {
+		return "", err
+	}
+
 	exists, isDirectory := t.PathExists(address)
 
 	if !exists {
@@ -205,15 +339,20 @@ func (t *Tree) CD(address string) (string, error) {
 	return address, nil
 }
 
-func (t *Tree) CopyFile(fileToCopy string, copyTo string) error {
+// CopyFile makes a copy that shares chunks with the file, no data is moved.
+// The caller is expected to count the new references to the chunks.
+func (t *Tree) CopyFile(fileToCopy string, copyTo string) (*Node, error) {
 	fileToCopy, fileToCopyMatched := CleanAddress(fileToCopy)
 	copyTo, copyToMatched := CleanAddress(copyTo)
 
 	if !fileToCopyMatched {
-		return fmt.Errorf("/%s wrong file name format", fileToCopy)
+		return nil, fmt.Errorf("/%s wrong file name format", fileToCopy)
 	}
 	if !copyToMatched {
-		return fmt.Errorf("/%s wrong file name format", copyTo)
+		return nil, fmt.Errorf("/%s wrong file name format", copyTo)
+	}
+	if IsReadOnly(copyTo) {
+		return nil, readOnly(copyTo)
 	}
 
 	var fullFilePath string
@@ -221,58 +360,284 @@ func (t *Tree) CopyFile(fileToCopy string, copyTo string) error {
 	fileToCopyExists, fileToCopyIsDirectory := t.PathExists(fileToCopy)
 
 	if !fileToCopyExists {
-		return fmt.Errorf("/%s file does not exist", fileToCopy)
+		return nil, fmt.Errorf("/%s file does not exist", fileToCopy)
 	} else if fileToCopyIsDirectory {
-		return fmt.Errorf("/%s/ cannot copy directory", fileToCopy)
+		return nil, fmt.Errorf("/%s/ cannot copy directory", fileToCopy)
 	}
 
 	if t.DirectoryExists(copyTo) {
 		fullFilePath = path.Join(copyTo, path.Base(fileToCopy))
 	} else if t.FileExists(copyTo) {
-		return fmt.Errorf("%s the file already exists", fileToCopy)
+		return nil, fmt.Errorf("%s the file already exists", fileToCopy)
 	} else {
 		fullFilePath = copyTo
 	}
 
 	if t.FileExists(fullFilePath) {
-		return fmt.Errorf("/%s the file already exists", fullFilePath)
+		return nil, fmt.Errorf("/%s the file already exists", fullFilePath)
 	}
 
-	parentDir := t.Nodes[path.Dir(fullFilePath)]
+	parentDir, ok := t.Nodes[path.Dir(fullFilePath)]
+	if !ok || !t.DirectoryExists(parentDir.Address) {
+		return nil, fmt.Errorf("/%s/ directory does not exist", path.Dir(fullFilePath))
+	}
+
+	if err := t.allow(fileToCopy, permRead); err != nil {
+		return nil, err
+	}
+	if err := t.allowEntries(fullFilePath); err != nil {
+		return nil, err
+	}
+	if err := t.checkQuota(parentDir.Address, int64(t.Nodes[fileToCopy].Size), 1, ""); err != nil {
+		return nil, err
+	}
 
 	copiedFile := *t.Nodes[fileToCopy]
 	copiedFile.Parent = parentDir.Address
 	copiedFile.Address = fullFilePath
+	// the chunks are shared, the slices are not
+	copiedFile.Chunks = append([]string{}, copiedFile.Chunks...)
+	copiedFile.Pending = map[string]bool{}
+	copiedFile.Staged = nil
+	copiedFile.Versions = nil
+	copiedFile.copyXattrs()
+	t.claim(&copiedFile, false)
 
 	t.Nodes[fullFilePath] = &copiedFile
 	parentDir.Childs = append(parentDir.Childs, &copiedFile)
+	t.account(parentDir.Address, int64(copiedFile.Size), 1)
 
 	t.CommitUpdate("copy", fileToCopy, copyTo)
 
-	return nil
+	return &copiedFile, nil
 }
 
-func (t *Tree) MoveFile(fileToMove string, moveTo string) error {
-	fileToMove, fileToMoveMatched := CleanAddress(fileToMove)
-	moveTo, moveToMatched := CleanAddress(moveTo)
+// CopyDirectory copies the directory along with everything in it. Like
+// copies of files, copied files share chunks with the originals. Files that
+// are being uploaded are not copied.
+func (t *Tree) CopyDirectory(dirToCopy string, copyTo string) (*Node, error) {
+	dirToCopy, dirToCopyMatched := CleanAddress(dirToCopy)
+	copyTo, copyToMatched := CleanAddress(copyTo)
 
-	if !fileToMoveMatched {
-		return fmt.Errorf("/%s wrong file name format", fileToMove)
+	if !dirToCopyMatched {
+		return nil, fmt.Errorf("/%s wrong file name format", dirToCopy)
+	}
+	if !copyToMatched {
+		return nil, fmt.Errorf("/%s wrong file name format", copyTo)
+	}
+	if IsReadOnly(copyTo) {
+		return nil, readOnly(copyTo)
 	}
-	if !moveToMatched {
-		return fmt.Errorf("/%s wrong file name format", moveTo)
 
+	if !t.DirectoryExists(dirToCopy) {
+		return nil, fmt.Errorf("/%s/ directory does not exist", dirToCopy)
 	}
 
-	err := t.CopyFile(fileToMove, moveTo)
+	fullDirPath := copyTo
+	if t.DirectoryExists(copyTo) {
+		fullDirPath = path.Join(copyTo, path.Base(dirToCopy))
+	}
 
-	if err != nil {
-		return fmt.Errorf("impossible to move file: %e", err)
+	if t.Exists(fullDirPath) {
+		return nil, fmt.Errorf("/%s the path already exists", fullDirPath)
 	}
 
-	_, _ = t.RemoveFile(fileToMove)
+	if dirToCopy == "." || fullDirPath == dirToCopy || strings.HasPrefix(fullDirPath, dirToCopy+"/") {
+		return nil, fmt.Errorf("/%s/ cannot copy directory into itself", dirToCopy)
+	}
 
-	return nil
+	parentDir, ok := t.Nodes[path.Dir(fullDirPath)]
+	if !ok || !t.DirectoryExists(parentDir.Address) {
+		return nil, fmt.Errorf("/%s/ directory does not exist", path.Dir(fullDirPath))
+	}
+
+	if err := t.allow(dirToCopy, permRead|permExec); err != nil {
+		return nil, err
+	}
+	if err := t.allowEntries(fullDirPath); err != nil {
+		return nil, err
+	}
+	// files being uploaded are counted, although they are not copied
+	bytes, objects := t.Nodes[dirToCopy].usage()
+	if err := t.checkQuota(parentDir.Address, bytes, objects, ""); err != nil {
+		return nil, err
+	}
+
+	copiedDir := t.copySubtree(t.Nodes[dirToCopy], fullDirPath, parentDir.Address)
+	t.claim(copiedDir, true)
+	parentDir.Childs = append(parentDir.Childs, copiedDir)
+
+	bytes, objects = copiedDir.usage()
+	t.account(parentDir.Address, bytes, objects)
+
+	t.CommitUpdate("copydir", dirToCopy, copyTo)
+
+	return copiedDir, nil
+}
+
+func (t *Tree) copySubtree(node *Node, address string, parent string) *Node {
+	copied := *node
+	copied.Address = address
+	copied.Parent = parent
+	copied.Childs = nil
+	copied.Chunks = append([]string{}, node.Chunks...)
+	copied.Pending = map[string]bool{}
+	copied.Staged = nil
+	copied.Versions = nil
+	copied.copyXattrs()
+
+	t.Nodes[address] = &copied
+
+	for _, child := range node.Childs {
+		if child.Removed || !t.Exists(child.Address) || child.Address == snapshotsDir || child.Address == trashDir {
+			continue
+		}
+
+		childAddress := path.Join(address, path.Base(child.Address))
+		copied.Childs = append(copied.Childs, t.copySubtree(child, childAddress, address))
+	}
+	copied.recount()
+
+	return &copied
+}
+
+// AllChunks returns chunks of the file or of all files in the directory.
+func (node *Node) AllChunks() []string {
+	chunks := append([]string{}, node.Chunks...)
+	for _, child := range node.Childs {
+		if !child.Removed {
+			chunks = append(chunks, child.AllChunks()...)
+		}
+	}
+
+	return chunks
+}
+
+// HeldChunks is like AllChunks, but takes previous versions of files as well.
+func (node *Node) HeldChunks() []string {
+	chunks := append(node.VersionChunks(), node.Chunks...)
+	for _, child := range node.Childs {
+		if !child.Removed {
+			chunks = append(chunks, child.HeldChunks()...)
+		}
+	}
+
+	return chunks
+}
+
+// Move renames a file or a whole directory. Descendants of the directory get
+// their addresses rewritten, as well as chunks of the files, all at once.
+func (t *Tree) Move(from string, to string, table *ChunkTable) (*Node, error) {
+	from, fromMatched := CleanAddress(from)
+	to, toMatched := CleanAddress(to)
+
+	if !fromMatched {
+		return nil, fmt.Errorf("/%s wrong file name format", from)
+	}
+	if !toMatched {
+		return nil, fmt.Errorf("/%s wrong file name format", to)
+	}
+	if IsReadOnly(from) {
+		return nil, readOnly(from)
+	}
+	if IsReadOnly(to) {
+		return nil, readOnly(to)
+	}
+
+	if from == "." {
+		return nil, fmt.Errorf("cannot move the root directory")
+	}
+
+	fromExists, fromIsDirectory := t.PathExists(from)
+	if !fromExists {
+		return nil, fmt.Errorf("/%s path does not exist", from)
+	}
+
+	dest := to
+	if t.DirectoryExists(to) {
+		dest = path.Join(to, path.Base(from))
+	}
+
+	if t.Exists(dest) {
+		return nil, fmt.Errorf("/%s the path already exists", dest)
+	}
+
+	if fromIsDirectory && (dest == from || strings.HasPrefix(dest, from+"/")) {
+		return nil, fmt.Errorf("/%s/ cannot move directory into itself", from)
+	}
+
+	parentDir, ok := t.Nodes[path.Dir(dest)]
+	if !ok || !t.DirectoryExists(parentDir.Address) {
+		return nil, fmt.Errorf("/%s/ directory does not exist", path.Dir(dest))
+	}
+
+	if err := t.allowEntries(from); err != nil {
+		return nil, err
+	}
+	if err := t.allowEntries(dest); err != nil {
+		return nil, err
+	}
+
+	node := t.Nodes[from]
+	bytes, objects := node.usage()
+	if err := t.checkQuota(parentDir.Address, bytes, objects, from); err != nil {
+		return nil, err
+	}
+
+	t.relocate(node, dest, parentDir, table)
+
+	t.CommitUpdate("move", from, to)
+
+	return node, nil
+}
+
+// relocate detaches the node from its parent and puts it into the directory
+// under the address.
+func (t *Tree) relocate(node *Node, address string, dir *Node, table *ChunkTable) {
+	oldParent := t.ParentNode(node)
+	for i, child := range oldParent.Childs {
+		if child == node {
+			oldParent.Childs = append(oldParent.Childs[:i], oldParent.Childs[i+1:]...)
+			break
+		}
+	}
+
+	bytes, objects := node.usage()
+	t.account(oldParent.Address, -bytes, -objects)
+
+	t.readdress(node, address, dir.Address, table)
+	dir.Childs = append(dir.Childs, node)
+
+	t.account(dir.Address, bytes, objects)
+}
+
+// readdress moves the node to the address along with its descendants.
+// Removed descendants are moved too, so that ClearRemoved finds their
+// parents, but they are not put back to Nodes.
+func (t *Tree) readdress(node *Node, address string, parent string, table *ChunkTable) {
+	old := node.Address
+	if t.Nodes[old] == node {
+		delete(t.Nodes, old)
+		t.Nodes[address] = node
+	}
+
+	node.Address = address
+	node.Parent = parent
+
+	// chunks are confirmed to the file they were uploaded to, not to copies
+	for _, chunkID := range append(node.VersionChunks(), node.Chunks...) {
+		if chunk, ok := table.Table[chunkID]; ok && chunk.File == old {
+			chunk.File = address
+		}
+	}
+
+	if node.Staged != nil {
+		t.readdress(node.Staged, address, parent, table)
+	}
+
+	for _, child := range node.Childs {
+		t.readdress(child, path.Join(address, path.Base(child.Address)), address, table)
+	}
 }
 
 func (t *Tree) LS(address string) ([]string, error) {
@@ -281,6 +646,11 @@ func (t *Tree) LS(address string) ([]string, error) {
 	if !matched {
 		return nil, fmt.Errorf("/%s wrong file name format", address)
 	}
+
+	address, err := t.Resolve(address)
+	if err != nil {
+		return nil, err
+	}
 	if !t.DirectoryExists(address) {
 		return nil, fmt.Errorf("/%s directory does not exist", address)
 	}
@@ -295,6 +665,8 @@ func (t *Tree) LS(address string) ([]string, error) {
 		name := path.Base(node.Address)
 		if node.IsDirectory {
 			name += "/"
+		} else if node.IsSymlink() {
+			name += "@"
 		}
 		list = append(list, name)
 	}
@@ -307,7 +679,7 @@ func (t *Tree) PathExists(address string) (exists bool, isDirectory bool) {
 	node, ok := t.Nodes[address]
 
 	if ok {
-		return ok && len(node.Pending) == 0 && !t.Nodes[address].Removed && t.ParentsExist(node), t.Nodes[address].IsDirectory
+		return ok && len(node.Pending) == 0 && node.UploadID == "" && !t.Nodes[address].Removed && t.ParentsExist(node), t.Nodes[address].IsDirectory
 	}
 	return ok, false
 }
@@ -322,18 +694,13 @@ func (t *Tree) ParentsExist(node *Node) bool {
 		return true
 	}
 
-	parent, _ := t.GetNodeByAddress(node.Parent)
-	if parent.Removed {
+	parent, ok := t.GetNodeByAddress(node.Parent)
+	if !ok || parent.Removed {
 		return false
 	}
 
-	result := t.ParentsExist(parent)
-
-	if result == false {
-		node.Removed = true
-	}
-
-	return result
+	// not cached in node.Removed, since it is called under the read lock
+	return t.ParentsExist(parent)
 }
 func (t *Tree) FileExists(address string) bool {
 	exists, isDirectory := t.PathExists(address)
@@ -372,68 +739,149 @@ func (t *Tree) NodeInfo(address string) (string, error) {
 	if node.IsDirectory {
 		isDirectory = "yes"
 	}
+	symlink := "no"
+	if node.IsSymlink() {
+		symlink = "-> " + node.Symlink
+	}
 	size := node.Size
 	sizeKB := float32(node.Size) / 1024
 	sizeOnDFS := sizeKB * 2 + 1
 
+	usage := ""
+	if node.IsDirectory {
+		usage = "\n" + t.QuotaInfo(node)
+	}
+	xattrs := ""
+	if list := node.XattrsList(); len(list) != 0 {
+		xattrs = "\nAttributes:\n  " + strings.Join(list, "\n  ")
+	}
+
+	// nodes created before permissions are open to everyone
+	owner, group, permissions := "-", "-", "open"
+	if node.Owner != "" || node.Mode != 0 {
+		owner, group, permissions = node.Owner, node.Group, node.ModeString()
+		if group == "" {
+			group = "-"
+		}
+	}
+
 	return fmt.Sprintf(
 		"Base name: %s\n"+
 			"Full path: %s\n"+
 			"Created on: %s\n"+
 			"Directory: %v\n"+
+			"Symbolic link: %s\n"+
+			"Owner: %s\n"+
+			"Group: %s\n"+
+			"Permissions: %s\n"+
 			"Number of chunks: %d\n"+
 			"File size: %d bytes (%.2f KB)\n"+
-			"Real size on dfs: ~%.2f KB",
+			"Real size on dfs: ~%.2f KB%s%s",
 		path.Base(address),
 		"/" + node.Address,
 		node.CreatedOn.Format("2006-01-02 15:04:05"),
 		isDirectory,
+		symlink,
+		owner,
+		group,
+		permissions,
 		chunksNum,
 		size,
 		sizeKB,
 		sizeOnDFS,
+		usage,
+		xattrs,
 	), nil
 }
 
-func (t *Tree) SaveTree(saveTo string) bool {
-	file, _ := os.Create(saveTo)
-	defer file.Close()
-	encoder := gob.NewEncoder(file)
+// relink is called on a decoded tree. The tree is expected to be saved
+// right after ClearRemoved, so that every node is in Nodes.
+func (t *Tree) relink() error {
+	root, ok := t.Nodes["."]
+	if !ok {
+		return fmt.Errorf("no root directory")
+	}
 
-	encoder.Encode(t)
-	return true
+	// gob decodes children as copies of the nodes; point them back
+	t.relinkChilds(root)
+
+	return nil
 }
 
-func LoadTree(openFrom string) *Tree {
-	file, _ := os.Open(openFrom)
-	defer file.Close()
+func (t *Tree) relinkChilds(dir *Node) {
+	childs := make([]*Node, 0, len(dir.Childs))
+	for _, child := range dir.Childs {
+		node, ok := t.Nodes[child.Address]
+		if !ok {
+			continue
+		}
 
-	decoder := gob.NewDecoder(file)
+		if node.Pending == nil {
+			node.Pending = map[string]bool{}
+		}
 
-	var tree Tree
-	decoder.Decode(&tree)
+		childs = append(childs, node)
+		if node.IsDirectory {
+			t.relinkChilds(node)
+		}
+	}
 
-	return &tree
+	dir.Childs = childs
+	dir.recount()
 }
 
 func (t *Tree) CommitUpdate(command string, args ...string) {
-	f, err := os.OpenFile(t.Conf.TreeLogName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Println(err)
+	t.Commit(LogRecord{Command: command, Args: args})
+}
+
+// AfterCommit starts the side effect of the operation, such as purging the
+// chunks it has released on fileservers, once the operation is committed.
+// Outside of a group it is started at once.
+func (t *Tree) AfterCommit(effect func()) {
+	if t.replaying {
+		return
+	}
+	if t.raft == nil {
+		go effect()
+		return
 	}
-	defer f.Close()
 
-	if _, err := f.WriteString(fmt.Sprintf("%d\t%s\t%s\n", t.Version, command, strings.Join(args, "\t"))); err != nil {
+	t.raft.after(t.Version, effect)
+}
+
+// Commit appends the operation to the log, every TreeUpdatePeriod operations
+// the log is replaced with a snapshot. The snapshot is taken after the whole
+// operation is done, see snapshotIfDue, since callers change the chunk table
+// after Commit returns.
+func (t *Tree) Commit(record LogRecord) {
+	if t.replaying {
+		t.Version += 1
+		return
+	}
+
+	record.Version = t.Version
+	if t.acting != nil && record.User == "" {
+		record.User = t.acting.Name
+	}
+	if t.raft != nil {
+		record.Term = t.raft.Term()
+	}
+
+	if err := AppendLogRecord(t.Conf.TreeLogName, record); err != nil {
 		log.Println(err)
 	}
 
 	t.Version += 1
+	t.Term = record.Term
 
-	if t.Version%100 == t.Conf.TreeUpdatePeriod {
-		t.ClearRemoved()
-		t.SaveTree(t.Conf.TreeGobName)
+	if t.raft != nil {
+		// the snapshot is taken once the operation is committed
+		t.raft.appended(record)
+		return
+	}
 
-		os.Remove(t.Conf.TreeLogName)
+	if t.Version%100 == t.Conf.TreeUpdatePeriod {
+		t.snapshotDue = true
 	}
 }
 
@@ -446,8 +894,9 @@ func (t *Tree) ClearRemoved() {
 		parent := t.ParentNode(node)
 
 		toRemoveInd := -1
+		// a new node may have taken the address of the removed one
 		for i, parentChild := range parent.Childs {
-			if parentChild.Address == node.Address {
+			if parentChild == node {
 				toRemoveInd = i
 				break
 			}
@@ -6,25 +6,40 @@ import (
 	"testing"
 )
 
+func assertNode(t *testing.T, got *Node, want *Node) {
+	t.Helper()
+
+	if want == nil || got == nil {
+		if want != got {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		return
+	}
+
+	if got.Address != want.Address || got.IsDirectory != want.IsDirectory ||
+		got.Parent != want.Parent || got.Removed != want.Removed {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
 func TestTree_CreateFile(t *testing.T) {
 	cases := []struct {
 		filename string
-		want     Node
+		want     *Node
 	}{
-		{"hello.txt", Node{"hello.txt", false, nil, ".", false}},
-		{".lala.txt", Node{".lala.txt", false, nil, ".", false}},
-		{"ohmydog.tar.gz", Node{"ohmydog.tar.gz", false, nil, ".", false}},
+		{"hello.txt", &Node{Address: "hello.txt", Parent: "."}},
+		{".lala.txt", &Node{Address: ".lala.txt", Parent: "."}},
+		{"ohmydog.tar.gz", &Node{Address: "ohmydog.tar.gz", Parent: "."}},
+		{"notexist/ohmydog.tar.gz", nil},
 	}
 	for _, test := range cases {
 		t.Run(fmt.Sprintf("Creating %v", test.filename),
 			func(t *testing.T) {
-				tree := initTree()
-				tree.CreateFile(test.filename)
+				tree := InitTree(Namenode{})
+				tree.CreateFile(test.filename, 0)
 				got, _ := tree.GetNodeByAddress(test.filename)
 
-				if !reflect.DeepEqual(*got, test.want) {
-					t.Errorf("got %v, want %v", got, test.want)
-				}
+				assertNode(t, got, test.want)
 			})
 	}
 }
@@ -34,25 +49,234 @@ func TestTree_CreateDirectory(t *testing.T) {
 		filename string
 		want     *Node
 	}{
-		{"hello.txt", &Node{"hello.txt", true, nil, ".", false}},
-		{".lala.txt", &Node{".lala.txt", true, nil, ".", false}},
-		{"ohmydog.tar.gz", &Node{"ohmydog.tar.gz", true, nil, ".", false}},
+		{"hello.txt", &Node{Address: "hello.txt", IsDirectory: true, Parent: "."}},
+		{".lala.txt", &Node{Address: ".lala.txt", IsDirectory: true, Parent: "."}},
+		{"ohmydog.tar.gz", &Node{Address: "ohmydog.tar.gz", IsDirectory: true, Parent: "."}},
 		{"notexist/ohmydog.tar.gz", nil},
 	}
 	for _, test := range cases {
 		t.Run(fmt.Sprintf("Creating %v", test.filename),
 			func(t *testing.T) {
-				tree := initTree()
+				tree := InitTree(Namenode{})
 				tree.CreateDirectory(test.filename)
 				got, _ := tree.GetNodeByAddress(test.filename)
 
-				if test.want == nil || got == nil {
-					if test.want != got {
-						t.Errorf("Non nil")
-					}
-				} else if !reflect.DeepEqual(*got, *test.want) {
-					t.Errorf("got %v, want %v", got, test.want)
-				}
+				assertNode(t, got, test.want)
 			})
 	}
 }
+
+func TestTree_RemoveDirectory(t *testing.T) {
+	f := newTreeFixture(t)
+	tree := f.tree
+
+	tree.CreateDirectory("a")
+	tree.CreateDirectory("a/b")
+	f.upload(t, "a/x", "x1")
+	f.upload(t, "a/b/y", "y1")
+
+	if _, err := tree.RemoveDirectory("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.CreateDirectory("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, address := range []string{"a/x", "a/b", "a/b/y"} {
+		if tree.Exists(address) {
+			t.Errorf("/%s outlived the removed directory", address)
+		}
+	}
+
+	if _, err := tree.CreateFile("a/x", 0); err != nil {
+		t.Errorf("could not create a file in place of a removed one: %v", err)
+	}
+	if got, _ := tree.LS("a"); !reflect.DeepEqual(got, []string{"x"}) {
+		t.Errorf("got %v, want [x]", got)
+	}
+
+	t.Run("replay",
+		func(t *testing.T) {
+			recovered, _ := f.recover(t)
+
+			if recovered.Exists("a/b/y") || !recovered.FileExists("a/x") {
+				t.Errorf("got a/b/y %v, a/x %v, want only a/x", recovered.Exists("a/b/y"), recovered.FileExists("a/x"))
+			}
+			if node := recovered.Nodes["a/x"]; node != nil && len(node.Chunks) != 0 {
+				t.Errorf("got chunks %v of the new file, want none", node.Chunks)
+			}
+		})
+}
+
+func TestTree_Move(t *testing.T) {
+	dir := t.TempDir()
+	namenode := Namenode{
+		TreeLogName:      dir + "/tree.log",
+		TreeGobName:      dir + "/tree.gob",
+		TreeUpdatePeriod: -1,
+	}
+
+	tree := InitTree(namenode)
+	table := NewChunkTable()
+	fs := &FileServerInfo{NodeID: "node-a"}
+
+	tree.CreateDirectory("a")
+	tree.CreateDirectory("a/b")
+	tree.CreateDirectory("c")
+	tree.CreateFile("a/b/f.txt", 0)
+	file, _ := tree.CreateFile("a/b/pending.txt", 10)
+	table.AssignChunk(file, "p1", fs)
+
+	t.Run("rename a file",
+		func(t *testing.T) {
+			if _, err := tree.Move("a/b/f.txt", "a/g.txt", table); err != nil {
+				t.Fatal(err)
+			}
+
+			got, _ := tree.GetNodeByAddress("a/g.txt")
+			assertNode(t, got, &Node{Address: "a/g.txt", Parent: "a"})
+			if tree.Exists("a/b/f.txt") {
+				t.Errorf("the file is still at the old address")
+			}
+		})
+
+	t.Run("move a directory into another one",
+		func(t *testing.T) {
+			if _, err := tree.Move("a", "c", table); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, want := range []*Node{
+				{Address: "c/a", IsDirectory: true, Parent: "c"},
+				{Address: "c/a/b", IsDirectory: true, Parent: "c/a"},
+				{Address: "c/a/g.txt", Parent: "c/a"},
+				{Address: "c/a/b/pending.txt", Parent: "c/a/b"},
+			} {
+				got, _ := tree.GetNodeByAddress(want.Address)
+				assertNode(t, got, want)
+			}
+
+			for _, address := range []string{"a", "a/b", "a/g.txt", "a/b/pending.txt"} {
+				if _, ok := tree.GetNodeByAddress(address); ok {
+					t.Errorf("/%s is still in the tree", address)
+				}
+			}
+
+			if got, _ := tree.LS("."); len(got) != 1 || got[0] != "c/" {
+				t.Errorf("got %v in the root, want only c/", got)
+			}
+
+			if got := table.Table["p1"].File; got != "c/a/b/pending.txt" {
+				t.Errorf("chunk of a moved file points to %s", got)
+			}
+		})
+
+	t.Run("cannot move a directory into itself",
+		func(t *testing.T) {
+			if _, err := tree.Move("c", "c/a/b", table); err == nil {
+				t.Errorf("moved a directory into itself")
+			}
+		})
+
+	t.Run("replay",
+		func(t *testing.T) {
+			recovered, _, err := Recover(namenode, &PoolInfo{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, address := range []string{"c/a", "c/a/b", "c/a/g.txt"} {
+				if !recovered.Exists(address) {
+					t.Errorf("/%s was not recovered", address)
+				}
+			}
+		})
+}
+
+func TestTree_CopyDirectory(t *testing.T) {
+	dir := t.TempDir()
+	namenode := Namenode{
+		TreeLogName:      dir + "/tree.log",
+		TreeGobName:      dir + "/tree.gob",
+		TreeUpdatePeriod: -1,
+	}
+
+	tree := InitTree(namenode)
+	table := NewChunkTable()
+	fs := &FileServerInfo{NodeID: "node-a"}
+
+	upload := func(address string, chunkID string, confirm bool) {
+		file, _ := tree.CreateFile(address, 10)
+		table.AssignChunk(file, chunkID, fs)
+		tree.Commit(LogRecord{Command: "upload", Args: []string{address}, Chunks: []string{chunkID}, Nodes: []string{fs.NodeID}})
+		if confirm {
+			tree.ConfirmReplica(table.Table[chunkID], fs.NodeID)
+		}
+	}
+
+	tree.CreateDirectory("project")
+	tree.CreateDirectory("project/src")
+	upload("project/a.txt", "a1", true)
+	upload("project/src/b.txt", "b1", true)
+	upload("project/src/pending.txt", "p1", false)
+
+	copied, err := tree.CopyDirectory("project", "experiment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.Ref(copied.AllChunks())
+
+	t.Run("subtree is copied",
+		func(t *testing.T) {
+			for _, want := range []*Node{
+				{Address: "experiment", IsDirectory: true, Parent: "."},
+				{Address: "experiment/src", IsDirectory: true, Parent: "experiment"},
+				{Address: "experiment/a.txt", Parent: "experiment"},
+				{Address: "experiment/src/b.txt", Parent: "experiment/src"},
+			} {
+				got, _ := tree.GetNodeByAddress(want.Address)
+				assertNode(t, got, want)
+			}
+
+			if tree.Exists("experiment/src/pending.txt") {
+				t.Errorf("file that is being uploaded was copied")
+			}
+
+			ls, _ := tree.LS("experiment/src")
+			if len(ls) != 1 || ls[0] != "b.txt" {
+				t.Errorf("got %v in the copy, want [b.txt]", ls)
+			}
+		})
+
+	t.Run("chunks are shared",
+		func(t *testing.T) {
+			for chunkID, want := range map[string]int{"a1": 2, "b1": 2, "p1": 1} {
+				if got := table.Table[chunkID].Refs; got != want {
+					t.Errorf("chunk %s: got %d references, want %d", chunkID, got, want)
+				}
+			}
+		})
+
+	t.Run("cannot copy a directory into itself",
+		func(t *testing.T) {
+			if _, err := tree.CopyDirectory("project", "project/src"); err == nil {
+				t.Errorf("copied a directory into itself")
+			}
+		})
+
+	t.Run("replay",
+		func(t *testing.T) {
+			recovered, recoveredTable, err := Recover(namenode, &PoolInfo{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !recovered.Exists("experiment/src/b.txt") {
+				t.Errorf("copied file was not recovered")
+			}
+
+			if got := recoveredTable.Table["a1"].Refs; got != 2 {
+				t.Errorf("got %d references, want %d", got, 2)
+			}
+		})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"path"
+	"testing"
+)
+
+// treeFixture is a tree with its log and snapshots in a temporary directory,
+// along with its chunk table and a fileserver to assign chunks to. Nothing is
+// snapshotted, unless snapshot is called.
+type treeFixture struct {
+	namenode Namenode
+	tree     *Tree
+	table    *ChunkTable
+	fs       *FileServerInfo
+}
+
+func newTreeFixture(t *testing.T, configure ...func(*Namenode)) *treeFixture {
+	dir := t.TempDir()
+	namenode := Namenode{
+		TreeLogName:      path.Join(dir, "tree.log"),
+		TreeGobName:      path.Join(dir, "tree.gob"),
+		TreeUpdatePeriod: -1,
+	}
+	for _, f := range configure {
+		f(&namenode)
+	}
+
+	return &treeFixture{
+		namenode: namenode,
+		tree:     InitTree(namenode),
+		table:    NewChunkTable(),
+		fs:       &FileServerInfo{NodeID: "node-a"},
+	}
+}
+
+// upload creates the file made of the confirmed chunk.
+func (f *treeFixture) upload(t *testing.T, address string, chunkID string) *Node {
+	t.Helper()
+
+	file, err := f.tree.CreateFile(address, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.table.AssignChunk(file, chunkID, f.fs)
+	f.tree.Commit(LogRecord{Command: "upload", Args: []string{address}, Chunks: []string{chunkID}, Nodes: []string{f.fs.NodeID}})
+	f.tree.ConfirmReplica(f.table.Table[chunkID], f.fs.NodeID)
+
+	return file
+}
+
+// snapshot saves the tree along with the table, the log starts over.
+func (f *treeFixture) snapshot(t *testing.T) {
+	t.Helper()
+
+	if err := f.tree.Snapshot(f.table); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recover loads the latest snapshot and replays the log on top of it.
+func (f *treeFixture) recover(t *testing.T) (*Tree, *ChunkTable) {
+	t.Helper()
+
+	tree, table, err := Recover(f.namenode, &PoolInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tree, table
+}
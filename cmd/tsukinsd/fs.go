@@ -22,6 +22,7 @@ const (
 
 type FileServerInfo struct {
 	mu          sync.Mutex
+	NodeID      string // persistent, unlike hosts
 	PrivateHost string
 	PublicHost  string
 	Port        int
@@ -50,13 +51,14 @@ func InitFServers(conf *Config) *PoolInfo {
 	}
 	i := 0
 	for _, storageNode := range conf.Storage {
-		available, ok := ProbeFServer(storageNode.Host, conf.Namenode.FSPrivatePort)
+		available, nodeID, ok := ProbeFServer(storageNode.Host, conf.Namenode.FSPrivatePort)
 		if !ok {
 			continue
 		}
 
 		storage.StorageNodes = append(storage.StorageNodes,
 			&FileServerInfo{
+				NodeID:      nodeID,
 				PrivateHost: storageNode.Host,
 				PublicHost:  storageNode.PublicHost,
 				Port:        conf.Namenode.FSPrivatePort,
@@ -71,15 +73,129 @@ func InitFServers(conf *Config) *PoolInfo {
 	}
 
 	if len(storage.StorageNodes) < conf.Namenode.Replicas {
-		log.Fatal("Not enough servers. Please add more and restart or reduce the number of replicas (number of replicas <= number of FSs)")
-	} else {
+		log.Printf("Not enough servers yet (number of replicas <= number of FSs); waiting for more to register")
+	}
+
+	if len(storage.StorageNodes) != 0 {
 		storage.StorageNodes[len(storage.StorageNodes)-1].NextAlive = 0
 	}
 
 	return &storage
 }
 
-func ProbeFServer(host string, port int) (int, bool) {
+// Register adds a fileserver to the pool at runtime. A fileserver that is
+// already known by its node ID only gets its addresses updated. Returns true
+// if the fileserver is new.
+func (s *PoolInfo) Register(nodeID, privateHost, publicHost string, available int) (*FileServerInfo, bool) {
+	s.mu.Lock()
+
+	for _, fs := range s.StorageNodes {
+		if fs.NodeID == nodeID {
+			fs.PrivateHost = privateHost
+			fs.PublicHost = publicHost
+			fs.Available = available
+			s.mu.Unlock()
+
+			return fs, false
+		}
+	}
+
+	id := len(s.StorageNodes)
+	node := &FileServerInfo{
+		NodeID:      nodeID,
+		PrivateHost: privateHost,
+		PublicHost:  publicHost,
+		Port:        conf.Namenode.FSPrivatePort,
+		Alive:       true,
+		Status:      LIVE,
+		NextAlive:   id,
+		ID:          id,
+		Available:   available,
+		LastPulse:   time.Now(),
+	}
+
+	if id != 0 {
+		// the last node knows the first alive one
+		node.NextAlive = s.StorageNodes[id-1].NextAlive
+	}
+
+	s.StorageNodes = append(s.StorageNodes, node)
+	s.Alive += 1
+	s.mu.Unlock()
+
+	if id != 0 {
+		s.setNewAlive(id, id-1)
+	}
+
+	return node, true
+}
+
+// GetByNodeID returns nil, if there is no such fileserver in the pool.
+func (s *PoolInfo) GetByNodeID(nodeID string) *FileServerInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, fs := range s.StorageNodes {
+		if fs.NodeID == nodeID {
+			return fs
+		}
+	}
+
+	return nil
+}
+
+// GetOrPlaceholder returns a dead placeholder for a fileserver that is not
+// in the pool yet. The placeholder is replaced on registration.
+func (s *PoolInfo) GetOrPlaceholder(nodeID string) *FileServerInfo {
+	if fs := s.GetByNodeID(nodeID); fs != nil {
+		return fs
+	}
+
+	return &FileServerInfo{NodeID: nodeID, ID: -1, Status: DEAD}
+}
+
+// Nodes returns the fileservers of the pool. It is a copy, since the pool
+// grows as fileservers register.
+func (s *PoolInfo) Nodes() []*FileServerInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*FileServerInfo{}, s.StorageNodes...)
+}
+
+// Size returns the number of fileservers in the pool.
+func (s *PoolInfo) Size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.StorageNodes)
+}
+
+// Node returns the fileserver by its ID.
+func (s *PoolInfo) Node(id int) *FileServerInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.StorageNodes[id]
+}
+
+// GetByHost returns nil, if there is no such fileserver in the pool.
+func (s *PoolInfo) GetByHost(privateHost string) *FileServerInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, fs := range s.StorageNodes {
+		if fs.PrivateHost == privateHost {
+			return fs
+		}
+	}
+
+	return nil
+}
+
+// ProbeFServer returns the available space and the node ID of the fileserver.
+// Fileservers that do not report an ID are identified by their host.
+func ProbeFServer(host string, port int) (int, string, bool) {
 	log.Printf("Probing %s:%d", host, port)
 
 	//req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s:%d/expect/write?token=%s", host, port), nil)
@@ -94,25 +210,38 @@ func ProbeFServer(host string, port int) (int, bool) {
 
 	if err != nil {
 		log.Printf("Probing %s:%d failed", host, port)
-		return 0, false
+		return 0, "", false
 	}
 	body, _ := ioutil.ReadAll(resp.Body)
 
 	res := &struct {
-		Available int `json:"available"`
+		Available int    `json:"available"`
+		NodeID    string `json:"nodeid"`
 	}{}
 	err = json.Unmarshal(body, &res)
 
 	if err != nil {
 		log.Printf("Probing %s:%d failed", host, port)
-		return 0, false
+		return 0, "", false
+	}
+
+	if res.NodeID == "" {
+		res.NodeID = host
 	}
 
-	log.Printf("Probing %s:%d is successful; available: %d", host, port, res.Available)
-	return res.Available, true
+	log.Printf("Probing %s:%d is successful; node: %s, available: %d", host, port, res.NodeID, res.Available)
+	return res.Available, res.NodeID, true
 }
 
+// Select returns nil, if there is no fileserver in the pool.
 func (s *PoolInfo) Select() *FileServerInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.StorageNodes) == 0 {
+		return nil
+	}
+
 	next := s.StorageNodes[s.Next]
 
 	if !next.Alive {
@@ -129,21 +258,20 @@ func (s *PoolInfo) SelectSeveralExcept(exceptMap map[string]*FileServerInfo, num
 	//	num = s.Alive - len(except)
 	//}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	selected := []*FileServerInfo{}
+	if len(s.StorageNodes) == 0 {
+		return selected
+	}
 
 	next := s.StorageNodes[s.Next]
-	start := next
-	for i := 0; i < num; {
-		if !next.Alive || exceptMap[next.PrivateHost] != nil {
-		} else {
+	for steps := 0; len(selected) < num && steps < len(s.StorageNodes); steps++ {
+		if next.Alive && exceptMap[next.NodeID] == nil {
 			selected = append(selected, next)
-			i++
 		}
 		next = s.StorageNodes[next.NextAlive]
-
-		if &next == &start {
-			break
-		}
 	}
 
 	return selected
@@ -151,14 +279,18 @@ func (s *PoolInfo) SelectSeveralExcept(exceptMap map[string]*FileServerInfo, num
 
 func (s *PoolInfo) SelectSeveralExceptArr(except []string, num int) []*FileServerInfo {
 	exceptMap := map[string]*FileServerInfo{}
-	for _, host := range except {
-		exceptMap[host] = &FileServerInfo{}
+	for _, nodeID := range except {
+		exceptMap[nodeID] = &FileServerInfo{}
 	}
 
 	return s.SelectSeveralExcept(exceptMap, num)
 }
 
 func (s *PoolInfo) SelectAmong(among map[string]*FileServerInfo) (*FileServerInfo, error) {
+	// the position is shared with Select, which is called by other requests
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	next := s.Next
 	var chosen *FileServerInfo
 
@@ -182,7 +314,11 @@ func (s *PoolInfo) SelectAmong(among map[string]*FileServerInfo) (*FileServerInf
 }
 
 func (s *PoolInfo) setNewAliveDead(nowDeadID int) {
-	s.setNewAlive(s.StorageNodes[nowDeadID].NextAlive, nowDeadID)
+	s.mu.Lock()
+	nextAlive := s.StorageNodes[nowDeadID].NextAlive
+	s.mu.Unlock()
+
+	s.setNewAlive(nextAlive, nowDeadID)
 }
 
 func (s *PoolInfo) setNewAlive(newAliveID int, cur int) {
@@ -200,8 +336,8 @@ func (s *PoolInfo) setNewAlive(newAliveID int, cur int) {
 	s.mu.Unlock()
 
 	if !setOne {
-		if cur != len(s.StorageNodes)-1 {
-			s.setNewAlive(newAliveID, len(s.StorageNodes)-1)
+		if last := s.Size() - 1; cur != last {
+			s.setNewAlive(newAliveID, last)
 		} else {
 			// no alive node; die
 			// panic("no alive node")
@@ -233,13 +369,34 @@ func ExpectChunksFromClient(inversed map[string][]string, token string) {
 	}
 }
 
+// ExpectReads tells fileservers to let the holder of the token read the
+// chunks, every one of them has to agree.
+func ExpectReads(hosts map[string][]string, token string) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	for host, chunks := range hosts {
+		body, _ := json.Marshal(chunks)
+		resp, err := client.Post(fmt.Sprintf("http://%s/expect/%s?action=read", host, token), "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			return fmt.Errorf("fileserver %s: %v", host, err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("fileserver %s: %s", host, resp.Status)
+		}
+	}
+
+	return nil
+}
+
 func Replicate(chunk *Chunk, sender string, receiver *FileServerInfo) {
 	client := &http.Client{}
 	json := []byte(fmt.Sprintf("[\"%s\"]", chunk.ChunkID))
 
-	ct.ivmu.Lock()
-	ct.InvertedTable[receiver.PrivateHost] = append(ct.InvertedTable[receiver.PrivateHost], chunk)
-	ct.ivmu.Unlock()
+	treemu.Lock()
+	ct.InvertedTable[receiver.NodeID] = append(ct.InvertedTable[receiver.NodeID], chunk)
+	treemu.Unlock()
 
 	token := generateToken()
 
@@ -275,7 +432,7 @@ func Replicate(chunk *Chunk, sender string, receiver *FileServerInfo) {
 }
 
 func (s *PoolInfo) ChangeStatus(id int, status FSStatus) {
-	node := s.StorageNodes[id]
+	node := s.Node(id)
 
 	prevState := node.Alive
 	prevStatus := node.GetStatus()
@@ -285,7 +442,7 @@ func (s *PoolInfo) ChangeStatus(id int, status FSStatus) {
 	changedState := node.Alive && !(prevState && node.Alive)
 
 	if node.Alive {
-		num := len(s.StorageNodes)
+		num := s.Size()
 		s.setNewAlive(id, ((id-1)%num+num)%num)
 
 		s.mu.Lock()
@@ -311,7 +468,7 @@ func (s *PoolInfo) ChangeStatus(id int, status FSStatus) {
 }
 
 func (s *PoolInfo) PurgeChunks(id int, chunks []string) {
-	fs := s.StorageNodes[id]
+	fs := s.Node(id)
 
 	jsonChunks, _ := json.Marshal(chunks)
 
@@ -325,13 +482,15 @@ func (s *PoolInfo) PurgeChunks(id int, chunks []string) {
 	req.Header.Set("Content-Type", "application/json")
 	_, err := client.Do(req)
 	if err != nil {
-		// todo: add to queue
+		// the fileserver will learn about obsolete chunks on inventory
 		return
 	}
 }
 
 func (s *PoolInfo) IsDead(id int, soft bool) bool {
-	return soft && s.StorageNodes[id].GetStatus() == PARTIALLY_DEAD || !soft && s.StorageNodes[id].GetStatus() == DEAD
+	status := s.Node(id).GetStatus()
+
+	return soft && status == PARTIALLY_DEAD || !soft && status == DEAD
 }
 
 func (fs *FileServerInfo) GetStatus() FSStatus {
@@ -340,6 +499,20 @@ func (fs *FileServerInfo) GetStatus() FSStatus {
 	return fs.Status
 }
 
+// Pulse notes a heartbeat of the fileserver.
+func (fs *FileServerInfo) Pulse() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.LastPulse = time.Now()
+}
+
+// SincePulse returns the time since the last heartbeat of the fileserver.
+func (fs *FileServerInfo) SincePulse() time.Duration {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return time.Since(fs.LastPulse)
+}
+
 func (s *PoolInfo) NodeIsDead(id int) {
 
 }
@@ -347,9 +520,11 @@ func (s *PoolInfo) NodeIsDead(id int) {
 func (s *PoolInfo) FSIsDown(node *FileServerInfo) {
 	log.Printf("OMG, %s is down", node.PrivateHost)
 
-	ct.ivmu.Lock()
-	chunks, ok := ct.InvertedTable[node.PrivateHost]
-	ct.ivmu.Unlock()
+	treemu.Lock()
+	defer treemu.Unlock()
+	defer t.snapshotIfDue(ct)
+
+	chunks, ok := ct.InvertedTable[node.NodeID]
 
 	if !ok {
 		// nothing to do; no chunks on server
@@ -357,9 +532,12 @@ func (s *PoolInfo) FSIsDown(node *FileServerInfo) {
 	}
 
 	for _, chunk := range chunks {
-		switch chunk.Status {
+		status := chunk.Status
+		// logged, so that other nameservers and replays drop the replica too
+		t.LoseReplica(ct, chunk, node.NodeID)
+
+		switch status {
 		case PENDING:
-			chunk.Status = DOWN
 			log.Printf("Impossible to replicate. The file is dead now. Chunk: %v", chunk)
 			//log.Fatal("Impossible to replicate. The file is dead now.")
 		case OBSOLETE, DOWN:
@@ -367,34 +545,35 @@ func (s *PoolInfo) FSIsDown(node *FileServerInfo) {
 			continue
 		}
 
-		sender, _ := s.SelectAmong(chunk.FServers)
+		sender, err := s.SelectAmong(chunk.FServers)
+		if err != nil {
+			log.Printf("Impossible to replicate %s: %v", chunk.ChunkID, err)
+			continue
+		}
 		newFS := s.SelectSeveralExcept(chunk.FServers, 1)
 
 		if len(newFS) == 0 {
 			// very bad, no new server
 			// todo: put it to a queue
-			return
+			continue
 		}
-		delete(chunk.FServers, node.PrivateHost)
-		chunk.ReadyReplicas -= 1
-		chunk.AllReplicas -= 1
 
 		chunk.AddFSToChunk(newFS[0])
 
 		log.Printf("OMG, %s is down; replicating %s from %s to %s", node.PrivateHost, chunk.ChunkID, sender.PrivateHost, newFS[0].PrivateHost)
-		go Replicate(chunk, sender.PrivateHost, newFS[0])
+		replicated, from, to := chunk, sender.PrivateHost, newFS[0]
+		t.AfterCommit(func() { Replicate(replicated, from, to) })
 	}
-
-	// possible data race with replicate function
-	// will still work, since no one can send something to down fs
-	delete(ct.InvertedTable, node.PrivateHost)
 }
 
 func (s *PoolInfo) FSIsUp(node *FileServerInfo) {
 	log.Printf("FS %s became online; removing everything from it", node.PrivateHost)
 
+	treemu.Lock()
+	defer treemu.Unlock()
+
 	alive := 0
-	for _, fs := range storages.StorageNodes {
+	for _, fs := range storages.Nodes() {
 		if fs.Alive {
 			alive += 1
 		}
@@ -416,6 +595,6 @@ func (s *PoolInfo) FSIsUp(node *FileServerInfo) {
 		}
 
 		log.Printf("FS %s became online; replicate %s from %s", node.PrivateHost, chunk.ChunkID, sender.PrivateHost)
-		go Replicate(chunk, sender.PrivateHost, receiver[1])
+		go Replicate(chunk, sender.PrivateHost, receiver[0])
 	}
 }
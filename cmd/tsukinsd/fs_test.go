@@ -0,0 +1,141 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPoolInfo_Register(t *testing.T) {
+	conf = &Config{Namenode: Namenode{FSPrivatePort: 7001}}
+	pool := &PoolInfo{}
+
+	if pool.Select() != nil {
+		t.Fatalf("selected a fileserver from empty pool")
+	}
+
+	first, isNew := pool.Register("node-a", "10.0.0.1", "1.1.1.1", 100)
+	if !isNew || first.ID != 0 {
+		t.Errorf("got fileserver %d (new: %v), want new fileserver 0", first.ID, isNew)
+	}
+
+	if pool.Select() != first || pool.Select() != first {
+		t.Errorf("expected the only fileserver to be selected every time")
+	}
+
+	second, _ := pool.Register("node-b", "10.0.0.2", "1.1.1.2", 100)
+	third, _ := pool.Register("node-c", "10.0.0.3", "1.1.1.3", 100)
+
+	t.Run("select in round robin fashion",
+		func(t *testing.T) {
+			want := []*FileServerInfo{first, second, third, first}
+			for i, fs := range want {
+				if got := pool.Select(); got != fs {
+					t.Errorf("selection %d: got fileserver %d, want %d", i, got.ID, fs.ID)
+				}
+			}
+		})
+
+	t.Run("select several except",
+		func(t *testing.T) {
+			got := pool.SelectSeveralExceptArr([]string{"node-b"}, 3)
+			if len(got) != 2 {
+				t.Errorf("got %d fileservers, want %d", len(got), 2)
+			}
+
+			for _, fs := range got {
+				if fs == second {
+					t.Errorf("selected excluded fileserver")
+				}
+			}
+		})
+
+	t.Run("register known node with new address",
+		func(t *testing.T) {
+			fs, isNew := pool.Register("node-b", "10.0.0.22", "1.1.1.22", 50)
+			if isNew || fs != second {
+				t.Errorf("known node was registered as new")
+			}
+
+			if len(pool.StorageNodes) != 3 {
+				t.Errorf("got %d fileservers in pool, want %d", len(pool.StorageNodes), 3)
+			}
+
+			if fs.PrivateHost != "10.0.0.22" || fs.PublicHost != "1.1.1.22" {
+				t.Errorf("addresses of node were not updated: %s, %s", fs.PrivateHost, fs.PublicHost)
+			}
+		})
+
+	t.Run("register new node with address of known one",
+		func(t *testing.T) {
+			fs, isNew := pool.Register("node-d", "10.0.0.1", "1.1.1.1", 50)
+			if !isNew || fs == first || fs.ID != 3 {
+				t.Errorf("got fileserver %d (new: %v), want new fileserver 3", fs.ID, isNew)
+			}
+
+			if got := pool.GetByNodeID("node-a"); got != first {
+				t.Errorf("node-a is not the first fileserver anymore")
+			}
+		})
+}
+
+func TestPoolInfo_FSIsDown(t *testing.T) {
+	f := newTreeFixture(t)
+	tree, table := f.tree, f.table
+	useTree(tree, table)
+
+	conf = &Config{Namenode: f.namenode}
+	pool := &PoolInfo{}
+	down, _ := pool.Register("node-a", "10.0.0.1", "1.1.1.1", 100)
+	up, _ := pool.Register("node-b", "10.0.0.2", "1.1.1.2", 100)
+
+	f.upload(t, "x", "x1")
+	f.upload(t, "y", "y1")
+
+	// a replica of x1 on the other node
+	replica := table.Table["x1"]
+	replica.AddFSToChunk(up)
+	table.InvertedTable[up.NodeID] = append(table.InvertedTable[up.NodeID], replica)
+	tree.ConfirmReplica(replica, up.NodeID)
+
+	// there is no node to replicate to
+	down.Alive = false
+	pool.FSIsDown(down)
+
+	t.Run("replicas are dropped",
+		func(t *testing.T) {
+			for chunkID, want := range map[string][]string{"x1": {"node-b"}, "y1": {}} {
+				chunk := table.Table[chunkID]
+
+				got := []string{}
+				for nodeID := range chunk.FServers {
+					got = append(got, nodeID)
+				}
+				if !reflect.DeepEqual(got, want) || chunk.ReadyReplicas != len(want) || chunk.AllReplicas != len(want) {
+					t.Errorf("chunk %s: got %v, %d ready of %d, want %v", chunkID, got, chunk.ReadyReplicas, chunk.AllReplicas, want)
+				}
+			}
+
+			if _, ok := table.InvertedTable[down.NodeID]; ok {
+				t.Errorf("got chunks of the node, which is down")
+			}
+		})
+
+	t.Run("replay",
+		func(t *testing.T) {
+			_, recoveredTable := f.recover(t)
+
+			for _, chunkID := range []string{"x1", "y1"} {
+				got, want := recoveredTable.Table[chunkID], table.Table[chunkID]
+				if !reflect.DeepEqual(got.Statuses, want.Statuses) || got.Status != want.Status ||
+					got.ReadyReplicas != want.ReadyReplicas || got.AllReplicas != want.AllReplicas {
+					t.Errorf("chunk %s: got %v %v, %d ready of %d, want %v %v, %d ready of %d", chunkID,
+						got.Status, got.Statuses, got.ReadyReplicas, got.AllReplicas,
+						want.Status, want.Statuses, want.ReadyReplicas, want.AllReplicas)
+				}
+			}
+
+			if got := recoveredTable.InvertedTable[down.NodeID]; len(got) != 0 {
+				t.Errorf("got %d chunks of the node, which is down", len(got))
+			}
+		})
+}
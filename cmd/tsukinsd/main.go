@@ -1,9 +1,9 @@
 package main
 
 import (
-	"encoding/gob"
+	"fmt"
 	"log"
-	"os"
+	"time"
 )
 
 type ChunkMessage struct {
@@ -12,57 +12,21 @@ type ChunkMessage struct {
 }
 
 type ClientMessage struct {
-	Status  string         `json:"status"`
-	Message string         `json:"message"`
-	Objects []string       `json:"objects"`
-	Token   string         `json:"token"`
-	Chunks  []ChunkMessage `json:"chunks"`
+	Status   string         `json:"status"`
+	Message  string         `json:"message"`
+	Objects  []string       `json:"objects"`
+	Token    string         `json:"token"`
+	Chunks   []ChunkMessage `json:"chunks"`
+	UploadID string         `json:"uploadID,omitempty"`
 }
 
 var t *Tree
 var conf *Config
 var storages *PoolInfo
-var ct = &ChunkTable{
-	Table:         map[string]*Chunk{}, // chunkID -> chunk
-	InvertedTable: map[string][]*Chunk{},
-}
+var ct = NewChunkTable()
 
 var tokens = map[string][]*FileServerInfo{}
 
-func loadAll() {
-	file, _ := os.Open("t.gob")
-	defer file.Close()
-	decoder := gob.NewDecoder(file)
-	decoder.Decode(t)
-
-	file, _ = os.Open("st.gob")
-	defer file.Close()
-	decoder = gob.NewDecoder(file)
-	decoder.Decode(storages)
-
-	file, _ = os.Open("ct.gob")
-	defer file.Close()
-	decoder = gob.NewDecoder(file)
-	decoder.Decode(ct)
-}
-
-func saveAll() {
-	file, _ := os.Create("t.gob")
-	defer file.Close()
-	decoder := gob.NewEncoder(file)
-	decoder.Encode(t)
-
-	file, _ = os.Create("st.gob")
-	defer file.Close()
-	decoder = gob.NewEncoder(file)
-	decoder.Encode(storages)
-
-	file, _ = os.Create("ct.gob")
-	defer file.Close()
-	decoder = gob.NewEncoder(file)
-	decoder.Encode(ct)
-}
-
 func main() {
 	var err error
 	conf, err = LoadConfig()
@@ -71,13 +35,53 @@ func main() {
 		log.Fatal(err)
 	}
 
-	//t = LoadTree(conf.Namenode.TreeGobName)
-	t = InitTree(conf.Namenode)
 	storages = InitFServers(conf)
-	//loadAll()
+
+	t, ct, err = Recover(conf.Namenode, storages)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(conf.Namenode.Peers) != 0 {
+		stateName := conf.Namenode.RaftStateName
+		if stateName == "" {
+			stateName = "raft.state"
+		}
+
+		self := fmt.Sprintf("%s:%d", conf.Namenode.Host, conf.Namenode.PrivatePort)
+		cluster, err = NewRaft(self, conf.Namenode.Peers, stateName, t, ct, storages)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cluster.OnReset = func(tree *Tree, table *ChunkTable) {
+			t, ct = tree, table
+		}
+	}
+
+	if conf.Namenode.AdminPassword == "" && len(t.Users) == 0 {
+		log.Printf("warning: there are no accounts and adminPassword is not set; clients cannot sign in")
+	}
+
+	if conf.Namenode.UploadLease > 0 {
+		uploads.Lease = conf.Namenode.UploadLease * time.Second
+	}
+	go uploads.Janitor(time.Second)
+	if conf.Namenode.TrashRetention > 0 {
+		go TrashJanitor(time.Minute, conf.Namenode.TrashRetention*time.Second)
+	}
 
 	go StartPrivateServer()
-	go storages.HeartbeatManager(true)
-	go storages.HeartbeatManager(false)
+
+	if cluster != nil {
+		go cluster.Run()
+		go storages.HeartbeatManager(true)
+		go storages.HeartbeatManager(false)
+	} else if conf.Namenode.Primary != "" {
+		standby = &Standby{Primary: conf.Namenode.Primary, Secret: conf.Namenode.ClusterSecret}
+		go standby.Follow(conf.Namenode.StandbyPollPeriod * time.Second)
+	} else {
+		go storages.HeartbeatManager(true)
+		go storages.HeartbeatManager(false)
+	}
 	StartPublicServer()
 }
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+)
+
+// LogRecord is an operation on the namespace. Records are replayed on top of
+// the last snapshot on startup, so each of them carries everything needed to
+// apply the operation once more.
+type LogRecord struct {
+	Version int64
+	Term    int64 `json:",omitempty"`
+	Command string
+	Args    []string `json:",omitempty"`
+	Size    int      `json:",omitempty"`
+	Chunks  []string `json:",omitempty"`
+	Nodes   []string `json:",omitempty"` // node IDs of fileservers the chunks were assigned to
+	User    string   `json:",omitempty"` // who made the change, new nodes are theirs
+}
+
+func AppendLogRecord(logName string, record LogRecord) error {
+	f, err := os.OpenFile(logName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("open log: %v", err)
+	}
+	defer f.Close()
+
+	line, _ := json.Marshal(record)
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("append to log: %v", err)
+	}
+
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("sync log: %v", err)
+	}
+
+	return nil
+}
+
+// ReadLogFrom returns at most max records of the log, starting with the
+// version. No max if it is negative.
+func ReadLogFrom(logName string, from int64, max int) ([]LogRecord, error) {
+	f, err := os.Open(logName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("open log: %v", err)
+	}
+	defer f.Close()
+
+	records := []LogRecord{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() && len(records) != max {
+		var record LogRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// the record is being written
+			break
+		}
+
+		if record.Version >= from {
+			records = append(records, record)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return records, fmt.Errorf("read log: %v", err)
+	}
+
+	return records, nil
+}
+
+// TruncateLog drops records of the log starting with the version.
+func TruncateLog(logName string, from int64) error {
+	records, err := ReadLogFrom(logName, 0, -1)
+	if err != nil {
+		return err
+	}
+
+	tmpName := logName + ".tmp"
+	os.Remove(tmpName)
+	for _, record := range records {
+		if record.Version >= from {
+			break
+		}
+
+		if err := AppendLogRecord(tmpName, record); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(tmpName, logName); os.IsNotExist(err) {
+		// no records are left
+		err = os.Remove(logName)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	} else if err != nil {
+		return fmt.Errorf("truncate log: %v", err)
+	}
+
+	return nil
+}
+
+// Recover loads the last snapshot of the tree and the chunk table and
+// replays the log on top of it. If there is no snapshot, it starts with an
+// empty tree. If it falls back to an older snapshot, segments of the log
+// newer than the snapshot are replayed first.
+func Recover(conf Namenode, pool *PoolInfo) (*Tree, *ChunkTable, error) {
+	tree, table, err := LoadSnapshot(conf.TreeGobName, pool)
+	if os.IsNotExist(err) {
+		tree, table = InitTree(conf), NewChunkTable()
+	} else if err != nil {
+		return nil, nil, err
+	}
+	// the config may have changed since the snapshot
+	tree.Conf = conf
+
+	segments, err := snapshotVersions(conf.TreeLogName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("list log segments: %v", err)
+	}
+
+	replayed := 0
+	for _, version := range segments {
+		if version <= tree.Version {
+			// already in the snapshot
+			continue
+		}
+
+		n, err := tree.Replay(snapshotName(conf.TreeLogName, version), table, pool)
+		replayed += n
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	n, err := tree.Replay(conf.TreeLogName, table, pool)
+	replayed += n
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.Printf("Recovered the tree at version %d, replayed %d operations", tree.Version, replayed)
+	return tree, table, nil
+}
+
+// Replay applies records from the log that are not in the tree yet and
+// returns how many of them were applied. A record that was cut short by a
+// crash ends the log. Records missing between the tree and the log are an
+// error, the tree would not be what the log was written against.
+func (t *Tree) Replay(logName string, table *ChunkTable, pool *PoolInfo) (int, error) {
+	f, err := os.Open(logName)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("open log: %v", err)
+	}
+	defer f.Close()
+
+	replayed := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		var record LogRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			log.Printf("Log record %d is broken, the rest of the log is skipped: %v", t.Version, err)
+			break
+		}
+
+		if record.Version < t.Version {
+			// already in the snapshot
+			continue
+		} else if record.Version > t.Version {
+			return replayed, fmt.Errorf("replay %s: records %d to %d are missing", logName, t.Version, record.Version-1)
+		}
+
+		if err := t.ApplyRecord(record, table, pool); err != nil {
+			log.Printf("Could not replay %s %v: %v", record.Command, record.Args, err)
+		}
+		replayed++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return replayed, fmt.Errorf("read log: %v", err)
+	}
+
+	return replayed, nil
+}
+
+// ApplyRecord applies a record of the log without logging it again.
+func (t *Tree) ApplyRecord(record LogRecord, table *ChunkTable, pool *PoolInfo) error {
+	t.replaying = true
+	t.acting = t.recordUser(record.User)
+	defer func() { t.replaying, t.acting = false, nil }()
+
+	err := t.apply(record, table, pool)
+	t.Version = record.Version + 1
+	t.Term = record.Term
+
+	return err
+}
+
+// ConfirmReplica marks the replica of the chunk on the fileserver ready. The
+// file is ready once all its chunks have a ready replica.
+func (t *Tree) ConfirmReplica(chunk *Chunk, nodeID string) {
+	chunk.Status = OK
+	chunk.Statuses[nodeID] = OK
+	chunk.ReadyReplicas += 1
+
+	if file, ok := t.Nodes[chunk.File]; ok {
+		delete(file.Pending, chunk.ChunkID)
+		if file.Staged != nil {
+			delete(file.Staged.Pending, chunk.ChunkID)
+		}
+	}
+
+	t.Commit(LogRecord{Command: "confirm", Args: []string{chunk.ChunkID, nodeID}})
+}
+
+// LoseReplica drops the replica of the chunk on the fileserver, which is
+// down. A chunk that has no ready replica yet is down along with it.
+func (t *Tree) LoseReplica(table *ChunkTable, chunk *Chunk, nodeID string) {
+	if chunk.Status == PENDING {
+		chunk.Status = DOWN
+	}
+	table.dropReplica(chunk, nodeID)
+
+	t.Commit(LogRecord{Command: "lost", Args: []string{chunk.ChunkID, nodeID}})
+}
+
+// Init empties the tree and the chunk table. The version goes on, so that
+// older snapshots and records are not mistaken for newer ones. Accounts are
+// kept.
+func (t *Tree) Init(table *ChunkTable) {
+	t.Nodes = InitTree(t.Conf).Nodes
+	t.Removed = nil
+
+	table.Table = map[string]*Chunk{}
+	table.InvertedTable = map[string][]*Chunk{}
+
+	t.Commit(LogRecord{Command: "init"})
+}
+
+// recordUser returns the account the record was made by, accounts may be
+// removed since then.
+func (t *Tree) recordUser(name string) *User {
+	if name == "" {
+		return nil
+	}
+	if user, ok := t.Users[name]; ok {
+		return user
+	}
+
+	return &User{Name: name, Admin: name == adminName}
+}
+
+func (t *Tree) apply(record LogRecord, table *ChunkTable, pool *PoolInfo) error {
+	switch record.Command {
+	case "noop":
+		return nil
+	case "init":
+		t.Init(table)
+		return nil
+	}
+
+	args := record.Args
+	if len(args) == 0 {
+		return fmt.Errorf("no arguments")
+	}
+
+	switch record.Command {
+	case "touch":
+		_, err := t.createFile(args[0], record.Size, parseSavedOn(args, 1))
+		return err
+	case "mkdir":
+		return t.createDirectory(args[0], parseSavedOn(args, 1))
+	case "rmdir":
+		dir, err := t.RemoveDirectory(args[0])
+		if err != nil {
+			return err
+		}
+
+		for _, chunkID := range table.Unref(dir.HeldChunks()) {
+			table.Table[chunkID].Status = OBSOLETE
+		}
+	case "copy":
+		if len(args) < 2 {
+			return fmt.Errorf("no destination")
+		}
+		file, err := t.CopyFile(args[0], args[1])
+		if err != nil {
+			return err
+		}
+
+		table.Ref(file.Chunks)
+	case "copydir":
+		if len(args) < 2 {
+			return fmt.Errorf("no destination")
+		}
+		dir, err := t.CopyDirectory(args[0], args[1])
+		if err != nil {
+			return err
+		}
+
+		table.Ref(dir.AllChunks())
+	case "move":
+		if len(args) < 2 {
+			return fmt.Errorf("no destination")
+		}
+		_, err := t.Move(args[0], args[1], table)
+		return err
+	case "rmfile":
+		file, err := t.RemoveFile(args[0])
+		if err != nil {
+			return err
+		}
+
+		// fileservers are told to purge the chunks on inventory
+		for _, chunkID := range table.Unref(append(file.VersionChunks(), file.Chunks...)) {
+			table.Table[chunkID].Status = OBSOLETE
+		}
+	case "trash":
+		if len(args) < 2 {
+			return fmt.Errorf("no trash id")
+		}
+
+		_, err := t.trash(args[0], args[1], parseSavedOn(args, 2), table)
+		return err
+	case "untrash":
+		_, err := t.RestoreTrashed(args[0], table)
+		return err
+	case "purge":
+		node, err := t.PurgeTrashed(args[0])
+		if err != nil {
+			return err
+		}
+
+		for _, chunkID := range table.Unref(node.HeldChunks()) {
+			table.Table[chunkID].Status = OBSOLETE
+		}
+	case "useradd":
+		if len(args) < 4 {
+			return fmt.Errorf("no password")
+		}
+
+		admin, err := strconv.ParseBool(args[1])
+		if err != nil {
+			return err
+		}
+
+		return t.addUser(args[0], admin, args[2], args[3])
+	case "passwd":
+		if len(args) < 3 {
+			return fmt.Errorf("no password")
+		}
+
+		return t.setPassword(args[0], args[1], args[2])
+	case "userdel":
+		return t.RemoveUser(args[0])
+	case "keyadd":
+		if len(args) < 3 {
+			return fmt.Errorf("no key")
+		}
+
+		_, err := t.addKey(args[0], args[1], args[2], parseSavedOn(args, 3))
+		return err
+	case "keydel":
+		if len(args) < 2 {
+			return fmt.Errorf("no key id")
+		}
+
+		return t.RemoveKey(args[0], args[1])
+	case "chmod":
+		if len(args) < 2 {
+			return fmt.Errorf("no mode")
+		}
+
+		mode, err := strconv.ParseUint(args[1], 8, 32)
+		if err != nil {
+			return err
+		}
+
+		return t.Chmod(args[0], uint32(mode))
+	case "chown":
+		if len(args) < 3 {
+			return fmt.Errorf("no owner")
+		}
+
+		return t.Chown(args[0], args[1], args[2])
+	case "usergroups":
+		return t.SetGroups(args[0], args[1:])
+	case "symlink":
+		if len(args) < 2 {
+			return fmt.Errorf("no link target")
+		}
+
+		_, err := t.createSymlink(args[0], args[1], parseSavedOn(args, 2))
+		return err
+	case "setxattr":
+		if len(args) < 3 {
+			return fmt.Errorf("no attribute")
+		}
+
+		return t.SetXattr(args[0], args[1], args[2])
+	case "rmxattr":
+		if len(args) < 2 {
+			return fmt.Errorf("no attribute")
+		}
+
+		return t.RemoveXattr(args[0], args[1])
+	case "quota":
+		if len(args) < 3 {
+			return fmt.Errorf("no quota")
+		}
+
+		bytes, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		objects, err := strconv.Atoi(args[2])
+		if err != nil {
+			return err
+		}
+
+		return t.SetQuota(args[0], bytes, objects)
+	case "snapshot":
+		if len(args) < 2 {
+			return fmt.Errorf("no snapshot name")
+		}
+
+		frozen, err := t.CreateDirSnapshot(args[0], args[1], parseSavedOn(args, 2))
+		if err != nil {
+			return err
+		}
+
+		table.Ref(frozen.AllChunks())
+	case "rmsnapshot":
+		frozen, err := t.RemoveDirSnapshot(args[0])
+		if err != nil {
+			return err
+		}
+
+		for _, chunkID := range table.Unref(frozen.AllChunks()) {
+			table.Table[chunkID].Status = OBSOLETE
+		}
+	case "keep":
+		if len(args) < 2 {
+			return fmt.Errorf("no number of versions")
+		}
+
+		keep, err := strconv.Atoi(args[1])
+		if err != nil {
+			return err
+		}
+
+		return t.KeepVersions(args[0], keep)
+	case "restore":
+		if len(args) < 2 {
+			return fmt.Errorf("no version")
+		}
+
+		n, err := strconv.Atoi(args[1])
+		if err != nil {
+			return err
+		}
+
+		restored, released, err := t.RestoreVersion(args[0], n, parseSavedOn(args, 2))
+		if err != nil {
+			return err
+		}
+
+		table.Ref(restored.Chunks)
+		for _, chunkID := range table.Unref(released) {
+			table.Table[chunkID].Status = OBSOLETE
+		}
+	case "upload":
+		if len(record.Chunks) != len(record.Nodes) {
+			return fmt.Errorf("%d chunks on %d fileservers", len(record.Chunks), len(record.Nodes))
+		}
+
+		file, ok := t.Nodes[args[0]]
+		if !ok {
+			return fmt.Errorf("/%s file does not exist", args[0])
+		}
+
+		for i, chunkID := range record.Chunks {
+			table.AssignChunk(file, chunkID, pool.GetOrPlaceholder(record.Nodes[i]))
+		}
+
+		if len(args) > 1 {
+			file.UploadID = args[1]
+		}
+	case "reupload":
+		if len(record.Chunks) != 1 || len(record.Nodes) != 1 {
+			return fmt.Errorf("%d chunks on %d fileservers", len(record.Chunks), len(record.Nodes))
+		}
+
+		chunk, ok := table.Table[record.Chunks[0]]
+		if !ok {
+			return fmt.Errorf("chunk %s does not exist", record.Chunks[0])
+		}
+
+		table.Reassign(chunk, pool.GetOrPlaceholder(record.Nodes[0]))
+	case "overwrite":
+		if len(args) < 2 || len(record.Chunks) != len(record.Nodes) {
+			return fmt.Errorf("%d chunks on %d fileservers", len(record.Chunks), len(record.Nodes))
+		}
+
+		file, err := t.StageOverwrite(args[0], record.Size, args[1])
+		if err != nil {
+			return err
+		}
+
+		for i, chunkID := range record.Chunks {
+			table.AssignChunk(file.Staged, chunkID, pool.GetOrPlaceholder(record.Nodes[i]))
+		}
+	case "append":
+		if len(args) < 2 || len(record.Chunks) != len(record.Nodes) {
+			return fmt.Errorf("%d chunks on %d fileservers", len(record.Chunks), len(record.Nodes))
+		}
+
+		file, err := t.StageAppend(args[0], record.Size, args[1])
+		if err != nil {
+			return err
+		}
+		table.Ref(file.Chunks)
+
+		for i, chunkID := range record.Chunks {
+			table.AssignChunk(file.Staged, chunkID, pool.GetOrPlaceholder(record.Nodes[i]))
+		}
+	case "commit":
+		file, ok := t.Nodes[args[0]]
+		if !ok {
+			return fmt.Errorf("/%s file does not exist", args[0])
+		}
+
+		id := file.UploadID
+		if len(args) > 1 {
+			id = args[1]
+		}
+
+		released, err := t.CommitUpload(file, id, parseSavedOn(args, 2))
+		if err != nil {
+			return err
+		}
+
+		for _, chunkID := range table.Unref(released) {
+			table.Table[chunkID].Status = OBSOLETE
+		}
+	case "abort":
+		file, ok := t.Nodes[args[0]]
+		if !ok {
+			return fmt.Errorf("/%s file does not exist", args[0])
+		}
+
+		id := file.UploadID
+		if len(args) > 1 {
+			id = args[1]
+		}
+
+		chunks, err := t.AbortUpload(file, id)
+		if err != nil {
+			return err
+		}
+
+		for _, chunkID := range table.Unref(chunks) {
+			table.Table[chunkID].Status = OBSOLETE
+		}
+	case "confirm":
+		if len(args) < 2 {
+			return fmt.Errorf("no fileserver")
+		}
+		chunkID, nodeID := args[0], args[1]
+
+		chunk, ok := table.Table[chunkID]
+		if !ok {
+			return fmt.Errorf("chunk %s not found", chunkID)
+		}
+
+		if _, ok := chunk.FServers[nodeID]; !ok {
+			// a replica
+			fs := pool.GetOrPlaceholder(nodeID)
+			chunk.AddFSToChunk(fs)
+			table.InvertedTable[nodeID] = append(table.InvertedTable[nodeID], chunk)
+		}
+
+		t.ConfirmReplica(chunk, nodeID)
+	case "lost":
+		if len(args) < 2 {
+			return fmt.Errorf("no fileserver")
+		}
+
+		chunk, ok := table.Table[args[0]]
+		if !ok {
+			return fmt.Errorf("chunk %s not found", args[0])
+		}
+
+		t.LoseReplica(table, chunk, args[1])
+	default:
+		return fmt.Errorf("unknown command")
+	}
+
+	return nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestRecover(t *testing.T) {
+	dir := t.TempDir()
+	namenode := Namenode{
+		TreeLogName:      path.Join(dir, "tree.log"),
+		TreeGobName:      path.Join(dir, "tree.gob"),
+		TreeUpdatePeriod: -1,
+	}
+
+	pool := &PoolInfo{}
+	fs := &FileServerInfo{NodeID: "node-a", Alive: true, Status: LIVE}
+	pool.StorageNodes = append(pool.StorageNodes, fs)
+
+	tree := InitTree(namenode)
+	useTree(tree, NewChunkTable())
+
+	upload := func(address string, size int, chunks ...string) {
+		t.Helper()
+
+		file, err := tree.CreateFile(address, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		nodes := []string{}
+		for _, chunkID := range chunks {
+			ct.AssignChunk(file, chunkID, fs)
+			nodes = append(nodes, fs.NodeID)
+		}
+		tree.Commit(LogRecord{Command: "upload", Args: []string{address}, Chunks: chunks, Nodes: nodes})
+
+		for _, chunkID := range chunks {
+			tree.ConfirmReplica(ct.Table[chunkID], fs.NodeID)
+		}
+	}
+
+	tree.CreateDirectory("docs")
+	upload("docs/a.txt", 10, "a1", "a2")
+	if err := tree.Snapshot(ct); err != nil {
+		t.Fatal(err)
+	}
+
+	upload("docs/b.txt", 20, "b1")
+	tree.CopyFile("docs/b.txt", "c.txt")
+	tree.CreateSymlink("latest", "docs/b.txt")
+	tree.CreateDirectory("logs")
+	tree.CreateDirectory("tmp")
+	tree.RemoveDirectory("tmp")
+	upload("d.txt", 5, "d1")
+	tree.RemoveFile("d.txt")
+
+	recovered, table, err := Recover(namenode, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if recovered.Version != tree.Version {
+		t.Errorf("got version %d, want %d", recovered.Version, tree.Version)
+	}
+
+	t.Run("namespace",
+		func(t *testing.T) {
+			for _, dir := range []string{".", "docs"} {
+				want, _ := tree.LS(dir)
+				got, err := recovered.LS(dir)
+				if err != nil || !reflect.DeepEqual(got, want) {
+					t.Errorf("ls %s: got %v (%v), want %v", dir, got, err, want)
+				}
+			}
+
+			for _, address := range []string{"docs/a.txt", "docs/b.txt", "c.txt"} {
+				file, err := recovered.GetFile(address)
+				if err != nil {
+					t.Errorf("file %s was not recovered: %v", address, err)
+					continue
+				}
+
+				want := tree.Nodes[address]
+				if file.Size != want.Size || !reflect.DeepEqual(file.Chunks, want.Chunks) {
+					t.Errorf("got file %v of size %d, want %v of size %d", file, file.Size, want, want.Size)
+				}
+			}
+
+			if recovered.Exists("d.txt") || recovered.Exists("tmp") {
+				t.Errorf("removed paths were recovered")
+			}
+		})
+
+	t.Run("creation times",
+		func(t *testing.T) {
+			for _, address := range []string{"docs", "docs/b.txt", "c.txt", "latest", "logs"} {
+				got, want := recovered.Nodes[address], tree.Nodes[address]
+				if got == nil {
+					t.Errorf("/%s was not recovered", address)
+					continue
+				}
+				if !got.CreatedOn.Equal(want.CreatedOn) {
+					t.Errorf("/%s: got created on %v, want %v", address, got.CreatedOn, want.CreatedOn)
+				}
+			}
+		})
+
+	t.Run("chunks",
+		func(t *testing.T) {
+			for _, chunkID := range []string{"a1", "a2", "b1"} {
+				chunk, ok := table.Table[chunkID]
+				if !ok {
+					t.Errorf("chunk %s was not recovered", chunkID)
+					continue
+				}
+
+				if chunk.Status != OK || chunk.Statuses[fs.NodeID] != OK || chunk.FServers[fs.NodeID] != fs {
+					t.Errorf("chunk %v is not ready on %s", chunk, fs.NodeID)
+				}
+			}
+
+			if table.Table["d1"].Status != OBSOLETE {
+				t.Errorf("chunk of removed file is not obsolete")
+			}
+
+			if got := len(table.InvertedTable[fs.NodeID]); got != 4 {
+				t.Errorf("got %d chunks on %s, want %d", got, fs.NodeID, 4)
+			}
+		})
+
+	t.Run("fileserver that has not registered yet",
+		func(t *testing.T) {
+			_, table, err := Recover(namenode, &PoolInfo{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			placeholder := table.Table["a1"].FServers[fs.NodeID]
+			if placeholder == fs || placeholder.Alive {
+				t.Fatalf("expected a dead placeholder, got %v", placeholder)
+			}
+
+			table.Relink(fs)
+			if table.Table["a1"].FServers[fs.NodeID] != fs {
+				t.Errorf("chunk was not relinked to the registered fileserver")
+			}
+		})
+}
+
+func TestRecover_SharedChunks(t *testing.T) {
+	dir := t.TempDir()
+	namenode := Namenode{
+		TreeLogName:      path.Join(dir, "tree.log"),
+		TreeGobName:      path.Join(dir, "tree.gob"),
+		TreeUpdatePeriod: -1,
+	}
+
+	pool := &PoolInfo{}
+	fs := &FileServerInfo{NodeID: "node-a", Alive: true, Status: LIVE}
+	pool.StorageNodes = append(pool.StorageNodes, fs)
+
+	tree := InitTree(namenode)
+	table := NewChunkTable()
+	useTree(tree, table)
+
+	file, _ := tree.CreateFile("a.txt", 10)
+	table.AssignChunk(file, "a1", fs)
+	tree.Commit(LogRecord{Command: "upload", Args: []string{"a.txt"}, Chunks: []string{"a1"}, Nodes: []string{fs.NodeID}})
+	tree.ConfirmReplica(table.Table["a1"], fs.NodeID)
+
+	copied, err := tree.CopyFile("a.txt", "b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.Ref(copied.Chunks)
+
+	if got := table.Table["a1"].Refs; got != 2 {
+		t.Fatalf("got %d references, want %d", got, 2)
+	}
+
+	removed, _ := tree.RemoveFile("a.txt")
+	if unused := table.Unref(removed.Chunks); len(unused) != 0 {
+		t.Errorf("chunks %v of the copy are to be purged", unused)
+	}
+
+	t.Run("recover the copy",
+		func(t *testing.T) {
+			_, recovered, err := Recover(namenode, pool)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			chunk := recovered.Table["a1"]
+			if chunk.Status == OBSOLETE || chunk.Refs != 1 {
+				t.Errorf("got chunk of status %d with %d references, want a live chunk with 1", chunk.Status, chunk.Refs)
+			}
+		})
+
+	t.Run("purge once the last copy is removed",
+		func(t *testing.T) {
+			removed, _ := tree.RemoveFile("b.txt")
+			unused := table.Unref(removed.Chunks)
+			if !reflect.DeepEqual(unused, []string{"a1"}) {
+				t.Errorf("got %v to purge, want %v", unused, []string{"a1"})
+			}
+
+			_, recovered, err := Recover(namenode, pool)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if recovered.Table["a1"].Status != OBSOLETE {
+				t.Errorf("chunk of removed copies is not obsolete")
+			}
+		})
+
+	t.Run("purge files of removed directories",
+		func(t *testing.T) {
+			tree.CreateDirectory("d")
+			file, _ := tree.CreateFile("d/c.txt", 10)
+			table.AssignChunk(file, "c1", fs)
+			tree.Commit(LogRecord{Command: "upload", Args: []string{"d/c.txt"}, Chunks: []string{"c1"}, Nodes: []string{fs.NodeID}})
+			tree.ConfirmReplica(table.Table["c1"], fs.NodeID)
+
+			removed, _ := tree.RemoveDirectory("d")
+			if unused := table.Unref(removed.HeldChunks()); !reflect.DeepEqual(unused, []string{"c1"}) {
+				t.Errorf("got %v to purge, want %v", unused, []string{"c1"})
+			}
+
+			_, recovered, err := Recover(namenode, pool)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if recovered.Table["c1"].Status != OBSOLETE {
+				t.Errorf("chunk of a removed directory is not obsolete")
+			}
+		})
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+)
+
+// Nodes have an owner, a group and rwx bits for the owner, the group and
+// others, much as in POSIX. Reading a file takes r, listing a directory r,
+// passing through a directory x, and creating or removing entries of a
+// directory takes w and x on it. Admins pass every check. Nodes created
+// before permissions were introduced have no owner and no bits, those are
+// open to everyone until an admin gives them an owner.
+const (
+	permRead  = 4
+	permWrite = 2
+	permExec  = 1
+)
+
+const (
+	defaultFileMode = 0644
+	defaultDirMode  = 0755
+)
+
+// ActAs makes the tree check the following operations against permissions of
+// the user and give new nodes to the user, until it is called with nil.
+// Operations of the nameserver itself are not checked.
+func (t *Tree) ActAs(user *User) {
+	t.acting = user
+}
+
+// InGroup tells whether the user is a member of the group.
+func (user *User) InGroup(group string) bool {
+	for _, member := range user.Groups {
+		if member == group && group != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PrimaryGroup is given to the nodes the user creates.
+func (user *User) PrimaryGroup() string {
+	if len(user.Groups) == 0 {
+		return ""
+	}
+
+	return user.Groups[0]
+}
+
+func (node *Node) permits(user *User, perm uint32) bool {
+	if node.Owner == "" && node.Mode == 0 {
+		return true
+	}
+
+	var bits uint32
+	switch {
+	case user.Name == node.Owner:
+		bits = node.Mode >> 6
+	case user.InGroup(node.Group):
+		bits = node.Mode >> 3
+	default:
+		bits = node.Mode
+	}
+
+	return bits&perm == perm
+}
+
+// ModeString formats the bits as ls does.
+func (node *Node) ModeString() string {
+	mode := os.FileMode(node.Mode)
+	if node.IsDirectory {
+		mode |= os.ModeDir
+	} else if node.IsSymlink() {
+		mode |= os.ModeSymlink
+	}
+
+	return mode.String()
+}
+
+// CheckAccess checks that the user may pass through the directories on the
+// way to the address and access its node with the permissions. Links on the
+// way are followed, the node itself is not; callers that follow it pass the
+// resolved address, see Resolve.
+func (t *Tree) CheckAccess(user *User, address string, perm uint32) error {
+	if user == nil || user.Admin {
+		return nil
+	}
+
+	address, _ = CleanAddress(address)
+
+	dir, err := t.Resolve(path.Dir(address))
+	if err != nil {
+		return err
+	}
+	resolved := path.Join(dir, path.Base(address))
+
+	for _, walked := range []string{address, resolved} {
+		for dir := walked; dir != "."; {
+			dir = path.Dir(dir)
+			if node, ok := t.Nodes[dir]; ok && !node.permits(user, permExec) {
+				return fmt.Errorf("/%s permission denied", address)
+			}
+		}
+	}
+
+	if node, ok := t.Nodes[resolved]; ok && !node.permits(user, perm) {
+		return fmt.Errorf("/%s permission denied", address)
+	}
+
+	return nil
+}
+
+// allow checks the acting user, see ActAs. Replayed operations were checked
+// when they were made.
+func (t *Tree) allow(address string, perm uint32) error {
+	if t.replaying {
+		return nil
+	}
+
+	return t.CheckAccess(t.acting, address, perm)
+}
+
+// allowEntries checks that the acting user may create or remove the entry of
+// the directory.
+func (t *Tree) allowEntries(address string) error {
+	if err := t.allow(path.Dir(address), permWrite|permExec); err != nil {
+		return fmt.Errorf("/%s permission denied", address)
+	}
+
+	return nil
+}
+
+// mayManage tells whether the acting user owns the node or is an admin.
+func (t *Tree) mayManage(node *Node) bool {
+	return t.replaying || t.acting == nil || t.acting.Admin || node.Owner == t.acting.Name
+}
+
+// own gives the new node to the acting user.
+func (t *Tree) own(node *Node) {
+	if t.acting == nil {
+		return
+	}
+
+	node.Owner = t.acting.Name
+	node.Group = t.acting.PrimaryGroup()
+	node.Mode = defaultFileMode
+	if node.IsDirectory {
+		node.Mode = defaultDirMode
+	}
+}
+
+// claim gives copied nodes to the acting user, the bits are kept.
+func (t *Tree) claim(node *Node, recursive bool) {
+	if t.acting == nil {
+		return
+	}
+
+	mode := node.Mode
+	t.own(node)
+	if mode != 0 {
+		node.Mode = mode
+	}
+
+	if recursive {
+		for _, child := range node.Childs {
+			t.claim(child, true)
+		}
+	}
+}
+
+// Chmod sets the bits of the node, only its owner or an admin may.
+func (t *Tree) Chmod(address string, mode uint32) error {
+	address, matched := CleanAddress(address)
+
+	if !matched {
+		return fmt.Errorf("/%s wrong file name format", address)
+	}
+	if IsReadOnly(address) {
+		return readOnly(address)
+	}
+	if mode > 0777 {
+		return fmt.Errorf("%o wrong mode", mode)
+	}
+	if err := t.allow(address, 0); err != nil {
+		return err
+	}
+
+	node, ok := t.Nodes[address]
+	if !ok || !t.Exists(address) {
+		return fmt.Errorf("/%s path does not exist", address)
+	}
+	if !t.mayManage(node) {
+		return fmt.Errorf("/%s permission denied; not the owner", address)
+	}
+
+	node.Mode = mode
+
+	t.CommitUpdate("chmod", address, strconv.FormatUint(uint64(mode), 8))
+
+	return nil
+}
+
+// Chown gives the node to the owner and the group. Only admins may change the
+// owner, the owner may change the group to one of its own groups.
+func (t *Tree) Chown(address string, owner string, group string) error {
+	address, matched := CleanAddress(address)
+
+	if !matched {
+		return fmt.Errorf("/%s wrong file name format", address)
+	}
+	if IsReadOnly(address) {
+		return readOnly(address)
+	}
+	if err := t.allow(address, 0); err != nil {
+		return err
+	}
+
+	node, ok := t.Nodes[address]
+	if !ok || !t.Exists(address) {
+		return fmt.Errorf("/%s path does not exist", address)
+	}
+
+	if owner == "" {
+		owner = node.Owner
+	}
+
+	if !t.replaying && t.acting != nil && !t.acting.Admin {
+		if owner != node.Owner || node.Owner != t.acting.Name {
+			return fmt.Errorf("/%s permission denied; only admins may change the owner", address)
+		}
+		if group != "" && !t.acting.InGroup(group) {
+			return fmt.Errorf("/%s permission denied; not a member of %s", address, group)
+		}
+	}
+
+	// the account may have been removed since
+	if owner != adminName && !t.replaying {
+		if _, err := t.GetUser(owner); err != nil {
+			return err
+		}
+	}
+
+	node.Owner, node.Group = owner, group
+	// the owner of a node created before permissions gets the usual bits
+	if node.Mode == 0 {
+		node.Mode = defaultFileMode
+		if node.IsDirectory {
+			node.Mode = defaultDirMode
+		}
+	}
+
+	t.CommitUpdate("chown", address, owner, group)
+
+	return nil
+}
+
+// SetGroups replaces the groups of the account, the first one is given to the
+// nodes the user creates.
+func (t *Tree) SetGroups(name string, groups []string) error {
+	user, err := t.GetUser(name)
+	if err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		if err := checkUserName(group); err != nil && group != adminName {
+			return fmt.Errorf("%q wrong group name", group)
+		}
+	}
+
+	user.Groups = append([]string{}, groups...)
+
+	t.CommitUpdate("usergroups", append([]string{name}, groups...)...)
+
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"path"
+	"testing"
+	"time"
+)
+
+func TestTree_Permissions(t *testing.T) {
+	f := newTreeFixture(t)
+	tree, table := f.tree, f.table
+
+	tree.AddUser("alice", "wonderland", false)
+	tree.AddUser("bob", "builder", false)
+	tree.AddUser("carol", "singer", false)
+	tree.SetGroups("alice", []string{"staff"})
+	tree.SetGroups("bob", []string{"staff"})
+
+	alice, bob, carol := tree.Users["alice"], tree.Users["bob"], tree.Users["carol"]
+
+	// the nameserver itself is not checked
+	tree.CreateDirectory("home")
+	tree.Chmod("home", 0777)
+
+	t.Run("new nodes belong to the user",
+		func(t *testing.T) {
+			tree.ActAs(alice)
+			defer tree.ActAs(nil)
+
+			if err := tree.CreateDirectory("home/alice"); err != nil {
+				t.Fatal(err)
+			}
+			file, err := tree.CreateFile("home/alice/notes.txt", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if file.Owner != "alice" || file.Group != "staff" || file.Mode != defaultFileMode {
+				t.Errorf("got %s:%s %o, want alice:staff %o", file.Owner, file.Group, file.Mode, defaultFileMode)
+			}
+			if got := file.ModeString(); got != "-rw-r--r--" {
+				t.Errorf("got %s, want -rw-r--r--", got)
+			}
+		})
+
+	t.Run("others may not change the directory",
+		func(t *testing.T) {
+			tree.ActAs(bob)
+			defer tree.ActAs(nil)
+
+			if _, err := tree.CreateFile("home/alice/bob.txt", 0); err == nil {
+				t.Errorf("created a file in the directory of another user")
+			}
+			if _, err := tree.RemoveFile("home/alice/notes.txt"); err == nil {
+				t.Errorf("removed a file of another user")
+			}
+			if err := tree.Chmod("home/alice/notes.txt", 0666); err == nil {
+				t.Errorf("changed the mode of a file of another user")
+			}
+			if err := tree.CheckAccess(bob, "home/alice/notes.txt", permRead); err != nil {
+				t.Errorf("could not read a file readable by everyone: %v", err)
+			}
+			if err := tree.CheckAccess(bob, "home/alice/notes.txt", permWrite); err == nil {
+				t.Errorf("could write a file of another user")
+			}
+		})
+
+	t.Run("group and other bits",
+		func(t *testing.T) {
+			tree.ActAs(alice)
+			if err := tree.Chmod("home/alice", 0770); err != nil {
+				t.Fatal(err)
+			}
+			tree.ActAs(nil)
+
+			if err := tree.CheckAccess(bob, "home/alice/notes.txt", permRead); err != nil {
+				t.Errorf("member of the group was denied: %v", err)
+			}
+			if err := tree.CheckAccess(carol, "home/alice/notes.txt", permRead); err == nil {
+				t.Errorf("passed through a directory closed to others")
+			}
+			if err := tree.CheckAccess(carol, "home/alice", permRead|permExec); err == nil {
+				t.Errorf("listed a directory closed to others")
+			}
+			if err := tree.CheckAccess(&User{Name: "root", Admin: true}, "home/alice", permWrite); err != nil {
+				t.Errorf("admin was denied: %v", err)
+			}
+
+			tree.ActAs(bob)
+			defer tree.ActAs(nil)
+			if _, err := tree.CreateFile("home/alice/bob.txt", 0); err != nil {
+				t.Errorf("member of the group could not create a file: %v", err)
+			}
+		})
+
+	t.Run("only admins change the owner",
+		func(t *testing.T) {
+			tree.ActAs(alice)
+			if err := tree.Chown("home/alice/notes.txt", "bob", ""); err == nil {
+				t.Errorf("user gave away a file")
+			}
+			if err := tree.Chown("home/alice/notes.txt", "", "admins"); err == nil {
+				t.Errorf("user set a group it is not a member of")
+			}
+			if err := tree.Chown("home/alice/notes.txt", "", ""); err != nil {
+				t.Errorf("owner could not clear the group: %v", err)
+			}
+			tree.ActAs(nil)
+
+			tree.ActAs(&User{Name: adminName, Admin: true})
+			defer tree.ActAs(nil)
+			if err := tree.Chown("home/alice/notes.txt", "carol", "staff"); err != nil {
+				t.Fatal(err)
+			}
+			if err := tree.Chown("home/alice/notes.txt", "nobody", ""); err == nil {
+				t.Errorf("gave a file to a user, which does not exist")
+			}
+			if node := tree.Nodes["home/alice/notes.txt"]; node.Owner != "carol" || node.Group != "staff" {
+				t.Errorf("got %s:%s, want carol:staff", node.Owner, node.Group)
+			}
+		})
+
+	t.Run("trash of each user",
+		func(t *testing.T) {
+			// removals of users are replayed on top of the snapshot
+			f.snapshot(t)
+
+			tree.ActAs(bob)
+			trashed, err := tree.Trash("home/alice/bob.txt", time.Now(), table)
+			tree.ActAs(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if list := tree.TrashInfo(alice); len(list) != 0 {
+				t.Errorf("saw objects removed by another user: %v", list)
+			}
+			if list := tree.TrashInfo(bob); len(list) != 1 {
+				t.Errorf("got %d objects in the trash, want 1", len(list))
+			}
+
+			if trashed.Address != path.Join(trashDir, "bob", path.Base(trashed.Address)) {
+				t.Errorf("got /%s, want it in the trash of bob", trashed.Address)
+			}
+			if err := tree.CheckAccess(alice, trashed.Address, permRead); err == nil {
+				t.Errorf("read an object in the trash of another user")
+			}
+
+			tree.ActAs(carol)
+			if _, err := tree.PurgeTrashed(path.Base(trashed.Address)); err == nil {
+				t.Errorf("purged an object removed by another user")
+			}
+			if _, err := tree.RestoreTrashed("home/alice/bob.txt", table); err == nil {
+				t.Errorf("restored an object removed by another user")
+			}
+			tree.ActAs(nil)
+
+			tree.ActAs(bob)
+			defer tree.ActAs(nil)
+			if _, err := tree.RestoreTrashed("home/alice/bob.txt", table); err != nil {
+				t.Errorf("could not restore own object: %v", err)
+			}
+		})
+
+	t.Run("replay",
+		func(t *testing.T) {
+			recovered, _ := f.recover(t)
+
+			for address, want := range map[string]*Node{
+				"home/alice":           {Owner: "alice", Group: "staff", Mode: 0770},
+				"home/alice/notes.txt": {Owner: "carol", Group: "staff", Mode: defaultFileMode},
+				"home/alice/bob.txt":   {Owner: "bob", Group: "staff", Mode: defaultFileMode},
+				".trash/bob":           {Owner: "bob", Group: "", Mode: 0700},
+			} {
+				node, ok := recovered.Nodes[address]
+				if !ok {
+					t.Errorf("/%s was not recovered", address)
+					continue
+				}
+				if node.Owner != want.Owner || node.Group != want.Group || node.Mode != want.Mode {
+					t.Errorf("/%s: got %s:%s %o, want %s:%s %o", address, node.Owner, node.Group, node.Mode, want.Owner, want.Group, want.Mode)
+				}
+			}
+
+			if groups := recovered.Users["bob"].Groups; len(groups) != 1 || groups[0] != "staff" {
+				t.Errorf("got groups %v, want [staff]", groups)
+			}
+		})
+}
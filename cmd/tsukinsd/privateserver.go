@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
 	"log"
@@ -42,7 +43,7 @@ func (s *PoolInfo) HeartbeatManager(soft bool) {
 				s.ChangeStatus(peerId, liveStatus)
 				nextDead, deathTime = s.GetFSWithOldestPulse(soft)
 				//log.Printf("%v %v %d %v", soft, deathTime, nextDead, s.StorageNodes[peerId].Status)
-				log.Printf("active %v deathTime %v nextDead %v status %d peerid %v", s.Alive, deathTime, nextDead, s.StorageNodes[peerId].GetStatus(), peerId)
+				log.Printf("active %v deathTime %v nextDead %v status %d peerid %v", s.Alive, deathTime, nextDead, s.Node(peerId).GetStatus(), peerId)
 			} else if peerId == nextDead || nextDead == -1 {
 				nextDead, deathTime = s.GetFSWithOldestPulse(soft)
 				//log.Printf("soft %v deathTime %v nextDead %v status %d peerid %v", soft, deathTime, nextDead, s.StorageNodes[peerId].Status, peerId)
@@ -50,6 +51,12 @@ func (s *PoolInfo) HeartbeatManager(soft bool) {
 				nextDead, deathTime = s.GetFSWithOldestPulse(soft)
 			}
 		case <-time.After(deathTime):
+			if isPassive() {
+				// pulses are not received until the nameserver is in charge
+				deathTime = period
+				continue
+			}
+
 			if nextDead == -1 {
 				//deathTime = period
 				continue
@@ -78,8 +85,8 @@ func (s *PoolInfo) GetFSWithOldestPulse(soft bool) (int, time.Duration) {
 	}
 
 	oldestDuration := time.Duration(0)
-	for i, fs := range s.StorageNodes {
-		if since := time.Since(fs.LastPulse); since > oldestDuration && (soft && fs.GetStatus() == LIVE || !soft && fs.GetStatus() != DEAD) {
+	for i, fs := range s.Nodes() {
+		if since := fs.SincePulse(); since > oldestDuration && (soft && fs.GetStatus() == LIVE || !soft && fs.GetStatus() != DEAD) {
 			oldestDuration = since
 			oldest = i
 		}
@@ -88,68 +95,130 @@ func (s *PoolInfo) GetFSWithOldestPulse(soft bool) (int, time.Duration) {
 	return oldest, period - oldestDuration
 }
 
-func pulse(w http.ResponseWriter, r *http.Request) {
+// identify finds the fileserver that sent the request by the node ID it
+// sends along. Fileservers that send no ID are looked up by their host.
+func identify(r *http.Request) (*FileServerInfo, string) {
+	if nodeID := r.URL.Query().Get("node"); nodeID != "" {
+		return storages.GetByNodeID(nodeID), nodeID
+	}
+
 	remoteHost := strings.Split(r.RemoteAddr, ":")[0]
-	//remoteHost := r.Header.Get("addr")
-	unknown := true
-	for _, fs := range storages.StorageNodes {
-		if fs.PrivateHost == remoteHost {
-			// log.Printf("Received heart beat from: %s", remoteHost)
-			// race condition but it is ok
-			// last pulse is also used in GetFSWithOldestPulse() in different thread
-			fs.LastPulse = time.Now()
-			storages.HardPulseQueue <- fs.ID
-			storages.SoftPulseQueue <- fs.ID
-			unknown = false
-			break
-		}
+	return storages.GetByHost(remoteHost), remoteHost
+}
+
+func pulse(w http.ResponseWriter, r *http.Request) {
+	fs, sender := identify(r)
+	if fs == nil {
+		// the fileserver should register
+		log.Printf("Received heart beat from unknown fileserver: %s", sender)
+		w.WriteHeader(http.StatusNotFound)
+		return
 	}
-	if unknown {
-		log.Printf("Received heart beat from unknown host: %s", remoteHost)
+
+	// last pulse is also used in GetFSWithOldestPulse() in different thread
+	fs.Pulse()
+	if isPassive() {
+		// no one watches heartbeats until promotion or election
+		w.WriteHeader(http.StatusOK)
+		return
 	}
+
+	storages.HardPulseQueue <- fs.ID
+	storages.SoftPulseQueue <- fs.ID
+
 	w.WriteHeader(http.StatusOK)
+}
 
+type RegisterMessage struct {
+	NodeID      string
+	PublicHost  string
+	PrivateHost string
+	Available   int
+}
+
+func register(w http.ResponseWriter, r *http.Request) {
+	var msg RegisterMessage
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil || msg.NodeID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if msg.PrivateHost == "" {
+		msg.PrivateHost = strings.Split(r.RemoteAddr, ":")[0]
+	}
+	if msg.PublicHost == "" {
+		msg.PublicHost = msg.PrivateHost
+	}
+
+	// the fileserver must be reachable and accept us as its NS
+	available, nodeID, ok := ProbeFServer(msg.PrivateHost, conf.Namenode.FSPrivatePort)
+	if !ok || nodeID != msg.NodeID {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	fs, isNew := storages.Register(msg.NodeID, msg.PrivateHost, msg.PublicHost, available)
+	if isNew {
+		treemu.Lock()
+		ct.Relink(fs)
+		treemu.Unlock()
+		log.Printf("Fileserver %s joined the pool as %d (%s, public %s)", fs.NodeID, fs.ID, fs.PrivateHost, fs.PublicHost)
+	} else {
+		log.Printf("Fileserver %s (%d) registered again at %s, public %s", fs.NodeID, fs.ID, fs.PrivateHost, fs.PublicHost)
+	}
+
+	w.WriteHeader(http.StatusOK)
 }
 
 func confirmChunk(w http.ResponseWriter, r *http.Request) {
+	treemu.Lock()
+	defer treemu.Unlock()
+
 	// chunk is ready at r.RemoteAddr
 	// we can set it as ready on remote addr and start sending to other servers
+	if isPassive() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
 	chunkID := r.URL.Query().Get("chunkID")
-	//remoteAddr := r.Header.Get("addr")
-	remoteAddr := strings.Split(r.RemoteAddr, ":")[0]
-	log.Printf("Got ready chunk %s from %s", chunkID, remoteAddr)
+	fs, sender := identify(r)
+	log.Printf("Got ready chunk %s from %s", chunkID, sender)
+
+	if fs == nil {
+		log.Printf("Fileserver %s is unknown; skipping", sender)
+		return
+	}
 
 	chunk, ok := ct.Table[chunkID]
-	chunk.Status = OK
 	if !ok {
-		// here send request to remove chunk since it does not exist on the ns
+		// the fileserver will learn about it on inventory
 		log.Printf("Chunk %s not found; skipping", chunkID)
 		return
 	}
 
-	_, ok = chunk.Statuses[remoteAddr]
+	_, ok = chunk.Statuses[fs.NodeID]
 
 	if !ok {
-		log.Printf("Got chunk %s from %s but it should not be there...", chunkID, remoteAddr)
+		log.Printf("Got chunk %s from %s but it should not be there...", chunkID, sender)
 		return
 	}
 
-	chunk.Statuses[remoteAddr] = OK
+	t.ConfirmReplica(chunk, fs.NodeID)
 
 	file, ok := t.GetNodeByAddress(chunk.File)
 	if !ok {
 		log.Printf("File %s not found; skipping", chunk.File)
 		return
 	}
-	delete(file.Pending, chunkID)
+	uploads.Renew(file)
 
-	chunk.ReadyReplicas += 1
 	remainingReplicas := conf.Namenode.Replicas - chunk.AllReplicas
 
 	senders := []string{}
-	for fs, status := range chunk.Statuses {
+	for nodeID, status := range chunk.Statuses {
 		if status == OK {
-			senders = append(senders, fs)
+			senders = append(senders, nodeID)
 			if len(senders) == remainingReplicas {
 				break
 			}
@@ -165,13 +234,51 @@ func confirmChunk(w http.ResponseWriter, r *http.Request) {
 	}
 
 	for i, receiver := range receivers {
-		go Replicate(chunk, senders[i], receiver)
-		log.Printf("Sending chunk %s from %s to %v", chunkID, senders[i], receiver)
+		senderHost := chunk.FServers[senders[i]].PrivateHost
+		go Replicate(chunk, senderHost, receiver)
+		log.Printf("Sending chunk %s from %s to %v", chunkID, senderHost, receiver)
 		chunk.AddFSToChunk(receiver)
 	}
 }
 
+func inventory(w http.ResponseWriter, r *http.Request) {
+	treemu.RLock()
+	defer treemu.RUnlock()
+
+	// the fileserver reports all the chunks it stores
+	// and gets back the ones it may delete
+	if isPassive() {
+		// the chunk table of a standby or a follower may lag behind
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	fs, sender := identify(r)
+	if fs == nil {
+		log.Printf("Received inventory from unknown fileserver: %s", sender)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var chunks []string
+	if err := json.NewDecoder(r.Body).Decode(&chunks); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	orphans := ct.Orphans(fs.NodeID, chunks)
+	if len(orphans) != 0 {
+		log.Printf("%s stores %d orphan chunks", sender, len(orphans))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orphans)
+}
+
 func printTree(w http.ResponseWriter, r *http.Request) {
+	treemu.RLock()
+	defer treemu.RUnlock()
+
 	w.WriteHeader(http.StatusOK)
 
 	t.PrintTreeStruct()
@@ -179,15 +286,47 @@ func printTree(w http.ResponseWriter, r *http.Request) {
 }
 
 func save(w http.ResponseWriter, r *http.Request) {
-	saveAll()
+	treemu.Lock()
+	defer treemu.Unlock()
+
+	var err error
+	if cluster != nil {
+		err = cluster.Save()
+	} else {
+		err = t.Snapshot(ct)
+	}
+
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
 }
 
-func StartPrivateServer() {
-	r :=  mux.NewRouter()
+func privateRouter() *mux.Router {
+	r := mux.NewRouter()
 	r.HandleFunc("/pulse", pulse).Methods("GET", "POST")
+	r.HandleFunc("/register", register).Methods("POST")
 	r.HandleFunc("/confirm/receivedChunk", confirmChunk).Methods("GET", "POST")
+	r.HandleFunc("/inventory", inventory).Methods("POST")
 	r.HandleFunc("/print", printTree).Methods("GET", "POST")
-	r.HandleFunc("/save", save).Methods("GET", "POST")
+	r.Handle("/save", authenticate(adminOnly(save))).Methods("GET", "POST")
+	r.HandleFunc("/oplog", clusterOnly(oplog)).Methods("GET")
+	r.HandleFunc("/snapshot", clusterOnly(snapshot)).Methods("GET")
+	r.Handle("/promote", authenticate(adminOnly(promote))).Methods("GET", "POST")
+
+	r.Use(snapshotWhenDue)
+
+	if cluster != nil {
+		r.HandleFunc("/raft/vote", cluster.VoteHandler).Methods("POST")
+		r.HandleFunc("/raft/append", cluster.AppendHandler).Methods("POST")
+		r.HandleFunc("/raft/snapshot", cluster.SnapshotHandler).Methods("POST")
+	}
+
+	return r
+}
+
+func StartPrivateServer() {
+	r := privateRouter()
 
 	http.ListenAndServe(fmt.Sprintf("%s:%d", conf.Namenode.Host, conf.Namenode.PrivatePort), r)
 }
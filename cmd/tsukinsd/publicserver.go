@@ -2,29 +2,50 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"log"
 	"math"
 	"net/http"
+	"path"
 	"strconv"
+	"strings"
+	"time"
 )
 
 
 func initTree(w http.ResponseWriter, r *http.Request) {
-	t = InitTree(conf.Namenode)
-	storages = InitFServers(conf)
-	saveAll()
+	treemu.Lock()
+	defer treemu.Unlock()
+
+	// the pool is kept, since fileservers registered at runtime are not in config
+	// chunks of the old tree are collected by fileservers as orphans
+	t.Init(ct)
+	uploads.Reset()
+
+	available := 0
+	for _, fs := range storages.Nodes() {
+		available += fs.Available
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Message: fmt.Sprintf("The tree is initialized; available space: %.2f", )})
+	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Message: fmt.Sprintf("The tree is initialized; available space: %.2f MB", float64(available)/1024/1024)})
 }
 
 func ls(w http.ResponseWriter, r *http.Request) {
+	treemu.RLock()
+	defer treemu.RUnlock()
+
 	w.Header().Set("Content-Type", "application/json")
 	address := r.URL.Query().Get("address")
 	list, err := t.LS(address)
+	if err == nil {
+		// the listed directory, if the address is a link
+		resolved, _ := t.Resolve(address)
+		err = t.CheckAccess(RequestUser(r), resolved, permRead|permExec)
+	}
 	if err == nil {
 		json.NewEncoder(w).Encode(&ClientMessage{
 			Status:  "OK",
@@ -37,6 +58,11 @@ func ls(w http.ResponseWriter, r *http.Request) {
 }
 
 func mkdir(w http.ResponseWriter, r *http.Request) {
+	treemu.Lock()
+	defer treemu.Unlock()
+	t.ActAs(RequestUser(r))
+	defer t.ActAs(nil)
+
 	w.Header().Set("Content-Type", "application/json")
 	dirName := r.URL.Query().Get("address")
 	err := t.CreateDirectory(dirName)
@@ -51,6 +77,11 @@ func mkdir(w http.ResponseWriter, r *http.Request) {
 }
 
 func touch(w http.ResponseWriter, r *http.Request) {
+	treemu.Lock()
+	defer treemu.Unlock()
+	t.ActAs(RequestUser(r))
+	defer t.ActAs(nil)
+
 	w.Header().Set("Content-Type", "application/json")
 	address := r.URL.Query().Get("address")
 	_, err := t.CreateFile(address, 0)
@@ -65,9 +96,15 @@ func touch(w http.ResponseWriter, r *http.Request) {
 }
 
 func cd(w http.ResponseWriter, r *http.Request) {
+	treemu.RLock()
+	defer treemu.RUnlock()
+
 	w.Header().Set("Content-Type", "application/json")
 	address := r.URL.Query().Get("address")
 	address, err := t.CD(address)
+	if err == nil {
+		err = t.CheckAccess(RequestUser(r), address, permExec)
+	}
 	if err == nil {
 		json.NewEncoder(w).Encode(&ClientMessage{
 			Status:  "OK",
@@ -81,6 +118,11 @@ func cd(w http.ResponseWriter, r *http.Request) {
 }
 
 func upload(w http.ResponseWriter, r *http.Request) {
+	treemu.Lock()
+	defer treemu.Unlock()
+	t.ActAs(RequestUser(r))
+	defer t.ActAs(nil)
+
 	w.Header().Set("Content-Type", "application/json")
 
 	sizeStr := r.URL.Query().Get("size")
@@ -94,18 +136,45 @@ func upload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	file, err := t.CreateFile(address, int(size))
+	if storages.Size() == 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: "no fileservers available"})
+		return
+	}
+
+	uploadID := generateToken()
+
+	// an existing file is overwritten atomically, once the new version is
+	// committed; a new file is hidden until then
+	var file *Node
+	command := "upload"
+	if r.URL.Query().Get("overwrite") == "true" && t.FileExists(address) {
+		file, err = t.StageOverwrite(address, int(size), uploadID)
+		command = "overwrite"
+	} else if file, err = t.CreateFile(address, int(size)); err == nil {
+		file.UploadID = uploadID
+	}
+
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
 		return
 	}
 
-	chunkNum := int(math.Ceil(float64(size) / 1024 / 1024 / float64(conf.Namenode.ChunkSize)))
-	var chunks []ChunkMessage
+	grantUpload(w, command, file, uploadID, size)
+}
 
+// grantUpload assigns chunks for size bytes of the upload to fileservers,
+// starts the upload session and replies with the chunks and the token.
+func grantUpload(w http.ResponseWriter, command string, file *Node, uploadID string, size int64) {
+	written := file.Uploading(uploadID)
 	token := generateToken()
 
+	chunkNum := int(math.Ceil(float64(size) / 1024 / 1024 / float64(conf.Namenode.ChunkSize)))
+	var chunks []ChunkMessage
+	var chunkIDs []string
+	var nodeIDs []string
+
 	//fmt.Printf("%q", string(tokenBytes))
 
 	inversed := map[string][]string{}
@@ -120,26 +189,23 @@ func upload(w http.ResponseWriter, r *http.Request) {
 			ChunkID: chunkID.String(),
 			StorageIP: fmt.Sprintf("%s:%d", storageNode.PublicHost, conf.Namenode.FSPublicPort)})
 
-		file.Chunks = append(file.Chunks, chunkID.String())
-		file.Pending[chunkID.String()] = true
-
-		chunk, _ :=ct.AddChunk(chunkID.String(), file.Address, storageNode)
-		fmt.Printf("%v\n", ct)
+		ct.AssignChunk(written, chunkID.String(), storageNode)
 		address := fmt.Sprintf("%s:%d", storageNode.PrivateHost, storageNode.Port)
 
-		ct.ivmu.Lock()
-		ct.InvertedTable[storageNode.PrivateHost] = append(ct.InvertedTable[storageNode.PrivateHost], chunk)
-		ct.ivmu.Unlock()
-
 		inversed[address] = append(inversed[address], chunkID.String())
+		chunkIDs = append(chunkIDs, chunkID.String())
+		nodeIDs = append(nodeIDs, storageNode.NodeID)
 	}
 
+	uploads.Begin(uploadID, file, t.acting, token, inversed)
+	t.Commit(LogRecord{Command: command, Args: []string{file.Address, uploadID}, Size: int(size), Chunks: chunkIDs, Nodes: nodeIDs})
+
 	//fmt.Printf("%v", inversed)
 	//fmt.Printf("%v\n", t)
 	//fmt.Printf("%v\n", ct)
-	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Message: "Go upload there", Chunks: chunks, Token: token})
+	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Message: "Go upload there", Chunks: chunks, Token: token, UploadID: uploadID})
 
-	go ExpectChunksFromClient(inversed, token)
+	t.AfterCommit(func() { ExpectChunksFromClient(inversed, token) })
 	// requests to fs's /expect/write?token JSON {chunks: []int}
 	// confirmation from fs's /confirm?chunkID=<chunkID>
 	// or client says /fserror?token=<token> <- for now error on client
@@ -150,11 +216,103 @@ func upload(w http.ResponseWriter, r *http.Request) {
 	// fs works like client now
 }
 
-func download(w http.ResponseWriter, r *http.Request) {
+// appendFile extends the file. The appended chunks follow the chunks of the
+// file, its last chunk may be shorter than the others. The file keeps its
+// size, until the upload is committed.
+func appendFile(w http.ResponseWriter, r *http.Request) {
+	treemu.Lock()
+	defer treemu.Unlock()
+	t.ActAs(RequestUser(r))
+	defer t.ActAs(nil)
+
 	w.Header().Set("Content-Type", "application/json")
 
 	address := r.URL.Query().Get("address")
-	file, err := t.GetFile(address)
+	size, err := strconv.ParseInt(r.URL.Query().Get("size"), 10, 32)
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	if storages.Size() == 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: "no fileservers available"})
+		return
+	}
+
+	uploadID := generateToken()
+
+	file, err := t.StageAppend(address, int(size), uploadID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+	// the new version shares the chunks of the file
+	ct.Ref(file.Chunks)
+
+	grantUpload(w, "append", file, uploadID, size)
+}
+
+// uploadStatus is the status of the failed operation on the upload, unless
+// the upload belongs to another user.
+func uploadStatus(err error, status int) int {
+	if errors.Is(err, errForeignUpload) {
+		return http.StatusForbidden
+	}
+
+	return status
+}
+
+func commitUpload(w http.ResponseWriter, r *http.Request) {
+	treemu.Lock()
+	defer treemu.Unlock()
+	t.ActAs(RequestUser(r))
+	defer t.ActAs(nil)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	file, err := uploads.Commit(r.URL.Query().Get("id"), t, ct)
+	if err != nil {
+		// the client retries, until chunks are confirmed by fileservers
+		w.WriteHeader(uploadStatus(err, http.StatusConflict))
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{
+		Status:  "OK",
+		Message: fmt.Sprintf("/%s file successfully uploaded", file.Address)})
+}
+
+func abortUpload(w http.ResponseWriter, r *http.Request) {
+	treemu.Lock()
+	defer treemu.Unlock()
+	t.ActAs(RequestUser(r))
+	defer t.ActAs(nil)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := uploads.Abort(r.URL.Query().Get("id"), t, ct); err != nil {
+		w.WriteHeader(uploadStatus(err, http.StatusBadRequest))
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Message: "the upload is aborted"})
+}
+
+func download(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	token := generateToken()
+	chunks, hosts, err := downloadChunks(r)
+	if err == nil {
+		// fileservers are asked outside of the lock
+		err = ExpectReads(hosts, token)
+	}
 
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -162,21 +320,49 @@ func download(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Message: "go download there:", Chunks: chunks, Token: token})
+}
+
+// downloadChunks selects a fileserver for every chunk of the requested file
+// and groups the chunks by the private addresses of fileservers, which are
+// to expect the token.
+func downloadChunks(r *http.Request) ([]ChunkMessage, map[string][]string, error) {
+	treemu.RLock()
+	defer treemu.RUnlock()
+
+	address := r.URL.Query().Get("address")
+	file, err := t.GetFile(address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// tokens are granted only to those who may read the file
+	if err := t.CheckAccess(RequestUser(r), file.Address, permRead); err != nil {
+		return nil, nil, err
+	}
+
 	chunks := file.Chunks
+	if n := r.URL.Query().Get("version"); n != "" {
+		version, err := versionOf(file, n)
+		if err != nil {
+			return nil, nil, err
+		}
+		chunks = version.Chunks
+	}
+
 	downloadChunks := []ChunkMessage{}
+	hosts := map[string][]string{}
 
 	for _, chunkID := range chunks {
 		chunk, ok := ct.Table[chunkID]
 		if !ok {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: fmt.Sprintf("the file is broken; no chunk: %s", chunkID)})
-			return
+			return nil, nil, fmt.Errorf("the file is broken; no chunk: %s", chunkID)
 		}
 
 		ready := map[string]*FileServerInfo{}
-		for address, fs := range chunk.FServers {
-			if chunk.Statuses[address] == OK {
-				ready[address] = fs
+		for nodeID, fs := range chunk.FServers {
+			if chunk.Statuses[nodeID] == OK {
+				ready[nodeID] = fs
 			}
 		}
 
@@ -184,45 +370,253 @@ func download(w http.ResponseWriter, r *http.Request) {
 
 		if err != nil {
 			// maybe set this file as corrupted?? but it should not happen
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
-			return
+			return nil, nil, err
 		}
 
 		downloadChunks = append(downloadChunks, ChunkMessage{ChunkID: chunkID, StorageIP: fmt.Sprintf("%s:%d", fs.PublicHost, conf.Namenode.FSPublicPort)})
+
+		host := fmt.Sprintf("%s:%d", fs.PrivateHost, fs.Port)
+		hosts[host] = append(hosts[host], chunkID)
 	}
 
-	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Message: "go download there:", Chunks: downloadChunks})
+	return downloadChunks, hosts, nil
 }
 
+// reupload is called by a client that failed to write a chunk of the upload,
+// the chunk is moved to another fileserver.
 func reupload(w http.ResponseWriter, r *http.Request) {
-	// todo
+	treemu.Lock()
+	defer treemu.Unlock()
+	t.ActAs(RequestUser(r))
+	defer t.ActAs(nil)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	id := r.URL.Query().Get("id")
+	chunkID := r.URL.Query().Get("chunkID")
+
+	fs, grant, err := uploads.Reupload(id, chunkID, t, ct, storages)
+	if err != nil {
+		w.WriteHeader(uploadStatus(err, http.StatusBadRequest))
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	log.Printf("Chunk %s of upload %s is moved to %s", chunkID, id, fs.PrivateHost)
+
+	chunks := []ChunkMessage{{
+		ChunkID:   chunkID,
+		StorageIP: fmt.Sprintf("%s:%d", fs.PublicHost, conf.Namenode.FSPublicPort)}}
+	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Message: "Go upload there", Chunks: chunks, Token: grant.Token, UploadID: id})
+
+	t.AfterCommit(func() { ExpectChunksFromClient(grant.Hosts, grant.Token) })
+}
+
+func versionOf(file *Node, n string) (*Version, error) {
+	number, err := strconv.Atoi(n)
+	if err != nil {
+		return nil, fmt.Errorf("wrong version %q", n)
+	}
+
+	return file.Version(number)
+}
+
+func versions(w http.ResponseWriter, r *http.Request) {
+	treemu.RLock()
+	defer treemu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	list, err := t.VersionsInfo(r.URL.Query().Get("address"))
+	if err == nil {
+		file, _ := t.GetFile(r.URL.Query().Get("address"))
+		err = t.CheckAccess(RequestUser(r), file.Address, permRead)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Objects: list})
+}
+
+func restoreVersion(w http.ResponseWriter, r *http.Request) {
+	treemu.Lock()
+	defer treemu.Unlock()
+	t.ActAs(RequestUser(r))
+	defer t.ActAs(nil)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	address := r.URL.Query().Get("address")
+	n, err := strconv.Atoi(r.URL.Query().Get("version"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	restored, released, err := t.RestoreVersion(address, n, time.Now())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	// the file references chunks of the version, before the replaced ones
+	// are released
+	ct.Ref(restored.Chunks)
+	t.AfterCommit(ct.purging(ct.Unref(released)))
+
+	json.NewEncoder(w).Encode(&ClientMessage{
+		Status:  "OK",
+		Message: fmt.Sprintf("/%s version %d of %s restored", address, n, restored.SavedOn.Format(time.RFC3339))})
+}
+
+func keepVersions(w http.ResponseWriter, r *http.Request) {
+	treemu.Lock()
+	defer treemu.Unlock()
+	t.ActAs(RequestUser(r))
+	defer t.ActAs(nil)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	address := r.URL.Query().Get("address")
+	keep, err := strconv.Atoi(r.URL.Query().Get("count"))
+	if err == nil {
+		err = t.KeepVersions(address, keep)
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{
+		Status:  "OK",
+		Message: fmt.Sprintf("files of /%s keep %d versions", address, keep)})
+}
+
+func dirSnapshots(w http.ResponseWriter, r *http.Request) {
+	treemu.RLock()
+	defer treemu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Objects: t.DirSnapshots()})
+}
+
+func createDirSnapshot(w http.ResponseWriter, r *http.Request) {
+	treemu.Lock()
+	defer treemu.Unlock()
+	t.ActAs(RequestUser(r))
+	defer t.ActAs(nil)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	address := r.URL.Query().Get("address")
+	name := r.URL.Query().Get("name")
+
+	frozen, err := t.CreateDirSnapshot(address, name, time.Now())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	// the snapshot pins the chunks of files
+	ct.Ref(frozen.AllChunks())
+
+	json.NewEncoder(w).Encode(&ClientMessage{
+		Status:  "OK",
+		Message: fmt.Sprintf("/%s/ snapshot of /%s successfully created", frozen.Address, address)})
+}
+
+func removeDirSnapshot(w http.ResponseWriter, r *http.Request) {
+	treemu.Lock()
+	defer treemu.Unlock()
+	t.ActAs(RequestUser(r))
+	defer t.ActAs(nil)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	frozen, err := t.RemoveDirSnapshot(r.URL.Query().Get("name"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{
+		Status:  "OK",
+		Message: fmt.Sprintf("/%s/ snapshot successfully removed", frozen.Address)})
+
+	// purge chunks, unless files or other snapshots still use them
+	t.AfterCommit(ct.purging(ct.Unref(frozen.AllChunks())))
 }
 
 func rmfile(w http.ResponseWriter, r *http.Request) {
+	treemu.Lock()
+	defer treemu.Unlock()
+	t.ActAs(RequestUser(r))
+	defer t.ActAs(nil)
+
 	w.Header().Set("Content-Type", "application/json")
 
 	address := r.URL.Query().Get("address")
 
-	file, err := t.RemoveFile(address)
+	// the new version of the file would have nothing to replace
+	if cleaned, _ := CleanAddress(address); t.FileExists(cleaned) {
+		if staged := t.Nodes[cleaned].Staged; staged != nil && t.allowEntries(cleaned) == nil {
+			uploads.Rollback(staged.UploadID, t, ct)
+		}
+	}
+
+	var file *Node
+	var err error
+	if cleaned, _ := CleanAddress(address); conf.Namenode.TrashRetention > 0 && t.FileExists(cleaned) {
+		file, err = t.Trash(address, time.Now(), ct)
+	} else {
+		file, err = t.RemoveFile(address)
+	}
 
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
 		return
 	}
+
+	if file.TrashedFrom != "" {
+		json.NewEncoder(w).Encode(&ClientMessage{
+			Status:  "OK",
+			Message: fmt.Sprintf("file moved to the trash as %s", path.Base(file.Address))})
+		return
+	}
 	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Message: "file successfully removed"})
 
-	// purge chunks
-	go ct.PurgeChunks(file.Chunks)
+	// purge chunks, unless copies of the file still use them
+	t.AfterCommit(ct.purging(ct.Unref(append(file.VersionChunks(), file.Chunks...))))
 }
 
 func rmdir(w http.ResponseWriter, r *http.Request) {
+	treemu.Lock()
+	defer treemu.Unlock()
+	t.ActAs(RequestUser(r))
+	defer t.ActAs(nil)
+
 	w.Header().Set("Content-Type", "application/json")
 
 	address := r.URL.Query().Get("address")
 
-	dir, err := t.RemoveDirectory(address)
+	var dir *Node
+	var err error
+	if cleaned, _ := CleanAddress(address); conf.Namenode.TrashRetention > 0 && t.DirectoryExists(cleaned) {
+		dir, err = t.Trash(address, time.Now(), ct)
+	} else {
+		dir, err = t.RemoveDirectory(address)
+	}
 
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -230,18 +624,40 @@ func rmdir(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if dir.TrashedFrom != "" {
+		json.NewEncoder(w).Encode(&ClientMessage{
+			Status:  "OK",
+			Message: fmt.Sprintf("/%s/ directory moved to the trash as %s", dir.TrashedFrom, path.Base(dir.Address))})
+		return
+	}
+
 	json.NewEncoder(w).Encode(&ClientMessage{
+		Status:  "OK",
 		Message: fmt.Sprintf("%s directory successfully removed", dir.Address),
 	})
+
+	// purge chunks of the files, unless copies outside still use them
+	t.AfterCommit(ct.purging(ct.Unref(dir.HeldChunks())))
 }
 
-func info(w http.ResponseWriter, r *http.Request) {
+func trash(w http.ResponseWriter, r *http.Request) {
+	treemu.RLock()
+	defer treemu.RUnlock()
+
 	w.Header().Set("Content-Type", "application/json")
 
-	address := r.URL.Query().Get("address")
+	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Objects: t.TrashInfo(RequestUser(r))})
+}
 
-	info, err := t.NodeInfo(address)
+func restoreTrashed(w http.ResponseWriter, r *http.Request) {
+	treemu.Lock()
+	defer treemu.Unlock()
+	t.ActAs(RequestUser(r))
+	defer t.ActAs(nil)
+
+	w.Header().Set("Content-Type", "application/json")
 
+	node, err := t.RestoreTrashed(r.URL.Query().Get("ref"), ct)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
@@ -249,30 +665,570 @@ func info(w http.ResponseWriter, r *http.Request) {
 	}
 
 	json.NewEncoder(w).Encode(&ClientMessage{
-		Message: info,
-	})
+		Status:  "OK",
+		Message: fmt.Sprintf("/%s successfully restored", node.Address)})
 }
 
-func getChunkSize(w http.ResponseWriter, r *http.Request) {
-	responseBody := []byte(strconv.Itoa(conf.Namenode.ChunkSize * 1024 * 1024))
-	w.Write(responseBody)
+func purgeTrashed(w http.ResponseWriter, r *http.Request) {
+	treemu.Lock()
+	defer treemu.Unlock()
+	t.ActAs(RequestUser(r))
+	defer t.ActAs(nil)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	node, err := t.PurgeTrashed(r.URL.Query().Get("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{
+		Status:  "OK",
+		Message: fmt.Sprintf("/%s successfully purged", node.TrashedFrom)})
+
+	// purge chunks, unless copies or snapshots still use them
+	t.AfterCommit(ct.purging(ct.Unref(node.HeldChunks())))
 }
 
-func StartPublicServer() {
-	r := mux.NewRouter()
-	r.HandleFunc("/init", initTree).Methods("GET")
-	r.HandleFunc("/ls", ls).Methods("GET")
-	r.HandleFunc("/mkdir", mkdir).Methods("GET")
-	r.HandleFunc("/touch", touch).Methods("GET")
-	r.HandleFunc("/cd", cd).Methods("GET")
-	r.HandleFunc("/upload", upload).Methods("GET")
-	r.HandleFunc("/download", download).Methods("GET")
-	r.HandleFunc("/reupload", reupload).Methods("GET")
-	r.HandleFunc("/rmfile", rmfile).Methods("GET")
-	r.HandleFunc("/rmdir", rmdir).Methods("GET")
-	r.HandleFunc("/info", info).Methods("GET")
-	r.HandleFunc("/getChunkSize", getChunkSize).Methods("GET")
+func whoami(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user := RequestUser(r)
+	role := "user"
+	if user.Admin {
+		role = "admin"
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Message: fmt.Sprintf("%s\t%s", user.Name, role)})
+}
+
+// account returns the account named in the request, the one signed in by
+// default. Only admins may name other accounts.
+func account(r *http.Request) (string, error) {
+	user := RequestUser(r)
 
+	name := r.FormValue("name")
+	if name == "" || name == user.Name {
+		return user.Name, nil
+	}
+	if !user.Admin {
+		return "", fmt.Errorf("only admins may manage other accounts")
+	}
+
+	return name, nil
+}
+
+func users(w http.ResponseWriter, r *http.Request) {
+	treemu.RLock()
+	defer treemu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Objects: t.UsersInfo()})
+}
+
+func addUser(w http.ResponseWriter, r *http.Request) {
+	treemu.Lock()
+	defer treemu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	name := r.FormValue("name")
+	admin := r.FormValue("admin") == "true"
+
+	if err := t.AddUser(name, r.FormValue("password"), admin); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{
+		Status:  "OK",
+		Message: fmt.Sprintf("user %s successfully created", name)})
+}
+
+func removeUser(w http.ResponseWriter, r *http.Request) {
+	treemu.Lock()
+	defer treemu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	name := r.FormValue("name")
+	if err := t.RemoveUser(name); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{
+		Status:  "OK",
+		Message: fmt.Sprintf("user %s successfully removed", name)})
+}
+
+func setPassword(w http.ResponseWriter, r *http.Request) {
+	treemu.Lock()
+	defer treemu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	name, err := account(r)
+	if err == nil {
+		err = t.SetPassword(name, r.FormValue("password"))
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{
+		Status:  "OK",
+		Message: fmt.Sprintf("password of %s successfully changed", name)})
+}
+
+func keys(w http.ResponseWriter, r *http.Request) {
+	treemu.RLock()
+	defer treemu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	name, err := account(r)
+	var list []string
+	if err == nil {
+		list, err = t.KeysInfo(name)
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Objects: list})
+}
+
+func addKey(w http.ResponseWriter, r *http.Request) {
+	treemu.Lock()
+	defer treemu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	name, err := account(r)
+	var key string
+	var apiKey *APIKey
+	if err == nil {
+		key, apiKey, err = t.AddKey(name, time.Now())
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{
+		Status:  "OK",
+		Message: fmt.Sprintf("key %s of %s successfully created", apiKey.ID, name),
+		Token:   key})
+}
+
+func removeKey(w http.ResponseWriter, r *http.Request) {
+	treemu.Lock()
+	defer treemu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	name, err := account(r)
+	if err == nil {
+		err = t.RemoveKey(name, r.FormValue("id"))
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{
+		Status:  "OK",
+		Message: fmt.Sprintf("key %s of %s successfully revoked", r.FormValue("id"), name)})
+}
+
+func chmod(w http.ResponseWriter, r *http.Request) {
+	treemu.Lock()
+	defer treemu.Unlock()
+	t.ActAs(RequestUser(r))
+	defer t.ActAs(nil)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	address := r.URL.Query().Get("address")
+	mode, err := strconv.ParseUint(r.URL.Query().Get("mode"), 8, 32)
+	if err == nil {
+		err = t.Chmod(address, uint32(mode))
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{
+		Status:  "OK",
+		Message: fmt.Sprintf("/%s mode changed to %03o", address, mode)})
+}
+
+func chown(w http.ResponseWriter, r *http.Request) {
+	treemu.Lock()
+	defer treemu.Unlock()
+	t.ActAs(RequestUser(r))
+	defer t.ActAs(nil)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	address := r.URL.Query().Get("address")
+	owner := r.URL.Query().Get("owner")
+	group := r.URL.Query().Get("group")
+	// the group is kept unless it is given, as chown does
+	if _, ok := r.URL.Query()["group"]; !ok {
+		if cleaned, _ := CleanAddress(address); t.Nodes[cleaned] != nil {
+			group = t.Nodes[cleaned].Group
+		}
+	}
+
+	if err := t.Chown(address, owner, group); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{
+		Status:  "OK",
+		Message: fmt.Sprintf("/%s owner changed to %s:%s", address, owner, group)})
+}
+
+func setGroups(w http.ResponseWriter, r *http.Request) {
+	treemu.Lock()
+	defer treemu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	name := r.FormValue("name")
+	groups := []string{}
+	if list := r.FormValue("groups"); list != "" {
+		groups = strings.Split(list, ",")
+	}
+
+	if err := t.SetGroups(name, groups); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{
+		Status:  "OK",
+		Message: fmt.Sprintf("groups of %s set to %v", name, groups)})
+}
+
+func setQuota(w http.ResponseWriter, r *http.Request) {
+	treemu.Lock()
+	defer treemu.Unlock()
+	t.ActAs(RequestUser(r))
+	defer t.ActAs(nil)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	address := r.URL.Query().Get("address")
+	bytes, err := strconv.ParseInt(r.URL.Query().Get("bytes"), 10, 64)
+	var objects int
+	if err == nil {
+		objects, err = strconv.Atoi(r.URL.Query().Get("objects"))
+	}
+	if err == nil {
+		err = t.SetQuota(address, bytes, objects)
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{
+		Status:  "OK",
+		Message: fmt.Sprintf("quota of /%s set to %d bytes, %d objects", address, bytes, objects)})
+}
+
+func symlink(w http.ResponseWriter, r *http.Request) {
+	treemu.Lock()
+	defer treemu.Unlock()
+	t.ActAs(RequestUser(r))
+	defer t.ActAs(nil)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	address := r.URL.Query().Get("address")
+	target := r.URL.Query().Get("target")
+
+	if _, err := t.CreateSymlink(address, target); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{
+		Status:  "OK",
+		Message: fmt.Sprintf("/%s links to %s", address, target)})
+}
+
+func readlink(w http.ResponseWriter, r *http.Request) {
+	treemu.RLock()
+	defer treemu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	address := r.URL.Query().Get("address")
+	target, err := t.Readlink(address)
+	if err == nil {
+		err = t.CheckAccess(RequestUser(r), address, 0)
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Message: target})
+}
+
+func xattrs(w http.ResponseWriter, r *http.Request) {
+	treemu.RLock()
+	defer treemu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	address := r.URL.Query().Get("address")
+	list, err := t.XattrsInfo(address)
+	if err == nil {
+		err = t.CheckAccess(RequestUser(r), address, permRead)
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Objects: list})
+}
+
+func getXattr(w http.ResponseWriter, r *http.Request) {
+	treemu.RLock()
+	defer treemu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	address := r.URL.Query().Get("address")
+	value, err := t.GetXattr(address, r.URL.Query().Get("name"))
+	if err == nil {
+		err = t.CheckAccess(RequestUser(r), address, permRead)
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Message: value})
+}
+
+func setXattr(w http.ResponseWriter, r *http.Request) {
+	treemu.Lock()
+	defer treemu.Unlock()
+	t.ActAs(RequestUser(r))
+	defer t.ActAs(nil)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// values may be long, they are sent in the body
+	address := r.FormValue("address")
+	name := r.FormValue("name")
+
+	if err := t.SetXattr(address, name, r.FormValue("value")); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{
+		Status:  "OK",
+		Message: fmt.Sprintf("attribute %s of /%s set", name, address)})
+}
+
+func removeXattr(w http.ResponseWriter, r *http.Request) {
+	treemu.Lock()
+	defer treemu.Unlock()
+	t.ActAs(RequestUser(r))
+	defer t.ActAs(nil)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	address := r.URL.Query().Get("address")
+	name := r.URL.Query().Get("name")
+
+	if err := t.RemoveXattr(address, name); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{
+		Status:  "OK",
+		Message: fmt.Sprintf("attribute %s of /%s removed", name, address)})
+}
+
+func cp(w http.ResponseWriter, r *http.Request) {
+	treemu.Lock()
+	defer treemu.Unlock()
+	t.ActAs(RequestUser(r))
+	defer t.ActAs(nil)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	from := r.URL.Query().Get("from")
+	to := r.URL.Query().Get("to")
+
+	var copied *Node
+	var err error
+	if t.DirectoryExists(from) {
+		copied, err = t.CopyDirectory(from, to)
+	} else {
+		copied, err = t.CopyFile(from, to)
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+	ct.Ref(copied.AllChunks())
+
+	json.NewEncoder(w).Encode(&ClientMessage{
+		Status:  "OK",
+		Message: fmt.Sprintf("%s successfully copied to %s", from, copied.Address)})
+}
+
+func mv(w http.ResponseWriter, r *http.Request) {
+	treemu.Lock()
+	defer treemu.Unlock()
+	t.ActAs(RequestUser(r))
+	defer t.ActAs(nil)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	from := r.URL.Query().Get("from")
+	to := r.URL.Query().Get("to")
+
+	node, err := t.Move(from, to, ct)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{
+		Status:  "OK",
+		Message: fmt.Sprintf("%s successfully moved to %s", from, node.Address)})
+}
+
+func info(w http.ResponseWriter, r *http.Request) {
+	treemu.RLock()
+	defer treemu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	address := r.URL.Query().Get("address")
+
+	info, err := t.NodeInfo(address)
+	if err == nil {
+		err = t.CheckAccess(RequestUser(r), address, 0)
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{
+		Message: info,
+	})
+}
+
+func getChunkSize(w http.ResponseWriter, r *http.Request) {
+	responseBody := []byte(strconv.Itoa(conf.Namenode.ChunkSize * 1024 * 1024))
+	w.Write(responseBody)
+}
+
+func publicRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/init", adminOnly(initTree)).Methods("GET")
+	r.HandleFunc("/ls", ls).Methods("GET")
+	r.HandleFunc("/mkdir", mkdir).Methods("GET")
+	r.HandleFunc("/touch", touch).Methods("GET")
+	r.HandleFunc("/cd", cd).Methods("GET")
+	r.HandleFunc("/upload", upload).Methods("GET")
+	r.HandleFunc("/upload/commit", commitUpload).Methods("GET")
+	r.HandleFunc("/upload/abort", abortUpload).Methods("GET")
+	r.HandleFunc("/append", appendFile).Methods("GET")
+	r.HandleFunc("/download", download).Methods("GET")
+	r.HandleFunc("/reupload", reupload).Methods("GET")
+	r.HandleFunc("/versions", versions).Methods("GET")
+	r.HandleFunc("/versions/restore", restoreVersion).Methods("GET")
+	r.HandleFunc("/versions/keep", keepVersions).Methods("GET")
+	r.HandleFunc("/snapshots", dirSnapshots).Methods("GET")
+	r.HandleFunc("/snapshots/create", createDirSnapshot).Methods("GET")
+	r.HandleFunc("/snapshots/remove", removeDirSnapshot).Methods("GET")
+	r.HandleFunc("/rmfile", rmfile).Methods("GET")
+	r.HandleFunc("/rmdir", rmdir).Methods("GET")
+	r.HandleFunc("/trash", trash).Methods("GET")
+	r.HandleFunc("/trash/restore", restoreTrashed).Methods("GET")
+	r.HandleFunc("/trash/purge", purgeTrashed).Methods("GET")
+	r.HandleFunc("/info", info).Methods("GET")
+	r.HandleFunc("/cp", cp).Methods("GET")
+	r.HandleFunc("/mv", mv).Methods("GET")
+	r.HandleFunc("/chmod", chmod).Methods("GET")
+	r.HandleFunc("/chown", chown).Methods("GET")
+	r.HandleFunc("/quota", adminOnly(setQuota)).Methods("GET")
+	r.HandleFunc("/symlink", symlink).Methods("GET")
+	r.HandleFunc("/readlink", readlink).Methods("GET")
+	r.HandleFunc("/xattrs", xattrs).Methods("GET")
+	r.HandleFunc("/xattrs/get", getXattr).Methods("GET")
+	r.HandleFunc("/xattrs/set", setXattr).Methods("POST")
+	r.HandleFunc("/xattrs/remove", removeXattr).Methods("GET")
+	r.HandleFunc("/getChunkSize", getChunkSize).Methods("GET")
+	r.HandleFunc("/whoami", whoami).Methods("GET")
+	r.HandleFunc("/users", adminOnly(users)).Methods("GET")
+	r.HandleFunc("/users/add", adminOnly(addUser)).Methods("POST")
+	r.HandleFunc("/users/remove", adminOnly(removeUser)).Methods("GET")
+	r.HandleFunc("/users/groups", adminOnly(setGroups)).Methods("GET")
+	r.HandleFunc("/users/passwd", setPassword).Methods("POST")
+	r.HandleFunc("/users/keys", keys).Methods("GET")
+	r.HandleFunc("/users/keys/add", addKey).Methods("GET")
+	r.HandleFunc("/users/keys/remove", removeKey).Methods("GET")
+	r.Use(snapshotWhenDue, refuseOnStandby, leaderOnly, authenticate)
+
+	return r
+}
+
+func StartPublicServer() {
+	r := publicRouter()
 
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", conf.Namenode.PublicPort), r))
 }
\ No newline at end of file
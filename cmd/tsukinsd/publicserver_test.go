@@ -0,0 +1,435 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// request calls the method as the admin, replies of the public server are
+// decoded.
+func request(server *httptest.Server, method string, query url.Values, public bool) (*ClientMessage, error) {
+	req, _ := http.NewRequest("GET", fmt.Sprintf("%s%s?%s", server.URL, method, query.Encode()), nil)
+	req.SetBasicAuth(adminName, conf.Namenode.AdminPassword)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var msg ClientMessage
+	if public {
+		json.NewDecoder(resp.Body).Decode(&msg)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return &msg, fmt.Errorf("%s %v: %s %s", method, query, resp.Status, msg.Message)
+	}
+
+	return &msg, nil
+}
+
+// fakeFileserver stands in for fileservers on their private port. It accepts
+// every request and keeps the expectations of tokens.
+type fakeFileserver struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	expects map[string][]string // the request URI -> chunks
+}
+
+func newFakeFileserver() *fakeFileserver {
+	fs := &fakeFileserver{expects: map[string][]string{}}
+	fs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/expect/") {
+			return
+		}
+
+		var chunks []string
+		json.NewDecoder(r.Body).Decode(&chunks)
+
+		fs.mu.Lock()
+		fs.expects[r.URL.RequestURI()] = chunks
+		fs.mu.Unlock()
+	}))
+
+	return fs
+}
+
+func (fs *fakeFileserver) Port() int {
+	return fs.Listener.Addr().(*net.TCPAddr).Port
+}
+
+// Expected returns the chunks the token is expected for.
+func (fs *fakeFileserver) Expected(token, action string) []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.expects[fmt.Sprintf("/expect/%s?action=%s", token, action)]
+}
+
+func TestPublicServer_Concurrent(t *testing.T) {
+	dir := t.TempDir()
+	fileserver := newFakeFileserver()
+	defer fileserver.Close()
+
+	conf = &Config{Namenode: Namenode{
+		TreeLogName:      path.Join(dir, "tree.log"),
+		TreeGobName:      path.Join(dir, "tree.gob"),
+		TreeUpdatePeriod: 50,
+		ChunkSize:        1,
+		Replicas:         1,
+		FSPublicPort:     7000,
+		FSPrivatePort:    fileserver.Port(),
+		AdminPassword:    "secret",
+	}}
+
+	storages = &PoolInfo{SoftPulseQueue: make(chan int, 1), HardPulseQueue: make(chan int, 1)}
+	storages.Register("node-a", "127.0.0.1", "fs-a", 0)
+	storages.Register("node-b", "127.0.0.1", "fs-b", 0)
+	nodeIDs := map[string]string{"fs-a:7000": "node-a", "fs-b:7000": "node-b"}
+	// those join while files are uploaded
+	joining := []string{"c", "d", "e", "f"}
+	for _, name := range joining {
+		nodeIDs["fs-"+name+":7000"] = "node-" + name
+	}
+
+	tree := InitTree(conf.Namenode)
+	useTree(tree, NewChunkTable())
+
+	public := httptest.NewServer(publicRouter())
+	defer public.Close()
+	private := httptest.NewServer(privateRouter())
+	defer private.Close()
+
+	get := func(server *httptest.Server, method string, query url.Values) (*ClientMessage, error) {
+		return request(server, method, query, server == public)
+	}
+
+	workers := 8
+	files := 5
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(dir string) {
+			defer wg.Done()
+
+			if _, err := get(public, "/mkdir", url.Values{"address": {dir}}); err != nil {
+				t.Error(err)
+				return
+			}
+
+			for j := 0; j < files; j++ {
+				address := fmt.Sprintf("%s/f%d", dir, j)
+
+				msg, err := get(public, "/upload", url.Values{"address": {address}, "size": {"2500000"}})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				for _, chunk := range msg.Chunks {
+					query := url.Values{"chunkID": {chunk.ChunkID}, "node": {nodeIDs[chunk.StorageIP]}}
+					if _, err := get(private, "/confirm/receivedChunk", query); err != nil {
+						t.Error(err)
+					}
+				}
+
+				if _, err := get(public, "/upload/commit", url.Values{"id": {msg.UploadID}}); err != nil {
+					t.Error(err)
+				}
+
+				msg, err = get(public, "/download", url.Values{"address": {address}})
+				if err != nil {
+					t.Error(err)
+				} else if len(msg.Chunks) != 3 {
+					t.Errorf("got %d chunks of %s, want %d", len(msg.Chunks), address, 3)
+				}
+
+				if j%2 == 1 {
+					if _, err := get(public, "/rmfile", url.Values{"address": {address}}); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}(fmt.Sprintf("w%d", i))
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for _, name := range joining {
+			storages.Register("node-"+name, "127.0.0.1", "fs-"+name, 0)
+
+			for _, nodeID := range []string{"node-a", "node-" + name} {
+				if _, err := get(private, "/pulse", url.Values{"node": {nodeID}}); err != nil {
+					t.Error(err)
+				}
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	readers.Add(2)
+	// watches heartbeats, as HeartbeatManager does
+	go func() {
+		defer readers.Done()
+
+		for {
+			select {
+			case <-done:
+				return
+			case id := <-storages.SoftPulseQueue:
+				storages.IsDead(id, true)
+			case id := <-storages.HardPulseQueue:
+				storages.IsDead(id, false)
+			}
+
+			storages.GetFSWithOldestPulse(true)
+		}
+	}()
+	go func() {
+		defer readers.Done()
+
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			get(public, "/ls", url.Values{"address": {"."}})
+			get(public, "/info", url.Values{"address": {"w0"}})
+			get(public, "/download", url.Values{"address": {"w0/f0"}})
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	treemu.Lock()
+	defer treemu.Unlock()
+
+	for i := 0; i < workers; i++ {
+		dir := fmt.Sprintf("w%d", i)
+
+		// removed files are swapped out of directories on snapshots
+		got, err := tree.LS(dir)
+		sort.Strings(got)
+		want := []string{"f0", "f2", "f4"}
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("ls %s: got %v (%v), want %v", dir, got, err, want)
+		}
+	}
+
+	t.Run("log is in the order of operations",
+		func(t *testing.T) {
+			recovered, _, err := Recover(conf.Namenode, storages)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < workers; i++ {
+				dir := fmt.Sprintf("w%d", i)
+
+				want, _ := tree.LS(dir)
+				got, _ := recovered.LS(dir)
+				sort.Strings(want)
+				sort.Strings(got)
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("ls %s: got %v, want %v", dir, got, want)
+				}
+			}
+		})
+}
+
+func TestPublicServer_SnapshotAfterOperation(t *testing.T) {
+	dir := t.TempDir()
+	fileserver := newFakeFileserver()
+	defer fileserver.Close()
+
+	conf = &Config{Namenode: Namenode{
+		TreeLogName:      path.Join(dir, "tree.log"),
+		TreeGobName:      path.Join(dir, "tree.gob"),
+		TreeUpdatePeriod: -1,
+		ChunkSize:        1,
+		Replicas:         1,
+		FSPublicPort:     7000,
+		FSPrivatePort:    fileserver.Port(),
+		AdminPassword:    "secret",
+	}}
+
+	storages = &PoolInfo{}
+	storages.Register("node-a", "127.0.0.1", "fs-a", 0)
+
+	tree, table := InitTree(conf.Namenode), NewChunkTable()
+	useTree(tree, table)
+
+	public := httptest.NewServer(publicRouter())
+	defer public.Close()
+	private := httptest.NewServer(privateRouter())
+	defer private.Close()
+
+	request(public, "/mkdir", url.Values{"address": {"data"}}, true)
+	msg, err := request(public, "/upload", url.Values{"address": {"data/a"}, "size": {"2"}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range msg.Chunks {
+		request(private, "/confirm/receivedChunk", url.Values{"chunkID": {chunk.ChunkID}, "node": {"node-a"}}, false)
+	}
+	if _, err := request(public, "/upload/commit", url.Values{"id": {msg.UploadID}}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// every operation below is the one to trigger the snapshot
+	steps := []struct {
+		method string
+		query  url.Values
+	}{
+		{"/cp", url.Values{"from": {"data/a"}, "to": {"data/b"}}},
+		{"/cp", url.Values{"from": {"data"}, "to": {"backup"}}},
+		{"/snapshots/create", url.Values{"address": {"data"}, "name": {"s1"}}},
+		{"/rmfile", url.Values{"address": {"data/b"}}},
+		{"/rmfile", url.Values{"address": {"backup/a"}}},
+		{"/rmdir", url.Values{"address": {"data"}}},
+	}
+
+	for _, step := range steps {
+		treemu.Lock()
+		tree.Conf.TreeUpdatePeriod = (tree.Version + 1) % 100
+		treemu.Unlock()
+
+		if _, err := request(public, step.method, step.query, true); err != nil {
+			t.Fatal(err)
+		}
+
+		treemu.Lock()
+		if _, err := os.Stat(conf.Namenode.TreeLogName); !os.IsNotExist(err) {
+			t.Errorf("%s %v: no snapshot was taken", step.method, step.query)
+		}
+
+		_, recovered, err := Recover(tree.Conf, storages)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for chunkID, chunk := range table.Table {
+			got, ok := recovered.Table[chunkID]
+			if !ok {
+				t.Errorf("%s %v: chunk %s was not recovered", step.method, step.query, chunkID)
+			} else if got.Refs != chunk.Refs || (got.Status == OBSOLETE) != (chunk.Status == OBSOLETE) {
+				t.Errorf("%s %v: got %d refs, status %d, want %d refs, status %d", step.method, step.query, got.Refs, got.Status, chunk.Refs, chunk.Status)
+			}
+		}
+		treemu.Unlock()
+	}
+}
+
+func TestPublicServer_Download(t *testing.T) {
+	dir := t.TempDir()
+	fileserver := newFakeFileserver()
+	defer fileserver.Close()
+
+	conf = &Config{Namenode: Namenode{
+		TreeLogName:      path.Join(dir, "tree.log"),
+		TreeGobName:      path.Join(dir, "tree.gob"),
+		TreeUpdatePeriod: -1,
+		ChunkSize:        1,
+		Replicas:         1,
+		FSPublicPort:     7000,
+		FSPrivatePort:    fileserver.Port(),
+		AdminPassword:    "secret",
+	}}
+
+	storages = &PoolInfo{}
+	storages.Register("node-a", "127.0.0.1", "fs-a", 0)
+
+	tree := InitTree(conf.Namenode)
+	useTree(tree, NewChunkTable())
+	uploads = NewUploadTable()
+
+	public := httptest.NewServer(publicRouter())
+	defer public.Close()
+	private := httptest.NewServer(privateRouter())
+	defer private.Close()
+
+	msg, err := request(public, "/upload", url.Values{"address": {"a.bin"}, "size": {"2500000"}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range msg.Chunks {
+		request(private, "/confirm/receivedChunk", url.Values{"chunkID": {chunk.ChunkID}, "node": {"node-a"}}, false)
+	}
+	if _, err := request(public, "/upload/commit", url.Values{"id": {msg.UploadID}}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("fileservers expect the token",
+		func(t *testing.T) {
+			msg, err := request(public, "/download", url.Values{"address": {"a.bin"}}, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Token == "" {
+				t.Fatal("no token was granted")
+			}
+
+			want := []string{}
+			for _, chunk := range msg.Chunks {
+				want = append(want, chunk.ChunkID)
+			}
+			if got := fileserver.Expected(msg.Token, "read"); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v expected for reading, want %v", got, want)
+			}
+		})
+
+	t.Run("no token without access",
+		func(t *testing.T) {
+			treemu.Lock()
+			tree.AddUser("bob", "builder", false)
+			tree.Chmod("a.bin", 0600)
+			treemu.Unlock()
+
+			req, _ := http.NewRequest("GET", public.URL+"/download?address=a.bin", nil)
+			req.SetBasicAuth("bob", "builder")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			var msg ClientMessage
+			json.NewDecoder(resp.Body).Decode(&msg)
+			if resp.StatusCode == http.StatusOK || msg.Token != "" {
+				t.Errorf("got %s with token %q, want no token", resp.Status, msg.Token)
+			}
+
+			fileserver.mu.Lock()
+			defer fileserver.mu.Unlock()
+
+			reads := 0
+			for uri := range fileserver.expects {
+				if strings.HasSuffix(uri, "action=read") {
+					reads++
+				}
+			}
+			if reads != 1 {
+				t.Errorf("got %d expectations to read, want the one of the previous download", reads)
+			}
+		})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Directories count the bytes of the files and the objects beneath them, the
+// counts of the ancestors are updated along with every change, so quotas are
+// checked without walking the tree. The counts are not saved, they are
+// recounted when a snapshot is loaded, see relink.
+//
+// Quotas limit logical bytes, that is the sizes of the files times the number
+// of replicas, and the number of files and directories. Previous versions of
+// files and staged uploads are not counted, the trash and the snapshots are
+// counted by the root only.
+
+// usage returns the bytes and the objects the node takes from its parent.
+func (node *Node) usage() (int64, int) {
+	if node.IsDirectory {
+		return node.usedBytes, node.usedObjects + 1
+	}
+
+	return int64(node.Size), 1
+}
+
+// account adds to the counts of the directory and of its ancestors.
+func (t *Tree) account(dir string, bytes int64, objects int) {
+	for {
+		if node, ok := t.Nodes[dir]; ok {
+			node.usedBytes += bytes
+			node.usedObjects += objects
+		}
+		if dir == "." || dir == "" {
+			return
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+// recount sums the counts of the directory from its children, which are
+// counted already.
+func (node *Node) recount() {
+	node.usedBytes, node.usedObjects = 0, 0
+	for _, child := range node.Childs {
+		if child.Removed {
+			continue
+		}
+
+		bytes, objects := child.usage()
+		node.usedBytes += bytes
+		node.usedObjects += objects
+	}
+}
+
+func (t *Tree) replicas() int64 {
+	if t.Conf.Replicas < 1 {
+		return 1
+	}
+
+	return int64(t.Conf.Replicas)
+}
+
+// checkQuota checks that the directory and its ancestors may take the bytes
+// and the objects more. Ancestors of the moved address are skipped, for them
+// nothing changes; it is empty, unless the objects are moved.
+func (t *Tree) checkQuota(dir string, bytes int64, objects int, moved string) error {
+	if t.replaying || bytes <= 0 && objects <= 0 {
+		return nil
+	}
+
+	for {
+		node, ok := t.Nodes[dir]
+		shared := moved != "" && (dir == "." || strings.HasPrefix(moved, dir+"/"))
+
+		if ok && !shared {
+			if node.QuotaBytes > 0 && bytes > 0 && (node.usedBytes+bytes)*t.replicas() > node.QuotaBytes {
+				return fmt.Errorf("/%s/ quota exceeded; %d of %d bytes are used, %d more are needed (replicas counted)",
+					dir, node.usedBytes*t.replicas(), node.QuotaBytes, bytes*t.replicas())
+			}
+			if node.QuotaObjects > 0 && objects > 0 && node.usedObjects+objects > node.QuotaObjects {
+				return fmt.Errorf("/%s/ quota exceeded; %d of %d objects are used, %d more are needed",
+					dir, node.usedObjects, node.QuotaObjects, objects)
+			}
+		}
+
+		if dir == "." || dir == "" {
+			return nil
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+// SetQuota limits logical bytes and objects beneath the directory, 0 is no
+// limit. Only admins may set quotas. The quota may be lower than the current
+// usage, then nothing is added until enough is removed.
+func (t *Tree) SetQuota(address string, bytes int64, objects int) error {
+	address, matched := CleanAddress(address)
+
+	if !matched {
+		return fmt.Errorf("/%s wrong file name format", address)
+	}
+	if !t.DirectoryExists(address) {
+		return fmt.Errorf("/%s/ directory does not exist", address)
+	}
+	if IsReadOnly(address) {
+		return readOnly(address)
+	}
+	if bytes < 0 || objects < 0 {
+		return fmt.Errorf("quota cannot be negative")
+	}
+	if !t.replaying && t.acting != nil && !t.acting.Admin {
+		return fmt.Errorf("/%s/ permission denied; only admins may set quotas", address)
+	}
+
+	dir := t.Nodes[address]
+	dir.QuotaBytes, dir.QuotaObjects = bytes, objects
+
+	t.CommitUpdate("quota", address, strconv.FormatInt(bytes, 10), strconv.Itoa(objects))
+
+	return nil
+}
+
+// QuotaInfo describes the usage and the quota of the directory.
+func (t *Tree) QuotaInfo(dir *Node) string {
+	quotaBytes, quotaObjects := "none", "none"
+	if dir.QuotaBytes > 0 {
+		quotaBytes = fmt.Sprintf("%d bytes", dir.QuotaBytes)
+	}
+	if dir.QuotaObjects > 0 {
+		quotaObjects = fmt.Sprintf("%d objects", dir.QuotaObjects)
+	}
+
+	return fmt.Sprintf(
+		"Usage: %d bytes (%d with replicas), %d objects\n"+
+			"Quota: %s, %s",
+		dir.usedBytes,
+		dir.usedBytes*t.replicas(),
+		dir.usedObjects,
+		quotaBytes,
+		quotaObjects,
+	)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTree_Quotas(t *testing.T) {
+	f := newTreeFixture(t, func(namenode *Namenode) { namenode.Replicas = 2 })
+	tree, table := f.tree, f.table
+
+	usage := func(address string) (int64, int) {
+		node := tree.Nodes[address]
+		return node.usedBytes, node.usedObjects
+	}
+	expect := func(t *testing.T, address string, bytes int64, objects int) {
+		t.Helper()
+		if gotBytes, gotObjects := usage(address); gotBytes != bytes || gotObjects != objects {
+			t.Errorf("/%s: got %d bytes, %d objects, want %d bytes, %d objects", address, gotBytes, gotObjects, bytes, objects)
+		}
+	}
+
+	tree.CreateDirectory("team")
+	tree.CreateDirectory("team/data")
+	tree.CreateDirectory("other")
+
+	t.Run("usage is counted",
+		func(t *testing.T) {
+			tree.CreateFile("team/data/a.bin", 100)
+			tree.CreateFile("team/b.bin", 50)
+
+			expect(t, "team/data", 100, 1)
+			expect(t, "team", 150, 3)
+			expect(t, ".", 150, 5)
+
+			tree.CopyFile("team/b.bin", "other")
+			tree.CopyDirectory("team/data", "other")
+			expect(t, "other", 150, 3)
+
+			tree.RemoveFile("other/b.bin")
+			tree.RemoveDirectory("other/data")
+			expect(t, "other", 0, 0)
+			expect(t, ".", 150, 5)
+		})
+
+	t.Run("only admins set quotas",
+		func(t *testing.T) {
+			tree.ActAs(&User{Name: "alice"})
+			defer tree.ActAs(nil)
+
+			if err := tree.SetQuota("team", 1000, 10); err == nil {
+				t.Errorf("user set a quota")
+			}
+		})
+
+	t.Run("quotas are checked",
+		func(t *testing.T) {
+			// 150 bytes are 300 with replicas
+			if err := tree.SetQuota("team", 400, 5); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := tree.CreateFile("team/data/c.bin", 60); err == nil {
+				t.Errorf("touch exceeded the byte quota")
+			}
+			if _, err := tree.CreateFile("team/data/c.bin", 50); err != nil {
+				t.Errorf("touch within the quota: %v", err)
+			}
+			if err := tree.CreateDirectory("team/logs"); err != nil {
+				t.Errorf("mkdir within the quota: %v", err)
+			}
+			if err := tree.CreateDirectory("team/logs/old"); err == nil {
+				t.Errorf("mkdir exceeded the object quota")
+			}
+			if _, err := tree.CopyFile("team/b.bin", "team/logs"); err == nil {
+				t.Errorf("cp exceeded the quota")
+			}
+
+			tree.CreateFile("other/big.bin", 100)
+			if _, err := tree.CopyDirectory("other", "team/logs"); err == nil {
+				t.Errorf("cp of a directory exceeded the quota")
+			}
+			if _, err := tree.Move("other/big.bin", "team/logs", table); err == nil {
+				t.Errorf("mv exceeded the quota")
+			}
+			if _, err := tree.StageOverwrite("team/b.bin", 100, "upload"); err == nil {
+				t.Errorf("overwrite exceeded the quota")
+			}
+
+			// nothing changes for the directory, when objects are moved within it
+			if _, err := tree.Move("team/data/c.bin", "team/logs", table); err != nil {
+				t.Errorf("mv within the directory: %v", err)
+			}
+			expect(t, "team", 200, 5)
+			expect(t, "team/logs", 50, 1)
+		})
+
+	t.Run("trash",
+		func(t *testing.T) {
+			if _, err := tree.Trash("team/logs/c.bin", time.Now(), table); err != nil {
+				t.Fatal(err)
+			}
+			expect(t, "team", 150, 4)
+			// along with the trash of admin
+			expect(t, ".", 300, 10)
+
+			tree.CreateFile("team/logs/d.bin", 50)
+			if _, err := tree.RestoreTrashed("team/logs/c.bin", table); err == nil {
+				t.Errorf("restore exceeded the quota")
+			}
+			tree.RemoveFile("team/logs/d.bin")
+			if _, err := tree.RestoreTrashed("team/logs/c.bin", table); err != nil {
+				t.Errorf("restore within the quota: %v", err)
+			}
+			expect(t, "team", 200, 5)
+			expect(t, trashDir, 0, 1)
+		})
+
+	t.Run("usage is recounted on recovery",
+		func(t *testing.T) {
+			f.snapshot(t)
+			tree.CreateFile("other/e.bin", 10)
+
+			recovered, _ := f.recover(t)
+
+			for _, address := range []string{".", "team", "team/logs", "other"} {
+				bytes, objects := usage(address)
+				node := recovered.Nodes[address]
+				if node.usedBytes != bytes || node.usedObjects != objects {
+					t.Errorf("/%s: got %d bytes, %d objects, want %d bytes, %d objects", address, node.usedBytes, node.usedObjects, bytes, objects)
+				}
+			}
+			if node := recovered.Nodes["team"]; node.QuotaBytes != 400 || node.QuotaObjects != 5 {
+				t.Errorf("got quota %d bytes, %d objects, want 400 bytes, 5 objects", node.QuotaBytes, node.QuotaObjects)
+			}
+		})
+}
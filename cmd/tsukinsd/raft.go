@@ -0,0 +1,944 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Raft keeps the logs of a group of nameservers in agreement. Unlike in
+// the paper, a nameserver applies records as soon as they are in its log:
+// the leader applies an operation before it is replicated, and replies to
+// the client once it is committed. Records that are not in the log of a
+// new leader are rolled back by rebuilding the tree from the snapshot and
+// the rest of the log. Snapshots contain committed records only. Side
+// effects of operations on fileservers wait for the commit, see after.
+type Raft struct {
+	mu sync.Mutex
+
+	Self  string   // private address of this nameserver
+	Peers []string // private addresses of the other ones
+
+	Heartbeat       time.Duration
+	ElectionTimeout time.Duration // randomized up to twice as long
+
+	// Called whenever the tree is replaced by a rollback or by a snapshot
+	// of the leader
+	OnReset func(*Tree, *ChunkTable)
+
+	stateName string
+	state     RaftState
+
+	role     RaftRole
+	leader   string
+	commit   int64 // records before it are committed
+	deadline time.Time
+	stopped  bool
+
+	// the first record of the leader's term, records before it are
+	// committed only along with it
+	termStart int64
+
+	// the log, as in the tree; kept here so that the tree is not read
+	// while it is changed by handlers
+	last         int64 // the next version
+	lastTerm     int64
+	snapshotted  int64
+	snapshotTerm int64
+
+	tree  *Tree
+	table *ChunkTable
+	pool  *PoolInfo
+
+	// of peers, on the leader
+	next  map[string]int64
+	match map[string]int64
+	kick  map[string]chan struct{}
+
+	// of operations that are not committed yet, on the leader
+	effects []sideEffect
+}
+
+// sideEffect of an operation, such as purging chunks on fileservers, is
+// started once the records before the version are committed.
+type sideEffect struct {
+	version int64
+	run     func()
+}
+
+type RaftRole int
+
+const (
+	FOLLOWER  RaftRole = 0
+	CANDIDATE RaftRole = 1
+	LEADER    RaftRole = 2
+)
+
+const (
+	raftBatch         = 64
+	raftSnapshotEvery = 100
+)
+
+// RaftState must be on disk before a vote or a record is acknowledged.
+type RaftState struct {
+	Term     int64
+	VotedFor string
+}
+
+type VoteRequest struct {
+	Term      int64
+	Candidate string
+	LastIndex int64
+	LastTerm  int64
+}
+
+type VoteReply struct {
+	Term    int64
+	Granted bool
+}
+
+type AppendRequest struct {
+	Term      int64
+	Leader    string
+	PrevIndex int64
+	PrevTerm  int64
+	Entries   []LogRecord
+	Commit    int64
+}
+
+// Next is the version the follower expects next. On failure, the leader
+// retries from it.
+type AppendReply struct {
+	Term    int64
+	Success bool
+	Next    int64
+}
+
+// nil, unless the nameserver is a member of a group
+var cluster *Raft
+
+// NewRaft recovers the term and the vote from stateName. The tree and the
+// table are expected to be recovered already.
+func NewRaft(self string, group []string, stateName string, tree *Tree, table *ChunkTable, pool *PoolInfo) (*Raft, error) {
+	r := &Raft{
+		Self:            self,
+		Heartbeat:       150 * time.Millisecond,
+		ElectionTimeout: time.Second,
+		stateName:       stateName,
+		pool:            pool,
+	}
+
+	for _, peer := range group {
+		if peer != self {
+			r.Peers = append(r.Peers, peer)
+		}
+	}
+
+	state, err := ioutil.ReadFile(stateName)
+	if err == nil {
+		if err := json.Unmarshal(state, &r.state); err != nil {
+			return nil, fmt.Errorf("raft state: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("raft state: %v", err)
+	}
+
+	r.adopt(tree, table)
+
+	return r, nil
+}
+
+// adopt expects r.mu to be locked, if r is running
+func (r *Raft) adopt(tree *Tree, table *ChunkTable) {
+	r.tree, r.table = tree, table
+	tree.raft = r
+
+	r.last, r.lastTerm = tree.Version, tree.Term
+	r.snapshotted, r.snapshotTerm = tree.SnapshotVersion, tree.SnapshotTerm
+	if r.commit < r.snapshotted {
+		r.commit = r.snapshotted
+	}
+}
+
+func (r *Raft) Term() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.state.Term
+}
+
+func (r *Raft) IsLeader() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.role == LEADER
+}
+
+// Leader returns the private address of the leader, empty if unknown.
+func (r *Raft) Leader() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.leader
+}
+
+func (r *Raft) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stopped = true
+	r.role = FOLLOWER
+}
+
+// Run starts elections whenever the leader is not heard from for too long.
+func (r *Raft) Run() {
+	r.mu.Lock()
+	r.resetDeadline()
+	r.mu.Unlock()
+
+	for {
+		time.Sleep(r.Heartbeat / 3)
+
+		r.mu.Lock()
+		if r.stopped {
+			r.mu.Unlock()
+			return
+		}
+		expired := r.role != LEADER && time.Now().After(r.deadline)
+		r.mu.Unlock()
+
+		if expired {
+			r.elect()
+		}
+	}
+}
+
+// resetDeadline expects r.mu to be locked
+func (r *Raft) resetDeadline() {
+	timeout := r.ElectionTimeout + time.Duration(rand.Int63n(int64(r.ElectionTimeout)))
+	r.deadline = time.Now().Add(timeout)
+}
+
+// persist expects r.mu to be locked
+func (r *Raft) persist() error {
+	state, _ := json.Marshal(&r.state)
+
+	tmpName := r.stateName + ".tmp"
+	if err := ioutil.WriteFile(tmpName, state, 0644); err != nil {
+		return fmt.Errorf("raft state: %v", err)
+	}
+
+	f, err := os.Open(tmpName)
+	if err != nil {
+		return fmt.Errorf("raft state: %v", err)
+	}
+	err = f.Sync()
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("raft state: %v", err)
+	}
+
+	if err := os.Rename(tmpName, r.stateName); err != nil {
+		return fmt.Errorf("raft state: %v", err)
+	}
+
+	return nil
+}
+
+// follow expects r.mu to be locked
+func (r *Raft) follow(term int64, leader string) {
+	if term > r.state.Term {
+		r.state = RaftState{Term: term}
+		if err := r.persist(); err != nil {
+			log.Println(err)
+		}
+	}
+
+	if r.role == LEADER {
+		log.Printf("Stepping down in term %d", term)
+
+		// the operations may be rolled back; whatever was released is
+		// purged on inventory, grants and tokens expire
+		r.effects = nil
+	}
+
+	r.role = FOLLOWER
+	if leader != "" {
+		r.leader = leader
+		r.resetDeadline()
+	}
+}
+
+func (r *Raft) elect() {
+	r.mu.Lock()
+	r.role = CANDIDATE
+	r.leader = ""
+	r.state = RaftState{Term: r.state.Term + 1, VotedFor: r.Self}
+	if err := r.persist(); err != nil {
+		log.Println(err)
+		r.mu.Unlock()
+		return
+	}
+	r.resetDeadline()
+
+	request := VoteRequest{
+		Term:      r.state.Term,
+		Candidate: r.Self,
+		LastIndex: r.last,
+		LastTerm:  r.lastTerm,
+	}
+	r.mu.Unlock()
+
+	log.Printf("Starting election in term %d", request.Term)
+
+	replies := make(chan VoteReply, len(r.Peers))
+	for _, peer := range r.Peers {
+		go func(peer string) {
+			var reply VoteReply
+			if err := r.call(peer, "/raft/vote", &request, &reply); err != nil {
+				reply = VoteReply{}
+			}
+			replies <- reply
+		}(peer)
+	}
+
+	votes := 1
+	for i := 0; i <= len(r.Peers); i++ {
+		if votes > (len(r.Peers)+1)/2 {
+			r.lead(request.Term)
+			return
+		}
+
+		if i == len(r.Peers) {
+			break
+		}
+
+		reply := <-replies
+		if reply.Term > request.Term {
+			r.mu.Lock()
+			r.follow(reply.Term, "")
+			r.mu.Unlock()
+			return
+		}
+
+		if reply.Granted {
+			votes++
+		}
+	}
+}
+
+func (r *Raft) lead(term int64) {
+	treemu.Lock()
+	defer treemu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.role != CANDIDATE || r.state.Term != term || r.stopped {
+		return
+	}
+
+	// commits records of previous terms, once it is committed itself
+	noop := LogRecord{Version: r.last, Term: term, Command: "noop"}
+	if err := AppendLogRecord(r.tree.Conf.TreeLogName, noop); err != nil {
+		log.Println(err)
+		r.role = FOLLOWER
+		return
+	}
+	r.tree.ApplyRecord(noop, r.table, r.pool)
+
+	log.Printf("Leading in term %d", term)
+
+	r.role = LEADER
+	r.leader = r.Self
+	r.termStart = r.last
+	r.last, r.lastTerm = noop.Version+1, term
+
+	r.next = map[string]int64{}
+	r.match = map[string]int64{}
+	r.kick = map[string]chan struct{}{}
+	for _, peer := range r.Peers {
+		r.next[peer] = r.last
+		r.match[peer] = 0
+		r.kick[peer] = make(chan struct{}, 1)
+
+		go r.replicate(peer, term)
+	}
+}
+
+// appended is called by the tree on the leader.
+func (r *Raft) appended(record LogRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.last, r.lastTerm = record.Version+1, record.Term
+
+	for _, kick := range r.kick {
+		select {
+		case kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (r *Raft) isLeaderOf(term int64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.role == LEADER && r.state.Term == term && !r.stopped
+}
+
+func (r *Raft) replicate(peer string, term int64) {
+	r.mu.Lock()
+	kick := r.kick[peer]
+	r.mu.Unlock()
+
+	for r.isLeaderOf(term) {
+		if err := r.sendAppend(peer, term); err != nil {
+			log.Printf("warning: could not replicate to %s: %v", peer, err)
+		}
+
+		select {
+		case <-kick:
+		case <-time.After(r.Heartbeat):
+		}
+	}
+}
+
+func (r *Raft) sendAppend(peer string, term int64) error {
+	r.mu.Lock()
+	next := r.next[peer]
+	snapshotted, snapshotTerm := r.snapshotted, r.snapshotTerm
+	commit := r.commit
+	logName := r.tree.Conf.TreeLogName
+	r.mu.Unlock()
+
+	if next < snapshotted {
+		return r.sendSnapshot(peer, term)
+	}
+
+	request := AppendRequest{
+		Term:      term,
+		Leader:    r.Self,
+		PrevIndex: next - 1,
+		Commit:    commit,
+	}
+
+	from := next
+	if request.PrevIndex == snapshotted-1 {
+		request.PrevTerm = snapshotTerm
+	} else if request.PrevIndex >= 0 {
+		from = request.PrevIndex
+	}
+
+	entries, err := ReadLogFrom(logName, from, raftBatch+1)
+	if err != nil {
+		return err
+	}
+
+	if from != next {
+		if len(entries) == 0 || entries[0].Version != request.PrevIndex {
+			// the log was dropped by a snapshot
+			return nil
+		}
+		request.PrevTerm = entries[0].Term
+		entries = entries[1:]
+	}
+	request.Entries = entries
+
+	var reply AppendReply
+	if err := r.call(peer, "/raft/append", &request, &reply); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	if reply.Term > r.state.Term {
+		r.follow(reply.Term, "")
+		r.mu.Unlock()
+		return nil
+	}
+
+	if r.role != LEADER || r.state.Term != term {
+		r.mu.Unlock()
+		return nil
+	}
+
+	r.next[peer] = reply.Next
+	if reply.Success {
+		r.match[peer] = reply.Next
+	}
+	r.mu.Unlock()
+
+	if reply.Success {
+		r.advance(term)
+	}
+
+	return nil
+}
+
+func (r *Raft) sendSnapshot(peer string, term int64) error {
+	r.mu.Lock()
+	filename, version, ok := latestSnapshot(r.tree.Conf.TreeGobName)
+	r.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no snapshot to send")
+	}
+
+	snapshot, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 10 * r.ElectionTimeout}
+	resp, err := client.Post(
+		fmt.Sprintf("http://%s/raft/snapshot?term=%d&leader=%s", peer, term, r.Self),
+		"application/octet-stream",
+		bytes.NewBuffer(snapshot))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var reply AppendReply
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if reply.Term > r.state.Term {
+		r.follow(reply.Term, "")
+	} else if reply.Success && r.role == LEADER {
+		log.Printf("Sent the snapshot at version %d to %s", version, peer)
+		r.next[peer] = reply.Next
+		r.match[peer] = reply.Next
+	}
+
+	return nil
+}
+
+// advance commits the records replicated to the majority.
+func (r *Raft) advance(term int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.role != LEADER || r.state.Term != term {
+		return
+	}
+
+	r.updateCommit()
+}
+
+// updateCommit expects r.mu to be locked by the leader
+func (r *Raft) updateCommit() {
+	replicated := []int64{r.last}
+	for _, match := range r.match {
+		replicated = append(replicated, match)
+	}
+	sort.Slice(replicated, func(i, j int) bool { return replicated[i] > replicated[j] })
+
+	commit := replicated[len(replicated)/2]
+	if commit > r.commit && commit > r.termStart {
+		r.commit = commit
+	}
+
+	ready := 0
+	for ready < len(r.effects) && r.effects[ready].version <= r.commit {
+		go r.effects[ready].run()
+		ready++
+	}
+	r.effects = r.effects[ready:]
+}
+
+// after starts the side effect once the records before the version are
+// committed. Effects are dropped, if the leader steps down before that.
+func (r *Raft) after(version int64, effect func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.role != LEADER {
+		return
+	}
+
+	r.updateCommit()
+	if r.commit >= version {
+		go effect()
+		return
+	}
+
+	r.effects = append(r.effects, sideEffect{version: version, run: effect})
+}
+
+// WaitCommitted waits until the records before the version are committed,
+// or until the nameserver is not the leader anymore.
+func (r *Raft) WaitCommitted(version int64) error {
+	deadline := time.Now().Add(2 * r.ElectionTimeout)
+
+	for time.Now().Before(deadline) {
+		r.mu.Lock()
+		if r.role != LEADER {
+			r.mu.Unlock()
+			return fmt.Errorf("not the leader anymore")
+		}
+
+		r.updateCommit()
+		committed := r.commit >= version
+		r.mu.Unlock()
+
+		if committed {
+			treemu.Lock()
+			r.mu.Lock()
+			r.snapshot()
+			r.mu.Unlock()
+			treemu.Unlock()
+
+			return nil
+		}
+
+		time.Sleep(r.Heartbeat / 10)
+	}
+
+	return fmt.Errorf("the operation was not committed in time")
+}
+
+// snapshot expects treemu and r.mu to be locked
+func (r *Raft) snapshot() {
+	if r.last-r.snapshotted < raftSnapshotEvery || r.commit < r.last {
+		return
+	}
+
+	if err := r.save(); err != nil {
+		log.Println(err)
+	}
+}
+
+// Save snapshots the tree, unless some of its records are not committed
+// yet. Only committed records are snapshotted, since they are never rolled
+// back. Expects treemu to be locked.
+func (r *Raft) Save() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.commit < r.last {
+		return fmt.Errorf("save snapshot: %d operations are not committed yet", r.last-r.commit)
+	}
+
+	return r.save()
+}
+
+// save expects treemu and r.mu to be locked
+func (r *Raft) save() error {
+	if err := r.tree.Snapshot(r.table); err != nil {
+		return err
+	}
+	r.snapshotted, r.snapshotTerm = r.tree.SnapshotVersion, r.tree.SnapshotTerm
+
+	return nil
+}
+
+// rollback expects treemu and r.mu to be locked
+func (r *Raft) rollback(from int64) error {
+	log.Printf("Rolling back records starting with %d", from)
+
+	if err := TruncateLog(r.tree.Conf.TreeLogName, from); err != nil {
+		return err
+	}
+
+	tree, table, err := Recover(r.tree.Conf, r.pool)
+	if err != nil {
+		return err
+	}
+
+	r.adopt(tree, table)
+	if r.OnReset != nil {
+		r.OnReset(tree, table)
+	}
+
+	return nil
+}
+
+func (r *Raft) call(peer, method string, request, reply interface{}) error {
+	body, _ := json.Marshal(request)
+
+	client := &http.Client{Timeout: r.ElectionTimeout}
+	resp, err := client.Post(fmt.Sprintf("http://%s%s", peer, method), "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
+
+func (r *Raft) VoteHandler(w http.ResponseWriter, req *http.Request) {
+	var request VoteRequest
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if request.Term > r.state.Term && !r.stopped {
+		r.follow(request.Term, "")
+	}
+
+	upToDate := request.LastTerm > r.lastTerm ||
+		request.LastTerm == r.lastTerm && request.LastIndex >= r.last
+
+	reply := VoteReply{Term: r.state.Term}
+	if request.Term == r.state.Term && upToDate && !r.stopped &&
+		(r.state.VotedFor == "" || r.state.VotedFor == request.Candidate) {
+
+		r.state.VotedFor = request.Candidate
+		if err := r.persist(); err == nil {
+			reply.Granted = true
+			r.resetDeadline()
+		} else {
+			log.Println(err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&reply)
+}
+
+func (r *Raft) AppendHandler(w http.ResponseWriter, req *http.Request) {
+	var request AppendRequest
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	treemu.Lock()
+	defer treemu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reply := r.append(&request)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&reply)
+}
+
+// append expects treemu and r.mu to be locked
+func (r *Raft) append(request *AppendRequest) AppendReply {
+	if request.Term < r.state.Term || r.stopped {
+		return AppendReply{Term: r.state.Term, Next: r.last}
+	}
+	r.follow(request.Term, request.Leader)
+
+	reply := AppendReply{Term: r.state.Term, Next: r.last}
+	if request.PrevIndex >= r.last {
+		return reply
+	}
+
+	// terms of the own records, those before the snapshot are committed
+	// and match the leader's ones
+	terms := map[int64]int64{}
+	from := request.PrevIndex
+	if from < r.snapshotted {
+		from = r.snapshotted
+	}
+
+	records, err := ReadLogFrom(r.tree.Conf.TreeLogName, from, -1)
+	if err != nil {
+		log.Println(err)
+		return reply
+	}
+	for _, record := range records {
+		terms[record.Version] = record.Term
+	}
+
+	if request.PrevIndex >= r.snapshotted && terms[request.PrevIndex] != request.PrevTerm {
+		reply.Next = request.PrevIndex
+		return reply
+	}
+
+	for _, record := range request.Entries {
+		if record.Version < r.last {
+			if record.Version < r.snapshotted || terms[record.Version] == record.Term {
+				continue
+			}
+
+			if err := r.rollback(record.Version); err != nil {
+				log.Printf("warning: could not roll back: %v", err)
+				reply.Next = r.last
+				return reply
+			}
+		}
+
+		if record.Version != r.last {
+			break
+		}
+
+		if err := AppendLogRecord(r.tree.Conf.TreeLogName, record); err != nil {
+			log.Println(err)
+			break
+		}
+
+		if err := r.tree.ApplyRecord(record, r.table, r.pool); err != nil {
+			log.Printf("Could not apply %s %v: %v", record.Command, record.Args, err)
+		}
+		r.last, r.lastTerm = record.Version+1, record.Term
+	}
+
+	if request.Commit > r.commit {
+		r.commit = request.Commit
+		if r.commit > r.last {
+			r.commit = r.last
+		}
+	}
+	r.snapshot()
+
+	reply.Success = true
+	reply.Next = r.last
+	return reply
+}
+
+func (r *Raft) SnapshotHandler(w http.ResponseWriter, req *http.Request) {
+	term, err := strconv.ParseInt(req.URL.Query().Get("term"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	treemu.Lock()
+	defer treemu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reply := AppendReply{Term: r.state.Term, Next: r.last}
+	if term < r.state.Term || r.stopped {
+		json.NewEncoder(w).Encode(&reply)
+		return
+	}
+	r.follow(term, req.URL.Query().Get("leader"))
+	reply.Term = r.state.Term
+
+	snapshot, err := decodeSnapshot(req.Body)
+	if err != nil {
+		log.Printf("warning: could not install snapshot: %v", err)
+		json.NewEncoder(w).Encode(&reply)
+		return
+	}
+
+	snapshot.Chunks.relink(r.pool)
+	snapshot.Tree.Conf = r.tree.Conf
+	if err := snapshot.Tree.Snapshot(snapshot.Chunks); err != nil {
+		log.Printf("warning: could not install snapshot: %v", err)
+		json.NewEncoder(w).Encode(&reply)
+		return
+	}
+
+	log.Printf("Installed the snapshot of %s at version %d", r.leader, snapshot.Tree.Version)
+
+	r.adopt(snapshot.Tree, snapshot.Chunks)
+	r.commit = r.last
+	if r.OnReset != nil {
+		r.OnReset(snapshot.Tree, snapshot.Chunks)
+	}
+
+	reply.Success = true
+	reply.Next = r.last
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&reply)
+}
+
+// View calls f with the tree and the table, while they are not changed by
+// the leader. Intended for followers.
+func (r *Raft) View(f func(*Tree, *ChunkTable)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f(r.tree, r.table)
+}
+
+// publicAddr returns the public address of the nameserver with the private
+// address, provided that all nameservers of the group listen on same ports.
+func publicAddr(privateAddr string) string {
+	host, _, err := net.SplitHostPort(privateAddr)
+	if err != nil {
+		host = privateAddr
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(conf.Namenode.PublicPort))
+}
+
+// isPassive is true, if the nameserver should leave fileservers alone,
+// since another one is in charge.
+func isPassive() bool {
+	return isStandby() || cluster != nil && !cluster.IsLeader()
+}
+
+// bufferedResponse holds the response until the operation is committed.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) Write(data []byte) (int, error) {
+	return b.body.Write(data)
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	b.status = status
+}
+
+// leaderOnly redirects clients to the leader of the group. The leader
+// replies once the operations of the request are committed.
+func leaderOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cluster == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !cluster.IsLeader() {
+			leader := cluster.Leader()
+			if leader == "" {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: "the leader is not elected yet"})
+				return
+			}
+
+			http.Redirect(w, r, "http://"+publicAddr(leader)+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+			return
+		}
+
+		buffered := &bufferedResponse{header: w.Header(), status: http.StatusOK}
+		next.ServeHTTP(buffered, r)
+
+		treemu.RLock()
+		version := t.Version
+		treemu.RUnlock()
+
+		if err := cluster.WaitCommitted(version); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+			return
+		}
+
+		w.WriteHeader(buffered.status)
+		w.Write(buffered.body.Bytes())
+	})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRaft(t *testing.T) {
+	dir := t.TempDir()
+
+	nodes := make([]*Raft, 3)
+	servers := make([]*httptest.Server, len(nodes))
+	addrs := []string{}
+	for i := range nodes {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/raft/vote":
+				nodes[i].VoteHandler(w, r)
+			case "/raft/append":
+				nodes[i].AppendHandler(w, r)
+			case "/raft/snapshot":
+				nodes[i].SnapshotHandler(w, r)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		defer servers[i].Close()
+
+		addrs = append(addrs, strings.TrimPrefix(servers[i].URL, "http://"))
+	}
+
+	for i := range nodes {
+		name := path.Join(dir, strings.Replace(addrs[i], ":", "_", 1))
+		os.Mkdir(name, 0755)
+
+		namenode := Namenode{
+			TreeLogName:      path.Join(name, "tree.log"),
+			TreeGobName:      path.Join(name, "tree.gob"),
+			TreeUpdatePeriod: -1,
+		}
+
+		var err error
+		nodes[i], err = NewRaft(addrs[i], addrs, path.Join(name, "raft.state"), InitTree(namenode), NewChunkTable(), &PoolInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[i].Heartbeat = 20 * time.Millisecond
+		nodes[i].ElectionTimeout = 150 * time.Millisecond
+	}
+
+	for _, node := range nodes {
+		go node.Run()
+		defer node.Stop()
+	}
+
+	waitLeader := func(t *testing.T, except *Raft) *Raft {
+		t.Helper()
+
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			for _, node := range nodes {
+				if node != except && node.IsLeader() {
+					return node
+				}
+			}
+		}
+
+		t.Fatal("no leader was elected")
+		return nil
+	}
+
+	assertReplicated := func(t *testing.T, leader *Raft, except *Raft) {
+		t.Helper()
+
+		want, _ := leader.tree.LS(".")
+		version := leader.tree.Version
+
+		for _, node := range nodes {
+			if node == leader || node == except {
+				continue
+			}
+
+			var got []string
+			var gotVersion int64
+			for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				node.View(func(tree *Tree, table *ChunkTable) {
+					got, _ = tree.LS(".")
+					gotVersion = tree.Version
+				})
+
+				if gotVersion == version {
+					break
+				}
+			}
+
+			if gotVersion != version || !reflect.DeepEqual(got, want) {
+				t.Errorf("%s has %v at version %d, want %v at version %d", node.Self, got, gotVersion, want, version)
+			}
+		}
+	}
+
+	leader := waitLeader(t, nil)
+
+	t.Run("commit on the majority",
+		func(t *testing.T) {
+			leader.tree.CreateDirectory("a")
+			leader.tree.CreateFile("a/b.txt", 10)
+
+			if err := leader.WaitCommitted(leader.tree.Version); err != nil {
+				t.Fatal(err)
+			}
+
+			assertReplicated(t, leader, nil)
+		})
+
+	t.Run("elect a new leader once the leader is gone",
+		func(t *testing.T) {
+			old, oldTerm := leader, leader.Term()
+			old.Stop()
+
+			leader = waitLeader(t, old)
+			if leader.Term() <= oldTerm {
+				t.Errorf("new leader is in term %d, the old one was in %d", leader.Term(), oldTerm)
+			}
+
+			leader.tree.CreateDirectory("c")
+			if err := leader.WaitCommitted(leader.tree.Version); err != nil {
+				t.Fatal(err)
+			}
+
+			if !leader.tree.Exists("a/b.txt") {
+				t.Errorf("committed file was lost")
+			}
+
+			assertReplicated(t, leader, old)
+		})
+}
+
+func TestRaft_SideEffects(t *testing.T) {
+	// the peers have replicated the records before 5 of 7
+	r := &Raft{role: LEADER, last: 7, commit: 5, match: map[string]int64{"b": 5, "c": 5}}
+
+	started := make(chan int64, 2)
+	r.after(5, func() { started <- 5 })
+	r.after(7, func() { started <- 7 })
+
+	select {
+	case version := <-started:
+		if version != 5 {
+			t.Errorf("effect of the uncommitted version %d was started", version)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("effect of the committed version was not started")
+	}
+
+	r.mu.Lock()
+	r.follow(0, "")
+	r.match["b"] = 7
+	r.updateCommit()
+	r.mu.Unlock()
+
+	select {
+	case version := <-started:
+		t.Errorf("effect of version %d was started after stepping down", version)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultSnapshotsKept = 2
+
+// Snapshot is a point-in-time image of the metadata. The tree and the chunk
+// table are saved together, so that they never disagree after recovery.
+type Snapshot struct {
+	Tree   *Tree
+	Chunks *ChunkTable
+}
+
+// Snapshot saves the tree along with the chunk table as <TreeGobName>.<version>
+// and, once it is durable, starts the log over and drops the oldest snapshots.
+// The log is kept as the segment <TreeLogName>.<version>, so that an older
+// snapshot is caught up with segments, if the newer ones are broken.
+func (t *Tree) Snapshot(table *ChunkTable) error {
+	t.ClearRemoved()
+	t.SnapshotVersion, t.SnapshotTerm = t.Version, t.Term
+
+	if err := SaveSnapshot(t.Conf.TreeGobName, t.Version, &Snapshot{t, table}); err != nil {
+		return err
+	}
+
+	if err := os.Rename(t.Conf.TreeLogName, snapshotName(t.Conf.TreeLogName, t.Version)); err != nil && !os.IsNotExist(err) {
+		// records of the log are older than the snapshot and are skipped
+		log.Printf("warning: could not rotate the log: %v", err)
+	}
+
+	kept := t.Conf.SnapshotsKept
+	if kept <= 0 {
+		kept = defaultSnapshotsKept
+	}
+	pruneSnapshots(t.Conf.TreeGobName, kept)
+	pruneSegments(t.Conf.TreeLogName, t.Conf.TreeGobName)
+
+	return nil
+}
+
+// snapshotIfDue takes the snapshot Commit has asked for. It is called once
+// the operation is done along with its changes to the chunk table, so that
+// they are saved together. Expects treemu to be locked.
+func (t *Tree) snapshotIfDue(table *ChunkTable) {
+	if !t.snapshotDue {
+		return
+	}
+	t.snapshotDue = false
+
+	if err := t.Snapshot(table); err != nil {
+		log.Println(err)
+	}
+}
+
+// snapshotWhenDue snapshots the global tree after the request, if it is due.
+func snapshotWhenDue(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+
+		treemu.RLock()
+		due := t.snapshotDue
+		treemu.RUnlock()
+
+		if due {
+			treemu.Lock()
+			t.snapshotIfDue(ct)
+			treemu.Unlock()
+		}
+	})
+}
+
+// SaveSnapshot writes the snapshot to a temporary file, which is renamed
+// once it is synced to disk. Either the whole snapshot is saved, or none.
+func SaveSnapshot(base string, version int64, snapshot *Snapshot) error {
+	dir, name := filepath.Split(base)
+	if dir == "" {
+		dir = "."
+	}
+
+	tmp, err := ioutil.TempFile(dir, name+".tmp")
+	if err != nil {
+		return fmt.Errorf("save snapshot: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := gob.NewEncoder(tmp).Encode(snapshot); err != nil {
+		tmp.Close()
+		return fmt.Errorf("save snapshot: encode: %v", err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("save snapshot: sync: %v", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("save snapshot: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), snapshotName(base, version)); err != nil {
+		return fmt.Errorf("save snapshot: %v", err)
+	}
+
+	// the rename itself is durable only once the directory is synced
+	if err := syncDir(dir); err != nil {
+		return fmt.Errorf("save snapshot: sync %s: %v", dir, err)
+	}
+
+	return nil
+}
+
+// LoadSnapshot loads the latest snapshot that can be decoded, falling back
+// to older ones. Returns an error satisfying os.IsNotExist if there are no
+// snapshots at all.
+func LoadSnapshot(base string, pool *PoolInfo) (*Tree, *ChunkTable, error) {
+	versions, err := snapshotVersions(base)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load snapshot: %v", err)
+	}
+
+	if len(versions) == 0 {
+		return nil, nil, &os.PathError{Op: "load snapshot", Path: base + ".*", Err: os.ErrNotExist}
+	}
+
+	for i := len(versions) - 1; i >= 0; i-- {
+		filename := snapshotName(base, versions[i])
+
+		snapshot, err := readSnapshot(filename)
+		if err != nil {
+			log.Printf("Snapshot %s is broken, trying an older one: %v", filename, err)
+			continue
+		}
+
+		snapshot.Chunks.relink(pool)
+		return snapshot.Tree, snapshot.Chunks, nil
+	}
+
+	return nil, nil, fmt.Errorf("load snapshot: all %d snapshots are broken", len(versions))
+}
+
+func readSnapshot(filename string) (*Snapshot, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return decodeSnapshot(file)
+}
+
+// decodeSnapshot returns the snapshot with the tree relinked, fileservers of
+// the chunk table are yet to be relinked.
+func decodeSnapshot(r io.Reader) (*Snapshot, error) {
+	var snapshot Snapshot
+	if err := gob.NewDecoder(r).Decode(&snapshot); err != nil {
+		return nil, fmt.Errorf("decode: %v", err)
+	}
+
+	if snapshot.Tree == nil {
+		return nil, fmt.Errorf("no tree")
+	}
+
+	if err := snapshot.Tree.relink(); err != nil {
+		return nil, err
+	}
+
+	if snapshot.Chunks == nil {
+		snapshot.Chunks = NewChunkTable()
+	}
+
+	return &snapshot, nil
+}
+
+// latestSnapshot returns false if there are no snapshots.
+func latestSnapshot(base string) (string, int64, bool) {
+	versions, err := snapshotVersions(base)
+	if err != nil || len(versions) == 0 {
+		return "", 0, false
+	}
+
+	version := versions[len(versions)-1]
+	return snapshotName(base, version), version, true
+}
+
+func snapshotName(base string, version int64) string {
+	return fmt.Sprintf("%s.%d", base, version)
+}
+
+// snapshotVersions returns versions of saved snapshots, or of log segments,
+// in ascending order.
+func snapshotVersions(base string) ([]int64, error) {
+	matches, err := filepath.Glob(base + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []int64{}
+	for _, match := range matches {
+		version, err := strconv.ParseInt(strings.TrimPrefix(match, base+"."), 10, 64)
+		if err != nil {
+			// temporary files
+			continue
+		}
+		versions = append(versions, version)
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+
+	return versions, nil
+}
+
+func pruneSnapshots(base string, kept int) {
+	versions, err := snapshotVersions(base)
+	if err != nil {
+		log.Printf("warning: could not list snapshots: %v", err)
+		return
+	}
+
+	for i := 0; i < len(versions)-kept; i++ {
+		if err := os.Remove(snapshotName(base, versions[i])); err != nil {
+			log.Printf("warning: could not remove an old snapshot: %v", err)
+		}
+	}
+}
+
+// pruneSegments drops segments of the log, which lead up to the oldest kept
+// snapshot, no snapshot is caught up with them anymore.
+func pruneSegments(logName string, base string) {
+	snapshots, err := snapshotVersions(base)
+	if err != nil || len(snapshots) == 0 {
+		return
+	}
+
+	segments, err := snapshotVersions(logName)
+	if err != nil {
+		log.Printf("warning: could not list log segments: %v", err)
+		return
+	}
+
+	for _, version := range segments {
+		if version > snapshots[0] {
+			break
+		}
+		if err := os.Remove(snapshotName(logName, version)); err != nil {
+			log.Printf("warning: could not remove an old log segment: %v", err)
+		}
+	}
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
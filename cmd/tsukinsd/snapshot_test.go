@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestTree_Snapshot(t *testing.T) {
+	dir := t.TempDir()
+	namenode := Namenode{
+		TreeLogName:      path.Join(dir, "tree.log"),
+		TreeGobName:      path.Join(dir, "tree.gob"),
+		TreeUpdatePeriod: -1,
+		SnapshotsKept:    2,
+	}
+
+	tree := InitTree(namenode)
+	table := NewChunkTable()
+
+	snapshot := func() {
+		t.Helper()
+		if err := tree.Snapshot(table); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tree.CreateDirectory("a")
+	snapshot()
+	tree.CreateDirectory("b")
+	snapshot()
+	tree.CreateDirectory("c")
+	snapshot()
+
+	t.Run("keep latest snapshots",
+		func(t *testing.T) {
+			got, err := snapshotVersions(namenode.TreeGobName)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := []int64{2, 3}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got snapshots %v, want %v", got, want)
+			}
+
+			if _, err := os.Stat(namenode.TreeLogName); !os.IsNotExist(err) {
+				t.Errorf("log was not rotated after snapshot")
+			}
+
+			// segments are kept for snapshots newer than the oldest one
+			if got, _ := snapshotVersions(namenode.TreeLogName); !reflect.DeepEqual(got, []int64{3}) {
+				t.Errorf("got log segments %v, want [3]", got)
+			}
+		})
+
+	t.Run("load latest snapshot",
+		func(t *testing.T) {
+			loaded, _, err := LoadSnapshot(namenode.TreeGobName, &PoolInfo{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, _ := loaded.LS(".")
+			want := []string{"a/", "b/", "c/"}
+			if loaded.Version != 3 || !reflect.DeepEqual(got, want) {
+				t.Errorf("got tree %v at version %d, want %v at version %d", got, loaded.Version, want, 3)
+			}
+		})
+
+	t.Run("fall back to older snapshot",
+		func(t *testing.T) {
+			broken := snapshotName(namenode.TreeGobName, 3)
+			if err := ioutil.WriteFile(broken, []byte("half of a snapsh"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			loaded, _, err := LoadSnapshot(namenode.TreeGobName, &PoolInfo{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if loaded.Version != 2 || loaded.Exists("c") {
+				t.Errorf("got tree at version %d, want %d", loaded.Version, 2)
+			}
+		})
+
+	t.Run("no snapshots",
+		func(t *testing.T) {
+			_, _, err := LoadSnapshot(path.Join(dir, "nothing.gob"), &PoolInfo{})
+			if !os.IsNotExist(err) {
+				t.Errorf("got error %v, want not exist", err)
+			}
+		})
+}
+
+func TestRecover_BrokenSnapshot(t *testing.T) {
+	f := newTreeFixture(t)
+	tree, table := f.tree, f.table
+
+	tree.CreateDirectory("a")
+	f.upload(t, "a/x", "x1")
+	f.snapshot(t)
+
+	tree.CreateDirectory("b")
+	removed, _ := tree.RemoveFile("a/x")
+	table.Unref(removed.Chunks)
+	f.upload(t, "b/y", "y1")
+	f.snapshot(t)
+
+	tree.CreateDirectory("c")
+	tree.CreateSymlink("c/y", "/b/y")
+
+	broken := snapshotName(f.namenode.TreeGobName, tree.SnapshotVersion)
+	if err := ioutil.WriteFile(broken, []byte("half of a snapsh"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("segments catch the older snapshot up",
+		func(t *testing.T) {
+			recovered, recoveredTable := f.recover(t)
+
+			if recovered.Version != tree.Version {
+				t.Errorf("got version %d, want %d", recovered.Version, tree.Version)
+			}
+
+			for _, dir := range []string{".", "a", "b", "c"} {
+				want, _ := tree.LS(dir)
+				got, err := recovered.LS(dir)
+				if err != nil || !reflect.DeepEqual(got, want) {
+					t.Errorf("ls %s: got %v (%v), want %v", dir, got, err, want)
+				}
+			}
+
+			for chunkID, want := range map[string]int{"x1": 0, "y1": 1} {
+				if got := recoveredTable.Table[chunkID].Refs; got != want {
+					t.Errorf("chunk %s: got %d references, want %d", chunkID, got, want)
+				}
+			}
+		})
+
+	t.Run("missing segment",
+		func(t *testing.T) {
+			if err := os.Remove(snapshotName(f.namenode.TreeLogName, tree.SnapshotVersion)); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, _, err := Recover(f.namenode, &PoolInfo{}); err == nil {
+				t.Errorf("recovered the tree with records missing")
+			}
+		})
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Standby follows the log of the primary nameserver, so that it can take
+// over once promoted. Until then, it refuses clients and only watches
+// fileservers.
+type Standby struct {
+	Primary string // private address of the primary nameserver
+	Secret  string // shared by the nameservers, see clusterOnly
+
+	// held while records are applied, so that promotion waits for them
+	mu       sync.Mutex
+	promoted bool
+}
+
+// nil, if the nameserver was started as the primary one
+var standby *Standby
+
+func isStandby() bool {
+	return standby != nil && !standby.Promoted()
+}
+
+func (s *Standby) Promoted() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.promoted
+}
+
+// Promote returns false, if the standby has already been promoted.
+func (s *Standby) Promote() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.promoted {
+		return false
+	}
+
+	s.promoted = true
+	return true
+}
+
+// standbyTimeout bounds requests of the standby to the primary nameserver.
+const standbyTimeout = 30 * time.Second
+
+// Follow catches up with the primary until promoted. Records are fetched
+// without holding the tree, it is locked only to apply them.
+func (s *Standby) Follow(period time.Duration) {
+	if period <= 0 {
+		period = time.Second
+	}
+
+	log.Printf("Following the primary nameserver at %s", s.Primary)
+
+	for !s.Promoted() {
+		treemu.RLock()
+		version := t.Version
+		treemu.RUnlock()
+
+		update, err := s.fetch(version)
+		if err == nil {
+			s.mu.Lock()
+			if !s.promoted {
+				treemu.Lock()
+				t, ct, err = s.apply(update, t, ct, storages)
+				treemu.Unlock()
+			}
+			s.mu.Unlock()
+		}
+
+		if err != nil {
+			log.Printf("warning: could not follow %s: %v", s.Primary, err)
+		}
+
+		time.Sleep(period)
+	}
+}
+
+// update is what the standby has fetched from the primary.
+type update struct {
+	snapshot *Snapshot // if the primary does not have the records anymore
+	records  []LogRecord
+}
+
+// CatchUp applies new records of the primary's log to the tree and saves
+// them to the own log. If the primary does not have the records anymore,
+// the tree and the table are replaced with the primary's snapshot.
+func (s *Standby) CatchUp(tree *Tree, table *ChunkTable, pool *PoolInfo) (*Tree, *ChunkTable, error) {
+	update, err := s.fetch(tree.Version)
+	if err != nil {
+		return tree, table, err
+	}
+
+	return s.apply(update, tree, table, pool)
+}
+
+// fetch gets the records of the primary starting with the version, or its
+// snapshot along with the records after it.
+func (s *Standby) fetch(version int64) (*update, error) {
+	records, err := s.fetchLog(version)
+	if err != errLogGone {
+		return &update{records: records}, err
+	}
+
+	snapshot, err := s.fetchSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	records, err = s.fetchLog(snapshot.Tree.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	return &update{snapshot: snapshot, records: records}, nil
+}
+
+var errLogGone = fmt.Errorf("oplog: the records are in the snapshot")
+
+// get requests the primary on behalf of the cluster.
+func (s *Standby) get(url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(clusterSecretHeader, s.Secret)
+
+	client := &http.Client{Timeout: standbyTimeout}
+	return client.Do(req)
+}
+
+func (s *Standby) fetchLog(from int64) ([]LogRecord, error) {
+	resp, err := s.get(fmt.Sprintf("http://%s/oplog?from=%d", s.Primary, from))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusGone:
+		return nil, errLogGone
+	default:
+		return nil, fmt.Errorf("oplog: %s", resp.Status)
+	}
+
+	records := []LogRecord{}
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		var record LogRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("oplog: %v", err)
+		}
+
+		records = append(records, record)
+	}
+
+	return records, scanner.Err()
+}
+
+func (s *Standby) fetchSnapshot() (*Snapshot, error) {
+	resp, err := s.get(fmt.Sprintf("http://%s/snapshot", s.Primary))
+	if err != nil {
+		return nil, fmt.Errorf("bootstrap: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bootstrap: %s", resp.Status)
+	}
+
+	snapshot, err := decodeSnapshot(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("bootstrap: %v", err)
+	}
+
+	return snapshot, nil
+}
+
+// apply expects the tree to be locked.
+func (s *Standby) apply(update *update, tree *Tree, table *ChunkTable, pool *PoolInfo) (*Tree, *ChunkTable, error) {
+	if update.snapshot != nil {
+		snapshot := update.snapshot
+		snapshot.Chunks.relink(pool)
+		snapshot.Tree.Conf = tree.Conf
+
+		if err := snapshot.Tree.Snapshot(snapshot.Chunks); err != nil {
+			return tree, table, fmt.Errorf("bootstrap: %v", err)
+		}
+
+		log.Printf("Bootstrapped from the snapshot of %s at version %d", s.Primary, snapshot.Tree.Version)
+		tree, table = snapshot.Tree, snapshot.Chunks
+	}
+
+	for _, record := range update.records {
+		if record.Version < tree.Version {
+			continue
+		} else if record.Version > tree.Version {
+			return tree, table, fmt.Errorf("oplog: expected record %d, got %d", tree.Version, record.Version)
+		}
+
+		if err := AppendLogRecord(tree.Conf.TreeLogName, record); err != nil {
+			return tree, table, err
+		}
+
+		if err := tree.ApplyRecord(record, table, pool); err != nil {
+			log.Printf("Could not apply %s %v: %v", record.Command, record.Args, err)
+		}
+
+		if tree.Version%100 == tree.Conf.TreeUpdatePeriod {
+			if err := tree.Snapshot(table); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+
+	return tree, table, nil
+}
+
+// WriteLogFrom writes records of the log starting with the version, as they
+// are in the log.
+func WriteLogFrom(w io.Writer, logName string, from int64) error {
+	f, err := os.Open(logName)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("open log: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		var record LogRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// the record is being written
+			break
+		}
+
+		if record.Version < from {
+			continue
+		}
+
+		if _, err := w.Write(append(scanner.Bytes(), '\n')); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+func oplog(w http.ResponseWriter, r *http.Request) {
+	from, err := strconv.ParseInt(r.URL.Query().Get("from"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// t is replaced, when the nameserver bootstraps from a snapshot
+	treemu.RLock()
+	namenode := t.Conf
+	treemu.RUnlock()
+
+	// the log starts with the latest snapshot
+	if _, version, ok := latestSnapshot(namenode.TreeGobName); ok && from < version {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if err := WriteLogFrom(w, namenode.TreeLogName, from); err != nil {
+		log.Printf("warning: could not send the log: %v", err)
+	}
+}
+
+func snapshot(w http.ResponseWriter, r *http.Request) {
+	treemu.RLock()
+	namenode := t.Conf
+	treemu.RUnlock()
+
+	filename, _, ok := latestSnapshot(namenode.TreeGobName)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	io.Copy(w, file)
+}
+
+// clusterSecretHeader carries the secret of the cluster in requests of
+// standbys.
+const clusterSecretHeader = "X-Tsuki-Cluster-Secret"
+
+// clusterOnly refuses requests without the secret shared by the nameservers.
+// Nothing is served, if the secret is not set.
+func clusterOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		secret := conf.Namenode.ClusterSecret
+		if secret == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get(clusterSecretHeader)), []byte(secret)) != 1 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func promote(w http.ResponseWriter, r *http.Request) {
+	if standby == nil || !standby.Promote() {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintln(w, "the nameserver is already primary")
+		return
+	}
+
+	log.Printf("Promoted to primary at version %d", t.Version)
+
+	go storages.HeartbeatManager(true)
+	go storages.HeartbeatManager(false)
+
+	fmt.Fprintln(w, "the nameserver is primary now")
+}
+
+func refuseOnStandby(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isStandby() {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: "the nameserver is a standby"})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func useTree(tree *Tree, table *ChunkTable) {
+	treemu.Lock()
+	defer treemu.Unlock()
+
+	t, ct = tree, table
+}
+
+func TestStandby_CatchUp(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(path.Join(dir, "primary"), 0755)
+	os.Mkdir(path.Join(dir, "standby"), 0755)
+
+	namenode := func(name string) Namenode {
+		return Namenode{
+			TreeLogName:      path.Join(dir, name, "tree.log"),
+			TreeGobName:      path.Join(dir, name, "tree.gob"),
+			TreeUpdatePeriod: -1,
+		}
+	}
+
+	// handlers of the primary use the global tree
+	tree := InitTree(namenode("primary"))
+	useTree(tree, NewChunkTable())
+	conf = &Config{Namenode: namenode("primary")}
+	conf.Namenode.ClusterSecret = "secret"
+
+	primary := httptest.NewServer(privateRouter())
+	defer primary.Close()
+
+	s := &Standby{Primary: strings.TrimPrefix(primary.URL, "http://"), Secret: "secret"}
+	followerTree, followerTable := InitTree(namenode("standby")), NewChunkTable()
+	pool := &PoolInfo{}
+
+	assertFollows := func(t *testing.T) {
+		t.Helper()
+
+		var err error
+		followerTree, followerTable, err = s.CatchUp(followerTree, followerTable, pool)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want, _ := tree.LS(".")
+		got, _ := followerTree.LS(".")
+		if followerTree.Version != tree.Version || !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v at version %d, want %v at version %d", got, followerTree.Version, want, tree.Version)
+		}
+	}
+
+	t.Run("follow the log",
+		func(t *testing.T) {
+			tree.CreateDirectory("a")
+			tree.CreateDirectory("b")
+			assertFollows(t)
+
+			tree.CreateFile("c.txt", 0)
+			assertFollows(t)
+		})
+
+	t.Run("bootstrap from snapshot once the log is dropped",
+		func(t *testing.T) {
+			tree.RemoveDirectory("a")
+			if err := tree.Snapshot(ct); err != nil {
+				t.Fatal(err)
+			}
+			tree.CreateDirectory("d")
+			assertFollows(t)
+		})
+
+	t.Run("refuse requests without the secret",
+		func(t *testing.T) {
+			for _, secret := range []string{"", "guess"} {
+				stranger := &Standby{Primary: s.Primary, Secret: secret}
+				if _, err := stranger.fetchLog(0); err == nil {
+					t.Errorf("got the log with secret %q", secret)
+				}
+				if _, err := stranger.fetchSnapshot(); err == nil {
+					t.Errorf("got the snapshot with secret %q", secret)
+				}
+			}
+		})
+
+	t.Run("recover the followed tree",
+		func(t *testing.T) {
+			recovered, _, err := Recover(followerTree.Conf, pool)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want, _ := tree.LS(".")
+			got, _ := recovered.LS(".")
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+}
+
+func TestStandby_FollowWithoutHoldingTheTree(t *testing.T) {
+	dir := t.TempDir()
+	useTree(InitTree(Namenode{
+		TreeLogName:      path.Join(dir, "tree.log"),
+		TreeGobName:      path.Join(dir, "tree.gob"),
+		TreeUpdatePeriod: -1,
+	}), NewChunkTable())
+	storages = &PoolInfo{}
+
+	fetching := make(chan struct{}, 1)
+	release := make(chan struct{})
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case fetching <- struct{}{}:
+		default:
+		}
+		<-release
+	}))
+	defer primary.Close()
+
+	s := &Standby{Primary: strings.TrimPrefix(primary.URL, "http://")}
+	followed := make(chan struct{})
+	go func() {
+		s.Follow(10 * time.Millisecond)
+		close(followed)
+	}()
+
+	<-fetching
+
+	locked := make(chan struct{})
+	go func() {
+		treemu.Lock()
+		treemu.Unlock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Error("the tree is held while the log is fetched")
+	}
+
+	promoted := make(chan struct{})
+	go func() {
+		s.Promote()
+		close(promoted)
+	}()
+
+	select {
+	case <-promoted:
+	case <-time.After(time.Second):
+		t.Error("promotion waits for the log to be fetched")
+	}
+
+	close(release)
+	select {
+	case <-followed:
+	case <-time.After(time.Second):
+		t.Error("promoted standby keeps following")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// Symbolic links are nodes pointing at another address, absolute or relative
+// to the directory of the link, which need not exist. CD, LS, GetFile and the
+// operations built on them follow links, the rest work on links themselves,
+// as rm and mv do. The target is never rewritten, so a link keeps pointing at
+// the address when its target is moved.
+const maxSymlinks = 16 // followed while one address is resolved
+
+// IsSymlink tells whether the node is a symbolic link.
+func (node *Node) IsSymlink() bool {
+	return node.Symlink != ""
+}
+
+// CreateSymlink creates the link to the target.
+func (t *Tree) CreateSymlink(address string, target string) (*Node, error) {
+	return t.createSymlink(address, target, time.Now())
+}
+
+// createSymlink creates the link as of the time, see createFile.
+func (t *Tree) createSymlink(address string, target string, createdOn time.Time) (*Node, error) {
+	address, matched := CleanAddress(address)
+
+	if !matched {
+		return nil, fmt.Errorf("/%s wrong file name format", address)
+	}
+	if IsReadOnly(address) {
+		return nil, readOnly(address)
+	}
+	if target == "" {
+		return nil, fmt.Errorf("/%s empty link target", address)
+	}
+	if _, matched := CleanAddress(target); !matched {
+		return nil, fmt.Errorf("%s wrong link target format", target)
+	}
+
+	if _, ok := t.Nodes[address]; ok || address == "." {
+		return nil, fmt.Errorf("/%s the path already exists", address)
+	}
+
+	dirPath := path.Dir(address)
+	if !t.DirectoryExists(dirPath) {
+		return nil, fmt.Errorf("/%s/ directory does not exist", dirPath)
+	}
+	if err := t.allowEntries(address); err != nil {
+		return nil, err
+	}
+	if err := t.checkQuota(dirPath, 0, 1, ""); err != nil {
+		return nil, err
+	}
+	dir := t.Nodes[dirPath]
+
+	link := &Node{
+		Address:   address,
+		Parent:    dir.Address,
+		Pending:   map[string]bool{},
+		CreatedOn: createdOn,
+		Symlink:   target,
+	}
+
+	t.own(link)
+	// permissions of the target apply, as in POSIX
+	if link.Mode != 0 {
+		link.Mode = 0777
+	}
+
+	dir.Childs = append(dir.Childs, link)
+	t.Nodes[address] = link
+	t.account(dir.Address, 0, 1)
+
+	t.CommitUpdate("symlink", address, target, createdOn.Format(time.RFC3339Nano))
+
+	return link, nil
+}
+
+// Readlink returns the target of the link as it was given.
+func (t *Tree) Readlink(address string) (string, error) {
+	address, _ = CleanAddress(address)
+
+	node, ok := t.Nodes[address]
+	if !ok || !t.Exists(address) {
+		return "", fmt.Errorf("/%s path does not exist", address)
+	}
+	if !node.IsSymlink() {
+		return "", fmt.Errorf("/%s is not a symbolic link", address)
+	}
+
+	return node.Symlink, nil
+}
+
+// Resolve follows the links on the way to the address, the last one included.
+// The address need not exist. Links that lead back to themselves are
+// reported, as are chains longer than maxSymlinks.
+func (t *Tree) Resolve(address string) (string, error) {
+	address, _ = CleanAddress(address)
+
+	resolved := "."
+	rest := splitAddress(address)
+	seen := map[string]bool{}
+	followed := 0
+
+	for len(rest) > 0 {
+		next := path.Join(resolved, rest[0])
+		rest = rest[1:]
+
+		node, ok := t.Nodes[next]
+		if !ok || !node.IsSymlink() || node.Removed {
+			resolved = next
+			continue
+		}
+
+		// the same link with the same remainder leads to the same place again
+		state := path.Join(append([]string{next}, rest...)...)
+		if seen[state] {
+			return "", fmt.Errorf("/%s symbolic link loop at /%s", address, next)
+		}
+		seen[state] = true
+
+		followed++
+		if followed > maxSymlinks {
+			return "", fmt.Errorf("/%s too many levels of symbolic links", address)
+		}
+
+		target := node.Symlink
+		if !strings.HasPrefix(target, "/") {
+			target = path.Join(path.Dir(next), target)
+		}
+		// targets cannot point above the root
+		target, _ = CleanAddress(path.Join("/", target))
+
+		rest = append(splitAddress(target), rest...)
+		resolved = "."
+	}
+
+	return resolved, nil
+}
+
+func splitAddress(address string) []string {
+	if address == "." || address == "" {
+		return nil
+	}
+
+	return strings.Split(address, "/")
+}
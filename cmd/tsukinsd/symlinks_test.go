@@ -0,0 +1,114 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTree_Symlinks(t *testing.T) {
+	f := newTreeFixture(t)
+	tree := f.tree
+
+	tree.CreateDirectory("datasets")
+	tree.CreateDirectory("datasets/2024")
+	tree.CreateFile("datasets/2024/users.csv", 10)
+
+	t.Run("links are followed",
+		func(t *testing.T) {
+			if _, err := tree.CreateSymlink("datasets/latest", "2024"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tree.CreateSymlink("users.csv", "/datasets/latest/users.csv"); err != nil {
+				t.Fatal(err)
+			}
+
+			if address, err := tree.CD("/datasets/latest"); err != nil || address != "datasets/2024" {
+				t.Errorf("cd: got %q, %v, want datasets/2024", address, err)
+			}
+			if list, err := tree.LS("datasets/latest"); err != nil || !reflect.DeepEqual(list, []string{"users.csv"}) {
+				t.Errorf("ls: got %v, %v, want [users.csv]", list, err)
+			}
+			if list, _ := tree.LS("datasets"); !reflect.DeepEqual(list, []string{"2024/", "latest@"}) {
+				t.Errorf("ls: got %v, want [2024/ latest@]", list)
+			}
+
+			file, err := tree.GetFile("users.csv")
+			if err != nil || file.Address != "datasets/2024/users.csv" {
+				t.Errorf("got %v, %v, want datasets/2024/users.csv", file, err)
+			}
+
+			if target, _ := tree.Readlink("datasets/latest"); target != "2024" {
+				t.Errorf("readlink: got %q, want 2024", target)
+			}
+			if info, _ := tree.NodeInfo("datasets/latest"); !strings.Contains(info, "Symbolic link: -> 2024") {
+				t.Errorf("info does not show the target:\n%s", info)
+			}
+		})
+
+	t.Run("links are repointed",
+		func(t *testing.T) {
+			tree.CreateDirectory("datasets/2025")
+			tree.RemoveFile("datasets/latest")
+			tree.CreateSymlink("datasets/latest", "2025")
+
+			if _, err := tree.GetFile("users.csv"); err == nil {
+				t.Errorf("dangling link was followed")
+			}
+			if address, _ := tree.CD("datasets/latest"); address != "datasets/2025" {
+				t.Errorf("cd: got %q, want datasets/2025", address)
+			}
+		})
+
+	t.Run("loops",
+		func(t *testing.T) {
+			// links before are saved by the snapshot, the rest are replayed
+			f.snapshot(t)
+
+			tree.CreateSymlink("a", "b")
+			tree.CreateSymlink("b", "/a")
+			if _, err := tree.CD("a"); err == nil || !strings.Contains(err.Error(), "loop") {
+				t.Errorf("got %v, want a loop", err)
+			}
+
+			// the link grows the address every time it is followed
+			tree.CreateSymlink("c", "c/d")
+			if _, err := tree.GetFile("c"); err == nil || !strings.Contains(err.Error(), "too many levels") {
+				t.Errorf("got %v, want too many levels", err)
+			}
+
+			// following the same link twice is not a loop
+			tree.CreateSymlink("datasets/self", ".")
+			if address, err := tree.CD("datasets/self/self/2024"); err != nil || address != "datasets/2024" {
+				t.Errorf("got %q, %v, want datasets/2024", address, err)
+			}
+
+			// info works on the link itself
+			if _, err := tree.NodeInfo("a"); err != nil {
+				t.Errorf("info of a looping link: %v", err)
+			}
+		})
+
+	t.Run("permissions of the target apply",
+		func(t *testing.T) {
+			tree.Chown("datasets/2024", adminName, "")
+			tree.Chmod("datasets/2024", 0700)
+
+			bob := &User{Name: "bob"}
+			resolved, _ := tree.Resolve("datasets/self/2024/users.csv")
+			if err := tree.CheckAccess(bob, resolved, permRead); err == nil {
+				t.Errorf("read a file in a closed directory through a link")
+			}
+		})
+
+	t.Run("replay",
+		func(t *testing.T) {
+			recovered, _ := f.recover(t)
+
+			for _, address := range []string{"datasets/latest", "users.csv", "a", "b", "c", "datasets/self"} {
+				if recovered.Nodes[address] == nil || recovered.Nodes[address].Symlink != tree.Nodes[address].Symlink {
+					t.Errorf("/%s link was not recovered", address)
+				}
+			}
+		})
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Removed files and directories are moved to /.trash/<user>/<id>, unless
+// the trash is off, see TrashRetention. There they keep their chunks and
+// versions, and may be restored to where they were removed from, until the
+// retention runs out and they are purged. Every user sees, restores and
+// purges only the own trash, which is closed to others. Objects removed on
+// behalf of no one go to the trash of admin.
+const trashDir = ".trash"
+
+// userTrash returns the trash of the acting user.
+func (t *Tree) userTrash() string {
+	if t.acting == nil {
+		return path.Join(trashDir, adminName)
+	}
+
+	return path.Join(trashDir, t.acting.Name)
+}
+
+// userTrashDir returns the trash of the acting user, creating it if it does
+// not exist yet.
+func (t *Tree) userTrashDir(createdOn time.Time) (*Node, error) {
+	if _, err := t.readOnlyDir(trashDir, createdOn); err != nil {
+		return nil, err
+	}
+
+	address := t.userTrash()
+	_, existed := t.Nodes[address]
+
+	dir, err := t.readOnlyDir(address, createdOn)
+	if err != nil || existed {
+		return dir, err
+	}
+
+	dir.Owner = path.Base(address)
+	dir.Group = ""
+	dir.Mode = 0700
+
+	return dir, nil
+}
+
+// InTrash tells whether the address is in the trash, which is read-only.
+func InTrash(address string) bool {
+	address, _ = CleanAddress(address)
+
+	return address == trashDir || strings.HasPrefix(address, trashDir+"/")
+}
+
+// Trash moves the file or the directory to the trash. Chunks stay referenced
+// until it is purged.
+func (t *Tree) Trash(address string, removedOn time.Time, table *ChunkTable) (*Node, error) {
+	address, _ = CleanAddress(address)
+
+	// versions grow with every operation, so that ids are not reused
+	return t.trash(address, fmt.Sprintf("%d-%s", t.Version, path.Base(address)), removedOn, table)
+}
+
+func (t *Tree) trash(address string, id string, removedOn time.Time, table *ChunkTable) (*Node, error) {
+	address, matched := CleanAddress(address)
+
+	if !matched {
+		return nil, fmt.Errorf("/%s wrong file name format", address)
+	}
+	if address == "." {
+		return nil, fmt.Errorf("cannot remove the root directory")
+	}
+	if IsReadOnly(address) {
+		return nil, readOnly(address)
+	}
+	if !t.Exists(address) {
+		return nil, fmt.Errorf("/%s path does not exist", address)
+	}
+	if err := t.allowEntries(address); err != nil {
+		return nil, err
+	}
+	if id == "" || strings.Contains(id, "/") {
+		return nil, fmt.Errorf("%q wrong trash id", id)
+	}
+
+	trashed := path.Join(t.userTrash(), id)
+	if _, ok := t.Nodes[trashed]; ok {
+		return nil, fmt.Errorf("/%s already exists", trashed)
+	}
+
+	dir, err := t.userTrashDir(removedOn)
+	if err != nil {
+		return nil, err
+	}
+
+	node := t.Nodes[address]
+	t.relocate(node, trashed, dir, table)
+	node.TrashedFrom = address
+	node.TrashedOn = removedOn
+	node.TrashedBy = ""
+	if t.acting != nil {
+		node.TrashedBy = t.acting.Name
+	}
+
+	t.CommitUpdate("trash", address, id, removedOn.Format(time.RFC3339Nano))
+
+	return node, nil
+}
+
+// trashed finds the object in the trash of the acting user by its id or,
+// failing that, by the address it was removed from; the latest removed one
+// is taken then.
+func (t *Tree) trashed(ref string) (*Node, error) {
+	dir, ok := t.Nodes[t.userTrash()]
+	if !ok {
+		return nil, fmt.Errorf("trash is empty")
+	}
+
+	if node, ok := t.Nodes[path.Join(dir.Address, ref)]; ok && node.TrashedFrom != "" && !strings.Contains(ref, "/") {
+		return node, nil
+	}
+
+	original, _ := CleanAddress(ref)
+
+	var latest *Node
+	for _, node := range dir.Childs {
+		if node.Removed || node.TrashedFrom != original {
+			continue
+		}
+		if latest == nil || node.TrashedOn.After(latest.TrashedOn) {
+			latest = node
+		}
+	}
+
+	if latest == nil {
+		return nil, fmt.Errorf("%s is not in the trash", ref)
+	}
+
+	return latest, nil
+}
+
+// RestoreTrashed moves the object back to where it was removed from. The
+// directory it was in must exist and the address must be free.
+func (t *Tree) RestoreTrashed(ref string, table *ChunkTable) (*Node, error) {
+	node, err := t.trashed(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	id := path.Base(node.Address)
+	original := node.TrashedFrom
+
+	if t.Exists(original) {
+		return nil, fmt.Errorf("/%s the path already exists; move it away first", original)
+	}
+
+	parentDir, ok := t.Nodes[path.Dir(original)]
+	if !ok || !t.DirectoryExists(parentDir.Address) {
+		return nil, fmt.Errorf("/%s/ directory does not exist; restore it first", path.Dir(original))
+	}
+	if err := t.allowEntries(original); err != nil {
+		return nil, err
+	}
+	bytes, objects := node.usage()
+	if err := t.checkQuota(parentDir.Address, bytes, objects, node.Address); err != nil {
+		return nil, err
+	}
+
+	t.relocate(node, original, parentDir, table)
+	node.TrashedFrom = ""
+	node.TrashedOn = time.Time{}
+	node.TrashedBy = ""
+
+	t.CommitUpdate("untrash", id)
+
+	return node, nil
+}
+
+// PurgeTrashed removes the object from the trash of the acting user for good.
+// The caller releases its chunks, see HeldChunks.
+func (t *Tree) PurgeTrashed(id string) (*Node, error) {
+	node, ok := t.Nodes[path.Join(t.userTrash(), id)]
+	if !ok || node.TrashedFrom == "" || strings.Contains(id, "/") {
+		return nil, fmt.Errorf("%s is not in the trash", id)
+	}
+
+	node.Removed = true
+	t.Removed = append(t.Removed, node)
+	t.forget(node)
+
+	bytes, objects := node.usage()
+	t.account(node.Parent, -bytes, -objects)
+
+	t.CommitUpdate("purge", id)
+
+	return node, nil
+}
+
+// trashedNodes returns objects in the trash of the user, nil stands for the
+// trash of every user.
+func (t *Tree) trashedNodes(user *User) []*Node {
+	nodes := []*Node{}
+
+	root, ok := t.Nodes[trashDir]
+	if !ok {
+		return nodes
+	}
+
+	for _, dir := range root.Childs {
+		if dir.Removed || user != nil && dir.Address != path.Join(trashDir, user.Name) {
+			continue
+		}
+
+		for _, node := range dir.Childs {
+			if !node.Removed && node.TrashedFrom != "" {
+				nodes = append(nodes, node)
+			}
+		}
+	}
+
+	return nodes
+}
+
+// ExpiredTrash returns objects removed before the time as <user>/<id>.
+func (t *Tree) ExpiredTrash(before time.Time) []string {
+	expired := []string{}
+
+	for _, node := range t.trashedNodes(nil) {
+		if node.TrashedOn.Before(before) {
+			expired = append(expired, strings.TrimPrefix(node.Address, trashDir+"/"))
+		}
+	}
+
+	return expired
+}
+
+// TrashInfo lists objects in the trash of the user along with where and when
+// they were removed, the latest removed one first. nil stands for the trash
+// of every user, ids are prefixed with the user then.
+func (t *Tree) TrashInfo(user *User) []string {
+	list := []string{}
+
+	nodes := t.trashedNodes(user)
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].TrashedOn.After(nodes[j].TrashedOn) })
+
+	for _, node := range nodes {
+		original := "/" + node.TrashedFrom
+		if node.IsDirectory {
+			original += "/"
+		}
+
+		id := path.Base(node.Address)
+		if user == nil {
+			id = strings.TrimPrefix(node.Address, trashDir+"/")
+		}
+
+		list = append(list, fmt.Sprintf("%s\t%s\t%s", id, original, node.TrashedOn.Format(time.RFC3339)))
+	}
+
+	return list
+}
+
+// TrashJanitor purges objects, which have been in the trash for longer than
+// the retention.
+func TrashJanitor(period time.Duration, retention time.Duration) {
+	for {
+		time.Sleep(period)
+		CollectTrash(retention)
+	}
+}
+
+// CollectTrash purges expired objects of the global tree.
+func CollectTrash(retention time.Duration) {
+	treemu.Lock()
+	defer treemu.Unlock()
+	defer t.snapshotIfDue(ct)
+
+	// the primary purges them, the rest follow its log
+	if isPassive() {
+		return
+	}
+
+	for _, expired := range t.ExpiredTrash(time.Now().Add(-retention)) {
+		user, id := path.Split(expired)
+
+		// purged on behalf of the user, so that the log finds the trash
+		t.ActAs(t.recordUser(path.Clean(user)))
+		node, err := t.PurgeTrashed(id)
+		t.ActAs(nil)
+
+		if err != nil {
+			log.Printf("warning: could not purge %s from the trash: %v", id, err)
+			continue
+		}
+
+		log.Printf("/%s has been in the trash for longer than %v; purging", node.TrashedFrom, retention)
+		t.AfterCommit(ct.purging(ct.Unref(node.HeldChunks())))
+	}
+}
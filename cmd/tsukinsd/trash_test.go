@@ -0,0 +1,133 @@
+package main
+
+import (
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTree_Trash(t *testing.T) {
+	f := newTreeFixture(t)
+	tree, table := f.tree, f.table
+
+	tree.CreateDirectory("project")
+	tree.CreateDirectory("project/src")
+	f.upload(t, "project/a.txt", "a1")
+	f.upload(t, "project/src/b.txt", "b1")
+
+	removedOn := time.Now().Add(-time.Hour)
+
+	t.Run("removed file is restored",
+		func(t *testing.T) {
+			trashed, err := tree.Trash("project/a.txt", removedOn, table)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tree.Exists("project/a.txt") || !tree.FileExists(trashed.Address) {
+				t.Errorf("file was not moved to the trash")
+			}
+			if table.Table["a1"].File != trashed.Address {
+				t.Errorf("got chunk of %s, want of %s", table.Table["a1"].File, trashed.Address)
+			}
+
+			// the trash keeps the file as it was removed
+			if _, err := tree.CreateFile(trashed.Address, 0); err == nil {
+				t.Errorf("changed the trash")
+			}
+
+			f.upload(t, "project/a.txt", "a2")
+			if _, err := tree.RestoreTrashed("project/a.txt", table); err == nil {
+				t.Errorf("restored a file over another one")
+			}
+			tree.Trash("project/a.txt", time.Now(), table)
+
+			// the latest removed one is restored by the address
+			restored, err := tree.RestoreTrashed("project/a.txt", table)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(restored.Chunks, []string{"a2"}) || restored.Address != "project/a.txt" {
+				t.Errorf("got %v of /%s, want [a2] of /project/a.txt", restored.Chunks, restored.Address)
+			}
+
+			// and the older one by its id, once its address is free
+			got := tree.TrashInfo(nil)
+			if len(got) != 1 {
+				t.Fatalf("got trash %v, want a single object", got)
+			}
+			if _, err := tree.Move("project/a.txt", "project/src/a.txt", table); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tree.RestoreTrashed(path.Base(trashed.Address), table); err != nil {
+				t.Errorf("could not restore by the id: %v", err)
+			}
+			if table.Table["a1"].File != "project/a.txt" {
+				t.Errorf("got chunk of %s, want of project/a.txt", table.Table["a1"].File)
+			}
+		})
+
+	t.Run("directory in the trash holds chunks until purged",
+		func(t *testing.T) {
+			// the purge is replayed on top of the snapshot
+			f.snapshot(t)
+
+			trashed, err := tree.Trash("project/src", removedOn, table)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tree.Exists("project/src/b.txt") || !tree.FileExists(trashed.Address+"/b.txt") {
+				t.Errorf("directory was not moved to the trash")
+			}
+
+			if got := tree.ExpiredTrash(time.Now().Add(-time.Minute)); !reflect.DeepEqual(got, []string{path.Join(adminName, path.Base(trashed.Address))}) {
+				t.Fatalf("got %v expired, want the directory", got)
+			}
+
+			purged, err := tree.PurgeTrashed(path.Base(trashed.Address))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := table.Unref(purged.HeldChunks())
+			if len(got) != 2 {
+				t.Errorf("got %v released, want b1 and a2", got)
+			}
+			if len(tree.TrashInfo(nil)) != 0 {
+				t.Errorf("got trash %v, want it empty", tree.TrashInfo(nil))
+			}
+		})
+
+	t.Run("root and the trash itself cannot be trashed",
+		func(t *testing.T) {
+			if _, err := tree.Trash(".", time.Now(), table); err == nil {
+				t.Errorf("removed the root directory")
+			}
+			if _, err := tree.Trash(trashDir, time.Now(), table); err == nil {
+				t.Errorf("removed the trash")
+			}
+		})
+
+	t.Run("replay",
+		func(t *testing.T) {
+			tree.Trash("project/a.txt", removedOn, table)
+
+			recovered, recoveredTable := f.recover(t)
+
+			if got, want := recovered.TrashInfo(nil), tree.TrashInfo(nil); !reflect.DeepEqual(got, want) {
+				t.Errorf("got trash %v, want %v", got, want)
+			}
+
+			if recovered.Exists("project/src") {
+				t.Errorf("purged directory was recovered")
+			}
+
+			for chunkID, want := range map[string]int{"a1": 1, "b1": 0, "a2": 0} {
+				if got := recoveredTable.Table[chunkID].Refs; got != want {
+					t.Errorf("chunk %s: got %d references, want %d", chunkID, got, want)
+				}
+			}
+		})
+}
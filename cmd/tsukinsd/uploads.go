@@ -0,0 +1,401 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const defaultUploadLease = 120 * time.Second
+
+// Upload is a session of a client uploading a file. The file stays invisible
+// until the client commits the upload. An upload that is neither committed
+// nor aborted within the lease is rolled back.
+type Upload struct {
+	ID      string
+	File    *Node
+	User    string  // who began the upload, empty if restored from the tree
+	Grants  []Grant // the first one is issued for the whole file, others on reuploads
+	Expires time.Time
+}
+
+var errForeignUpload = errors.New("the upload was begun by another user")
+
+// Grant is a token issued to the client and the chunks it authorizes.
+type Grant struct {
+	Token string
+	Hosts map[string][]string // private address of a fileserver -> chunks expected there
+}
+
+// UploadTable is guarded by treemu, like the tree. Sessions are kept only by
+// the nameserver in charge, others restore them from the tree once they take
+// over.
+type UploadTable struct {
+	Sessions map[string]*Upload
+	Lease    time.Duration
+
+	// false, until sessions of the current tree are restored
+	restored bool
+}
+
+var uploads = NewUploadTable()
+
+func NewUploadTable() *UploadTable {
+	return &UploadTable{
+		Sessions: map[string]*Upload{},
+		Lease:    defaultUploadLease,
+	}
+}
+
+// Begin starts the upload on behalf of the user, nil if it is begun by the
+// nameserver itself.
+func (u *UploadTable) Begin(id string, file *Node, user *User, token string, hosts map[string][]string) *Upload {
+	upload := &Upload{
+		ID:      id,
+		File:    file,
+		Expires: time.Now().Add(u.Lease),
+	}
+	if user != nil {
+		upload.User = user.Name
+	}
+	if token != "" {
+		upload.Grants = append(upload.Grants, Grant{Token: token, Hosts: hosts})
+	}
+	u.Sessions[id] = upload
+
+	return upload
+}
+
+// Renew extends the lease of the upload of the file, if there is one.
+func (u *UploadTable) Renew(file *Node) {
+	id := file.UploadID
+	if file.Staged != nil {
+		id = file.Staged.UploadID
+	}
+
+	if upload, ok := u.Sessions[id]; ok {
+		upload.Expires = time.Now().Add(u.Lease)
+	}
+}
+
+// Reset forgets all sessions, they are restored from the tree.
+func (u *UploadTable) Reset() {
+	u.Sessions = map[string]*Upload{}
+	u.restored = false
+}
+
+// restore starts sessions for files that are being uploaded according to the
+// tree. Their tokens are unknown, so they are left to expire on fileservers.
+func (u *UploadTable) restore(tree *Tree) {
+	for _, node := range tree.Nodes {
+		id := node.UploadID
+		if node.Staged != nil {
+			id = node.Staged.UploadID
+		}
+
+		if id == "" {
+			continue
+		}
+
+		if _, ok := u.Sessions[id]; !ok {
+			u.Begin(id, node, nil, "", nil)
+		}
+	}
+
+	u.restored = true
+}
+
+// session returns the upload, if the acting user of the tree may go on with
+// it: the user who began it or an admin. Users who began restored uploads are
+// unknown, so those are left to anyone who may write the file.
+func (u *UploadTable) session(id string, tree *Tree) (*Upload, error) {
+	upload, ok := u.Sessions[id]
+	if !ok {
+		return nil, fmt.Errorf("upload %s not found; it may have expired", id)
+	}
+
+	user := tree.acting
+	if user == nil || user.Admin || user.Name == upload.User {
+		return upload, nil
+	}
+
+	if upload.User == "" && tree.CheckAccess(user, upload.File.Address, permWrite) == nil {
+		return upload, nil
+	}
+
+	return nil, fmt.Errorf("upload %s: %w", id, errForeignUpload)
+}
+
+// Commit makes the file visible, once all its chunks are confirmed. The
+// chunks of an overwritten file are purged only after the new ones replace
+// them, unless they are kept as a version.
+func (u *UploadTable) Commit(id string, tree *Tree, table *ChunkTable) (*Node, error) {
+	upload, err := u.session(id, tree)
+	if err != nil {
+		return nil, err
+	}
+
+	released, err := tree.CommitUpload(upload.File, id, time.Now())
+	if err != nil {
+		upload.Expires = time.Now().Add(u.Lease)
+		return nil, err
+	}
+
+	delete(u.Sessions, id)
+
+	if len(released) != 0 {
+		tree.AfterCommit(table.purging(table.Unref(released)))
+	}
+
+	return upload.File, nil
+}
+
+// Abort removes the file, or drops its new version, and purges the chunks of
+// the upload. Tokens are cancelled on fileservers in the background, once
+// the operation is committed.
+func (u *UploadTable) Abort(id string, tree *Tree, table *ChunkTable) error {
+	upload, err := u.session(id, tree)
+	if err != nil {
+		return err
+	}
+
+	return u.rollback(upload, tree, table)
+}
+
+// Rollback aborts the upload regardless of who began it, for expired uploads
+// and files that are removed.
+func (u *UploadTable) Rollback(id string, tree *Tree, table *ChunkTable) error {
+	upload, ok := u.Sessions[id]
+	if !ok {
+		return fmt.Errorf("upload %s not found; it may have expired", id)
+	}
+
+	return u.rollback(upload, tree, table)
+}
+
+func (u *UploadTable) rollback(upload *Upload, tree *Tree, table *ChunkTable) error {
+	id := upload.ID
+	delete(u.Sessions, id)
+
+	chunks, err := tree.AbortUpload(upload.File, id)
+	if err != nil {
+		return err
+	}
+
+	tree.AfterCommit(table.purging(table.Unref(chunks)))
+	for _, grant := range upload.Grants {
+		grant := grant
+		tree.AfterCommit(func() { CancelToken(grant.Hosts, grant.Token) })
+	}
+
+	return nil
+}
+
+// Janitor rolls back uploads, whose lease has expired.
+func (u *UploadTable) Janitor(period time.Duration) {
+	for {
+		time.Sleep(period)
+		u.Collect()
+	}
+}
+
+// Collect rolls back expired uploads of the global tree.
+func (u *UploadTable) Collect() {
+	treemu.Lock()
+	defer treemu.Unlock()
+
+	tree, table := t, ct
+	defer tree.snapshotIfDue(table)
+
+	if isPassive() {
+		u.Reset()
+		return
+	}
+
+	if !u.restored {
+		u.restore(tree)
+	}
+
+	now := time.Now()
+	for id, upload := range u.Sessions {
+		if now.Before(upload.Expires) {
+			continue
+		}
+
+		log.Printf("Upload %s of /%s has expired; rolling back", id, upload.File.Address)
+		if err := u.Rollback(id, tree, table); err != nil {
+			log.Printf("warning: could not roll back upload %s: %v", id, err)
+		}
+	}
+}
+
+// Reupload moves the chunk, which the client failed to write, to another
+// fileserver and grants a fresh token for it.
+func (u *UploadTable) Reupload(id, chunkID string, tree *Tree, table *ChunkTable, pool *PoolInfo) (*FileServerInfo, *Grant, error) {
+	upload, err := u.session(id, tree)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	chunk, ok := table.Table[chunkID]
+	if written := upload.File.Uploading(id); !ok || written == nil || !written.Pending[chunkID] {
+		return nil, nil, fmt.Errorf("chunk %s is not pending in /%s", chunkID, upload.File.Address)
+	}
+
+	// the fileservers that failed are not tried again
+	selected := pool.SelectSeveralExcept(chunk.FServers, 1)
+	if len(selected) == 0 {
+		return nil, nil, fmt.Errorf("no other fileserver available for chunk %s", chunkID)
+	}
+	fs := selected[0]
+
+	table.Reassign(chunk, fs)
+	tree.Commit(LogRecord{Command: "reupload", Args: []string{upload.File.Address}, Chunks: []string{chunkID}, Nodes: []string{fs.NodeID}})
+
+	address := fmt.Sprintf("%s:%d", fs.PrivateHost, fs.Port)
+	grant := Grant{Token: generateToken(), Hosts: map[string][]string{address: {chunkID}}}
+	upload.Grants = append(upload.Grants, grant)
+	upload.Expires = time.Now().Add(u.Lease)
+
+	return fs, &grant, nil
+}
+
+// CancelToken tells fileservers to drop the token and the chunks written
+// with it.
+func CancelToken(hosts map[string][]string, token string) {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	for host := range hosts {
+		resp, err := client.Post(fmt.Sprintf("http://%s/cancelToken?token=%s", host, token), "", nil)
+		if err != nil {
+			// the token expires on the fileserver anyway
+			log.Printf("warning: could not cancel token on %s: %v", host, err)
+			continue
+		}
+		resp.Body.Close()
+	}
+}
+
+// Uploading returns the node that chunks of the upload are assigned to: the
+// file itself, or its new version staged for overwrite.
+func (node *Node) Uploading(id string) *Node {
+	if node.Staged != nil && node.Staged.UploadID == id {
+		return node.Staged
+	}
+
+	if node.UploadID == id {
+		return node
+	}
+
+	return nil
+}
+
+// StageOverwrite starts a new version of the existing file. The file keeps
+// its chunks, until the upload of the new version is committed.
+func (t *Tree) StageOverwrite(address string, size int, id string) (*Node, error) {
+	return t.stage(address, size, false, id)
+}
+
+// StageAppend starts a new version of the existing file, made of its chunks
+// and the appended ones. The chunks are shared with the file, so the caller
+// references them once more.
+func (t *Tree) StageAppend(address string, size int, id string) (*Node, error) {
+	return t.stage(address, size, true, id)
+}
+
+// stage starts a new version of the file, of which the size is uploaded.
+func (t *Tree) stage(address string, size int, appended bool, id string) (*Node, error) {
+	file, err := t.GetFile(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if IsReadOnly(file.Address) {
+		return nil, readOnly(file.Address)
+	}
+	if err := t.allow(file.Address, permWrite); err != nil {
+		return nil, err
+	}
+
+	if file.Staged != nil {
+		return nil, fmt.Errorf("/%s file is already being overwritten", file.Address)
+	}
+
+	staged := &Node{
+		Address:   file.Address,
+		Parent:    file.Parent,
+		Pending:   map[string]bool{},
+		CreatedOn: file.CreatedOn,
+		Size:      size,
+		UploadID:  id,
+	}
+	if appended {
+		staged.Chunks = append([]string{}, file.Chunks...)
+		staged.Size = file.Size + size
+	}
+
+	// the new version is counted once it is committed, but checked now
+	if err := t.checkQuota(file.Parent, int64(staged.Size-file.Size), 0, ""); err != nil {
+		return nil, err
+	}
+
+	file.Staged = staged
+
+	return file, nil
+}
+
+// CommitUpload makes the file visible, or swaps the new version of the file
+// in, if all chunks of the upload are confirmed. The overwritten content is
+// kept as a version, if the directory keeps them. It returns the chunks that
+// are not held anymore, those are left to the caller.
+func (t *Tree) CommitUpload(file *Node, id string, savedOn time.Time) ([]string, error) {
+	written := file.Uploading(id)
+	if written == nil {
+		return nil, fmt.Errorf("/%s is not being uploaded by %s", file.Address, id)
+	}
+
+	if len(written.Pending) != 0 {
+		return nil, fmt.Errorf("%d chunks of /%s are not confirmed yet", len(written.Pending), file.Address)
+	}
+
+	var released []string
+	if written == file {
+		file.UploadID = ""
+	} else {
+		released = t.keepVersion(file, savedOn)
+		t.account(file.Parent, int64(written.Size-file.Size), 0)
+		file.Chunks, file.Size = written.Chunks, written.Size
+		file.Staged = nil
+	}
+
+	t.CommitUpdate("commit", file.Address, id, savedOn.Format(time.RFC3339Nano))
+
+	return released, nil
+}
+
+// AbortUpload removes the file that is being uploaded, or drops the new
+// version of the file. It returns the chunks of the upload, those are left
+// to the caller.
+func (t *Tree) AbortUpload(file *Node, id string) ([]string, error) {
+	written := file.Uploading(id)
+	if written == nil {
+		return nil, fmt.Errorf("/%s is not being uploaded by %s", file.Address, id)
+	}
+
+	if written == file {
+		if t.Nodes[file.Address] == file {
+			delete(t.Nodes, file.Address)
+			t.account(file.Parent, -int64(file.Size), -1)
+		}
+		file.Removed = true
+		t.Removed = append(t.Removed, file)
+	} else {
+		file.Staged = nil
+	}
+
+	t.CommitUpdate("abort", file.Address, id)
+
+	return written.Chunks, nil
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadTable(t *testing.T) {
+	cancelled := make(chan string, 10)
+	fileserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/cancelToken" {
+			cancelled <- r.URL.Query().Get("token")
+		}
+	}))
+	defer fileserver.Close()
+
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(fileserver.URL, "http://"))
+	privatePort, _ := strconv.Atoi(port)
+
+	dir := t.TempDir()
+	conf = &Config{Namenode: Namenode{
+		TreeLogName:      path.Join(dir, "tree.log"),
+		TreeGobName:      path.Join(dir, "tree.gob"),
+		TreeUpdatePeriod: -1,
+		ChunkSize:        1,
+		Replicas:         1,
+		FSPublicPort:     7000,
+		FSPrivatePort:    privatePort,
+		AdminPassword:    "secret",
+	}}
+
+	storages = &PoolInfo{}
+	storages.Register("node-a", host, host, 0)
+
+	tree := InitTree(conf.Namenode)
+	useTree(tree, NewChunkTable())
+	uploads = NewUploadTable()
+
+	public := httptest.NewServer(publicRouter())
+	defer public.Close()
+
+	getAs := func(name, password, method string, query url.Values) (*ClientMessage, int) {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("%s%s?%s", public.URL, method, query.Encode()), nil)
+		req.SetBasicAuth(name, password)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var msg ClientMessage
+		json.NewDecoder(resp.Body).Decode(&msg)
+
+		return &msg, resp.StatusCode
+	}
+	get := func(method string, query url.Values) (*ClientMessage, int) {
+		return getAs(adminName, conf.Namenode.AdminPassword, method, query)
+	}
+
+	begin := func(t *testing.T, address string) *ClientMessage {
+		t.Helper()
+
+		msg, status := get("/upload", url.Values{"address": {address}, "size": {"1500000"}})
+		if status != http.StatusOK || msg.UploadID == "" || len(msg.Chunks) != 2 {
+			t.Fatalf("upload of %s: got %d %v", address, status, msg)
+		}
+
+		return msg
+	}
+
+	t.Run("file is visible once committed",
+		func(t *testing.T) {
+			msg := begin(t, "a.txt")
+
+			if tree.Exists("a.txt") {
+				t.Errorf("file is visible before commit")
+			}
+
+			if _, status := get("/upload/commit", url.Values{"id": {msg.UploadID}}); status != http.StatusConflict {
+				t.Errorf("committed upload of unconfirmed chunks: got %d", status)
+			}
+
+			treemu.Lock()
+			for _, chunk := range msg.Chunks {
+				tree.ConfirmReplica(ct.Table[chunk.ChunkID], "node-a")
+			}
+			treemu.Unlock()
+
+			if msg, status := get("/upload/commit", url.Values{"id": {msg.UploadID}}); status != http.StatusOK {
+				t.Fatalf("commit: got %d %s", status, msg.Message)
+			}
+
+			if !tree.Exists("a.txt") {
+				t.Errorf("file is not visible after commit")
+			}
+		})
+
+	t.Run("abandoned upload is rolled back",
+		func(t *testing.T) {
+			msg := begin(t, "b.txt")
+
+			treemu.Lock()
+			uploads.Sessions[msg.UploadID].Expires = time.Now()
+			treemu.Unlock()
+			uploads.Collect()
+
+			select {
+			case token := <-cancelled:
+				if token != msg.Token {
+					t.Errorf("got token %s cancelled, want %s", token, msg.Token)
+				}
+			case <-time.After(5 * time.Second):
+				t.Errorf("token was not cancelled on the fileserver")
+			}
+
+			treemu.Lock()
+			defer treemu.Unlock()
+
+			if _, ok := tree.Nodes["b.txt"]; ok {
+				t.Errorf("file of the abandoned upload is still in the tree")
+			}
+
+			for _, chunk := range msg.Chunks {
+				if ct.Table[chunk.ChunkID].Refs != 0 {
+					t.Errorf("chunk %s is still referenced", chunk.ChunkID)
+				}
+			}
+
+			if _, err := tree.CreateFile("b.txt", 0); err != nil {
+				t.Errorf("name of the abandoned upload cannot be reused: %v", err)
+			}
+		})
+
+	t.Run("abort",
+		func(t *testing.T) {
+			msg := begin(t, "c.txt")
+
+			if _, status := get("/upload/abort", url.Values{"id": {msg.UploadID}}); status != http.StatusOK {
+				t.Fatalf("abort: got %d", status)
+			}
+
+			if _, status := get("/upload/commit", url.Values{"id": {msg.UploadID}}); status == http.StatusOK {
+				t.Errorf("committed aborted upload")
+			}
+		})
+
+	t.Run("failed chunk is moved to another fileserver",
+		func(t *testing.T) {
+			// both resolve to the fake fileserver
+			storages.Register("node-b", "localhost", "localhost", 0)
+			nodeIDs := map[string]string{host + ":7000": "node-a", "localhost:7000": "node-b"}
+
+			msg := begin(t, "d.txt")
+			failed := msg.Chunks[0]
+
+			moved, status := get("/reupload", url.Values{"id": {msg.UploadID}, "chunkID": {failed.ChunkID}})
+			if status != http.StatusOK || len(moved.Chunks) != 1 {
+				t.Fatalf("reupload: got %d %s", status, moved.Message)
+			}
+
+			if moved.Chunks[0].StorageIP == failed.StorageIP || moved.Token == msg.Token {
+				t.Errorf("got the same fileserver or token: %v", moved)
+			}
+
+			treemu.Lock()
+			chunk := ct.Table[failed.ChunkID]
+			for _, stored := range ct.InvertedTable[nodeIDs[failed.StorageIP]] {
+				if stored == chunk {
+					t.Errorf("chunk is still assigned to the failed fileserver")
+				}
+			}
+			if _, ok := chunk.FServers[nodeIDs[moved.Chunks[0].StorageIP]]; !ok || len(chunk.FServers) != 1 {
+				t.Errorf("got chunk on %v, want on %s", chunk.FServers, moved.Chunks[0].StorageIP)
+			}
+
+			tree.ConfirmReplica(chunk, nodeIDs[moved.Chunks[0].StorageIP])
+			tree.ConfirmReplica(ct.Table[msg.Chunks[1].ChunkID], nodeIDs[msg.Chunks[1].StorageIP])
+			treemu.Unlock()
+
+			if msg, status := get("/upload/commit", url.Values{"id": {msg.UploadID}}); status != http.StatusOK {
+				t.Fatalf("commit: got %d %s", status, msg.Message)
+			}
+
+			if _, status := get("/reupload", url.Values{"id": {msg.UploadID}, "chunkID": {failed.ChunkID}}); status == http.StatusOK {
+				t.Errorf("reuploaded chunk of a committed upload")
+			}
+		})
+
+	t.Run("overwrite is swapped in once committed",
+		func(t *testing.T) {
+			treemu.Lock()
+			file := tree.Nodes["a.txt"]
+			old := file.Chunks
+			treemu.Unlock()
+
+			msg, status := get("/upload", url.Values{"address": {"a.txt"}, "size": {"500000"}, "overwrite": {"true"}})
+			if status != http.StatusOK || len(msg.Chunks) != 1 {
+				t.Fatalf("overwrite: got %d %s", status, msg.Message)
+			}
+
+			if _, status := get("/upload", url.Values{"address": {"a.txt"}, "size": {"500000"}, "overwrite": {"true"}}); status == http.StatusOK {
+				t.Errorf("overwrote a file that is being overwritten")
+			}
+
+			treemu.Lock()
+			if !tree.Exists("a.txt") || !reflect.DeepEqual(file.Chunks, old) {
+				t.Errorf("file was changed before commit: %v", file)
+			}
+			tree.ConfirmReplica(ct.Table[msg.Chunks[0].ChunkID], "node-a")
+			treemu.Unlock()
+
+			if msg, status := get("/upload/commit", url.Values{"id": {msg.UploadID}}); status != http.StatusOK {
+				t.Fatalf("commit: got %d %s", status, msg.Message)
+			}
+
+			treemu.Lock()
+			defer treemu.Unlock()
+
+			if len(file.Chunks) != 1 || file.Chunks[0] != msg.Chunks[0].ChunkID || file.Size != 500000 {
+				t.Errorf("got %v of size %d, want [%s] of size %d", file.Chunks, file.Size, msg.Chunks[0].ChunkID, 500000)
+			}
+
+			for _, chunkID := range old {
+				if ct.Table[chunkID].Refs != 0 {
+					t.Errorf("chunk %s of the old version is still referenced", chunkID)
+				}
+			}
+		})
+
+	t.Run("appended chunks follow the chunks of the file",
+		func(t *testing.T) {
+			treemu.Lock()
+			file := tree.Nodes["d.txt"]
+			old, oldSize := file.Chunks, file.Size
+			treemu.Unlock()
+
+			msg, status := get("/append", url.Values{"address": {"d.txt"}, "size": {"500000"}})
+			if status != http.StatusOK || len(msg.Chunks) != 1 {
+				t.Fatalf("append: got %d %s", status, msg.Message)
+			}
+
+			treemu.Lock()
+			if !reflect.DeepEqual(file.Chunks, old) || file.Size != oldSize {
+				t.Errorf("file was changed before commit: %v", file)
+			}
+			tree.ConfirmReplica(ct.Table[msg.Chunks[0].ChunkID], "node-a")
+			treemu.Unlock()
+
+			if msg, status := get("/upload/commit", url.Values{"id": {msg.UploadID}}); status != http.StatusOK {
+				t.Fatalf("commit: got %d %s", status, msg.Message)
+			}
+
+			treemu.Lock()
+			defer treemu.Unlock()
+
+			want := append(append([]string{}, old...), msg.Chunks[0].ChunkID)
+			if !reflect.DeepEqual(file.Chunks, want) || file.Size != oldSize+500000 {
+				t.Errorf("got %v of size %d, want %v of size %d", file.Chunks, file.Size, want, oldSize+500000)
+			}
+
+			for _, chunkID := range want {
+				if got := ct.Table[chunkID].Refs; got != 1 {
+					t.Errorf("chunk %s: got %d references, want %d", chunkID, got, 1)
+				}
+			}
+		})
+
+	t.Run("upload of another user",
+		func(t *testing.T) {
+			treemu.Lock()
+			tree.AddUser("alice", "wonderland", false)
+			tree.AddUser("bob", "builder", false)
+			if err := tree.CreateDirectory("shared"); err != nil {
+				t.Fatal(err)
+			}
+			tree.Nodes["shared"].Mode = 0777
+			treemu.Unlock()
+
+			msg, status := getAs("alice", "wonderland", "/upload", url.Values{"address": {"shared/e.txt"}, "size": {"500000"}})
+			if status != http.StatusOK {
+				t.Fatalf("upload: got %d %s", status, msg.Message)
+			}
+
+			treemu.Lock()
+			tree.ConfirmReplica(ct.Table[msg.Chunks[0].ChunkID], "node-a")
+			treemu.Unlock()
+
+			for _, method := range []string{"/upload/commit", "/upload/abort", "/reupload"} {
+				query := url.Values{"id": {msg.UploadID}, "chunkID": {msg.Chunks[0].ChunkID}}
+				if _, status := getAs("bob", "builder", method, query); status != http.StatusForbidden {
+					t.Errorf("%s of the upload of alice by bob: got %d, want %d", method, status, http.StatusForbidden)
+				}
+			}
+
+			if msg, status := getAs("alice", "wonderland", "/upload/commit", url.Values{"id": {msg.UploadID}}); status != http.StatusOK {
+				t.Fatalf("commit: got %d %s", status, msg.Message)
+			}
+		})
+
+	t.Run("replay",
+		func(t *testing.T) {
+			treemu.Lock()
+			defer treemu.Unlock()
+
+			recovered, table, err := Recover(conf.Namenode, storages)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !recovered.Exists("a.txt") {
+				t.Errorf("committed upload was not recovered")
+			}
+
+			if node, ok := recovered.Nodes["c.txt"]; ok {
+				t.Errorf("aborted upload was recovered: %v", node)
+			}
+
+			if !recovered.Exists("d.txt") {
+				t.Errorf("upload with a moved chunk was not recovered")
+			}
+
+			moved := table.Table[recovered.Nodes["d.txt"].Chunks[0]]
+			for nodeID := range ct.Table[moved.ChunkID].FServers {
+				if _, ok := moved.FServers[nodeID]; !ok || len(moved.FServers) != 1 {
+					t.Errorf("got moved chunk on %v, want on %s", moved.FServers, nodeID)
+				}
+			}
+
+			if got, want := recovered.Nodes["a.txt"].Chunks, tree.Nodes["a.txt"].Chunks; !reflect.DeepEqual(got, want) {
+				t.Errorf("got overwritten file of %v, want %v", got, want)
+			}
+
+			if got, want := recovered.Nodes["d.txt"].Size, tree.Nodes["d.txt"].Size; got != want {
+				t.Errorf("got appended file of size %d, want %d", got, want)
+			}
+
+			for _, chunkID := range recovered.Nodes["d.txt"].Chunks {
+				if got := table.Table[chunkID].Refs; got != 1 {
+					t.Errorf("chunk %s of appended file: got %d references, want %d", chunkID, got, 1)
+				}
+			}
+
+			for _, chunk := range recovered.Nodes["a.txt"].Chunks {
+				if table.Table[chunk].Status == OBSOLETE {
+					t.Errorf("chunk of committed upload is obsolete")
+				}
+			}
+		})
+}
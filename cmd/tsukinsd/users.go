@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// adminName is the built-in account, which signs in with adminPassword of the
+// config. It is not stored in the tree, so that a wiped or lost list of users
+// never locks the administrator out.
+const adminName = "admin"
+
+// passwordIterations of PBKDF2, every request signed with a password pays
+// for them.
+const passwordIterations = 10000
+
+// User is an account of the public API. Accounts are kept in the tree, so
+// they are saved in snapshots and replicated with the log.
+type User struct {
+	Name     string
+	Admin    bool   // may initialize the namespace and manage other users
+	Salt     string // hex
+	Password string // PBKDF2 of the password, hex; empty if keys are used only
+	Keys     []APIKey
+	Groups   []string // the first one is given to new nodes, see CheckAccess
+}
+
+// APIKey lets scripts sign in without the password. Only a hash of the key
+// is kept, the key itself is shown once, when it is created.
+type APIKey struct {
+	ID        string // prefix of the key, to tell keys apart
+	Hash      string // SHA-256 of the key, hex
+	CreatedOn time.Time
+}
+
+func derivePassword(password string, salt string) string {
+	// PBKDF2-HMAC-SHA256, a single block is as long as the hash
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write([]byte(salt))
+	binary.Write(mac, binary.BigEndian, uint32(1))
+	u := mac.Sum(nil)
+
+	key := append([]byte{}, u...)
+	for i := 1; i < passwordIterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+
+	return hex.EncodeToString(key)
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+
+	return hex.EncodeToString(sum[:])
+}
+
+func newSalt() string {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+
+	return hex.EncodeToString(salt)
+}
+
+func checkUserName(name string) error {
+	if name == "" || strings.ContainsAny(name, ":/ \t\n") {
+		return fmt.Errorf("%q wrong user name", name)
+	}
+	if name == adminName {
+		return fmt.Errorf("%s is the built-in account", adminName)
+	}
+
+	return nil
+}
+
+// GetUser returns the stored account.
+func (t *Tree) GetUser(name string) (*User, error) {
+	user, ok := t.Users[name]
+	if !ok && name == adminName {
+		return nil, fmt.Errorf("%s is the built-in account, it is set up in the config; create another one", adminName)
+	}
+	if !ok {
+		return nil, fmt.Errorf("user %s does not exist", name)
+	}
+
+	return user, nil
+}
+
+// AddUser creates an account signing in with the password.
+func (t *Tree) AddUser(name string, password string, admin bool) error {
+	if password == "" {
+		return fmt.Errorf("empty password")
+	}
+
+	salt := newSalt()
+
+	return t.addUser(name, admin, salt, derivePassword(password, salt))
+}
+
+func (t *Tree) addUser(name string, admin bool, salt string, password string) error {
+	if err := checkUserName(name); err != nil {
+		return err
+	}
+	if _, ok := t.Users[name]; ok {
+		return fmt.Errorf("user %s already exists", name)
+	}
+
+	// snapshots taken before accounts were added have none
+	if t.Users == nil {
+		t.Users = map[string]*User{}
+	}
+	t.Users[name] = &User{Name: name, Admin: admin, Salt: salt, Password: password}
+
+	t.CommitUpdate("useradd", name, strconv.FormatBool(admin), salt, password)
+
+	return nil
+}
+
+// SetPassword replaces the password of the account.
+func (t *Tree) SetPassword(name string, password string) error {
+	if password == "" {
+		return fmt.Errorf("empty password")
+	}
+
+	salt := newSalt()
+
+	return t.setPassword(name, salt, derivePassword(password, salt))
+}
+
+func (t *Tree) setPassword(name string, salt string, password string) error {
+	user, err := t.GetUser(name)
+	if err != nil {
+		return err
+	}
+
+	user.Salt, user.Password = salt, password
+
+	t.CommitUpdate("passwd", name, salt, password)
+
+	return nil
+}
+
+// RemoveUser removes the account along with its keys.
+func (t *Tree) RemoveUser(name string) error {
+	if _, err := t.GetUser(name); err != nil {
+		return err
+	}
+
+	delete(t.Users, name)
+
+	t.CommitUpdate("userdel", name)
+
+	return nil
+}
+
+// AddKey creates an API key of the account. The key is returned only here.
+func (t *Tree) AddKey(name string, createdOn time.Time) (string, *APIKey, error) {
+	key := generateToken()
+
+	apiKey, err := t.addKey(name, key[:8], hashKey(key), createdOn)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return key, apiKey, nil
+}
+
+func (t *Tree) addKey(name string, id string, hash string, createdOn time.Time) (*APIKey, error) {
+	user, err := t.GetUser(name)
+	if err != nil {
+		return nil, err
+	}
+
+	user.Keys = append(user.Keys, APIKey{ID: id, Hash: hash, CreatedOn: createdOn})
+
+	t.CommitUpdate("keyadd", name, id, hash, createdOn.Format(time.RFC3339Nano))
+
+	return &user.Keys[len(user.Keys)-1], nil
+}
+
+// RemoveKey revokes the API key of the account.
+func (t *Tree) RemoveKey(name string, id string) error {
+	user, err := t.GetUser(name)
+	if err != nil {
+		return err
+	}
+
+	for i, key := range user.Keys {
+		if key.ID == id {
+			user.Keys = append(user.Keys[:i], user.Keys[i+1:]...)
+			t.CommitUpdate("keydel", name, id)
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf("user %s has no key %s", name, id)
+}
+
+// Authenticate checks the password of the account. The built-in account is
+// checked against adminPassword, it is disabled, if the password is not set.
+func (t *Tree) Authenticate(name string, password string, adminPassword string) (*User, error) {
+	if name == adminName {
+		if adminPassword != "" && subtle.ConstantTimeCompare([]byte(password), []byte(adminPassword)) == 1 {
+			return &User{Name: adminName, Admin: true}, nil
+		}
+
+		return nil, fmt.Errorf("wrong user name or password")
+	}
+
+	user, ok := t.Users[name]
+	if !ok || user.Password == "" {
+		return nil, fmt.Errorf("wrong user name or password")
+	}
+
+	derived := derivePassword(password, user.Salt)
+	if subtle.ConstantTimeCompare([]byte(derived), []byte(user.Password)) != 1 {
+		return nil, fmt.Errorf("wrong user name or password")
+	}
+
+	return user, nil
+}
+
+// AuthenticateKey finds the account the API key belongs to.
+func (t *Tree) AuthenticateKey(key string) (*User, error) {
+	hash := hashKey(key)
+
+	for _, user := range t.Users {
+		for _, apiKey := range user.Keys {
+			if subtle.ConstantTimeCompare([]byte(hash), []byte(apiKey.Hash)) == 1 {
+				return user, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("wrong API key")
+}
+
+// UsersInfo lists accounts along with their roles.
+func (t *Tree) UsersInfo() []string {
+	list := []string{}
+	for name, user := range t.Users {
+		role := "user"
+		if user.Admin {
+			role = "admin"
+		}
+
+		list = append(list, fmt.Sprintf("%s\t%s\t%d keys", name, role, len(user.Keys)))
+	}
+	sort.Strings(list)
+
+	return list
+}
+
+// KeysInfo lists API keys of the account.
+func (t *Tree) KeysInfo(name string) ([]string, error) {
+	user, err := t.GetUser(name)
+	if err != nil {
+		return nil, err
+	}
+
+	list := []string{}
+	for _, key := range user.Keys {
+		list = append(list, fmt.Sprintf("%s\t%s", key.ID, key.CreatedOn.Format(time.RFC3339)))
+	}
+
+	return list, nil
+}
+
+type userKey struct{}
+
+// RequestUser returns the account the request is signed in with.
+func RequestUser(r *http.Request) *User {
+	user, _ := r.Context().Value(userKey{}).(*User)
+
+	return user
+}
+
+// authenticate refuses requests, which are not signed in with a password
+// (basic authentication) or an API key (bearer token).
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var user *User
+		var err error
+
+		treemu.RLock()
+		if name, password, ok := r.BasicAuth(); ok {
+			user, err = t.Authenticate(name, password, conf.Namenode.AdminPassword)
+		} else if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			user, err = t.AuthenticateKey(strings.TrimPrefix(auth, "Bearer "))
+		} else {
+			err = fmt.Errorf("sign in with a password or an API key; see tsuki login")
+		}
+		treemu.RUnlock()
+
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("WWW-Authenticate", `Basic realm="tsuki"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+	})
+}
+
+// adminOnly refuses users without the admin role.
+func adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if user := RequestUser(r); user == nil || !user.Admin {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: "only admins may do that"})
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestAuthentication(t *testing.T) {
+	dir := t.TempDir()
+	conf = &Config{Namenode: Namenode{
+		TreeLogName:      path.Join(dir, "tree.log"),
+		TreeGobName:      path.Join(dir, "tree.gob"),
+		TreeUpdatePeriod: -1,
+		AdminPassword:    "secret",
+	}}
+
+	storages = &PoolInfo{}
+	tree := InitTree(conf.Namenode)
+	useTree(tree, NewChunkTable())
+	uploads = NewUploadTable()
+
+	public := httptest.NewServer(publicRouter())
+	defer public.Close()
+
+	// sign is applied to every request, the status of the response is returned
+	request := func(method string, endpoint string, form url.Values, sign func(*http.Request)) (*ClientMessage, int) {
+		var req *http.Request
+		if method == "POST" {
+			req, _ = http.NewRequest(method, public.URL+endpoint, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			req, _ = http.NewRequest(method, public.URL+endpoint+"?"+form.Encode(), nil)
+		}
+		if sign != nil {
+			sign(req)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var msg ClientMessage
+		json.NewDecoder(resp.Body).Decode(&msg)
+
+		return &msg, resp.StatusCode
+	}
+
+	password := func(name, password string) func(*http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth(name, password) }
+	}
+	key := func(key string) func(*http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+key) }
+	}
+	admin := password(adminName, "secret")
+
+	t.Run("requests are signed in",
+		func(t *testing.T) {
+			if _, status := request("GET", "/ls", url.Values{"address": {"/"}}, nil); status != http.StatusUnauthorized {
+				t.Errorf("anonymous ls: got %d, want %d", status, http.StatusUnauthorized)
+			}
+			if _, status := request("GET", "/init", nil, nil); status != http.StatusUnauthorized {
+				t.Errorf("anonymous init: got %d, want %d", status, http.StatusUnauthorized)
+			}
+			if _, status := request("GET", "/ls", url.Values{"address": {"/"}}, password(adminName, "wrong")); status != http.StatusUnauthorized {
+				t.Errorf("wrong password: got %d, want %d", status, http.StatusUnauthorized)
+			}
+			if _, status := request("GET", "/ls", url.Values{"address": {"/"}}, admin); status != http.StatusOK {
+				t.Errorf("admin ls: got %d", status)
+			}
+		})
+
+	t.Run("users are not admins",
+		func(t *testing.T) {
+			if msg, status := request("POST", "/users/add", url.Values{"name": {"alice"}, "password": {"wonderland"}}, admin); status != http.StatusOK {
+				t.Fatalf("add user: got %d %s", status, msg.Message)
+			}
+			request("POST", "/users/add", url.Values{"name": {"bob"}, "password": {"builder"}}, admin)
+
+			alice := password("alice", "wonderland")
+			if _, status := request("GET", "/ls", url.Values{"address": {"/"}}, alice); status != http.StatusOK {
+				t.Errorf("user ls: got %d", status)
+			}
+			if _, status := request("GET", "/init", nil, alice); status != http.StatusForbidden {
+				t.Errorf("user init: got %d, want %d", status, http.StatusForbidden)
+			}
+			if _, status := request("POST", "/users/add", url.Values{"name": {"eve"}, "password": {"x"}}, alice); status != http.StatusForbidden {
+				t.Errorf("user adds users: got %d, want %d", status, http.StatusForbidden)
+			}
+			if _, status := request("POST", "/users/passwd", url.Values{"name": {"bob"}, "password": {"x"}}, alice); status == http.StatusOK {
+				t.Errorf("user changed password of another one")
+			}
+
+			if msg, status := request("POST", "/users/passwd", url.Values{"password": {"looking-glass"}}, alice); status != http.StatusOK {
+				t.Fatalf("passwd: got %d %s", status, msg.Message)
+			}
+			if _, status := request("GET", "/whoami", nil, alice); status != http.StatusUnauthorized {
+				t.Errorf("old password: got %d, want %d", status, http.StatusUnauthorized)
+			}
+		})
+
+	t.Run("API keys",
+		func(t *testing.T) {
+			alice := password("alice", "looking-glass")
+
+			msg, status := request("GET", "/users/keys/add", nil, alice)
+			if status != http.StatusOK || msg.Token == "" {
+				t.Fatalf("add key: got %d %s", status, msg.Message)
+			}
+
+			whoami, status := request("GET", "/whoami", nil, key(msg.Token))
+			if status != http.StatusOK || !strings.HasPrefix(whoami.Message, "alice\t") {
+				t.Errorf("signed in with the key: got %d %s", status, whoami.Message)
+			}
+
+			if _, status := request("GET", "/users/keys/remove", url.Values{"id": {msg.Token[:8]}}, alice); status != http.StatusOK {
+				t.Errorf("remove key: got %d", status)
+			}
+			if _, status := request("GET", "/whoami", nil, key(msg.Token)); status != http.StatusUnauthorized {
+				t.Errorf("revoked key: got %d, want %d", status, http.StatusUnauthorized)
+			}
+		})
+
+	t.Run("cluster operations are for admins",
+		func(t *testing.T) {
+			private := httptest.NewServer(privateRouter())
+			defer private.Close()
+
+			for _, tc := range []struct {
+				endpoint string
+				sign     func(*http.Request)
+				want     int
+			}{
+				{"/save", nil, http.StatusUnauthorized},
+				{"/save", password("alice", "looking-glass"), http.StatusForbidden},
+				{"/save", admin, http.StatusOK},
+				{"/promote", nil, http.StatusUnauthorized},
+				{"/promote", password("alice", "looking-glass"), http.StatusForbidden},
+				// not a standby
+				{"/promote", admin, http.StatusConflict},
+			} {
+				req, _ := http.NewRequest("POST", private.URL+tc.endpoint, nil)
+				if tc.sign != nil {
+					tc.sign(req)
+				}
+
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+
+				if resp.StatusCode != tc.want {
+					t.Errorf("%s: got %d, want %d", tc.endpoint, resp.StatusCode, tc.want)
+				}
+			}
+		})
+
+	t.Run("accounts survive init",
+		func(t *testing.T) {
+			if msg, status := request("GET", "/init", nil, admin); status != http.StatusOK {
+				t.Fatalf("init: got %d %s", status, msg.Message)
+			}
+			if _, status := request("GET", "/whoami", nil, password("bob", "builder")); status != http.StatusOK {
+				t.Errorf("user was lost on init: got %d", status)
+			}
+		})
+
+	t.Run("replay",
+		func(t *testing.T) {
+			request("GET", "/users/remove", url.Values{"name": {"bob"}}, admin)
+
+			treemu.Lock()
+			defer treemu.Unlock()
+
+			recovered, _, err := Recover(conf.Namenode, storages)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := recovered.Authenticate("alice", "looking-glass", ""); err != nil {
+				t.Errorf("could not sign in after recovery: %v", err)
+			}
+			if _, ok := recovered.Users["bob"]; ok {
+				t.Errorf("removed user was recovered")
+			}
+			if _, err := recovered.Authenticate(adminName, "secret", ""); err == nil {
+				t.Errorf("signed in as the built-in account without adminPassword")
+			}
+		})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Version is a previous content of a file. Like copies, versions share chunks
+// with the file and hold references to them.
+type Version struct {
+	Chunks  []string
+	Size    int
+	SavedOn time.Time // when the content was replaced
+}
+
+// Version returns the n-th previous version of the file, 1 is the latest one.
+func (node *Node) Version(n int) (*Version, error) {
+	if n < 1 || n > len(node.Versions) {
+		return nil, fmt.Errorf("/%s has no version %d; %d versions kept", node.Address, n, len(node.Versions))
+	}
+
+	return &node.Versions[len(node.Versions)-n], nil
+}
+
+// VersionChunks returns chunks of all versions of the file.
+func (node *Node) VersionChunks() []string {
+	chunks := []string{}
+	for _, version := range node.Versions {
+		chunks = append(chunks, version.Chunks...)
+	}
+
+	return chunks
+}
+
+// keepVersion saves the current content of the file as its latest version,
+// if the directory of the file keeps versions. It returns the chunks that are
+// not held anymore: those of versions beyond the retention, or the current
+// ones, if versions are not kept.
+func (t *Tree) keepVersion(file *Node, savedOn time.Time) []string {
+	keep := 0
+	if dir, ok := t.Nodes[file.Parent]; ok {
+		keep = dir.KeepVersions
+	}
+
+	released := []string{}
+	if keep == 0 {
+		released = append(released, file.Chunks...)
+	} else {
+		file.Versions = append(file.Versions, Version{Chunks: file.Chunks, Size: file.Size, SavedOn: savedOn})
+	}
+
+	// retention may have been lowered since the versions were saved
+	for len(file.Versions) > keep {
+		released = append(released, file.Versions[0].Chunks...)
+		file.Versions = file.Versions[1:]
+	}
+
+	return released
+}
+
+// KeepVersions sets how many previous versions files of the directory keep.
+// Files drop extra versions, when they change next time.
+func (t *Tree) KeepVersions(address string, keep int) error {
+	address, matched := CleanAddress(address)
+
+	if !matched {
+		return fmt.Errorf("/%s wrong file name format", address)
+	}
+	if !t.DirectoryExists(address) {
+		return fmt.Errorf("/%s/ directory does not exist", address)
+	}
+	if IsReadOnly(address) {
+		return readOnly(address)
+	}
+	if keep < 0 {
+		return fmt.Errorf("cannot keep %d versions", keep)
+	}
+	if err := t.allow(address, permWrite); err != nil {
+		return err
+	}
+
+	t.Nodes[address].KeepVersions = keep
+	t.CommitUpdate("keep", address, strconv.Itoa(keep))
+
+	return nil
+}
+
+// RestoreVersion makes the n-th previous version of the file current. The
+// current content is saved as a version in turn. It returns the version, whose
+// chunks the file now references as well, and the chunks that are not held
+// anymore, both are left to the caller.
+func (t *Tree) RestoreVersion(address string, n int, savedOn time.Time) (*Version, []string, error) {
+	file, err := t.GetFile(address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if IsReadOnly(file.Address) {
+		return nil, nil, readOnly(file.Address)
+	}
+	if err := t.allow(file.Address, permWrite); err != nil {
+		return nil, nil, err
+	}
+
+	if file.Staged != nil {
+		return nil, nil, fmt.Errorf("/%s file is being overwritten", file.Address)
+	}
+
+	version, err := file.Version(n)
+	if err != nil {
+		return nil, nil, err
+	}
+	restored := *version
+
+	if err := t.checkQuota(file.Parent, int64(restored.Size-file.Size), 0, ""); err != nil {
+		return nil, nil, err
+	}
+
+	released := t.keepVersion(file, savedOn)
+	t.account(file.Parent, int64(restored.Size-file.Size), 0)
+	file.Chunks = append([]string{}, restored.Chunks...)
+	file.Size = restored.Size
+
+	t.CommitUpdate("restore", file.Address, strconv.Itoa(n), savedOn.Format(time.RFC3339Nano))
+
+	return &restored, released, nil
+}
+
+// VersionsInfo lists previous versions of the file, the latest one first.
+func (t *Tree) VersionsInfo(address string) ([]string, error) {
+	file, err := t.GetFile(address)
+	if err != nil {
+		return nil, err
+	}
+
+	list := []string{}
+	for n := 1; n <= len(file.Versions); n++ {
+		version, _ := file.Version(n)
+		list = append(list, fmt.Sprintf("%d\t%s\t%d bytes", n, version.SavedOn.Format(time.RFC3339), version.Size))
+	}
+
+	return list, nil
+}
+
+// parseSavedOn reads the time logged with a record, so that a replayed
+// version or snapshot keeps its time.
+func parseSavedOn(args []string, i int) time.Time {
+	if len(args) > i {
+		if savedOn, err := time.Parse(time.RFC3339Nano, args[i]); err == nil {
+			return savedOn
+		}
+	}
+
+	return time.Now()
+}
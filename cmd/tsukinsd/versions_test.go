@@ -0,0 +1,137 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTree_Versions(t *testing.T) {
+	f := newTreeFixture(t)
+	tree, table := f.tree, f.table
+
+	// overwrite writes the file anew with a single chunk and returns the
+	// chunks that are not held anymore
+	overwrite := func(t *testing.T, chunkID string, size int) []string {
+		t.Helper()
+
+		file, err := tree.StageOverwrite("docs/a.txt", size, chunkID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		table.AssignChunk(file.Staged, chunkID, f.fs)
+		tree.Commit(LogRecord{Command: "overwrite", Args: []string{file.Address, chunkID}, Size: size, Chunks: []string{chunkID}, Nodes: []string{f.fs.NodeID}})
+		tree.ConfirmReplica(table.Table[chunkID], f.fs.NodeID)
+
+		released, err := tree.CommitUpload(file, chunkID, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return table.Unref(released)
+	}
+
+	tree.CreateDirectory("docs")
+	file := f.upload(t, "docs/a.txt", "v1")
+
+	t.Run("versions are not kept by default",
+		func(t *testing.T) {
+			if got := overwrite(t, "v2", 20); !reflect.DeepEqual(got, []string{"v1"}) {
+				t.Errorf("got %v released, want [v1]", got)
+			}
+		})
+
+	if err := tree.KeepVersions("docs", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("previous versions are kept up to the retention",
+		func(t *testing.T) {
+			if got := overwrite(t, "v3", 30); len(got) != 0 {
+				t.Errorf("got %v released, want none", got)
+			}
+			if got := overwrite(t, "v4", 40); len(got) != 0 {
+				t.Errorf("got %v released, want none", got)
+			}
+			if got := overwrite(t, "v5", 50); !reflect.DeepEqual(got, []string{"v2"}) {
+				t.Errorf("got %v released, want [v2]", got)
+			}
+
+			got, _ := tree.VersionsInfo("docs/a.txt")
+			if len(got) != 2 {
+				t.Fatalf("got versions %v, want 2 of them", got)
+			}
+
+			if version, _ := file.Version(1); version.Size != 40 || version.Chunks[0] != "v4" {
+				t.Errorf("got %v as the latest version, want v4", version)
+			}
+		})
+
+	t.Run("restore",
+		func(t *testing.T) {
+			restored, released, err := tree.RestoreVersion("docs/a.txt", 2, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			table.Ref(restored.Chunks)
+
+			if got := table.Unref(released); !reflect.DeepEqual(got, []string{}) {
+				t.Errorf("got %v released, want none", got)
+			}
+
+			if !reflect.DeepEqual(file.Chunks, []string{"v3"}) || file.Size != 30 {
+				t.Errorf("got %v of size %d, want [v3] of size %d", file.Chunks, file.Size, 30)
+			}
+
+			// v3 is dropped from versions beyond the retention, v5 is saved
+			if len(file.Versions) != 2 || file.Versions[0].Chunks[0] != "v4" || file.Versions[1].Chunks[0] != "v5" {
+				t.Errorf("got versions %v, want v4 and v5", file.Versions)
+			}
+
+			for chunkID, want := range map[string]int{"v3": 1, "v4": 1, "v5": 1} {
+				if got := table.Table[chunkID].Refs; got != want {
+					t.Errorf("chunk %s: got %d references, want %d", chunkID, got, want)
+				}
+			}
+		})
+
+	t.Run("copies do not carry versions",
+		func(t *testing.T) {
+			// versions are saved by the snapshot, the copy is replayed
+			f.snapshot(t)
+
+			copied, err := tree.CopyFile("docs/a.txt", "docs/b.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			table.Ref(copied.Chunks)
+
+			if len(copied.Versions) != 0 {
+				t.Errorf("got %d versions of the copy", len(copied.Versions))
+			}
+		})
+
+	t.Run("replay",
+		func(t *testing.T) {
+			recovered, recoveredTable := f.recover(t)
+
+			got := recovered.Nodes["docs/a.txt"]
+			if !reflect.DeepEqual(got.Chunks, file.Chunks) || len(got.Versions) != len(file.Versions) {
+				t.Fatalf("got %v with versions %v, want %v with versions %v", got.Chunks, got.Versions, file.Chunks, file.Versions)
+			}
+
+			for i, version := range got.Versions {
+				if want := file.Versions[i]; !reflect.DeepEqual(version.Chunks, want.Chunks) || !version.SavedOn.Equal(want.SavedOn) {
+					t.Errorf("got version %v, want %v", version, want)
+				}
+			}
+
+			// the copy shares v3
+			for chunkID, want := range map[string]int{"v3": 2, "v4": 1, "v5": 1} {
+				if got := recoveredTable.Table[chunkID].Refs; got != want {
+					t.Errorf("chunk %s: got %d references, want %d", chunkID, got, want)
+				}
+			}
+		})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Extended attributes are arbitrary key/value pairs of files and directories,
+// such as the source of a dataset. They are kept in the node, so they are
+// saved in snapshots, replicated with the log and copied along with the node.
+// Reading them takes r on the node, changing them w.
+const (
+	maxXattrName  = 255
+	maxXattrValue = 64 * 1024
+	maxXattrs     = 128 // of a node
+)
+
+func checkXattrName(name string) error {
+	if name == "" || len(name) > maxXattrName || strings.ContainsAny(name, "=\n\t") {
+		return fmt.Errorf("%q wrong attribute name", name)
+	}
+
+	return nil
+}
+
+// copyXattrs keeps copies of nodes from sharing the map.
+func (node *Node) copyXattrs() {
+	if node.Xattrs == nil {
+		return
+	}
+
+	xattrs := make(map[string]string, len(node.Xattrs))
+	for name, value := range node.Xattrs {
+		xattrs[name] = value
+	}
+	node.Xattrs = xattrs
+}
+
+// xattrNode returns the existing node of the address.
+func (t *Tree) xattrNode(address string) (*Node, string, error) {
+	address, matched := CleanAddress(address)
+
+	if !matched {
+		return nil, address, fmt.Errorf("/%s wrong file name format", address)
+	}
+
+	node, ok := t.Nodes[address]
+	if !ok || !t.Exists(address) {
+		return nil, address, fmt.Errorf("/%s path does not exist", address)
+	}
+
+	return node, address, nil
+}
+
+// SetXattr sets the attribute of the file or the directory.
+func (t *Tree) SetXattr(address string, name string, value string) error {
+	node, address, err := t.xattrNode(address)
+	if err != nil {
+		return err
+	}
+
+	if IsReadOnly(address) {
+		return readOnly(address)
+	}
+	if err := checkXattrName(name); err != nil {
+		return err
+	}
+	if len(value) > maxXattrValue {
+		return fmt.Errorf("%s value is longer than %d bytes", name, maxXattrValue)
+	}
+	if _, ok := node.Xattrs[name]; !ok && len(node.Xattrs) >= maxXattrs {
+		return fmt.Errorf("/%s has %d attributes already", address, maxXattrs)
+	}
+	if err := t.allow(address, permWrite); err != nil {
+		return err
+	}
+
+	// nodes created before attributes were introduced have none
+	if node.Xattrs == nil {
+		node.Xattrs = map[string]string{}
+	}
+	node.Xattrs[name] = value
+
+	t.CommitUpdate("setxattr", address, name, value)
+
+	return nil
+}
+
+// GetXattr returns the attribute of the file or the directory.
+func (t *Tree) GetXattr(address string, name string) (string, error) {
+	node, address, err := t.xattrNode(address)
+	if err != nil {
+		return "", err
+	}
+
+	value, ok := node.Xattrs[name]
+	if !ok {
+		return "", fmt.Errorf("/%s has no attribute %s", address, name)
+	}
+
+	return value, nil
+}
+
+// RemoveXattr removes the attribute of the file or the directory.
+func (t *Tree) RemoveXattr(address string, name string) error {
+	node, address, err := t.xattrNode(address)
+	if err != nil {
+		return err
+	}
+
+	if IsReadOnly(address) {
+		return readOnly(address)
+	}
+	if _, ok := node.Xattrs[name]; !ok {
+		return fmt.Errorf("/%s has no attribute %s", address, name)
+	}
+	if err := t.allow(address, permWrite); err != nil {
+		return err
+	}
+
+	delete(node.Xattrs, name)
+
+	t.CommitUpdate("rmxattr", address, name)
+
+	return nil
+}
+
+// XattrsInfo lists attributes of the file or the directory as name=value,
+// sorted by name.
+func (t *Tree) XattrsInfo(address string) ([]string, error) {
+	node, _, err := t.xattrNode(address)
+	if err != nil {
+		return nil, err
+	}
+
+	return node.XattrsList(), nil
+}
+
+// XattrsList lists attributes of the node as name=value, sorted by name.
+func (node *Node) XattrsList() []string {
+	list := []string{}
+	for name, value := range node.Xattrs {
+		list = append(list, fmt.Sprintf("%s=%s", name, value))
+	}
+	sort.Strings(list)
+
+	return list
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTree_Xattrs(t *testing.T) {
+	f := newTreeFixture(t)
+	tree := f.tree
+
+	tree.CreateDirectory("datasets")
+	tree.CreateFile("datasets/users.csv", 10)
+
+	t.Run("set, get and remove",
+		func(t *testing.T) {
+			if err := tree.SetXattr("datasets/users.csv", "source", "crm export"); err != nil {
+				t.Fatal(err)
+			}
+			tree.SetXattr("datasets/users.csv", "schema", "v1")
+			tree.SetXattr("datasets/users.csv", "schema", "v2")
+			tree.SetXattr("datasets", "team", "analytics")
+
+			if value, err := tree.GetXattr("/datasets/users.csv", "schema"); err != nil || value != "v2" {
+				t.Errorf("got %q, %v, want v2", value, err)
+			}
+
+			list, _ := tree.XattrsInfo("datasets/users.csv")
+			if want := []string{"schema=v2", "source=crm export"}; !reflect.DeepEqual(list, want) {
+				t.Errorf("got %v, want %v", list, want)
+			}
+
+			if err := tree.RemoveXattr("datasets/users.csv", "source"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tree.GetXattr("datasets/users.csv", "source"); err == nil {
+				t.Errorf("removed attribute was found")
+			}
+			if err := tree.RemoveXattr("datasets/users.csv", "source"); err == nil {
+				t.Errorf("removed an attribute twice")
+			}
+		})
+
+	t.Run("wrong attributes",
+		func(t *testing.T) {
+			if err := tree.SetXattr("datasets/users.csv", "", "x"); err == nil {
+				t.Errorf("set an attribute without a name")
+			}
+			if err := tree.SetXattr("datasets/users.csv", "a=b", "x"); err == nil {
+				t.Errorf("set an attribute with = in the name")
+			}
+			if err := tree.SetXattr("datasets/missing.csv", "schema", "v1"); err == nil {
+				t.Errorf("set an attribute of a missing file")
+			}
+		})
+
+	t.Run("copies do not share attributes",
+		func(t *testing.T) {
+			if _, err := tree.CopyDirectory("datasets", "backup"); err != nil {
+				t.Fatal(err)
+			}
+			tree.SetXattr("backup/users.csv", "schema", "v3")
+
+			if value, _ := tree.GetXattr("datasets/users.csv", "schema"); value != "v2" {
+				t.Errorf("original changed along with the copy: got %q, want v2", value)
+			}
+			if value, _ := tree.GetXattr("backup", "team"); value != "analytics" {
+				t.Errorf("got %q, want analytics", value)
+			}
+		})
+
+	t.Run("others may not change attributes",
+		func(t *testing.T) {
+			tree.Chown("datasets/users.csv", adminName, "")
+
+			tree.ActAs(&User{Name: "bob"})
+			defer tree.ActAs(nil)
+
+			if err := tree.SetXattr("datasets/users.csv", "schema", "v4"); err == nil {
+				t.Errorf("changed an attribute of a file of another user")
+			}
+		})
+
+	t.Run("replay",
+		func(t *testing.T) {
+			f.snapshot(t)
+			tree.SetXattr("datasets", "note", "after the snapshot")
+
+			recovered, _ := f.recover(t)
+
+			for _, address := range []string{"datasets", "datasets/users.csv", "backup/users.csv"} {
+				if !reflect.DeepEqual(recovered.Nodes[address].Xattrs, tree.Nodes[address].Xattrs) {
+					t.Errorf("/%s: got %v, want %v", address, recovered.Nodes[address].Xattrs, tree.Nodes[address].Xattrs)
+				}
+			}
+		})
+}
@@ -0,0 +1,63 @@
+package tsuki
+
+import (
+	"log"
+	"time"
+)
+
+// OrphanCollector reclaims space taken by chunks that NS has forgotten,
+// e.g. because the fileserver was down when they were purged. On every poll
+// it reports the inventory of the fileserver to NS. A chunk is purged once
+// NS has been calling it an orphan for at least Grace, which protects chunks
+// NS is about to learn of.
+type OrphanCollector struct {
+    server *FileServer
+    Grace time.Duration
+    Now func() time.Time
+
+    // chunkId -> time it was first reported as orphan
+    suspects map[string]time.Time
+}
+
+func NewOrphanCollector(server *FileServer, grace time.Duration) *OrphanCollector {
+    return &OrphanCollector{
+        server: server,
+        Grace: grace,
+        Now: time.Now,
+        suspects: make(map[string]time.Time),
+    }
+}
+
+func (c *OrphanCollector) Poll() {
+    orphans, err := c.server.nsConn.ReportInventory(c.server.chunks.List())
+    if err != nil {
+        log.Printf("warning: could not reconcile chunks with NS, %v", err)
+        return
+    }
+
+    now := c.Now()
+    suspects := make(map[string]time.Time, len(orphans))
+    var toPurge []string
+
+    for _, id := range orphans {
+        since, suspected := c.suspects[id]
+        if !suspected {
+            since = now
+        }
+
+        if now.Sub(since) >= c.Grace {
+            toPurge = append(toPurge, id)
+            continue
+        }
+
+        suspects[id] = since
+    }
+
+    // Chunks NS has recognized since the last poll are forgiven
+    c.suspects = suspects
+
+    if len(toPurge) != 0 {
+        log.Printf("Purging orphan chunks: %v", toPurge)
+        c.server.Purge(toPurge...)
+    }
+}
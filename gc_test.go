@@ -0,0 +1,86 @@
+package tsuki_test
+
+import (
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/kureduro/tsuki"
+)
+
+func TestOrphanCollector(t *testing.T) {
+    store := tsuki.NewInMemoryChunkStorage(
+        map[string]string {
+            "known": "abc",
+            "orphan": "def",
+            "late": "ghi",
+            "used": "jkl",
+    })
+
+    nsConn := &tsuki.SpyNSConnector{}
+
+    fsd := tsuki.NewFileServer(store, nsConn)
+
+    now := time.Now()
+    collector := tsuki.NewOrphanCollector(fsd, time.Hour)
+    collector.Now = func() time.Time { return now }
+
+    t.Run("report inventory",
+    func (t *testing.T) {
+        nsConn.Orphans = []string{"orphan", "late", "used"}
+        collector.Poll()
+
+        got := append([]string{}, nsConn.Inventory...)
+        sort.Strings(got)
+        tsuki.AssertChunkList(t, got, "known", "late", "orphan", "used")
+    })
+
+    t.Run("keep orphans during grace period",
+    func (t *testing.T) {
+        now = now.Add(30 * time.Minute)
+        collector.Poll()
+
+        time.Sleep(5 * time.Millisecond)
+
+        for _, id := range []string{"known", "orphan", "late", "used"} {
+            tsuki.AssertChunkContents(t, store, id, store.Index[id])
+        }
+    })
+
+    t.Run("purge orphans after grace period",
+    func (t *testing.T) {
+        // NS has learned of "late" in the meantime
+        nsConn.Orphans = []string{"orphan", "used"}
+        fsd.Expect("reader", tsuki.ExpectActionRead, "used")
+
+        now = now.Add(30 * time.Minute)
+        collector.Poll()
+
+        time.Sleep(5 * time.Millisecond)
+
+        tsuki.AssertChunkDoesntExists(t, store, "orphan")
+        tsuki.AssertChunkContents(t, store, "known", "abc")
+        tsuki.AssertChunkContents(t, store, "late", "ghi")
+
+        // Tokens are respected, just as in case of purge by NS
+        tsuki.AssertChunkContents(t, store, "used", "jkl")
+        fsd.ServeNS(httptest.NewRecorder(), tsuki.NewCancelTokenRequest("reader"))
+
+        time.Sleep(5 * time.Millisecond)
+
+        tsuki.AssertChunkDoesntExists(t, store, "used")
+    })
+
+    t.Run("forgiven orphan starts grace period anew",
+    func (t *testing.T) {
+        nsConn.Orphans = []string{"late"}
+
+        now = now.Add(time.Minute)
+        collector.Poll()
+
+        time.Sleep(5 * time.Millisecond)
+
+        tsuki.AssertChunkContents(t, store, "late", "ghi")
+    })
+}
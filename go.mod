@@ -3,6 +3,9 @@ module github.com/kureduro/tsuki
 go 1.15
 
 require (
-	github.com/cheggaaa/pb/v3 v3.0.5 // indirect
+	github.com/BurntSushi/toml v0.3.1
+	github.com/cheggaaa/pb/v3 v3.0.5
+	github.com/google/uuid v1.6.0
+	github.com/gorilla/mux v1.8.1
 	github.com/urfave/cli/v2 v2.2.0
 )
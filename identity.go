@@ -0,0 +1,60 @@
+package tsuki
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// FSRegisterInfo is sent by a fileserver that wants to join the pool.
+// Empty hosts are substituted by NS with the address the request came from.
+type FSRegisterInfo struct {
+    NodeID string
+    PublicHost string
+    PrivateHost string
+    Available int
+}
+
+// LoadNodeID reads the persistent ID of the fileserver from filename. If
+// there is no such file, a new random ID is generated and saved there.
+func LoadNodeID(filename string) (string, error) {
+    idBytes, err := ioutil.ReadFile(filename)
+    if err == nil {
+        id := strings.TrimSpace(string(idBytes))
+        if id == "" {
+            return "", fmt.Errorf("load node id: %s is empty", filename)
+        }
+
+        return id, nil
+    }
+
+    if !os.IsNotExist(err) {
+        return "", fmt.Errorf("load node id: %v", err)
+    }
+
+    id, err := newNodeID()
+    if err != nil {
+        return "", fmt.Errorf("generate node id: %v", err)
+    }
+
+    if err := ioutil.WriteFile(filename, []byte(id), 0644); err != nil {
+        return "", fmt.Errorf("save node id: %v", err)
+    }
+
+    return id, nil
+}
+
+// newNodeID generates random (version 4) UUID.
+func newNodeID() (string, error) {
+    b := make([]byte, 16)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+
+    b[6] = b[6] & 0x0f | 0x40
+    b[8] = b[8] & 0x3f | 0x80
+
+    return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
@@ -0,0 +1,43 @@
+package tsuki_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/kureduro/tsuki"
+)
+
+func TestLoadNodeID(t *testing.T) {
+    dir, err := ioutil.TempDir("", "tsukifs")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    filename := path.Join(dir, "node.id")
+
+    id, err := tsuki.LoadNodeID(filename)
+    if err != nil {
+        t.Fatalf("could not generate node id, %v", err)
+    }
+
+    if len(id) != 36 {
+        t.Errorf("got node id %q, want UUID", id)
+    }
+
+    again, err := tsuki.LoadNodeID(filename)
+    if err != nil {
+        t.Fatalf("could not load node id, %v", err)
+    }
+
+    if again != id {
+        t.Errorf("got node id %q after restart, want %q", again, id)
+    }
+
+    other, _ := tsuki.LoadNodeID(path.Join(dir, "other.id"))
+    if other == id {
+        t.Errorf("got the same node id %q for different nodes", id)
+    }
+}
@@ -1,10 +1,13 @@
 package tsuki
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"strings"
+	"sync"
 )
 
 const NSPORT = ":7071"
@@ -12,6 +15,10 @@ const NSPORT = ":7071"
 type NSConnector interface {
     ReceivedChunk(id string)
 
+    // ReportInventory sends IDs of all stored chunks to NS and returns
+    // the ones NS considers orphaned.
+    ReportInventory(chunks []string) ([]string, error)
+
     SetNSAddr(addr string)
     GetNSAddr() string
     IsNS(addr string) bool
@@ -23,14 +30,62 @@ type HTTPNSConnector struct {
     Addr string
     httpAddr string
     ip string
+
+    // Sent along with every message, so that NS recognizes the fileserver
+    // even if its address changes.
+    NodeID string
+
+    // Sent to NS whenever it doesn't know the fileserver. Nil, if the
+    // fileserver is listed in NS configuration instead.
+    Registration *FSRegisterInfo
+    registered bool
+}
+
+func (c *HTTPNSConnector) Register(info *FSRegisterInfo) error {
+    jsonInfo, _ := json.Marshal(info)
+
+    resp, err := http.Post(c.httpAddr + "/register", "application/json", bytes.NewBuffer(jsonInfo))
+    if err != nil {
+        return fmt.Errorf("register: %v", err)
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("register: %d %s", resp.StatusCode, resp.Status)
+    }
+
+    log.Printf("Registered at %s as %s", c.Addr, info.NodeID)
+
+    return nil
 }
 
 func (c *HTTPNSConnector) ReceivedChunk(id string) {
-    url := fmt.Sprintf("%s/confirm/receivedChunk?chunkID=%s", c.httpAddr, id)
+    url := fmt.Sprintf("%s/confirm/receivedChunk?chunkID=%s&node=%s", c.httpAddr, id, c.NodeID)
     log.Printf("ReceivedChunk: %s", url)
     go http.Get(url)
 }
 
+func (c *HTTPNSConnector) ReportInventory(chunks []string) ([]string, error) {
+    jsonChunks, _ := json.Marshal(chunks)
+
+    resp, err := http.Post(c.httpAddr + "/inventory?node=" + c.NodeID, "application/json", bytes.NewBuffer(jsonChunks))
+    if err != nil {
+        return nil, fmt.Errorf("report inventory: %v", err)
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("report inventory: %d %s", resp.StatusCode, resp.Status)
+    }
+
+    var orphans []string
+    if err := json.NewDecoder(resp.Body).Decode(&orphans); err != nil {
+        return nil, fmt.Errorf("report inventory: %v", err)
+    }
+
+    return orphans, nil
+}
+
 func (c *HTTPNSConnector) GetNSAddr() string {
     return c.Addr
 }
@@ -64,25 +119,158 @@ func (c *HTTPNSConnector) IsNS(addr string) bool {
     return c.ip == ip
 }
 
+// Poll sends a heartbeat to NS. It also (re)registers the fileserver, if
+// NS doesn't know it, e.g. because NS was down at the previous attempt.
 func (c *HTTPNSConnector) Poll() {
-    _, err := http.Get(c.httpAddr + "/pulse")
+    if c.Registration != nil && !c.registered {
+        if err := c.Register(c.Registration); err != nil {
+            log.Printf("warning: couldn't register at %s, %v", c.Addr, err)
+            return
+        }
+
+        c.registered = true
+    }
+
+    resp, err := http.Get(c.httpAddr + "/pulse?node=" + c.NodeID)
 
     if err != nil {
         log.Printf("warning: couldn't send hertbeat to %s", c.httpAddr + "/pulse")
+        return
+    }
+    resp.Body.Close()
+
+    if resp.StatusCode == http.StatusNotFound {
+        log.Printf("warning: %s doesn't know this fileserver", c.Addr)
+        c.registered = false
+    }
+}
+
+
+// MultiNSConnector talks to several name servers, e.g. the primary one and
+// its standby. Heartbeats and confirmations go to all of them, so that any
+// of them may take over.
+type MultiNSConnector struct {
+    mu sync.Mutex
+    conns []*HTTPNSConnector
+
+    nodeID string
+    registration *FSRegisterInfo
+}
+
+// NewMultiNSConnector accepts no addresses, if the fileserver waits to be
+// probed by NS. Registration may be nil, see HTTPNSConnector.
+func NewMultiNSConnector(nodeID string, registration *FSRegisterInfo, addrs ...string) *MultiNSConnector {
+    c := &MultiNSConnector{
+        nodeID: nodeID,
+        registration: registration,
+    }
+
+    for _, addr := range addrs {
+        if addr != "" {
+            c.SetNSAddr(addr)
+        }
+    }
+
+    return c
+}
+
+func (c *MultiNSConnector) connectors() []*HTTPNSConnector {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    return append([]*HTTPNSConnector(nil), c.conns...)
+}
+
+func (c *MultiNSConnector) ReceivedChunk(id string) {
+    for _, conn := range c.connectors() {
+        conn.ReceivedChunk(id)
+    }
+}
+
+// ReportInventory asks name servers in turn until one of them answers,
+// a standby refuses to.
+func (c *MultiNSConnector) ReportInventory(chunks []string) ([]string, error) {
+    err := fmt.Errorf("report inventory: no name server")
+    for _, conn := range c.connectors() {
+        var orphans []string
+        if orphans, err = conn.ReportInventory(chunks); err == nil {
+            return orphans, nil
+        }
     }
+
+    return nil, err
 }
 
+// GetNSAddr returns addresses of all name servers separated by commas.
+func (c *MultiNSConnector) GetNSAddr() string {
+    addrs := []string{}
+    for _, conn := range c.connectors() {
+        addrs = append(addrs, conn.GetNSAddr())
+    }
+
+    return strings.Join(addrs, ",")
+}
+
+// SetNSAddr adds a name server, unless it is already known.
+func (c *MultiNSConnector) SetNSAddr(addr string) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    for _, conn := range c.conns {
+        if conn.IsNS(addr) {
+            return
+        }
+    }
+
+    conn := &HTTPNSConnector{
+        NodeID: c.nodeID,
+        Registration: c.registration,
+    }
+    conn.SetNSAddr(addr)
+
+    c.conns = append(c.conns, conn)
+}
+
+func (c *MultiNSConnector) IsNS(addr string) bool {
+    conns := c.connectors()
+    if len(conns) == 0 {
+        return true
+    }
+
+    for _, conn := range conns {
+        if conn.IsNS(addr) {
+            return true
+        }
+    }
+
+    return false
+}
+
+func (c *MultiNSConnector) Poll() {
+    for _, conn := range c.connectors() {
+        conn.Poll()
+    }
+}
 
 type SpyNSConnector struct {
     receivedChunks []string
     Addr string
     PulseCount int
+
+    // Returned by ReportInventory
+    Orphans []string
+    Inventory []string
 }
 
 func (c *SpyNSConnector) ReceivedChunk(id string) {
     c.receivedChunks = append(c.receivedChunks, id)
 }
 
+func (c *SpyNSConnector) ReportInventory(chunks []string) ([]string, error) {
+    c.Inventory = chunks
+    return c.Orphans, nil
+}
+
 func (c *SpyNSConnector) Reset() {
     c.receivedChunks = nil
 }
@@ -0,0 +1,45 @@
+package tsuki_test
+
+import (
+	"testing"
+
+	"github.com/kureduro/tsuki"
+)
+
+func TestMultiNSConnector(t *testing.T) {
+    t.Run("accept any name server until the first one is known",
+        func(t *testing.T) {
+            conn := tsuki.NewMultiNSConnector("node", nil)
+
+            if !conn.IsNS("10.0.0.1:54321") {
+                t.Errorf("name server was not accepted")
+            }
+        })
+
+    t.Run("accept every listed name server",
+        func(t *testing.T) {
+            conn := tsuki.NewMultiNSConnector("node", nil, "10.0.0.1", "10.0.0.2:7071")
+
+            for _, addr := range []string{"10.0.0.1:54321", "10.0.0.2:12345"} {
+                if !conn.IsNS(addr) {
+                    t.Errorf("name server %s was not accepted", addr)
+                }
+            }
+
+            if conn.IsNS("10.0.0.3:54321") {
+                t.Errorf("unknown host was accepted as name server")
+            }
+        })
+
+    t.Run("add name server once",
+        func(t *testing.T) {
+            conn := tsuki.NewMultiNSConnector("node", nil, "10.0.0.1")
+            conn.SetNSAddr("10.0.0.2:54321")
+            conn.SetNSAddr("10.0.0.1:12345")
+
+            want := "10.0.0.1" + tsuki.NSPORT + ",10.0.0.2" + tsuki.NSPORT
+            if got := conn.GetNSAddr(); got != want {
+                t.Errorf("got name servers %q, want %q", got, want)
+            }
+        })
+}
@@ -56,6 +56,72 @@ func NewReplicateRequest(addr, token string, chunks ...string) *http.Request {
     return req
 }
 
+func NewBatchReadRequest(token string, chunks ...string) *http.Request {
+    b, _ := json.Marshal(chunks)
+    url := fmt.Sprintf("/batch?token=%s", token)
+    req, _ := http.NewRequest(http.MethodGet, url, bytes.NewBuffer(b))
+    return req
+}
+
+// NewBatchWriteRequest frames contents of chunks in the order of ids.
+func NewBatchWriteRequest(token string, contents map[string]string, ids ...string) *http.Request {
+    buf := &bytes.Buffer{}
+    for _, id := range ids {
+        WriteFrame(buf, id, []byte(contents[id]))
+    }
+
+    url := fmt.Sprintf("/batch?token=%s", token)
+    req, _ := http.NewRequest(http.MethodPost, url, buf)
+    return req
+}
+
+func AssertBatchContents(t *testing.T, body io.Reader, chunks ChunkDB, ids ...string) {
+    t.Helper()
+
+    for _, want := range ids {
+        id, size, err := ReadFrameHeader(body)
+        if err != nil {
+            t.Fatalf("could not read frame for chunk %s, %v", want, err)
+        }
+
+        if id != want {
+            t.Fatalf("got chunk %s in batch, want %s", id, want)
+        }
+
+        got := &strings.Builder{}
+        io.CopyN(got, body, size)
+
+        AssertChunkContents(t, chunks, id, got.String())
+    }
+
+    if _, _, err := ReadFrameHeader(body); err != io.EOF {
+        t.Errorf("expected batch to end after %d chunks, but it doesn't, %v", len(ids), err)
+    }
+}
+
+func AssertStoredChunks(t *testing.T, body io.Reader, ids ...string) {
+    t.Helper()
+
+    var got []string
+    if err := json.NewDecoder(body).Decode(&got); err != nil {
+        t.Fatalf("could not parse list of stored chunks, %v", err)
+    }
+
+    AssertChunkList(t, got, ids...)
+}
+
+func AssertChunkList(t *testing.T, got []string, want ...string) {
+    t.Helper()
+
+    if len(got) == 0 && len(want) == 0 {
+        return
+    }
+
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("got chunks %v, want %v", got, want)
+    }
+}
+
 func AssertChunkContents(t *testing.T, chunks ChunkDB, id, want string) {
     t.Helper()
 